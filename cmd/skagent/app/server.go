@@ -8,6 +8,8 @@ import (
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"p9t.io/kuberboat/pkg/api/core"
 	pb "p9t.io/skafos/pkg/proto"
 	"p9t.io/skafos/pkg/skagent"
@@ -19,44 +21,67 @@ type server struct {
 	pb.UnimplementedSkagentSkpilotServiceServer
 }
 
-var agent = skagent.NewAgent()
+var agent skagent.Agent
 
 func (*server) CreateProxy(ctx context.Context, req *pb.CreateProxyRequest) (*pb.DefaultResponse, error) {
 	var retErr error = nil
-	var retStatus int32 = 0
 	for idx, sandboxName := range req.ContainerNames {
 		ip := req.SandboxIps[idx]
 		err := agent.SetupProxy(sandboxName, ip)
 		if err != nil {
-			retErr = err
-			retStatus = -1
+			retErr = status.Errorf(codes.Internal, "failed to create proxy for container %v: %v", sandboxName, err)
 			glog.Errorf("failed to create proxy for container %v: %v", sandboxName, err.Error())
 		}
 	}
-	return &pb.DefaultResponse{
-		Status: retStatus,
-	}, retErr
+	if retErr != nil {
+		return nil, retErr
+	}
+	return &pb.DefaultResponse{}, nil
 }
 
-func (*server) UpdateRule(ctx context.Context, req *pb.UpdateRulesRequest) (*pb.DefaultResponse, error) {
+func (*server) UpdateRule(ctx context.Context, req *pb.UpdateRulesRequest) (*pb.UpdateRulesResponse, error) {
 	var config skproxy.Config
 	if err := json.Unmarshal(req.Config, &config); err != nil {
-		return &pb.DefaultResponse{
-			Status: -1,
-		}, err
+		glog.Errorf("failed to unmarshal config version %v: %v", req.Version, err.Error())
+		return &pb.UpdateRulesResponse{
+			Version: req.Version,
+			Nonce:   req.Nonce,
+			Error:   fmt.Sprintf("failed to unmarshal config: %v", err.Error()),
+		}, nil
+	}
+	config.Version = req.Version
+	config.Nonce = req.Nonce
+
+	// Each proxy acknowledges the update separately, while the agent acknowledges it only if
+	// some proxy confirmed it, and skpilot keeps it buffered otherwise.
+	statuses, err := agent.ApplyProxyConfig(&config, req.Full)
+	proxies := make([]*pb.ProxyConfigStatus, 0, len(statuses))
+	for _, status := range statuses {
+		proxies = append(proxies, &pb.ProxyConfigStatus{
+			ProxyId: status.ProxyID,
+			Address: status.IP,
+			Version: status.Version,
+			Error:   status.Error,
+		})
 	}
-	err := agent.ApplyProxyConfig(&config)
 	if err != nil {
-		return &pb.DefaultResponse{
-			Status: -1,
-		}, err
+		return &pb.UpdateRulesResponse{
+			Version: req.Version,
+			Nonce:   req.Nonce,
+			Error:   err.Error(),
+			Proxies: proxies,
+		}, nil
 	}
-	return &pb.DefaultResponse{
-		Status: 0,
+	return &pb.UpdateRulesResponse{
+		Version: req.Version,
+		Nonce:   req.Nonce,
+		Proxies: proxies,
 	}, nil
 }
 
-func StartServer(ip string, port uint16, skPilotIP string, skPilotPort uint16) {
+func StartServer(ip string, port uint16, skPilotIP string, skPilotPort uint16, proxyArgs []string) {
+	agent = skagent.NewAgent(proxyArgs)
+
 	grpcServer := grpc.NewServer()
 	pb.RegisterSkagentSkpilotServiceServer(grpcServer, &server{})
 
@@ -79,6 +104,7 @@ func StartServer(ip string, port uint16, skPilotIP string, skPilotPort uint16) {
 	if err != nil {
 		glog.Fatalf("failed to register skagent to skpilot: %v", err.Error())
 	}
+	go client.StreamConfig(&nodeSelf, false, &server{})
 
 	glog.Infof("skagent listening at %v", lis.Addr())
 	if err := grpcServer.Serve(lis); err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"strings"
 
 	"p9t.io/skafos/cmd/skagent/app"
 	"p9t.io/skafos/pkg/api/core"
@@ -12,6 +13,7 @@ var (
 	port           uint
 	skPilotAddress string
 	skPilotPort    uint
+	proxyArgs      string
 )
 
 func init() {
@@ -20,9 +22,10 @@ func init() {
 	flag.UintVar(&port, "port", core.SKAGENT_PORT, "Port skagent listens to.")
 	flag.StringVar(&skPilotAddress, "skpilot-ip", "localhost", "IPv4 address of the host skpilot runs on.")
 	flag.UintVar(&skPilotPort, "skpilot-port", core.SKPILOT_PORT, "Port skpilot listens to.")
+	flag.StringVar(&proxyArgs, "proxy-args", "", "Space separated command line arguments passed to every skproxy, e.g. '-access-log-sample-rate=0.1'.")
 }
 
 func main() {
 	flag.Parse()
-	app.StartServer(address, uint16(port), skPilotAddress, uint16(skPilotPort))
+	app.StartServer(address, uint16(port), skPilotAddress, uint16(skPilotPort), strings.Fields(proxyArgs))
 }
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"p9t.io/kuberboat/pkg/api/core"
+	pb "p9t.io/skafos/pkg/proto"
+	"p9t.io/skafos/pkg/skagent/client"
+	"p9t.io/skafos/pkg/skagent/proxy"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+type server struct {
+	pb.UnimplementedSkagentSkpilotServiceServer
+}
+
+var (
+	// ruleCache handles incremental changes of rules from skpilot.
+	ruleCache = proxy.NewRuleGeneratorCache()
+	// gateway routes requests from outside the mesh.
+	gateway = skproxy.NewGateway()
+	// gatewayAddress is the address on which the gateway accepts requests.
+	gatewayAddress string
+)
+
+func (*server) CreateProxy(ctx context.Context, req *pb.CreateProxyRequest) (*pb.DefaultResponse, error) {
+	// No pod runs on a gateway, so there is no proxy to create.
+	return &pb.DefaultResponse{}, nil
+}
+
+func (*server) UpdateRule(ctx context.Context, req *pb.UpdateRulesRequest) (*pb.UpdateRulesResponse, error) {
+	var config skproxy.Config
+	if err := json.Unmarshal(req.Config, &config); err != nil {
+		return &pb.UpdateRulesResponse{
+			Version: req.Version,
+			Nonce:   req.Nonce,
+			Error:   fmt.Sprintf("failed to unmarshal config: %v", err.Error()),
+		}, nil
+	}
+	config.Version = req.Version
+	config.Nonce = req.Nonce
+	// The update is merged into a copy of the cache, which replaces the cache only once the
+	// gateway accepts it, so that skpilot keeps a rejected update buffered.
+	next := ruleCache.Clone()
+	if req.Full {
+		next.ReplaceConfig(&config)
+	} else {
+		next.ApplyConfig(&config)
+	}
+
+	// The gateway reports itself as the only proxy.
+	status := &pb.ProxyConfigStatus{
+		ProxyId: "skgateway",
+		Address: gatewayAddress,
+	}
+	newConfig := next.DumpConfig()
+	if err := gateway.ApplyConfig(newConfig); err != nil {
+		glog.Errorf("gateway config rejected: %v", err.Error())
+		status.Error = err.Error()
+		status.Version = gateway.AppliedVersion()
+		return &pb.UpdateRulesResponse{
+			Version: req.Version,
+			Nonce:   req.Nonce,
+			Error:   err.Error(),
+			Proxies: []*pb.ProxyConfigStatus{status},
+		}, nil
+	}
+	ruleCache.ReplaceConfig(newConfig)
+	glog.Infof("gateway config version %v updated", req.Version)
+	status.Version = gateway.AppliedVersion()
+	return &pb.UpdateRulesResponse{
+		Version: req.Version,
+		Nonce:   req.Nonce,
+		Proxies: []*pb.ProxyConfigStatus{status},
+	}, nil
+}
+
+func StartServer(ip string, port uint16, gatewayPort uint16, adminPort uint16, skPilotIP string, skPilotPort uint16) {
+	gatewayAddress = fmt.Sprintf("%v:%v", ip, gatewayPort)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterSkagentSkpilotServiceServer(grpcServer, &server{})
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	client, err := client.NewClient(skPilotIP, skPilotPort)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	nodeSelf := core.Node{
+		Status: core.NodeStatus{
+			Address: ip,
+			Port:    port,
+		},
+	}
+	_, err = client.RegisterGateway(&nodeSelf)
+	if err != nil {
+		glog.Fatalf("failed to register skgateway to skpilot: %v", err.Error())
+	}
+	go client.StreamConfig(&nodeSelf, true, &server{})
+
+	go func() {
+		gatewayLis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", gatewayPort))
+		if err != nil {
+			glog.Fatal(err)
+		}
+		server := &http.Server{
+			Handler:   gateway,
+			ConnState: skproxy.TrackConnState,
+		}
+		glog.Infof("skgateway serving requests at port %v", gatewayPort)
+		skproxy.MarkReady()
+		if err := server.Serve(gatewayLis); err != nil {
+			glog.Fatal(err)
+		}
+	}()
+	go func() {
+		addr := fmt.Sprintf("0.0.0.0:%v", adminPort)
+		glog.Infof("skgateway serving admin requests at port %v", adminPort)
+		if err := http.ListenAndServe(addr, gateway.AdminHandler()); err != nil {
+			glog.Fatal(err)
+		}
+	}()
+
+	glog.Infof("skgateway listening at %v", lis.Addr())
+	if err := grpcServer.Serve(lis); err != nil {
+		glog.Fatal(err)
+	}
+}
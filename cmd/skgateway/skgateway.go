@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/golang/glog"
+	"p9t.io/skafos/cmd/skgateway/app"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+var (
+	address        string
+	port           uint
+	gatewayPort    uint
+	adminPort      uint
+	skPilotAddress string
+	skPilotPort    uint
+
+	accessLogConfig skproxy.AccessLogConfig
+	traceCollector  string
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+	flag.StringVar(&address, "host-ip", "localhost", "IPv4 address of this gateway skpilot will see when this gateway is registered.")
+	flag.UintVar(&port, "port", core.SKGATEWAY_PORT, "Port skgateway listens to for rules from skpilot.")
+	flag.UintVar(&gatewayPort, "gateway-port", uint(skproxy.GatewayPort), "Port skgateway listens to for requests from outside the mesh.")
+	flag.UintVar(&adminPort, "admin-port", uint(skproxy.AdminPort), "Port skgateway serves the admin API on.")
+	flag.StringVar(&skPilotAddress, "skpilot-ip", "localhost", "IPv4 address of the host skpilot runs on.")
+	flag.UintVar(&skPilotPort, "skpilot-port", core.SKPILOT_PORT, "Port skpilot listens to.")
+	flag.StringVar(&accessLogConfig.Path, "access-log", skproxy.AccessLogStdout, "Where access logs are written to, either stdout or a file path. Empty disables access logs.")
+	flag.StringVar(&accessLogConfig.Format, "access-log-format", skproxy.AccessLogJSONFormat, "Format of access logs, either json or a Go template such as '{{.Method}} {{.Path}} {{.Code}}'.")
+	flag.Float64Var(&accessLogConfig.SampleRate, "access-log-sample-rate", 1, "Proportion of requests that are logged, ranging from 0 to 1.")
+	flag.IntVar(&accessLogConfig.MaxSizeMB, "access-log-max-size", 100, "Size in megabytes after which the access log file is rotated. 0 disables rotation.")
+	flag.IntVar(&accessLogConfig.MaxBackups, "access-log-max-backups", 3, "Number of rotated access log files to keep.")
+	flag.StringVar(&traceCollector, "trace-collector", "", "Address host:port of the OTLP/HTTP collector spans are exported to. Empty disables exporting.")
+}
+
+func main() {
+	flag.Parse()
+	if err := skproxy.SetupAccessLog(&accessLogConfig); err != nil {
+		glog.Fatal(err)
+	}
+	skproxy.SetupTracing(traceCollector)
+	app.StartServer(address, uint16(port), uint16(gatewayPort), uint16(adminPort), skPilotAddress, uint16(skPilotPort))
+}
@@ -3,22 +3,27 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	kuberboatCore "p9t.io/kuberboat/pkg/api/core"
 	"p9t.io/skafos/pkg/api/core"
 	pb "p9t.io/skafos/pkg/proto"
 	"p9t.io/skafos/pkg/skpilot"
 	"p9t.io/skafos/pkg/skpilot/agent"
 	"p9t.io/skafos/pkg/skpilot/buffer"
+	"p9t.io/skafos/pkg/skpilot/client"
 	"p9t.io/skafos/pkg/skpilot/component"
+	"p9t.io/skafos/pkg/skpilot/registry"
+	"p9t.io/skafos/pkg/skpilot/store"
+	"p9t.io/skafos/pkg/skproxy"
 )
 
-var kubeEndpoint = "localhost"
-
 var skPilot skpilot.SkPilot
 var agentManager agent.AgentManager
 
@@ -34,12 +39,12 @@ func (s *server) ApplyRatioRule(
 	var rule core.RatioRule
 	if err := json.Unmarshal(req.RatioRule, &rule); err != nil {
 		glog.Errorf("unmarshal rule failed: %v", err)
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rule failed: %v", err)
 	}
 	if err := skPilot.ApplyRatioRule(&rule); err != nil {
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, statusError(err)
 	}
-	return &pb.DefaultResponse{Status: 0}, nil
+	return &pb.DefaultResponse{}, nil
 }
 
 func (s *server) ApplyRegexRule(
@@ -49,12 +54,300 @@ func (s *server) ApplyRegexRule(
 	var rule core.RegexRule
 	if err := json.Unmarshal(req.RegexRule, &rule); err != nil {
 		glog.Errorf("unmarshal rule failed: %v", err)
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rule failed: %v", err)
 	}
 	if err := skPilot.ApplyRegexRule(&rule); err != nil {
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) ApplyServiceEntry(
+	ctx context.Context,
+	req *pb.ApplyServiceEntryRequest,
+) (*pb.DefaultResponse, error) {
+	var entry core.ServiceEntry
+	if err := json.Unmarshal(req.ServiceEntry, &entry); err != nil {
+		glog.Errorf("unmarshal service entry failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal service entry failed: %v", err)
+	}
+	if err := skPilot.ApplyServiceEntry(&entry); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) ApplyGateway(
+	ctx context.Context,
+	req *pb.ApplyGatewayRequest,
+) (*pb.DefaultResponse, error) {
+	var gateway core.Gateway
+	if err := json.Unmarshal(req.Gateway, &gateway); err != nil {
+		glog.Errorf("unmarshal gateway failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal gateway failed: %v", err)
+	}
+	if err := skPilot.ApplyGateway(&gateway); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) ApplyDestinationPolicy(
+	ctx context.Context,
+	req *pb.ApplyDestinationPolicyRequest,
+) (*pb.DefaultResponse, error) {
+	var policy core.DestinationPolicy
+	if err := json.Unmarshal(req.DestinationPolicy, &policy); err != nil {
+		glog.Errorf("unmarshal destination policy failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal destination policy failed: %v", err)
+	}
+	if err := skPilot.ApplyDestinationPolicy(&policy); err != nil {
+		return nil, statusError(err)
 	}
-	return &pb.DefaultResponse{Status: 0}, nil
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) ApplyRollout(
+	ctx context.Context,
+	req *pb.ApplyRolloutRequest,
+) (*pb.DefaultResponse, error) {
+	var rollout core.Rollout
+	if err := json.Unmarshal(req.Rollout, &rollout); err != nil {
+		glog.Errorf("unmarshal rollout failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rollout failed: %v", err)
+	}
+	if err := skPilot.ApplyRollout(&rollout); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) UpdateRatioRule(
+	ctx context.Context,
+	req *pb.UpdateRatioRuleRequest,
+) (*pb.DefaultResponse, error) {
+	var rule core.RatioRule
+	if err := json.Unmarshal(req.RatioRule, &rule); err != nil {
+		glog.Errorf("unmarshal rule failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rule failed: %v", err)
+	}
+	if err := skPilot.UpdateRatioRule(&rule); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) UpdateRegexRule(
+	ctx context.Context,
+	req *pb.UpdateRegexRuleRequest,
+) (*pb.DefaultResponse, error) {
+	var rule core.RegexRule
+	if err := json.Unmarshal(req.RegexRule, &rule); err != nil {
+		glog.Errorf("unmarshal rule failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rule failed: %v", err)
+	}
+	if err := skPilot.UpdateRegexRule(&rule); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) UpdateServiceEntry(
+	ctx context.Context,
+	req *pb.UpdateServiceEntryRequest,
+) (*pb.DefaultResponse, error) {
+	var entry core.ServiceEntry
+	if err := json.Unmarshal(req.ServiceEntry, &entry); err != nil {
+		glog.Errorf("unmarshal service entry failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal service entry failed: %v", err)
+	}
+	if err := skPilot.UpdateServiceEntry(&entry); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) UpdateGateway(
+	ctx context.Context,
+	req *pb.UpdateGatewayRequest,
+) (*pb.DefaultResponse, error) {
+	var gateway core.Gateway
+	if err := json.Unmarshal(req.Gateway, &gateway); err != nil {
+		glog.Errorf("unmarshal gateway failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal gateway failed: %v", err)
+	}
+	if err := skPilot.UpdateGateway(&gateway); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) UpdateDestinationPolicy(
+	ctx context.Context,
+	req *pb.UpdateDestinationPolicyRequest,
+) (*pb.DefaultResponse, error) {
+	var policy core.DestinationPolicy
+	if err := json.Unmarshal(req.DestinationPolicy, &policy); err != nil {
+		glog.Errorf("unmarshal destination policy failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal destination policy failed: %v", err)
+	}
+	if err := skPilot.UpdateDestinationPolicy(&policy); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) UpdateRollout(
+	ctx context.Context,
+	req *pb.UpdateRolloutRequest,
+) (*pb.DefaultResponse, error) {
+	var rollout core.Rollout
+	if err := json.Unmarshal(req.Rollout, &rollout); err != nil {
+		glog.Errorf("unmarshal rollout failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rollout failed: %v", err)
+	}
+	if err := skPilot.UpdateRollout(&rollout); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) ControlRollout(
+	ctx context.Context,
+	req *pb.ControlRolloutRequest,
+) (*pb.ControlRolloutResponse, error) {
+	rollout, err := skPilot.ControlRollout(req.Name, core.RolloutAction(req.Action))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.ControlRolloutResponse{Rollout: data}, nil
+}
+
+func (s *server) DeleteRule(
+	ctx context.Context,
+	req *pb.DeleteRuleRequest,
+) (*pb.DefaultResponse, error) {
+	if err := skPilot.DeleteRule(req.Name); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) GetRule(
+	ctx context.Context,
+	req *pb.GetRuleRequest,
+) (*pb.GetRuleResponse, error) {
+	kind, rule, err := skPilot.GetRule(req.Name)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.GetRuleResponse{Kind: string(kind), Rule: data}, nil
+}
+
+func (s *server) GetRuleStatus(
+	ctx context.Context,
+	req *pb.GetRuleStatusRequest,
+) (*pb.GetRuleStatusResponse, error) {
+	ruleStatus, err := skPilot.GetRuleStatus(req.Name)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	data, err := json.Marshal(ruleStatus)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.GetRuleStatusResponse{RuleStatus: data}, nil
+}
+
+func (s *server) ListRules(
+	ctx context.Context,
+	req *pb.ListRulesRequest,
+) (*pb.ListRulesResponse, error) {
+	data, err := json.Marshal(skPilot.ListRules())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.ListRulesResponse{Rules: data}, nil
+}
+
+func (s *server) DryRunRule(
+	ctx context.Context,
+	req *pb.DryRunRuleRequest,
+) (*pb.DryRunRuleResponse, error) {
+	rule, err := core.NewRule(core.Kind(req.Kind))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if err := json.Unmarshal(req.Rule, rule); err != nil {
+		glog.Errorf("unmarshal rule failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal rule failed: %v", err)
+	}
+	generator, currentGenerator, err := skPilot.DryRunRule(rule)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	generatorData, err := json.Marshal(generator)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	currentGeneratorData, err := json.Marshal(currentGenerator)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DryRunRuleResponse{
+		Generator:        generatorData,
+		CurrentGenerator: currentGeneratorData,
+	}, nil
+}
+
+func (s *server) TestRoute(
+	ctx context.Context,
+	req *pb.TestRouteRequest,
+) (*pb.TestRouteResponse, error) {
+	var request core.RouteTestRequest
+	if err := json.Unmarshal(req.Request, &request); err != nil {
+		glog.Errorf("unmarshal route test request failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal route test request failed: %v", err)
+	}
+	result, err := skPilot.TestRoute(&request)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.TestRouteResponse{Result: data}, nil
+}
+
+func (s *server) ListSyncStatus(
+	ctx context.Context,
+	req *pb.ListSyncStatusRequest,
+) (*pb.ListSyncStatusResponse, error) {
+	data, err := json.Marshal(skPilot.ListSyncStatus())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.ListSyncStatusResponse{Statuses: data}, nil
+}
+
+func (s *server) ListAgents(
+	ctx context.Context,
+	req *pb.ListAgentsRequest,
+) (*pb.ListAgentsResponse, error) {
+	data, err := json.Marshal(skPilot.ListAgents())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.ListAgentsResponse{Agents: data}, nil
 }
 
 func (s *server) RegisterSelf(
@@ -62,22 +355,104 @@ func (s *server) RegisterSelf(
 	req *pb.RegisterSelfRequest,
 ) (*pb.DefaultResponse, error) {
 	var node kuberboatCore.Node
-	json.Unmarshal(req.Node, &node)
-	err := agentManager.AddAgent(node.Status.Address, node.Status.Port)
+	if err := json.Unmarshal(req.Node, &node); err != nil {
+		glog.Errorf("unmarshal node failed: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal node failed: %v", err)
+	}
+	var err error
+	if req.Gateway {
+		err = agentManager.AddGateway(node.Status.Address, node.Status.Port)
+	} else {
+		err = agentManager.AddAgent(node.Status.Address, node.Status.Port)
+	}
 	if err != nil {
 		glog.Errorf("fail to create client with skagent: %v", err)
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, statusError(err)
+	}
+	return &pb.DefaultResponse{}, nil
+}
+
+func (s *server) StreamConfig(stream pb.SkpilotSkagentService_StreamConfigServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := msg.GetHello()
+	if hello == nil {
+		return errors.New("the first message on config stream must be hello")
+	}
+	var node kuberboatCore.Node
+	if err := json.Unmarshal(hello.Node, &node); err != nil {
+		glog.Errorf("unmarshal node failed: %v", err)
+		return status.Errorf(codes.InvalidArgument, "unmarshal node failed: %v", err)
+	}
+
+	conn := client.NewStreamConn(stream)
+	key, err := agentManager.AttachStream(node.Status.Address, node.Status.Port, hello.Gateway, conn)
+	if err != nil {
+		glog.Errorf("fail to attach config stream of %v: %v", node.Status.Address, err)
+		return err
+	}
+	defer agentManager.DetachStream(key, conn)
+	agentManager.MarkSeen(key)
+
+	err = conn.Serve(func() { agentManager.MarkSeen(key) })
+	glog.Infof("config stream of %v closed: %v", key, err)
+	return nil
+}
+
+// errorCodes maps the reasons of errors caused by requests to the gRPC codes returned to
+// clients.
+var errorCodes = map[core.ErrorReason]codes.Code{
+	core.ErrorReasonInvalid:      codes.InvalidArgument,
+	core.ErrorReasonNotFound:     codes.NotFound,
+	core.ErrorReasonDuplicate:    codes.AlreadyExists,
+	core.ErrorReasonKindMismatch: codes.FailedPrecondition,
+	core.ErrorReasonConflict:     codes.FailedPrecondition,
+	core.ErrorReasonInUse:        codes.FailedPrecondition,
+	core.ErrorReasonInvalidPhase: codes.FailedPrecondition,
+}
+
+// statusError converts an error of skpilot to the gRPC status returned to clients. An error
+// caused by the request carries its reason, field and value as an ErrorDetail, and any other
+// error is an internal error of skpilot.
+func statusError(err error) error {
+	var requestErr *core.Error
+	if !errors.As(err, &requestErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code, ok := errorCodes[requestErr.Reason]
+	if !ok {
+		code = codes.Unknown
+	}
+	st := status.New(code, requestErr.Message)
+	detailed, detailErr := st.WithDetails(&pb.ErrorDetail{
+		Reason: string(requestErr.Reason),
+		Field:  requestErr.Field,
+		Value:  requestErr.Value,
+	})
+	if detailErr != nil {
+		glog.Errorf("failed to attach error detail: %v", detailErr)
+		return st.Err()
 	}
-	return &pb.DefaultResponse{Status: 0}, nil
+	return detailed.Err()
 }
 
-func StartServer() {
+func StartServer(
+	registry registry.Registry,
+	ruleStore store.RuleStore,
+	outboundPolicy skproxy.OutboundPolicy,
+	traceSampleRate float64,
+) {
 	components := component.NewSkComponents()
 	ruleBuffer := buffer.NewRuleBuffer()
+	ruleBuffer.SetOutboundPolicy(outboundPolicy)
+	ruleBuffer.SetTraceSampleRate(traceSampleRate)
 	proxyBuffer := buffer.NewProxyBuffer()
-	agentManager = agent.NewAgentManager(ruleBuffer, proxyBuffer)
+	agentManager = agent.NewAgentManager(components, ruleBuffer, proxyBuffer)
 	skPilot = skpilot.NewSkPilot(
-		kubeEndpoint,
+		registry,
+		ruleStore,
 		components,
 		ruleBuffer,
 		proxyBuffer,
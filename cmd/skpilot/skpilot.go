@@ -3,14 +3,63 @@ package main
 import (
 	"flag"
 
+	"github.com/golang/glog"
 	"p9t.io/skafos/cmd/skpilot/app"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skpilot/registry"
+	"p9t.io/skafos/pkg/skpilot/store"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+var (
+	outboundPolicy  string
+	traceSampleRate float64
+	registryType    string
+	registryFile    string
+	kubeEndpoint    string
+	ruleStorePath   string
 )
 
 func init() {
 	flag.Set("logtostderr", "true")
+	flag.StringVar(&outboundPolicy, "outbound-policy", string(skproxy.AllowAny),
+		"How proxies handle requests to hosts outside the mesh, either ALLOW_ANY or REGISTRY_ONLY.")
+	flag.Float64Var(&traceSampleRate, "trace-sample-rate", 0.01, "Proportion of new traces that are sampled by proxies, ranging from 0 to 1.")
+	flag.StringVar(&registryType, "registry", "kuberboat", "Where pods and services are discovered from, either kuberboat or file.")
+	flag.StringVar(&registryFile, "registry-file", "", "Path of the YAML file listing pods and services, used by the file registry.")
+	flag.StringVar(&kubeEndpoint, "kube-endpoint", "localhost", "Address of the API server of Kuberboat, used by the kuberboat registry.")
+	flag.StringVar(&ruleStorePath, "rule-store", "/var/lib/skafos/rules.json", "Path of the file where applied rules are persisted.")
 }
 
 func main() {
 	flag.Parse()
-	app.StartServer()
+	policy := skproxy.OutboundPolicy(outboundPolicy)
+	if policy == "" || !policy.IsValid() {
+		glog.Fatalf("invalid outbound policy: %v", outboundPolicy)
+	}
+	if traceSampleRate < 0 || traceSampleRate > 1 {
+		glog.Fatalf("invalid trace sample rate: %v", traceSampleRate)
+	}
+
+	var r registry.Registry
+	var err error
+	switch registryType {
+	case "kuberboat":
+		r, err = registry.NewKuberboatRegistry(kubeEndpoint, core.KUBE_PORT)
+	case "file":
+		if registryFile == "" {
+			glog.Fatal("registry file is not specified")
+		}
+		r, err = registry.NewFileRegistry(registryFile)
+	default:
+		glog.Fatalf("invalid registry: %v", registryType)
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+	ruleStore, err := store.NewFileStore(ruleStorePath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	app.StartServer(r, ruleStore, policy, traceSampleRate)
 }
@@ -2,24 +2,35 @@ package app
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/golang/glog"
 	"p9t.io/skafos/pkg/skproxy"
 )
 
-func Listen(port uint16, handler func(resp http.ResponseWriter, req *http.Request)) {
-	addr := fmt.Sprintf("0.0.0.0:%v", port)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handler)
+// Listen serves handler at port. onListening, if not nil, is called once the port is bound.
+func Listen(port uint16, handler http.Handler, connState func(net.Conn, http.ConnState), onListening func()) {
+	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", port))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   handler,
+		ConnState: connState,
+	}
 	glog.Infof("listening at port %v", port)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	if onListening != nil {
+		onListening()
+	}
+	if err := server.Serve(lis); err != nil {
 		glog.Fatal(err)
 	}
 }
 
 func StartServer() {
-	go Listen(skproxy.ProxyPort, skproxy.ProxyRequest)
-	go Listen(skproxy.ConfigPort, skproxy.SetConfig)
+	go Listen(skproxy.ProxyPort, http.HandlerFunc(skproxy.ProxyRequest), skproxy.TrackConnState, skproxy.MarkReady)
+	go Listen(skproxy.ConfigPort, http.HandlerFunc(skproxy.SetConfig), nil, nil)
+	go Listen(skproxy.AdminPort, skproxy.NewAdminHandler(), nil, nil)
 	select {}
 }
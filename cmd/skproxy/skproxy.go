@@ -3,14 +3,31 @@ package main
 import (
 	"flag"
 
+	"github.com/golang/glog"
 	"p9t.io/skafos/cmd/skproxy/app"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+var (
+	accessLogConfig skproxy.AccessLogConfig
+	traceCollector  string
 )
 
 func init() {
 	flag.Set("logtostderr", "true")
+	flag.StringVar(&accessLogConfig.Path, "access-log", skproxy.AccessLogStdout, "Where access logs are written to, either stdout or a file path. Empty disables access logs.")
+	flag.StringVar(&accessLogConfig.Format, "access-log-format", skproxy.AccessLogJSONFormat, "Format of access logs, either json or a Go template such as '{{.Method}} {{.Path}} {{.Code}}'.")
+	flag.Float64Var(&accessLogConfig.SampleRate, "access-log-sample-rate", 1, "Proportion of requests that are logged, ranging from 0 to 1.")
+	flag.IntVar(&accessLogConfig.MaxSizeMB, "access-log-max-size", 100, "Size in megabytes after which the access log file is rotated. 0 disables rotation.")
+	flag.IntVar(&accessLogConfig.MaxBackups, "access-log-max-backups", 3, "Number of rotated access log files to keep.")
+	flag.StringVar(&traceCollector, "trace-collector", "", "Address host:port of the OTLP/HTTP collector spans are exported to. Empty disables exporting.")
 }
 
 func main() {
 	flag.Parse()
+	if err := skproxy.SetupAccessLog(&accessLogConfig); err != nil {
+		glog.Fatal(err)
+	}
+	skproxy.SetupTracing(traceCollector)
 	app.StartServer()
 }
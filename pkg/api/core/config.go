@@ -1,10 +1,16 @@
 package core
 
+import "time"
+
 // Port reference: https://istio.io/latest/docs/ops/deployment/requirements/#ports-used-by-istio
 const SKPILOT_PORT = 15017
 const SKAGENT_PORT = 15000
+const SKGATEWAY_PORT = 15001
 const KUBE_PORT = 6443
 
+// SKAGENT_HEARTBEAT_INTERVAL is how often skagent sends heartbeats to skpilot on its config stream.
+const SKAGENT_HEARTBEAT_INTERVAL = time.Second * 5
+
 type RuleKind struct {
 	Kind string
 }
@@ -0,0 +1,56 @@
+package core
+
+import "fmt"
+
+// ErrorReason tells why skpilot refuses a request.
+type ErrorReason string
+
+const (
+	// ErrorReasonInvalid means a field of the request has an invalid value.
+	ErrorReasonInvalid ErrorReason = "Invalid"
+	// ErrorReasonNotFound means the rule, service, subset or port a field names does not exist.
+	ErrorReasonNotFound ErrorReason = "NotFound"
+	// ErrorReasonDuplicate means there is already a rule with the name.
+	ErrorReasonDuplicate ErrorReason = "Duplicate"
+	// ErrorReasonKindMismatch means the rule with the name is of another kind.
+	ErrorReasonKindMismatch ErrorReason = "KindMismatch"
+	// ErrorReasonConflict means the rule conflicts with another rule of its service.
+	ErrorReasonConflict ErrorReason = "Conflict"
+	// ErrorReasonInUse means a subset of the destination policy is referred to by other rules.
+	ErrorReasonInUse ErrorReason = "InUse"
+	// ErrorReasonInvalidPhase means the action cannot be taken on the rollout in its phase.
+	ErrorReasonInvalidPhase ErrorReason = "InvalidPhase"
+)
+
+// Error is an error caused by a request to skpilot rather than by skpilot itself, like a rule
+// failing validation. It names the field of the request at fault and its value, so that
+// clients can point users to them.
+type Error struct {
+	Reason ErrorReason
+	// Field is the path of the field at fault, like "spec.matchers[1].subset". It is empty if
+	// the request as a whole is at fault.
+	Field string
+	// Value is the value of the field at fault.
+	Value   string
+	Message string
+}
+
+// NewError returns an Error of the reason caused by the value of the field, with the message
+// formatted according to format.
+func NewError(reason ErrorReason, field string, value string, format string, a ...interface{}) *Error {
+	return &Error{
+		Reason:  reason,
+		Field:   field,
+		Value:   value,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// Error returns the message prefixed with the field at fault, like
+// "spec.serviceName: no such service: reviews".
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SelectorOperator is the relationship between a label and a set of values.
+type SelectorOperator string
+
+// These are valid operators of a label selector requirement.
+const (
+	// SelectorOpIn means the value of the label is in the set of values.
+	SelectorOpIn SelectorOperator = "In"
+	// SelectorOpNotIn means the label is absent, or its value is not in the set of values.
+	SelectorOpNotIn SelectorOperator = "NotIn"
+	// SelectorOpExists means the label is present, whatever its value is.
+	SelectorOpExists SelectorOperator = "Exists"
+	// SelectorOpDoesNotExist means the label is absent.
+	SelectorOpDoesNotExist SelectorOperator = "DoesNotExist"
+)
+
+// SelectorRequirement is a set-based requirement on the labels of pods.
+type SelectorRequirement struct {
+	// Key is the label key the requirement applies to.
+	Key string
+	// Operator is the relationship between the label and Values.
+	Operator SelectorOperator
+	// Values is a non-empty set of values for In and NotIn, and must be empty for Exists and
+	// DoesNotExist.
+	Values []string `yaml:",omitempty" json:",omitempty"`
+}
+
+// Matches returns true if labels satisfy the requirement.
+func (r *SelectorRequirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case SelectorOpIn:
+		return ok && containsString(r.Values, value)
+	case SelectorOpNotIn:
+		return !ok || !containsString(r.Values, value)
+	case SelectorOpExists:
+		return ok
+	case SelectorOpDoesNotExist:
+		return !ok
+	default:
+		return false
+	}
+}
+
+// MatchSelector returns true if labels contain all the labels in selector, and satisfy all
+// the requirements in expressions. Labels not in the selector are ignored, so an empty
+// selector without expressions matches any labels.
+func MatchSelector(selector map[string]string, expressions []SelectorRequirement, labels map[string]string) bool {
+	for k, v := range selector {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	for i := range expressions {
+		if !expressions[i].Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateSelector checks whether a selector and its expressions are well-formed. A selector
+// must have at least one label or expression, so that it never selects all pods by mistake.
+func ValidateSelector(selector map[string]string, expressions []SelectorRequirement) error {
+	if len(selector) == 0 && len(expressions) == 0 {
+		return errors.New("selector must have at least one label or expression")
+	}
+	for k := range selector {
+		if k == "" {
+			return errors.New("selector must not have an empty label key")
+		}
+	}
+	for _, r := range expressions {
+		if r.Key == "" {
+			return errors.New("selector expression must have a key")
+		}
+		switch r.Operator {
+		case SelectorOpIn, SelectorOpNotIn:
+			if len(r.Values) == 0 {
+				return fmt.Errorf("selector expression on %s with operator %s must have values", r.Key, r.Operator)
+			}
+		case SelectorOpExists, SelectorOpDoesNotExist:
+			if len(r.Values) != 0 {
+				return fmt.Errorf("selector expression on %s with operator %s must not have values", r.Key, r.Operator)
+			}
+		default:
+			return fmt.Errorf("selector expression on %s has unknown operator %q, expected one of In, NotIn, Exists and DoesNotExist", r.Key, r.Operator)
+		}
+	}
+	return nil
+}
+
+// FormatSelector returns the labels of a selector sorted by key followed by its expressions,
+// like "app=reviews,version in (v2,v3),!canary".
+func FormatSelector(selector map[string]string, expressions []SelectorRequirement) string {
+	labels := make([]string, 0, len(selector))
+	for k, v := range selector {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(labels)
+	for _, r := range expressions {
+		switch r.Operator {
+		case SelectorOpIn:
+			labels = append(labels, fmt.Sprintf("%s in (%s)", r.Key, strings.Join(r.Values, ",")))
+		case SelectorOpNotIn:
+			labels = append(labels, fmt.Sprintf("%s notin (%s)", r.Key, strings.Join(r.Values, ",")))
+		case SelectorOpExists:
+			labels = append(labels, r.Key)
+		case SelectorOpDoesNotExist:
+			labels = append(labels, "!"+r.Key)
+		}
+	}
+	return strings.Join(labels, ",")
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchSelector(t *testing.T) {
+	labels := map[string]string{"app": "reviews", "version": "v2"}
+	tests := []struct {
+		name        string
+		selector    map[string]string
+		expressions []SelectorRequirement
+		want        bool
+	}{
+		{"empty selector", nil, nil, true},
+		{"labels match", map[string]string{"app": "reviews"}, nil, true},
+		{"label value differs", map[string]string{"app": "ratings"}, nil, false},
+		{"label missing", map[string]string{"canary": "true"}, nil, false},
+		{"in", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpIn, Values: []string{"v2", "v3"}}}, true},
+		{"not in values", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpIn, Values: []string{"v3"}}}, false},
+		{"in on missing label", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpIn, Values: []string{"true"}}}, false},
+		{"not in", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpNotIn, Values: []string{"v1"}}}, true},
+		{"not in with value in values", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpNotIn, Values: []string{"v2"}}}, false},
+		{"not in on missing label", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpNotIn, Values: []string{"true"}}}, true},
+		{"exists", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpExists}}, true},
+		{"exists on missing label", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpExists}}, false},
+		{"does not exist", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpDoesNotExist}}, true},
+		{"does not exist on present label", nil, []SelectorRequirement{{Key: "app", Operator: SelectorOpDoesNotExist}}, false},
+		{"unknown operator", nil, []SelectorRequirement{{Key: "app", Operator: "Gt"}}, false},
+		{
+			"labels and expressions",
+			map[string]string{"app": "reviews"},
+			[]SelectorRequirement{
+				{Key: "version", Operator: SelectorOpIn, Values: []string{"v2"}},
+				{Key: "canary", Operator: SelectorOpDoesNotExist},
+			},
+			true,
+		},
+		{
+			"one expression fails",
+			map[string]string{"app": "reviews"},
+			[]SelectorRequirement{
+				{Key: "version", Operator: SelectorOpIn, Values: []string{"v2"}},
+				{Key: "app", Operator: SelectorOpDoesNotExist},
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchSelector(tt.selector, tt.expressions, labels); got != tt.want {
+				t.Errorf("MatchSelector() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSelector(t *testing.T) {
+	tests := []struct {
+		name        string
+		selector    map[string]string
+		expressions []SelectorRequirement
+		// wantErr is contained in the error, or empty if the selector is valid.
+		wantErr string
+	}{
+		{"empty selector", nil, nil, "at least one label or expression"},
+		{"labels only", map[string]string{"app": "reviews"}, nil, ""},
+		{"empty label key", map[string]string{"": "reviews"}, nil, "empty label key"},
+		{"in", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpIn, Values: []string{"v2"}}}, ""},
+		{"in without values", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpIn}}, "must have values"},
+		{"not in", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpNotIn, Values: []string{"v1"}}}, ""},
+		{"not in without values", nil, []SelectorRequirement{{Key: "version", Operator: SelectorOpNotIn}}, "must have values"},
+		{"exists", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpExists}}, ""},
+		{"exists with values", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpExists, Values: []string{"true"}}}, "must not have values"},
+		{"does not exist", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpDoesNotExist}}, ""},
+		{"does not exist with values", nil, []SelectorRequirement{{Key: "canary", Operator: SelectorOpDoesNotExist, Values: []string{"true"}}}, "must not have values"},
+		{"missing key", nil, []SelectorRequirement{{Operator: SelectorOpExists}}, "must have a key"},
+		{"unknown operator", nil, []SelectorRequirement{{Key: "version", Operator: "Gt", Values: []string{"1"}}}, "unknown operator"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSelector(tt.selector, tt.expressions)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateSelector() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateSelector() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package core
 
+import "time"
+
 // Kind specified the category of an rule object.
 type Kind string
 
@@ -9,6 +11,15 @@ const (
 	RatioType Kind = "ratio"
 	// RegexType means it's a regular expression matching rule.
 	RegexType Kind = "regex"
+	// ServiceEntryType means it's an entry registering a service outside Kuberboat.
+	ServiceEntryType Kind = "serviceentry"
+	// GatewayType means it's a set of routes from outside the mesh to services.
+	GatewayType Kind = "gateway"
+	// DestinationPolicyType means it's a set of named subsets of a service with their traffic
+	// policies.
+	DestinationPolicyType Kind = "destinationpolicy"
+	// RolloutType means it's a canary rollout shifting the traffic of a service step by step.
+	RolloutType Kind = "rollout"
 )
 
 // RuleMeta contains the metadata of a rule.
@@ -17,6 +28,105 @@ type RuleMeta struct {
 	Kind
 	// The name of the rule.
 	Name string
+	// LastApplied is the JSON of the rule last applied by skctl apply, against which the next
+	// apply is merged. It is empty if the rule is not managed by skctl apply.
+	LastApplied string `yaml:"-" json:",omitempty"`
+	// AppliedFrom is the absolute path of the file or directory the rule was last applied
+	// from by skctl apply. skctl apply --prune only deletes rules applied from the same path.
+	AppliedFrom string `yaml:"-" json:",omitempty"`
+	// ActiveFrom is when the rule takes effect. The rule is not sent to proxies before then.
+	// Destination policies cannot be scheduled, since the rules referring to their subsets
+	// would select no pods before then.
+	ActiveFrom *time.Time `yaml:"activeFrom,omitempty" json:",omitempty"`
+	// ExpiresAt is when the rule is deleted by skpilot. Destination policies cannot expire.
+	ExpiresAt *time.Time `yaml:"expiresAt,omitempty" json:",omitempty"`
+	// TTL is how long the rule lives from ActiveFrom, or from when it is created if ActiveFrom
+	// is not set, like "72h". It cannot be set together with ExpiresAt.
+	TTL string `yaml:"ttl,omitempty" json:",omitempty"`
+	// CreatedAt is when the rule was created. It is set by skpilot.
+	CreatedAt *time.Time `yaml:"-" json:",omitempty"`
+}
+
+// GetRuleMeta returns the metadata of a rule.
+func (m *RuleMeta) GetRuleMeta() *RuleMeta {
+	return m
+}
+
+// Expiry returns when the rule is deleted, which is ExpiresAt, or TTL after ActiveFrom or
+// CreatedAt. It is nil if the rule never expires, or if its TTL is invalid.
+func (m *RuleMeta) Expiry() *time.Time {
+	if m.ExpiresAt != nil || m.TTL == "" {
+		return m.ExpiresAt
+	}
+	ttl, err := time.ParseDuration(m.TTL)
+	if err != nil {
+		return nil
+	}
+	start := m.ActiveFrom
+	if start == nil {
+		start = m.CreatedAt
+	}
+	if start == nil {
+		return nil
+	}
+	expiry := start.Add(ttl)
+	return &expiry
+}
+
+// RuleState is whether a rule is in effect.
+type RuleState string
+
+// These are valid states of a rule.
+const (
+	// RuleScheduled means the rule is not in effect until its ActiveFrom.
+	RuleScheduled RuleState = "Scheduled"
+	// RuleActive means the rule is in effect.
+	RuleActive RuleState = "Active"
+	// RuleExpired means the rule has expired. skpilot deletes expired rules within a second,
+	// so a rule is rarely seen in this state.
+	RuleExpired RuleState = "Expired"
+)
+
+// State returns the state of the rule at now.
+func (m *RuleMeta) State(now time.Time) RuleState {
+	if expiry := m.Expiry(); expiry != nil && !now.Before(*expiry) {
+		return RuleExpired
+	}
+	if m.ActiveFrom != nil && now.Before(*m.ActiveFrom) {
+		return RuleScheduled
+	}
+	return RuleActive
+}
+
+// IsActive tells whether the rule is in effect at now.
+func (m *RuleMeta) IsActive(now time.Time) bool {
+	return m.State(now) == RuleActive
+}
+
+// Rule is a ratio rule, a regex rule, a service entry, a gateway, a destination policy or a
+// rollout.
+type Rule interface {
+	GetRuleMeta() *RuleMeta
+}
+
+// NewRule returns an empty rule of the kind.
+func NewRule(kind Kind) (Rule, error) {
+	switch kind {
+	case RatioType:
+		return &RatioRule{}, nil
+	case RegexType:
+		return &RegexRule{}, nil
+	case ServiceEntryType:
+		return &ServiceEntry{}, nil
+	case GatewayType:
+		return &Gateway{}, nil
+	case DestinationPolicyType:
+		return &DestinationPolicy{}, nil
+	case RolloutType:
+		return &Rollout{}, nil
+	default:
+		return nil, NewError(ErrorReasonInvalid, "kind", string(kind), "%v is not supported", kind)
+	}
 }
 
 // RatioSpec contains the specifications of a ratio rule.
@@ -25,8 +135,13 @@ type RatioSpec struct {
 	ServiceName string `yaml:"serviceName"`
 	// Ratio is the ratio of requests forwarding to selected pods.
 	Ratio uint32
-	// Selector selects the pods whose labels match with the selector.
+	// Selector selects the pods having all the labels in the selector.
 	Selector map[string]string
+	// MatchExpressions are the set-based requirements the selected pods must also satisfy.
+	MatchExpressions []SelectorRequirement `yaml:"matchExpressions,omitempty" json:",omitempty"`
+	// Subset is the name of a subset in the destination policy of the service, which selects
+	// the pods instead of Selector and MatchExpressions.
+	Subset string `yaml:"subset,omitempty" json:",omitempty"`
 }
 
 // RatioRule is a rule defining the network traffic of a service in a ratio pattern.
@@ -43,8 +158,13 @@ type Matcher struct {
 	Header string
 	// Regex is the regular expression of this matcher.
 	Regex string
-	// Selector selects the pods whose labels match with the selector.
+	// Selector selects the pods having all the labels in the selector.
 	Selector map[string]string
+	// MatchExpressions are the set-based requirements the selected pods must also satisfy.
+	MatchExpressions []SelectorRequirement `yaml:"matchExpressions,omitempty" json:",omitempty"`
+	// Subset is the name of a subset in the destination policy of the service, which selects
+	// the pods instead of Selector and MatchExpressions.
+	Subset string `yaml:"subset,omitempty" json:",omitempty"`
 }
 
 // RegexSpec contains the specifications of a regex rule.
@@ -63,6 +183,375 @@ type RegexRule struct {
 	Spec RegexSpec
 }
 
+// ServiceEntryEndpoint is an address at which an external service can be reached.
+type ServiceEntryEndpoint struct {
+	// Address is the IP or domain name of the endpoint.
+	Address string
+	// Weight is the relative proportion of requests forwarded to this endpoint.
+	Weight uint32
+}
+
+// ServiceEntrySpec contains the specifications of a service entry.
+type ServiceEntrySpec struct {
+	// Hosts are the domain names or IPs of the external service.
+	Hosts []string
+	// Ports are the ports of the external service. Requests to any port are accepted if empty.
+	Ports []uint16
+	// Endpoints are the addresses to which requests are forwarded according to their weights.
+	// Requests are forwarded to the original host if it is empty.
+	Endpoints []ServiceEntryEndpoint
+	// Retries is the number of times a failed request will be retried.
+	Retries uint32
+	// Timeout is the timeout of each attempt in milliseconds. Zero means no timeout.
+	Timeout uint32
+}
+
+// ServiceEntry registers a service outside Kuberboat, so that requests to it can be
+// routed by skproxy and will not be blocked when only registered hosts are allowed.
+type ServiceEntry struct {
+	// RuleMeta contains the type and the name of a service entry.
+	RuleMeta `yaml:",inline"`
+	// Specifications of the external service.
+	Spec ServiceEntrySpec
+}
+
+// GatewayRoute routes requests from outside the mesh to a service.
+type GatewayRoute struct {
+	// Host is the host of requests this route matches. Any host is matched if it is empty.
+	Host string
+	// PathPrefix is the prefix of the path of requests this route matches.
+	PathPrefix string `yaml:"pathPrefix"`
+	// ServiceName is the name of the service to which matched requests are forwarded.
+	ServiceName string `yaml:"serviceName"`
+	// Port is the service port to which matched requests are forwarded.
+	Port uint16
+}
+
+// GatewaySpec contains the specifications of a gateway.
+type GatewaySpec struct {
+	// Routes are the routes from requests outside the mesh to services.
+	Routes []GatewayRoute
+}
+
+// Gateway defines how skgateway routes requests from outside the mesh to services.
+type Gateway struct {
+	// RuleMeta contains the type and the name of a gateway.
+	RuleMeta `yaml:",inline"`
+	// Specifications of the gateway routes.
+	Spec GatewaySpec
+}
+
+// These are valid load balancers of a traffic policy.
+const (
+	// LoadBalancerRoundRobin selects the pods in turn.
+	LoadBalancerRoundRobin = "ROUND_ROBIN"
+	// LoadBalancerRandom selects a pod at random.
+	LoadBalancerRandom = "RANDOM"
+)
+
+// These are valid TLS modes of a traffic policy.
+const (
+	// TLSModeDisable sends plain HTTP requests to the pods.
+	TLSModeDisable = "DISABLE"
+	// TLSModeSimple sends HTTPS requests to the pods.
+	TLSModeSimple = "SIMPLE"
+)
+
+// ConnectionPool limits the requests to each pod.
+type ConnectionPool struct {
+	// MaxRequests is the maximum number of concurrent requests to each pod. Requests beyond
+	// the limit fail at once. Zero means no limit.
+	MaxRequests uint32 `yaml:"maxRequests"`
+}
+
+// OutlierDetection ejects the pods that keep failing from load balancing for a while.
+type OutlierDetection struct {
+	// ConsecutiveErrors is the number of consecutive failed requests after which a pod is
+	// ejected. Zero means the default of skproxy.
+	ConsecutiveErrors uint32 `yaml:"consecutiveErrors"`
+	// BaseEjectionTime is how long a pod is ejected for the first time in milliseconds, which
+	// grows with the number of ejections. Zero means the default of skproxy.
+	BaseEjectionTime uint32 `yaml:"baseEjectionTime"`
+}
+
+// TrafficPolicy describes how requests are sent to the pods of a subset. Unset fields take
+// the defaults of skproxy.
+type TrafficPolicy struct {
+	// LoadBalancer is how a pod is selected for a request, ROUND_ROBIN or RANDOM.
+	LoadBalancer string `yaml:"loadBalancer,omitempty" json:",omitempty"`
+	// ConnectionPool limits the requests to each pod.
+	ConnectionPool *ConnectionPool `yaml:"connectionPool,omitempty" json:",omitempty"`
+	// OutlierDetection ejects the pods that keep failing.
+	OutlierDetection *OutlierDetection `yaml:"outlierDetection,omitempty" json:",omitempty"`
+	// TLSMode is whether requests are sent over TLS, DISABLE or SIMPLE.
+	TLSMode string `yaml:"tlsMode,omitempty" json:",omitempty"`
+}
+
+// Subset is a named set of pods of a service.
+type Subset struct {
+	// Name is how rules refer to the subset.
+	Name string
+	// Selector selects the pods having all the labels in the selector.
+	Selector map[string]string
+	// MatchExpressions are the set-based requirements the selected pods must also satisfy.
+	MatchExpressions []SelectorRequirement `yaml:"matchExpressions,omitempty" json:",omitempty"`
+	// TrafficPolicy overrides the fields set in the traffic policy of the destination policy
+	// for the pods of the subset.
+	TrafficPolicy *TrafficPolicy `yaml:"trafficPolicy,omitempty" json:",omitempty"`
+}
+
+// DestinationPolicySpec contains the specifications of a destination policy.
+type DestinationPolicySpec struct {
+	// ServiceName is the name of the service this policy applies to.
+	ServiceName string `yaml:"serviceName"`
+	// TrafficPolicy is the traffic policy of all the pods of the service.
+	TrafficPolicy *TrafficPolicy `yaml:"trafficPolicy,omitempty" json:",omitempty"`
+	// Subsets are the named subsets of the service that ratio and regex rules may refer to.
+	Subsets []Subset
+}
+
+// DestinationPolicy names the subsets of a service and defines how requests are sent to them.
+// A service can have at most one destination policy.
+type DestinationPolicy struct {
+	// RuleMeta contains the type and the name of a destination policy.
+	RuleMeta `yaml:",inline"`
+	// Specifications of the subsets and traffic policies.
+	Spec DestinationPolicySpec
+}
+
+// GetSubset returns the subset with the name, or nil if there is no such subset.
+func (p *DestinationPolicy) GetSubset(name string) *Subset {
+	for i := range p.Spec.Subsets {
+		if p.Spec.Subsets[i].Name == name {
+			return &p.Spec.Subsets[i]
+		}
+	}
+	return nil
+}
+
+// RolloutStep is a step of a rollout.
+type RolloutStep struct {
+	// Weight is the percentage of requests forwarded to the canary pods in this step.
+	Weight uint32
+	// Pause is how long the rollout stays in this step in seconds before moving on to the next
+	// one. Zero means until the rollout is resumed, except for the last step, which completes
+	// the rollout at once.
+	Pause uint32
+}
+
+// RolloutAnalysis is the thresholds the canary pods must meet for a rollout to move on. The
+// requests to the canary pods are gathered from the metrics of skproxy in each step.
+type RolloutAnalysis struct {
+	// MinSuccessRate is the lowest percentage of requests not responded with 5xx. Zero means
+	// no threshold.
+	MinSuccessRate float64 `yaml:"minSuccessRate"`
+	// MaxLatency is the highest 99th percentile of the latency in milliseconds. Zero means no
+	// threshold.
+	MaxLatency uint32 `yaml:"maxLatency"`
+	// MinRequests is the number of requests needed in a step before the thresholds are
+	// checked, and before the rollout moves on to the next step.
+	MinRequests uint32 `yaml:"minRequests"`
+}
+
+// RolloutSpec contains the specifications of a rollout.
+type RolloutSpec struct {
+	// ServiceName is the name of the service this rollout applies to.
+	ServiceName string `yaml:"serviceName"`
+	// Selector selects the canary pods having all the labels in the selector.
+	Selector map[string]string
+	// MatchExpressions are the set-based requirements the canary pods must also satisfy.
+	MatchExpressions []SelectorRequirement `yaml:"matchExpressions,omitempty" json:",omitempty"`
+	// Subset is the name of a subset in the destination policy of the service, which selects
+	// the canary pods instead of Selector and MatchExpressions.
+	Subset string `yaml:"subset,omitempty" json:",omitempty"`
+	// Steps are the steps the weight of the canary pods goes through.
+	Steps []RolloutStep
+	// Analysis is the thresholds checked in each step. The rollout is rolled back to a weight
+	// of zero once they are breached.
+	Analysis *RolloutAnalysis `yaml:"analysis,omitempty" json:",omitempty"`
+}
+
+// RolloutPhase is the phase of a rollout.
+type RolloutPhase string
+
+// These are valid phases of a rollout.
+const (
+	// RolloutProgressing means the rollout is moving through its steps.
+	RolloutProgressing RolloutPhase = "Progressing"
+	// RolloutPaused means the rollout stays in its current step until resumed.
+	RolloutPaused RolloutPhase = "Paused"
+	// RolloutCompleted means the rollout has finished its last step.
+	RolloutCompleted RolloutPhase = "Completed"
+	// RolloutRolledBack means the analysis has failed, and no requests go to the canary pods.
+	RolloutRolledBack RolloutPhase = "RolledBack"
+	// RolloutAborted means the rollout is aborted by users, and no requests go to the canary
+	// pods.
+	RolloutAborted RolloutPhase = "Aborted"
+)
+
+// RolloutStatus is the progress of a rollout, which is maintained by skpilot.
+type RolloutStatus struct {
+	// Phase is the phase of the rollout.
+	Phase RolloutPhase
+	// Step is the index of the current step.
+	Step int
+	// Weight is the percentage of requests currently forwarded to the canary pods.
+	Weight uint32
+	// StepStartedAt is when the current step started or was last resumed.
+	StepStartedAt *time.Time `json:",omitempty"`
+	// Requests is the number of requests to the canary pods in the current step.
+	Requests uint64
+	// SuccessRate is the percentage of requests to the canary pods not responded with 5xx in
+	// the current step.
+	SuccessRate float64
+	// LatencyP99 is the 99th percentile of the latency of the canary pods in the current step,
+	// like "250ms", or like ">10s" if it is beyond what skproxy measures.
+	LatencyP99 string `json:",omitempty"`
+	// Message tells why the rollout is in the phase.
+	Message string `json:",omitempty"`
+}
+
+// Rollout shifts the requests to a service from its stable pods to its canary pods step by
+// step, acting as the ratio rule of the service. skpilot drives it and rolls it back if the
+// canary pods breach the thresholds of its analysis.
+type Rollout struct {
+	// RuleMeta contains the type and the name of a rollout.
+	RuleMeta `yaml:",inline"`
+	// Specifications of the steps and the analysis.
+	Spec RolloutSpec
+	// Status is the progress of the rollout. It is set by skpilot and ignored when applied.
+	Status RolloutStatus `yaml:"status,omitempty"`
+}
+
+// RatioRule returns the ratio rule the rollout acts as in its current step. It has the metadata
+// of the rollout.
+func (r *Rollout) RatioRule() *RatioRule {
+	return &RatioRule{
+		RuleMeta: r.RuleMeta,
+		Spec: RatioSpec{
+			ServiceName:      r.Spec.ServiceName,
+			Ratio:            r.Status.Weight,
+			Selector:         r.Spec.Selector,
+			MatchExpressions: r.Spec.MatchExpressions,
+			Subset:           r.Spec.Subset,
+		},
+	}
+}
+
+// RolloutAction is an action users take on a rollout.
+type RolloutAction string
+
+// These are valid actions on a rollout.
+const (
+	// RolloutPause keeps a progressing rollout in its current step.
+	RolloutPause RolloutAction = "pause"
+	// RolloutResume moves a rollout waiting to be resumed on to its next step, and restarts the
+	// current step of a paused rollout. A rolled back or aborted rollout starts over.
+	RolloutResume RolloutAction = "resume"
+	// RolloutAbort stops a rollout and forwards no requests to its canary pods.
+	RolloutAbort RolloutAction = "abort"
+)
+
+// RuleList contains rules of all kinds, each kind sorted by name.
+type RuleList struct {
+	RatioRules          []*RatioRule
+	RegexRules          []*RegexRule
+	ServiceEntries      []*ServiceEntry
+	Gateways            []*Gateway
+	DestinationPolicies []*DestinationPolicy
+	Rollouts            []*Rollout
+}
+
+// All returns the rules of all kinds in the list.
+func (l *RuleList) All() []Rule {
+	rules := make([]Rule, 0)
+	for _, rule := range l.RatioRules {
+		rules = append(rules, rule)
+	}
+	for _, rule := range l.RegexRules {
+		rules = append(rules, rule)
+	}
+	for _, entry := range l.ServiceEntries {
+		rules = append(rules, entry)
+	}
+	for _, gateway := range l.Gateways {
+		rules = append(rules, gateway)
+	}
+	for _, policy := range l.DestinationPolicies {
+		rules = append(rules, policy)
+	}
+	for _, rollout := range l.Rollouts {
+		rules = append(rules, rollout)
+	}
+	return rules
+}
+
+// RouteTestRequest is a synthetic request sent to a service, whose routing is simulated by
+// skpilot with the current rules and endpoints.
+type RouteTestRequest struct {
+	// Service is the name of the service the request is sent to.
+	Service string
+	// Port is the port of the service. Zero means the first port of the service.
+	Port uint16
+	// Method is the HTTP method of the request.
+	Method string
+	// Path is the path of the request.
+	Path string
+	// Headers are the HTTP headers of the request.
+	Headers map[string]string
+	// Count is the number of times the request is simulated.
+	Count int
+}
+
+// RouteTestCluster is a cluster of the rule matched by a simulated request.
+type RouteTestCluster struct {
+	// Name tells which part of the rule the cluster belongs to, e.g. "proxied" for a ratio rule.
+	Name string
+	// Rule is the name of the rule the cluster comes from.
+	Rule string
+	// Matcher is the matcher of a regex rule the cluster corresponds to.
+	Matcher *Matcher `json:",omitempty"`
+	// Hosts are the candidate IPs or domain names of the cluster.
+	Hosts []string
+	// PortMapping maps the requested port to the upstream port. It is nil if the port is kept.
+	PortMapping map[uint16]uint16 `json:",omitempty"`
+}
+
+// RouteTestSplit is the number of simulated requests forwarded to an address.
+type RouteTestSplit struct {
+	// Rule is the name of the rule routing the requests. It is empty if no rule is matched.
+	Rule string `json:",omitempty"`
+	// Kind is the kind of Rule.
+	Kind Kind `json:",omitempty"`
+	// Cluster is the name of the cluster from which the address is selected. It is empty if
+	// the request is forwarded as is.
+	Cluster string `json:",omitempty"`
+	// Address is the address the requests are forwarded to.
+	Address string
+	// Requests is the number of requests forwarded to the address.
+	Requests int
+}
+
+// RouteTestResult is the simulated routing of a RouteTestRequest.
+type RouteTestResult struct {
+	// Host is the cluster IP of the service.
+	Host string
+	// Port is the port of the service the request is sent to.
+	Port uint16
+	// Rule is the name of the rule deciding the routing, which is the regex rule whose matcher
+	// the request matches, or otherwise the rule splitting requests by ratio. It is empty if no
+	// rule is matched.
+	Rule string `json:",omitempty"`
+	// Kind is the kind of Rule.
+	Kind Kind `json:",omitempty"`
+	// Clusters are the clusters of the rules in Splits, which include those of all the ratio
+	// and regex rules of the service.
+	Clusters []RouteTestCluster `json:",omitempty"`
+	// Splits are the addresses the simulated requests are forwarded to, sorted by rule,
+	// cluster and address.
+	Splits []RouteTestSplit
+}
+
 // SandboxInfo contains the basic information of the sandbox container in a pod.
 type SandboxInfo struct {
 	// SandboxName is the name of the sandbox container in a pod.
@@ -72,3 +561,166 @@ type SandboxInfo struct {
 	// HostIP is the IP of host of the pod.
 	HostIP string
 }
+
+// ProxySyncStatus is the config sync status of a proxy.
+type ProxySyncStatus struct {
+	// ID is the ID of the proxy container.
+	ID string
+	// Address is the address of the proxy.
+	Address string
+	// Version is the config version running on the proxy.
+	Version uint64
+	// Error is why the proxy rejected the latest config. It is empty if the config is accepted.
+	Error string `json:",omitempty"`
+}
+
+// AgentSyncStatus is the config sync status of an SkAgent and the proxies on its node.
+type AgentSyncStatus struct {
+	// Agent is the address of the SkAgent.
+	Agent string
+	// SentVersion is the version of the latest config sent to the SkAgent.
+	SentVersion uint64
+	// AckedVersion is the version of the latest config accepted by the SkAgent.
+	AckedVersion uint64
+	// Nonce is the nonce of the latest config sent to the SkAgent.
+	Nonce string
+	// Error is why the latest config failed to reach the SkAgent.
+	Error string `json:",omitempty"`
+	// UpdatedAt is when the SkAgent last responded. It is nil if no config has been sent.
+	UpdatedAt *time.Time `json:",omitempty"`
+	// Proxies are the sync status of the proxies as of the latest accepted config.
+	Proxies []ProxySyncStatus
+}
+
+// IsSynced returns true if the latest config has been accepted by the SkAgent and all its proxies.
+func (s *AgentSyncStatus) IsSynced() bool {
+	if s.SentVersion != s.AckedVersion || s.Error != "" {
+		return false
+	}
+	for _, p := range s.Proxies {
+		if p.Version != s.AckedVersion || p.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// RuleConditionType is a type of condition of a rule.
+type RuleConditionType string
+
+// These are valid types of condition of a rule.
+const (
+	// RuleResolved means the services and the pods the rule refers to are found.
+	RuleResolved RuleConditionType = "Resolved"
+	// RulePropagated means all the agents and proxies run a config carrying the rule as it is.
+	RulePropagated RuleConditionType = "Propagated"
+)
+
+// These are reasons why a condition of a rule does not hold.
+const (
+	// RuleReasonServiceNotFound means a service the rule refers to does not exist.
+	RuleReasonServiceNotFound = "ServiceNotFound"
+	// RuleReasonNoClusterIP means a service the rule refers to has no cluster IP.
+	RuleReasonNoClusterIP = "NoClusterIP"
+	// RuleReasonNoPods means a selector or a subset of the rule matches no pods.
+	RuleReasonNoPods = "NoPods"
+	// RuleReasonScheduled means the rule is not sent to proxies until it takes effect.
+	RuleReasonScheduled = "Scheduled"
+	// RuleReasonExpired means the rule has expired and is being removed from proxies.
+	RuleReasonExpired = "Expired"
+	// RuleReasonPending means some agents or proxies have not acknowledged the rule yet.
+	RuleReasonPending = "Pending"
+	// RuleReasonRejected means some proxies rejected the config carrying the rule.
+	RuleReasonRejected = "Rejected"
+)
+
+// RuleCondition is an aspect of the status of a rule.
+type RuleCondition struct {
+	// Type is the type of the condition.
+	Type RuleConditionType
+	// Status is whether the condition holds.
+	Status bool
+	// Reason tells in a word why the condition does not hold. It is empty if it holds.
+	Reason string `json:",omitempty"`
+	// Message tells the details, like "selector app=reviews,version=v3 matches no pods".
+	Message string `json:",omitempty"`
+}
+
+// RuleSubsetStatus is the pods selected by a selector or a subset of a rule.
+type RuleSubsetStatus struct {
+	// Name tells which part of the rule selects the pods, like "proxied" for a ratio rule,
+	// "matcher-0" for the first matcher of a regex rule, "canary" for a rollout, or the name
+	// of a subset of a destination policy.
+	Name string
+	// Subset is the subset of the destination policy the pods are selected by. It is empty if
+	// they are selected by Selector and MatchExpressions.
+	Subset string `json:",omitempty"`
+	// Selector selects the pods having all the labels in the selector.
+	Selector map[string]string `json:",omitempty"`
+	// MatchExpressions are the set-based requirements the selected pods must also satisfy.
+	MatchExpressions []SelectorRequirement `json:",omitempty"`
+	// IPs is the number of pod IPs selected.
+	IPs int
+}
+
+// RuleStatus is the status of a rule, which is observed by skpilot when asked.
+type RuleStatus struct {
+	// State is whether the rule is in effect.
+	State RuleState
+	// Version is the first config version carrying the rule as it is, including the pods it
+	// selects. Agents and proxies running this version or later are in sync with the rule. It
+	// is zero if the rule is not in effect.
+	Version uint64
+	// Conditions are the Resolved and Propagated conditions of the rule.
+	Conditions []RuleCondition
+	// Subsets are the pods selected by each selector or subset of the rule.
+	Subsets []RuleSubsetStatus `json:",omitempty"`
+	// Agents are the sync status of the agents and their proxies, sorted by agent address.
+	// Evicted agents are not included.
+	Agents []AgentSyncStatus
+}
+
+// GetCondition returns the condition of the type, or nil if there is no such condition.
+func (s *RuleStatus) GetCondition(conditionType RuleConditionType) *RuleCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// AgentState is the health state of an SkAgent seen by skpilot.
+type AgentState string
+
+// These are valid states of an SkAgent.
+const (
+	// AgentHealthy means the SkAgent has sent a heartbeat recently.
+	AgentHealthy AgentState = "Healthy"
+	// AgentUnreachable means the SkAgent has missed heartbeats. No update is sent to it until
+	// it recovers.
+	AgentUnreachable AgentState = "Unreachable"
+	// AgentRemoved means the SkAgent has been unreachable for too long and has been evicted.
+	// It has to register again to receive updates.
+	AgentRemoved AgentState = "Removed"
+)
+
+// AgentStatus is the registration and health status of an SkAgent or an SkGateway.
+type AgentStatus struct {
+	// Name identifies the agent, which is its address for an SkAgent.
+	Name string
+	// Address is the address of the agent.
+	Address string
+	// Port is the port the agent listens to.
+	Port uint16
+	// Gateway is true if the agent is an SkGateway.
+	Gateway bool
+	// State is the health state of the agent.
+	State AgentState
+	// Streaming is true if the agent has a config stream to skpilot.
+	Streaming bool
+	// RegisteredAt is when the agent last registered.
+	RegisteredAt time.Time
+	// LastSeen is when skpilot last heard from the agent.
+	LastSeen time.Time
+}
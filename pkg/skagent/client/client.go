@@ -5,16 +5,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/golang/glog"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
-	"p9t.io/kuberboat/pkg/api/core"
+	"google.golang.org/grpc/status"
+	kubeCore "p9t.io/kuberboat/pkg/api/core"
+	"p9t.io/skafos/pkg/api/core"
 	pb "p9t.io/skafos/pkg/proto"
 )
 
 var CONN_TIMEOUT time.Duration = time.Second
 
+const (
+	minStreamBackoff = time.Second
+	maxStreamBackoff = time.Second * 30
+)
+
 type SkPilotClient struct {
 	connection *grpc.ClientConn
 	client     pb.SkpilotSkagentServiceClient
@@ -32,14 +41,135 @@ func NewClient(skPilotIP string, skPilotPort uint16) (*SkPilotClient, error) {
 	}, nil
 }
 
-func (c *SkPilotClient) RegisterSelf(node *core.Node) (*pb.DefaultResponse, error) {
+func (c *SkPilotClient) RegisterSelf(node *kubeCore.Node) (*pb.DefaultResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
 	defer cancel()
 	data, err := json.Marshal(node)
 	if err != nil {
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, err
 	}
 	return c.client.RegisterSelf(ctx, &pb.RegisterSelfRequest{
 		Node: data,
 	})
 }
+
+// RegisterGateway registers a gateway to skpilot. Gateways receive rules just like skagent,
+// but no proxy will be created on them.
+func (c *SkPilotClient) RegisterGateway(node *kubeCore.Node) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.RegisterSelf(ctx, &pb.RegisterSelfRequest{
+		Node:    data,
+		Gateway: true,
+	})
+}
+
+// StreamConfig opens a config stream to skpilot and serves the updates pushed on it with
+// handler, acknowledging each of them on the same stream. skpilot resyncs the full state on
+// each new stream, so the stream is simply reopened whenever it breaks. It never returns.
+func (c *SkPilotClient) StreamConfig(node *kubeCore.Node, gateway bool, handler pb.SkagentSkpilotServiceServer) {
+	data, err := json.Marshal(node)
+	if err != nil {
+		glog.Errorf("failed to marshal node: %v", err.Error())
+		return
+	}
+	hello := &pb.RegisterSelfRequest{
+		Node:    data,
+		Gateway: gateway,
+	}
+
+	backoff := minStreamBackoff
+	for {
+		openedAt := time.Now()
+		err := c.serveStream(hello, handler)
+		if time.Since(openedAt) > maxStreamBackoff {
+			backoff = minStreamBackoff
+		}
+		glog.Errorf("config stream to skpilot broken: %v, reopen in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxStreamBackoff {
+			backoff = maxStreamBackoff
+		}
+	}
+}
+
+// serveStream serves one config stream until it breaks.
+func (c *SkPilotClient) serveStream(hello *pb.RegisterSelfRequest, handler pb.SkagentSkpilotServiceServer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := c.client.StreamConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&pb.AgentMessage{
+		Message: &pb.AgentMessage_Hello{Hello: hello},
+	}); err != nil {
+		return err
+	}
+	glog.Infof("config stream to skpilot opened")
+
+	// Replies and heartbeats are sent from different goroutines.
+	var sendMtx sync.Mutex
+	send := func(msg *pb.AgentMessage) error {
+		sendMtx.Lock()
+		defer sendMtx.Unlock()
+		return stream.Send(msg)
+	}
+	go func() {
+		ticker := time.NewTicker(core.SKAGENT_HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := send(&pb.AgentMessage{
+					Message: &pb.AgentMessage_Heartbeat{Heartbeat: &pb.Heartbeat{}},
+				}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		var reply *pb.AgentMessage
+		switch m := msg.Message.(type) {
+		case *pb.PilotMessage_UpdateRules:
+			resp, err := handler.UpdateRule(ctx, m.UpdateRules)
+			if err != nil {
+				resp = &pb.UpdateRulesResponse{
+					Version: m.UpdateRules.Version,
+					Nonce:   m.UpdateRules.Nonce,
+					Error:   err.Error(),
+				}
+			}
+			reply = &pb.AgentMessage{
+				Message: &pb.AgentMessage_RuleAck{RuleAck: resp},
+			}
+		case *pb.PilotMessage_CreateProxy:
+			ack := &pb.CreateProxyResponse{Nonce: m.CreateProxy.Nonce}
+			if _, err := handler.CreateProxy(ctx, m.CreateProxy); err != nil {
+				ack.Error = status.Convert(err).Message()
+			}
+			reply = &pb.AgentMessage{
+				Message: &pb.AgentMessage_ProxyAck{ProxyAck: ack},
+			}
+		default:
+			glog.Warningf("unexpected message on config stream: %v", msg)
+			continue
+		}
+		if err := send(reply); err != nil {
+			return err
+		}
+	}
+}
@@ -9,15 +9,28 @@ import (
 // RuleGeneratorCache handles incremental changes of proxy rules, so that
 // new proxies can quickly catch up with the others.
 type RuleGeneratorCache struct {
-	mtx                 sync.RWMutex
-	ratioRuleGenerators map[string]*skproxy.RatioRuleGenerator
-	regexRuleGenerators map[string]*skproxy.RegexRuleGenerator
+	mtx                    sync.RWMutex
+	ratioRuleGenerators    map[string]*skproxy.RatioRuleGenerator
+	regexRuleGenerators    map[string]*skproxy.RegexRuleGenerator
+	routeTableGenerators   map[string]*skproxy.RouteTableGenerator
+	serviceEntryGenerators map[string]*skproxy.ServiceEntryGenerator
+	gatewayGenerators      map[string]*skproxy.GatewayGenerator
+	outboundPolicy         skproxy.OutboundPolicy
+	meshHosts              []string
+	traceSampleRate        float64
+	// version and nonce are those of the latest update from skpilot.
+	version uint64
+	nonce   string
 }
 
 func NewRuleGeneratorCache() *RuleGeneratorCache {
 	return &RuleGeneratorCache{
-		ratioRuleGenerators: map[string]*skproxy.RatioRuleGenerator{},
-		regexRuleGenerators: map[string]*skproxy.RegexRuleGenerator{},
+		ratioRuleGenerators:    map[string]*skproxy.RatioRuleGenerator{},
+		regexRuleGenerators:    map[string]*skproxy.RegexRuleGenerator{},
+		routeTableGenerators:   map[string]*skproxy.RouteTableGenerator{},
+		serviceEntryGenerators: map[string]*skproxy.ServiceEntryGenerator{},
+		gatewayGenerators:      map[string]*skproxy.GatewayGenerator{},
+		meshHosts:              []string{},
 	}
 }
 
@@ -37,28 +50,188 @@ func (c *RuleGeneratorCache) SetRegexRule(name string, generator *skproxy.RegexR
 	}
 }
 
+func (c *RuleGeneratorCache) SetRouteTable(name string, generator *skproxy.RouteTableGenerator) {
+	if generator != nil {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.routeTableGenerators[name] = generator
+	}
+}
+
+// DeleteRouteTable deletes the route table of a service. Route tables are named after
+// services rather than rules, so they are deleted apart from rules.
+func (c *RuleGeneratorCache) DeleteRouteTable(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.routeTableGenerators, name)
+}
+
+func (c *RuleGeneratorCache) SetServiceEntry(name string, generator *skproxy.ServiceEntryGenerator) {
+	if generator != nil {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.serviceEntryGenerators[name] = generator
+	}
+}
+
+func (c *RuleGeneratorCache) SetGateway(name string, generator *skproxy.GatewayGenerator) {
+	if generator != nil {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.gatewayGenerators[name] = generator
+	}
+}
+
+// SetMeshSettings updates the outbound policy, the hosts inside the mesh and the trace sample rate.
+func (c *RuleGeneratorCache) SetMeshSettings(policy skproxy.OutboundPolicy, meshHosts []string, traceSampleRate float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.outboundPolicy = policy
+	c.meshHosts = meshHosts
+	c.traceSampleRate = traceSampleRate
+}
+
 func (c *RuleGeneratorCache) DeleteRule(name string) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 	delete(c.ratioRuleGenerators, name)
 	delete(c.regexRuleGenerators, name)
+	delete(c.serviceEntryGenerators, name)
+	delete(c.gatewayGenerators, name)
 }
 
-func (c *RuleGeneratorCache) HasRules() bool {
+// ApplyConfig updates the cache incrementally with config from skpilot.
+// A nil generator means the rule with that name should be deleted.
+func (c *RuleGeneratorCache) ApplyConfig(config *skproxy.Config) {
+	for name, rule := range config.RatioRules {
+		if rule == nil {
+			c.DeleteRule(name)
+		} else {
+			c.SetRatioRule(name, rule)
+		}
+	}
+	for name, rule := range config.RegexRules {
+		if rule == nil {
+			c.DeleteRule(name)
+		} else {
+			c.SetRegexRule(name, rule)
+		}
+	}
+	for name, table := range config.RouteTables {
+		if table == nil {
+			c.DeleteRouteTable(name)
+		} else {
+			c.SetRouteTable(name, table)
+		}
+	}
+	for name, entry := range config.ServiceEntries {
+		if entry == nil {
+			c.DeleteRule(name)
+		} else {
+			c.SetServiceEntry(name, entry)
+		}
+	}
+	for name, gateway := range config.Gateways {
+		if gateway == nil {
+			c.DeleteRule(name)
+		} else {
+			c.SetGateway(name, gateway)
+		}
+	}
+	// Mesh settings are always sent together, and an empty policy means they are not changed.
+	if config.OutboundPolicy != "" {
+		c.SetMeshSettings(config.OutboundPolicy, config.MeshHosts, config.TraceSampleRate)
+	}
+	if config.Version != 0 {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.version = config.Version
+		c.nonce = config.Nonce
+	}
+}
+
+// ReplaceConfig replaces everything in the cache with config, which is the full state from
+// skpilot.
+func (c *RuleGeneratorCache) ReplaceConfig(config *skproxy.Config) {
+	c.mtx.Lock()
+	c.ratioRuleGenerators = map[string]*skproxy.RatioRuleGenerator{}
+	c.regexRuleGenerators = map[string]*skproxy.RegexRuleGenerator{}
+	c.routeTableGenerators = map[string]*skproxy.RouteTableGenerator{}
+	c.serviceEntryGenerators = map[string]*skproxy.ServiceEntryGenerator{}
+	c.gatewayGenerators = map[string]*skproxy.GatewayGenerator{}
+	c.outboundPolicy = ""
+	c.meshHosts = []string{}
+	c.traceSampleRate = 0
+	c.mtx.Unlock()
+	c.ApplyConfig(config)
+}
+
+// Clone returns a copy of the cache, which is left unchanged by later updates to the cache.
+func (c *RuleGeneratorCache) Clone() *RuleGeneratorCache {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	clone := NewRuleGeneratorCache()
+	for name, generator := range c.ratioRuleGenerators {
+		clone.ratioRuleGenerators[name] = generator
+	}
+	for name, generator := range c.regexRuleGenerators {
+		clone.regexRuleGenerators[name] = generator
+	}
+	for name, generator := range c.routeTableGenerators {
+		clone.routeTableGenerators[name] = generator
+	}
+	for name, generator := range c.serviceEntryGenerators {
+		clone.serviceEntryGenerators[name] = generator
+	}
+	for name, generator := range c.gatewayGenerators {
+		clone.gatewayGenerators[name] = generator
+	}
+	clone.outboundPolicy = c.outboundPolicy
+	clone.meshHosts = c.meshHosts
+	clone.traceSampleRate = c.traceSampleRate
+	clone.version = c.version
+	clone.nonce = c.nonce
+	return clone
+}
+
+// HasConfig returns true if there is anything new proxies should be configured with.
+func (c *RuleGeneratorCache) HasConfig() bool {
 	c.mtx.RLock()
 	defer c.mtx.RUnlock()
-	return len(c.ratioRuleGenerators) != 0 || len(c.regexRuleGenerators) != 0
+	return len(c.ratioRuleGenerators) != 0 ||
+		len(c.regexRuleGenerators) != 0 ||
+		len(c.routeTableGenerators) != 0 ||
+		len(c.serviceEntryGenerators) != 0 ||
+		c.outboundPolicy != ""
 }
 
 func (c *RuleGeneratorCache) DumpConfig() *skproxy.Config {
 	c.mtx.RLock()
 	defer c.mtx.RUnlock()
 	return &skproxy.Config{
-		RatioRules: c.ratioRuleGenerators,
-		RegexRules: c.regexRuleGenerators,
+		RatioRules:      c.ratioRuleGenerators,
+		RegexRules:      c.regexRuleGenerators,
+		RouteTables:     c.routeTableGenerators,
+		ServiceEntries:  c.serviceEntryGenerators,
+		Gateways:        c.gatewayGenerators,
+		OutboundPolicy:  c.outboundPolicy,
+		MeshHosts:       c.meshHosts,
+		TraceSampleRate: c.traceSampleRate,
+		Version:         c.version,
+		Nonce:           c.nonce,
 	}
 }
 
+// ProxyConfigStatus is the result of sending a config to a proxy.
+type ProxyConfigStatus struct {
+	ProxyID string
+	IP      string
+	// Version is the config version running on the proxy.
+	Version uint64
+	// Error is why the proxy rejected the config or could not be reached. It is empty on ACK.
+	Error string
+}
+
 type ProxyContainer struct {
 	IP          string
 	ID          string
@@ -86,6 +259,18 @@ func (m *ProxyManager) GetProxies() []*ProxyContainer {
 	return ret
 }
 
+// GetProxyBySandbox returns the proxy of the sandbox, or nil if there is none.
+func (m *ProxyManager) GetProxyBySandbox(sandboxName string) *ProxyContainer {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, p := range m.idToProxy {
+		if p.SandboxName == sandboxName {
+			return p
+		}
+	}
+	return nil
+}
+
 func (m *ProxyManager) SetProxy(id string, proxy *ProxyContainer) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
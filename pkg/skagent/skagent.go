@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os/exec"
 	"time"
@@ -30,7 +31,10 @@ type Agent interface {
 	// identified by sandboxName.
 	SetupProxy(sandboxName string, ip string) error
 	// ApplyProxyConfig updates proxy rules sends the lastest rules to all proxies on this node.
-	ApplyProxyConfig(config *skproxy.Config) error
+	// If full is true, config replaces all the current rules. It returns whether each proxy has
+	// accepted the rules. An error is returned unless some proxy has confirmed the rules, and
+	// the current rules are left unchanged if the updated rules are invalid or rejected.
+	ApplyProxyConfig(config *skproxy.Config, full bool) ([]*proxy.ProxyConfigStatus, error)
 }
 
 type agent struct {
@@ -40,9 +44,11 @@ type agent struct {
 	ruleCache *proxy.RuleGeneratorCache
 	// proxyManager manages all proxies.
 	proxyManager *proxy.ProxyManager
+	// proxyArgs are the command line arguments of every proxy.
+	proxyArgs []string
 }
 
-func NewAgent() Agent {
+func NewAgent(proxyArgs []string) Agent {
 	// Create docker client.
 	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
 	if err != nil {
@@ -53,6 +59,7 @@ func NewAgent() Agent {
 		dockerClient: cli,
 		ruleCache:    proxy.NewRuleGeneratorCache(),
 		proxyManager: proxy.NewProxyManager(),
+		proxyArgs:    proxyArgs,
 	}
 
 	go func() {
@@ -67,10 +74,23 @@ func NewAgent() Agent {
 func (a *agent) SetupProxy(sandboxName string, ip string) error {
 	cli := a.dockerClient
 
+	// skpilot asks for the proxies of all pods on this node each time skagent registers.
+	if a.proxyManager.GetProxyBySandbox(sandboxName) != nil {
+		return nil
+	}
+	adopted, err := a.adoptProxy(sandboxName, ip)
+	if err != nil {
+		return err
+	}
+	if adopted {
+		return nil
+	}
+
 	// Create proxy container.
 	resp, err := cli.ContainerCreate(context.Background(), &dockercontainer.Config{
 		Image: proxyImageName,
 		User:  proxyUserId,
+		Cmd:   a.proxyArgs,
 	}, &dockercontainer.HostConfig{
 		NetworkMode: dockercontainer.NetworkMode(fmt.Sprintf("container:%v", sandboxName)),
 	}, nil, nil, getProxyContainerName(sandboxName))
@@ -99,58 +119,136 @@ func (a *agent) SetupProxy(sandboxName string, ip string) error {
 		SandboxName: sandboxName,
 	})
 
-	// If there are rules currently, sync the rule to that proxy.
-	if a.ruleCache.HasRules() {
-		err := a.applyConfigToOneProxy(ip, skproxy.ConfigPort, a.ruleCache.DumpConfig())
-		if err != nil {
-			glog.Errorf("failed to apply proxy rule to skproxy at %v: %v", ip, err.Error())
-		}
-	}
+	a.syncConfigToNewProxy(ip)
 
 	return nil
 }
 
-func (a *agent) ApplyProxyConfig(config *skproxy.Config) error {
-	// Update rules incrementally.
-	for name, rule := range config.RatioRules {
-		if rule == nil {
-			a.ruleCache.DeleteRule(name)
-		} else {
-			a.ruleCache.SetRatioRule(name, rule)
+// adoptProxy takes over the proxy container of the sandbox if it exists, which happens when
+// skagent restarts while pods keep running. iptables were configured when the container was set
+// up, so they are left untouched.
+func (a *agent) adoptProxy(sandboxName string, ip string) (bool, error) {
+	cli := a.dockerClient
+	container, err := cli.ContainerInspect(context.Background(), getProxyContainerName(sandboxName))
+	if err != nil {
+		if dockerclient.IsErrNotFound(err) {
+			return false, nil
 		}
+		return false, err
 	}
-	for name, rule := range config.RegexRules {
-		if rule == nil {
-			a.ruleCache.DeleteRule(name)
-		} else {
-			a.ruleCache.SetRegexRule(name, rule)
+	if !container.State.Running {
+		if err := cli.ContainerStart(
+			context.Background(),
+			container.ID,
+			dockertypes.ContainerStartOptions{}); err != nil {
+			return false, err
 		}
 	}
 
-	newConfig := a.ruleCache.DumpConfig()
-	var ret error = nil
-	for _, proxy := range a.proxyManager.GetProxies() {
-		err := a.applyConfigToOneProxy(proxy.IP, skproxy.ConfigPort, newConfig)
+	a.proxyManager.SetProxy(container.ID, &proxy.ProxyContainer{
+		IP:          ip,
+		ID:          container.ID,
+		SandboxName: sandboxName,
+	})
+	glog.Infof("adopt existing proxy for %v", sandboxName)
+
+	a.syncConfigToNewProxy(ip)
+	return true, nil
+}
+
+// syncConfigToNewProxy sends the current rules to a proxy that has just been set up.
+func (a *agent) syncConfigToNewProxy(ip string) {
+	// If there are rules currently, sync the rule to that proxy.
+	if a.ruleCache.HasConfig() {
+		ack, err := a.applyConfigToOneProxy(ip, skproxy.ConfigPort, a.ruleCache.DumpConfig())
 		if err != nil {
-			ret = err
-			glog.Errorf("failed to apply proxy rule to skproxy %v: %v", proxy.ID, err.Error())
+			glog.Errorf("failed to apply proxy rule to skproxy at %v: %v", ip, err.Error())
+		} else if ack.Error != "" {
+			glog.Errorf("skproxy at %v rejected proxy rule: %v", ip, ack.Error)
 		}
 	}
-	return ret
 }
 
-func (a *agent) applyConfigToOneProxy(ip string, port uint16, config *skproxy.Config) error {
+func (a *agent) ApplyProxyConfig(config *skproxy.Config, full bool) ([]*proxy.ProxyConfigStatus, error) {
+	// The update is merged into a copy of the cache, which replaces the cache only once the
+	// update is accepted, so that rejected rules are never sent to new proxies.
+	next := a.ruleCache.Clone()
+	if full {
+		next.ReplaceConfig(config)
+	} else {
+		// Update rules incrementally.
+		next.ApplyConfig(config)
+	}
+
+	newConfig := next.DumpConfig()
+	if err := skproxy.ValidateConfig(newConfig); err != nil {
+		glog.Errorf("reject proxy rule version %v: %v", config.Version, err)
+		return nil, err
+	}
+	proxies := a.proxyManager.GetProxies()
+	statuses := make([]*proxy.ProxyConfigStatus, 0, len(proxies))
+	confirmed, rejected := 0, 0
+	for _, p := range proxies {
+		status := &proxy.ProxyConfigStatus{
+			ProxyID: p.ID,
+			IP:      p.IP,
+		}
+		ack, err := a.applyConfigToOneProxy(p.IP, skproxy.ConfigPort, newConfig)
+		switch {
+		case err != nil:
+			status.Error = err.Error()
+			glog.Errorf("failed to apply proxy rule to skproxy %v: %v", p.ID, err.Error())
+		case ack.Error != "":
+			status.Version = ack.Version
+			status.Error = ack.Error
+			rejected++
+			glog.Errorf("skproxy %v rejected proxy rule: %v", p.ID, ack.Error)
+		case ack.Nonce != newConfig.Nonce:
+			status.Version = ack.Version
+			status.Error = fmt.Sprintf("response is for nonce %q instead of %q", ack.Nonce, newConfig.Nonce)
+			glog.Errorf("skproxy %v: %v", p.ID, status.Error)
+		default:
+			status.Version = ack.Version
+			confirmed++
+		}
+		statuses = append(statuses, status)
+	}
+	if confirmed == 0 {
+		// Nothing rejected the update, so it is kept for the proxies created or reachable
+		// later, but it is not acknowledged until a proxy runs it, and skpilot sends it again.
+		if rejected == 0 {
+			a.ruleCache.ReplaceConfig(newConfig)
+		}
+		return statuses, fmt.Errorf("proxy rule version %v is not confirmed by any of %d proxies (%d rejected)",
+			config.Version, len(proxies), rejected)
+	}
+	a.ruleCache.ReplaceConfig(newConfig)
+	return statuses, nil
+}
+
+// applyConfigToOneProxy sends config to the proxy at ip:port. An error is returned only if
+// the proxy does not respond with a ConfigAck, while rejection is reported in the ack.
+func (a *agent) applyConfigToOneProxy(ip string, port uint16, config *skproxy.Config) (*skproxy.ConfigAck, error) {
 	configJson, err := json.Marshal(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = http.Post(
+	resp, err := http.Post(
 		fmt.Sprintf("http://%v:%v", ip, port),
 		"application/json", bytes.NewBuffer(configJson))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var ack skproxy.ConfigAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return nil, fmt.Errorf("skproxy responded with %v: %s", resp.Status, data)
+	}
+	return &ack, nil
 }
 
 func getProxyContainerName(sandboxName string) string {
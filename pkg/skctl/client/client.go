@@ -17,43 +17,323 @@ var CONN_TIMEOUT time.Duration = time.Second
 var SKPILOT_URL string = "localhost"
 var SKPILOT_PORT uint16 = core.SKPILOT_PORT
 
-type ctlClient struct {
+type CtlClient struct {
 	connection *grpc.ClientConn
 	client     pb.SkpilotCtlServiceClient
 }
 
-func NewCtlClient() *ctlClient {
+func NewCtlClient() *CtlClient {
 	addr := fmt.Sprintf("%v:%v", SKPILOT_URL, SKPILOT_PORT)
-	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(
+		addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(decodeError),
+	)
 	if err != nil {
 		log.Fatal("skctl client failed to connect to skpilot")
 	}
-	return &ctlClient{
+	return &CtlClient{
 		connection: conn,
 		client:     pb.NewSkpilotCtlServiceClient(conn),
 	}
 }
 
-func (c *ctlClient) ApplyRatioRule(rule *core.RatioRule) (*pb.DefaultResponse, error) {
+func (c *CtlClient) ApplyRatioRule(rule *core.RatioRule) (*pb.DefaultResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
 	defer cancel()
 	data, err := json.Marshal(rule)
 	if err != nil {
-		return &pb.DefaultResponse{Status: 1}, err
+		return nil, err
 	}
 	return c.client.ApplyRatioRule(ctx, &pb.ApplyRatioRuleRequest{
 		RatioRule: data,
 	})
 }
 
-func (c *ctlClient) ApplyRegexRule(rule *core.RegexRule) (*pb.DefaultResponse, error) {
+func (c *CtlClient) ApplyRegexRule(rule *core.RegexRule) (*pb.DefaultResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
 	defer cancel()
 	data, err := json.Marshal(rule)
 	if err != nil {
-		return &pb.DefaultResponse{Status: 1}, err
+		return nil, err
 	}
 	return c.client.ApplyRegexRule(ctx, &pb.ApplyRegexRuleRequest{
 		RegexRule: data,
 	})
 }
+
+func (c *CtlClient) ApplyServiceEntry(entry *core.ServiceEntry) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ApplyServiceEntry(ctx, &pb.ApplyServiceEntryRequest{
+		ServiceEntry: data,
+	})
+}
+
+func (c *CtlClient) ApplyGateway(gateway *core.Gateway) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(gateway)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ApplyGateway(ctx, &pb.ApplyGatewayRequest{
+		Gateway: data,
+	})
+}
+
+func (c *CtlClient) ApplyDestinationPolicy(policy *core.DestinationPolicy) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ApplyDestinationPolicy(ctx, &pb.ApplyDestinationPolicyRequest{
+		DestinationPolicy: data,
+	})
+}
+
+func (c *CtlClient) ApplyRollout(rollout *core.Rollout) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ApplyRollout(ctx, &pb.ApplyRolloutRequest{
+		Rollout: data,
+	})
+}
+
+func (c *CtlClient) UpdateRatioRule(rule *core.RatioRule) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateRatioRule(ctx, &pb.UpdateRatioRuleRequest{
+		RatioRule: data,
+	})
+}
+
+func (c *CtlClient) UpdateRegexRule(rule *core.RegexRule) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateRegexRule(ctx, &pb.UpdateRegexRuleRequest{
+		RegexRule: data,
+	})
+}
+
+func (c *CtlClient) UpdateServiceEntry(entry *core.ServiceEntry) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateServiceEntry(ctx, &pb.UpdateServiceEntryRequest{
+		ServiceEntry: data,
+	})
+}
+
+func (c *CtlClient) UpdateGateway(gateway *core.Gateway) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(gateway)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateGateway(ctx, &pb.UpdateGatewayRequest{
+		Gateway: data,
+	})
+}
+
+func (c *CtlClient) UpdateDestinationPolicy(policy *core.DestinationPolicy) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateDestinationPolicy(ctx, &pb.UpdateDestinationPolicyRequest{
+		DestinationPolicy: data,
+	})
+}
+
+func (c *CtlClient) UpdateRollout(rollout *core.Rollout) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateRollout(ctx, &pb.UpdateRolloutRequest{
+		Rollout: data,
+	})
+}
+
+// ControlRollout pauses, resumes or aborts the rollout with the name, and returns the rollout
+// with its new status.
+func (c *CtlClient) ControlRollout(name string, action core.RolloutAction) (*core.Rollout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	resp, err := c.client.ControlRollout(ctx, &pb.ControlRolloutRequest{
+		Name:   name,
+		Action: string(action),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rollout core.Rollout
+	if err := json.Unmarshal(resp.Rollout, &rollout); err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+func (c *CtlClient) DeleteRule(name string) (*pb.DefaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	return c.client.DeleteRule(ctx, &pb.DeleteRuleRequest{
+		Name: name,
+	})
+}
+
+// GetRule returns the rule with the name, which is one of *core.RatioRule, *core.RegexRule,
+// *core.ServiceEntry, *core.Gateway, *core.DestinationPolicy and *core.Rollout according to its
+// kind.
+func (c *CtlClient) GetRule(name string) (core.Rule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	resp, err := c.client.GetRule(ctx, &pb.GetRuleRequest{
+		Name: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rule, err := core.NewRule(core.Kind(resp.Kind))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(resp.Rule, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// GetRuleStatus returns the status of the rule with the name, which tells whether the services
+// and pods it refers to are found, and which agents and proxies run a config carrying it.
+func (c *CtlClient) GetRuleStatus(name string) (*core.RuleStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	resp, err := c.client.GetRuleStatus(ctx, &pb.GetRuleStatusRequest{
+		Name: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var status core.RuleStatus
+	if err := json.Unmarshal(resp.RuleStatus, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *CtlClient) ListRules() (*core.RuleList, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	resp, err := c.client.ListRules(ctx, &pb.ListRulesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var rules core.RuleList
+	if err := json.Unmarshal(resp.Rules, &rules); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// DryRunRule asks skpilot to check the rule without committing it. It returns the generator
+// the rule would produce, and the generator of the current rule with the same name, which is
+// nil if there is no such rule. Both are decoded as generic JSON values.
+func (c *CtlClient) DryRunRule(rule core.Rule) (interface{}, interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.client.DryRunRule(ctx, &pb.DryRunRuleRequest{
+		Kind: string(rule.GetRuleMeta().Kind),
+		Rule: data,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var generator, currentGenerator interface{}
+	if err := json.Unmarshal(resp.Generator, &generator); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(resp.CurrentGenerator, &currentGenerator); err != nil {
+		return nil, nil, err
+	}
+	return generator, currentGenerator, nil
+}
+
+// TestRoute asks skpilot to simulate the routing of the request with its current rules and
+// endpoints.
+func (c *CtlClient) TestRoute(request *core.RouteTestRequest) (*core.RouteTestResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.TestRoute(ctx, &pb.TestRouteRequest{Request: data})
+	if err != nil {
+		return nil, err
+	}
+	var result core.RouteTestResult
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *CtlClient) ListSyncStatus() ([]core.AgentSyncStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	resp, err := c.client.ListSyncStatus(ctx, &pb.ListSyncStatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var statuses []core.AgentSyncStatus
+	if err := json.Unmarshal(resp.Statuses, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (c *CtlClient) ListAgents() ([]core.AgentStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONN_TIMEOUT)
+	defer cancel()
+	resp, err := c.client.ListAgents(ctx, &pb.ListAgentsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var agents []core.AgentStatus
+	if err := json.Unmarshal(resp.Agents, &agents); err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"p9t.io/skafos/pkg/api/core"
+	pb "p9t.io/skafos/pkg/proto"
+)
+
+// decodeError is a unary interceptor turning the status of a failed call to skpilot into an
+// error readable by users. A request refused by skpilot yields a *core.Error telling the field
+// at fault, and any other failure yields its code and message, like
+// "Unavailable: connection refused".
+func decodeError(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*pb.ErrorDetail); ok {
+			return &core.Error{
+				Reason:  core.ErrorReason(d.Reason),
+				Field:   d.Field,
+				Value:   d.Value,
+				Message: st.Message(),
+			}
+		}
+	}
+	return fmt.Errorf("%v: %s", st.Code(), st.Message())
+}
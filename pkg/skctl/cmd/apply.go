@@ -1,10 +1,19 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -12,83 +21,668 @@ import (
 	"p9t.io/skafos/pkg/skctl/client"
 )
 
+// These are valid modes of dry run.
+const (
+	// dryRunNone means rules are applied.
+	dryRunNone = "none"
+	// dryRunClient means rules are only checked and merged by skctl.
+	dryRunClient = "client"
+	// dryRunServer means rules are also checked by skpilot against the current services and
+	// pods, without being committed.
+	dryRunServer = "server"
+)
+
+// applyWaitInterval is how often the status of applied rules is polled with --wait.
+const applyWaitInterval = time.Second
+
 var (
-	file     string
-	applyCmd = &cobra.Command{
-		Use:   "apply [-f FILENAME]",
-		Short: "Apply a routing rule by filename",
-		Long: `Apply a routing rule by filename
+	file        string
+	prune       bool
+	dryRun      string
+	wait        bool
+	waitTimeout time.Duration
+	applyCmd    = &cobra.Command{
+		Use:   "apply [-f FILENAME] [--prune] [--dry-run=none|client|server] [--wait [--timeout DURATION]]",
+		Short: "Apply routing rules by filename or directory",
+		Long: `Apply routing rules by filename or directory
+
+A rule is created if there is no rule with the same name, and updated in place otherwise.
+The update merges the rule last applied, the live rule and the rule in the file, so that
+fields changed by others since the last apply are kept unless the file changes them too.
+
+Every document in a multi-document YAML file is applied. If a directory is given, all the
+.yaml and .yml files in it are applied.
+
+With --prune, the rules applied from the same file or directory before but absent from it
+now are deleted. Rules applied from elsewhere or created otherwise are never pruned.
+
+With --dry-run=server, skpilot checks the rules against the current services and pods, and
+returns the config each rule would produce, e.g. which pod IPs land in which subset, without
+committing anything or pushing it to agents.
+
+A rule with activeFrom is not pushed to agents until then, and a rule with expiresAt, or
+with a ttl counted from activeFrom or from its creation, is deleted by skpilot once it
+expires. Timestamps are in RFC 3339, like 2024-05-01T18:00:00+08:00, and a ttl is a
+duration like 72h.
+
+With --wait, skctl waits until every rule in the file is propagated, i.e. all the agents
+and proxies run a config carrying it, for at most --timeout. Rules not in effect yet are not
+waited for. skctl exits with 1 if any rule is rejected by proxies or is not propagated in
+time, and warns about rules whose services or pods are not found.
 
 Examples:
   # Apply the ratio rule in ratio.yaml
-  skctl apply -f ./ratio.yaml`,
+  skctl apply -f ./ratio.yaml
+
+  # Apply all the rules in rules/, and delete the rules applied from rules/ before but no
+  # longer there
+  skctl apply -f ./rules/ --prune
+
+  # Show the config the ratio rule in ratio.yaml would produce without applying it
+  skctl apply -f ./ratio.yaml --dry-run=server
+
+  # Apply the ratio rule in ratio.yaml and wait until all the proxies run it
+  skctl apply -f ./ratio.yaml --wait`,
 		Run: func(cmd *cobra.Command, args []string) {
-			data, err := os.ReadFile(file)
+			if dryRun != dryRunNone && dryRun != dryRunClient && dryRun != dryRunServer {
+				log.Fatalf("invalid dry run mode: %v", dryRun)
+			}
+			rules, err := readRules(file)
 			if err != nil {
 				log.Fatal(err)
 			}
-			var ruleKind core.RuleKind
-			err = yaml.Unmarshal(data, &ruleKind)
+			source, err := filepath.Abs(file)
 			if err != nil {
-				log.Fatal("error decoding rule's type")
+				log.Fatal(err)
+			}
+			for _, rule := range rules {
+				rule.GetRuleMeta().AppliedFrom = source
 			}
-			if ruleKind.Kind != string(core.RatioType) && ruleKind.Kind != string(core.RegexType) {
-				log.Fatalf("type %v is not supported", ruleKind.Kind)
+
+			client := client.NewCtlClient()
+			liveRules, err := listRules(client)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			failed := false
+			for _, rule := range rules {
+				meta := rule.GetRuleMeta()
+				planned, result, err := planRule(rule, liveRules[meta.Name])
+				var generator interface{}
+				if err == nil && planned != nil {
+					switch dryRun {
+					case dryRunNone:
+						if liveRules[meta.Name] == nil {
+							err = createRule(client, planned)
+						} else {
+							err = updateRule(client, planned)
+						}
+					case dryRunServer:
+						generator, _, err = client.DryRunRule(planned)
+					}
+				}
+				if err != nil {
+					log.Printf("%s/%s: %v", meta.Kind, meta.Name, err)
+					failed = true
+					continue
+				}
+				fmt.Printf("%s/%s %s%s\n", meta.Kind, meta.Name, result, dryRunSuffix())
+				if generator != nil {
+					data, err := yaml.Marshal(generator)
+					if err != nil {
+						log.Fatal(err)
+					}
+					fmt.Print(indent(string(data), "  "))
+				}
+			}
+			// Never prune after a failure, since the rules failed to apply may be pruned otherwise.
+			if failed {
+				os.Exit(1)
+			}
+
+			if prune {
+				for _, rule := range rulesToPrune(rules, liveRules, source) {
+					meta := rule.GetRuleMeta()
+					if dryRun == dryRunNone {
+						if _, err := client.DeleteRule(meta.Name); err != nil {
+							log.Fatalf("%s/%s: %v", meta.Kind, meta.Name, err)
+						}
+					}
+					fmt.Printf("%s/%s pruned%s\n", meta.Kind, meta.Name, dryRunSuffix())
+				}
 			}
 
-			switch ruleKind.Kind {
-			case string(core.RatioType):
-				applyRatioRule(data)
-			case string(core.RegexType):
-				applyRegexRule(data)
+			if wait && dryRun == dryRunNone && !waitForRules(client, rules, waitTimeout) {
+				os.Exit(1)
 			}
 		},
 	}
 )
 
-func applyRatioRule(data []byte) {
-	var rule core.RatioRule
-	if err := yaml.Unmarshal(data, &rule); err != nil {
-		log.Fatalf("cannot unmarshal data: %v", err)
+// readRules reads the rules in the file, or in all the YAML files in the directory.
+func readRules(path string) ([]core.Rule, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
 	}
 
-	// Do some sanity checks
-	if rule.Spec.Ratio > 100 {
-		log.Fatalf("ratio cannot be more than 100")
+	rules := make([]core.Rule, 0)
+	names := make(map[string]string)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fileRules, err := parseRules(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		for _, rule := range fileRules {
+			name := rule.GetRuleMeta().Name
+			if previousFile, ok := names[name]; ok {
+				return nil, fmt.Errorf("%s: duplicate rule %s, which is also in %s", f, name, previousFile)
+			}
+			names[name] = f
+		}
+		rules = append(rules, fileRules...)
 	}
+	return rules, nil
+}
 
-	client := client.NewCtlClient()
-	resp, err := client.ApplyRatioRule(&rule)
-	if err != nil {
-		log.Fatal(err)
+// parseRules decodes every document in a YAML file into a rule.
+func parseRules(data []byte) ([]core.Rule, error) {
+	rules := make([]core.Rule, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Skip empty documents.
+		if doc == nil {
+			continue
+		}
+		docData, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		rule, err := parseRule(docData)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
 	}
-	fmt.Printf("Response status: %v ;Ratio rule Applied\n", resp.Status)
+	return rules, nil
 }
 
-func applyRegexRule(data []byte) {
-	var rule core.RegexRule
-	if err := yaml.Unmarshal(data, &rule); err != nil {
-		log.Fatalf("cannot unmarshal data: %v", err)
+// parseRule decodes a document into a rule according to its kind, and does some sanity checks.
+func parseRule(data []byte) (core.Rule, error) {
+	var ruleKind core.RuleKind
+	if err := yaml.Unmarshal(data, &ruleKind); err != nil {
+		return nil, errors.New("error decoding rule's type")
+	}
+	rule, err := core.NewRule(core.Kind(ruleKind.Kind))
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, rule); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal data: %v", err)
+	}
+	if rule.GetRuleMeta().Name == "" {
+		return nil, fmt.Errorf("%s must have a name", ruleKind.Kind)
+	}
+	if err := checkSchedule(rule.GetRuleMeta()); err != nil {
+		return nil, err
 	}
 
 	// Do some sanity checks
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		return rule, checkRatioRule(rule)
+	case *core.RegexRule:
+		return rule, checkRegexRule(rule)
+	case *core.ServiceEntry:
+		return rule, checkServiceEntry(rule)
+	case *core.Gateway:
+		return rule, checkGateway(rule)
+	case *core.DestinationPolicy:
+		return rule, checkDestinationPolicy(rule)
+	case *core.Rollout:
+		return rule, checkRollout(rule)
+	}
+	return rule, nil
+}
+
+// checkSchedule checks when a rule takes effect and expires.
+func checkSchedule(meta *core.RuleMeta) error {
+	if meta.TTL != "" {
+		if meta.ExpiresAt != nil {
+			return errors.New("ttl and expiresAt cannot be set together")
+		}
+		ttl, err := time.ParseDuration(meta.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl %q: %v", meta.TTL, err)
+		}
+		if ttl <= 0 {
+			return errors.New("ttl must be positive")
+		}
+	}
+	if meta.ActiveFrom != nil && meta.ExpiresAt != nil && !meta.ExpiresAt.After(*meta.ActiveFrom) {
+		return errors.New("expiresAt must be after activeFrom")
+	}
+	return nil
+}
+
+func checkRatioRule(rule *core.RatioRule) error {
+	if rule.Spec.Ratio > 100 {
+		return errors.New("ratio cannot be more than 100")
+	}
+	return checkPodSelection(rule.Spec.Subset, rule.Spec.Selector, rule.Spec.MatchExpressions)
+}
+
+func checkRegexRule(rule *core.RegexRule) error {
 	for _, matcher := range rule.Spec.Matchers {
 		_, err := regexp.Compile(matcher.Regex)
 		if err != nil {
-			log.Fatalf("incorrect regex %s", matcher.Regex)
+			return fmt.Errorf("incorrect regex %s", matcher.Regex)
+		}
+		if err := checkPodSelection(matcher.Subset, matcher.Selector, matcher.MatchExpressions); err != nil {
+			return fmt.Errorf("matcher of header %s: %v", matcher.Header, err)
+		}
+	}
+	return nil
+}
+
+// checkPodSelection checks that pods are selected either by a subset or by a selector.
+func checkPodSelection(subset string, selector map[string]string, expressions []core.SelectorRequirement) error {
+	if subset == "" {
+		return core.ValidateSelector(selector, expressions)
+	}
+	if len(selector) != 0 || len(expressions) != 0 {
+		return fmt.Errorf("subset %s cannot be used together with a selector", subset)
+	}
+	return nil
+}
+
+func checkServiceEntry(entry *core.ServiceEntry) error {
+	if len(entry.Spec.Hosts) == 0 {
+		return errors.New("service entry must have at least one host")
+	}
+	if len(entry.Spec.Endpoints) != 0 {
+		var totalWeight uint32 = 0
+		for _, endpoint := range entry.Spec.Endpoints {
+			totalWeight += endpoint.Weight
+		}
+		if totalWeight == 0 {
+			return errors.New("at least one endpoint must have a positive weight")
 		}
 	}
+	return nil
+}
+
+func checkGateway(gateway *core.Gateway) error {
+	for _, route := range gateway.Spec.Routes {
+		if route.ServiceName == "" {
+			return errors.New("gateway route must have a service name")
+		}
+		if route.Port == 0 {
+			return fmt.Errorf("gateway route to %s must have a port", route.ServiceName)
+		}
+	}
+	return nil
+}
 
-	client := client.NewCtlClient()
-	resp, err := client.ApplyRegexRule(&rule)
+func checkDestinationPolicy(policy *core.DestinationPolicy) error {
+	if policy.Spec.ServiceName == "" {
+		return errors.New("destination policy must have a service name")
+	}
+	if err := checkTrafficPolicy(policy.Spec.TrafficPolicy); err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(policy.Spec.Subsets))
+	for _, subset := range policy.Spec.Subsets {
+		if subset.Name == "" {
+			return errors.New("subset must have a name")
+		}
+		if names[subset.Name] {
+			return fmt.Errorf("duplicate subset %s", subset.Name)
+		}
+		names[subset.Name] = true
+		if err := core.ValidateSelector(subset.Selector, subset.MatchExpressions); err != nil {
+			return fmt.Errorf("subset %s: %v", subset.Name, err)
+		}
+		if err := checkTrafficPolicy(subset.TrafficPolicy); err != nil {
+			return fmt.Errorf("subset %s: %v", subset.Name, err)
+		}
+	}
+	return nil
+}
+
+func checkRollout(rollout *core.Rollout) error {
+	if rollout.Spec.ServiceName == "" {
+		return errors.New("rollout must have a service name")
+	}
+	if len(rollout.Spec.Steps) == 0 {
+		return errors.New("rollout must have at least one step")
+	}
+	for i, step := range rollout.Spec.Steps {
+		if step.Weight > 100 {
+			return fmt.Errorf("weight of step %d cannot be more than 100", i+1)
+		}
+	}
+	if analysis := rollout.Spec.Analysis; analysis != nil {
+		if analysis.MinSuccessRate < 0 || analysis.MinSuccessRate > 100 {
+			return errors.New("minSuccessRate must be between 0 and 100")
+		}
+	}
+	return checkPodSelection(rollout.Spec.Subset, rollout.Spec.Selector, rollout.Spec.MatchExpressions)
+}
+
+func checkTrafficPolicy(policy *core.TrafficPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	switch policy.LoadBalancer {
+	case "", core.LoadBalancerRoundRobin, core.LoadBalancerRandom:
+	default:
+		return fmt.Errorf(
+			"unknown load balancer %s, expected %s or %s",
+			policy.LoadBalancer,
+			core.LoadBalancerRoundRobin,
+			core.LoadBalancerRandom,
+		)
+	}
+	switch policy.TLSMode {
+	case "", core.TLSModeDisable, core.TLSModeSimple:
+	default:
+		return fmt.Errorf(
+			"unknown TLS mode %s, expected %s or %s",
+			policy.TLSMode,
+			core.TLSModeDisable,
+			core.TLSModeSimple,
+		)
+	}
+	return nil
+}
+
+// listRules returns all the live rules by name.
+func listRules(c *client.CtlClient) (map[string]core.Rule, error) {
+	list, err := c.ListRules()
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[string]core.Rule)
+	for _, rule := range list.RatioRules {
+		rules[rule.Name] = rule
+	}
+	for _, rule := range list.RegexRules {
+		rules[rule.Name] = rule
+	}
+	for _, entry := range list.ServiceEntries {
+		rules[entry.Name] = entry
+	}
+	for _, gateway := range list.Gateways {
+		rules[gateway.Name] = gateway
+	}
+	for _, policy := range list.DestinationPolicies {
+		rules[policy.Name] = policy
+	}
+	for _, rollout := range list.Rollouts {
+		rules[rollout.Name] = rollout
+	}
+	return rules, nil
+}
+
+// planRule returns the rule to create if liveRule is nil, or the rule to update liveRule to
+// otherwise, together with whether the rule is created, configured or unchanged. The returned
+// rule is nil if unchanged.
+func planRule(rule core.Rule, liveRule core.Rule) (core.Rule, string, error) {
+	if liveRule == nil {
+		lastApplied, err := json.Marshal(rule)
+		if err != nil {
+			return nil, "", err
+		}
+		rule.GetRuleMeta().LastApplied = string(lastApplied)
+		return rule, "created", nil
+	}
+
+	merged, changed, err := mergeRule(rule, liveRule)
+	if err != nil {
+		return nil, "", err
+	}
+	if !changed {
+		return nil, "unchanged", nil
+	}
+	return merged, "configured", nil
+}
+
+// mergeRule merges the rule into the live rule against the rule last applied, and returns the
+// merged rule and whether it differs from the live rule.
+func mergeRule(rule core.Rule, liveRule core.Rule) (core.Rule, bool, error) {
+	meta := rule.GetRuleMeta()
+	liveMeta := liveRule.GetRuleMeta()
+	if meta.Kind != liveMeta.Kind {
+		return nil, false, fmt.Errorf(
+			"rule %s is of kind %s rather than %s, delete it before applying",
+			meta.Name,
+			liveMeta.Kind,
+			meta.Kind,
+		)
+	}
+
+	lastApplied, err := json.Marshal(rule)
+	if err != nil {
+		return nil, false, err
+	}
+	// A rule not created by skctl apply has nothing last applied, so that all the fields in the
+	// file take effect.
+	original := make(map[string]interface{})
+	if liveMeta.LastApplied != "" {
+		if err := json.Unmarshal([]byte(liveMeta.LastApplied), &original); err != nil {
+			return nil, false, fmt.Errorf("malformed last applied rule: %v", err)
+		}
+	}
+	modified, err := toMap(rule)
+	if err != nil {
+		return nil, false, err
+	}
+	current, err := toMap(liveRule)
 	if err != nil {
-		log.Fatal(err)
+		return nil, false, err
+	}
+	delete(current, "LastApplied")
+
+	mergedMap := threeWayMerge(original, current, modified)
+	changed := !reflect.DeepEqual(mergedMap, current) || liveMeta.LastApplied != string(lastApplied)
+
+	merged, err := core.NewRule(meta.Kind)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := json.Marshal(mergedMap)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, merged); err != nil {
+		return nil, false, err
+	}
+	merged.GetRuleMeta().LastApplied = string(lastApplied)
+	return merged, changed, nil
+}
+
+// toMap converts a rule to its JSON object.
+func toMap(rule core.Rule) (map[string]interface{}, error) {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func createRule(c *client.CtlClient, rule core.Rule) error {
+	var err error
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		_, err = c.ApplyRatioRule(rule)
+	case *core.RegexRule:
+		_, err = c.ApplyRegexRule(rule)
+	case *core.ServiceEntry:
+		_, err = c.ApplyServiceEntry(rule)
+	case *core.Gateway:
+		_, err = c.ApplyGateway(rule)
+	case *core.DestinationPolicy:
+		_, err = c.ApplyDestinationPolicy(rule)
+	case *core.Rollout:
+		_, err = c.ApplyRollout(rule)
+	}
+	return err
+}
+
+func updateRule(c *client.CtlClient, rule core.Rule) error {
+	var err error
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		_, err = c.UpdateRatioRule(rule)
+	case *core.RegexRule:
+		_, err = c.UpdateRegexRule(rule)
+	case *core.ServiceEntry:
+		_, err = c.UpdateServiceEntry(rule)
+	case *core.Gateway:
+		_, err = c.UpdateGateway(rule)
+	case *core.DestinationPolicy:
+		_, err = c.UpdateDestinationPolicy(rule)
+	case *core.Rollout:
+		_, err = c.UpdateRollout(rule)
+	}
+	return err
+}
+
+// waitForRules waits until every rule is propagated to all the agents and proxies, and prints
+// whether it is. Rules not in effect are not waited for. It returns false if any rule is
+// rejected, or is not propagated before the timeout.
+func waitForRules(c *client.CtlClient, rules []core.Rule, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ok := true
+	for _, rule := range rules {
+		meta := rule.GetRuleMeta()
+		status, err := waitForRule(c, meta.Name, deadline)
+		if err != nil {
+			log.Printf("%s/%s: %v", meta.Kind, meta.Name, err)
+			ok = false
+			continue
+		}
+		if resolved := status.GetCondition(core.RuleResolved); resolved != nil && !resolved.Status {
+			log.Printf("%s/%s: warning: %s", meta.Kind, meta.Name, resolved.Message)
+		}
+		propagated := status.GetCondition(core.RulePropagated)
+		switch {
+		case propagated.Status:
+			fmt.Printf("%s/%s synced (%s)\n", meta.Kind, meta.Name, propagated.Message)
+		case status.State != core.RuleActive:
+			fmt.Printf("%s/%s not waited for (%s)\n", meta.Kind, meta.Name, propagated.Message)
+		case propagated.Reason == core.RuleReasonRejected:
+			log.Printf("%s/%s rejected: %s", meta.Kind, meta.Name, propagated.Message)
+			ok = false
+		default:
+			log.Printf("%s/%s not synced within %v: %s", meta.Kind, meta.Name, timeout, propagated.Message)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// waitForRule polls the status of the rule with the name until the rule is propagated, rejected
+// or not in effect, or until the deadline, and returns its last status.
+func waitForRule(c *client.CtlClient, name string, deadline time.Time) (*core.RuleStatus, error) {
+	for {
+		status, err := c.GetRuleStatus(name)
+		if err != nil {
+			return nil, err
+		}
+		propagated := status.GetCondition(core.RulePropagated)
+		if propagated == nil {
+			return nil, fmt.Errorf("no %s condition in the status", core.RulePropagated)
+		}
+		if propagated.Status || propagated.Reason == core.RuleReasonRejected ||
+			status.State != core.RuleActive || !time.Now().Before(deadline) {
+			return status, nil
+		}
+		time.Sleep(applyWaitInterval)
+	}
+}
+
+// dryRunSuffix returns the suffix of results in the dry run mode.
+func dryRunSuffix() string {
+	switch dryRun {
+	case dryRunClient:
+		return " (dry run)"
+	case dryRunServer:
+		return " (server dry run)"
+	default:
+		return ""
+	}
+}
+
+// indent prefixes every line of s with prefix.
+func indent(s string, prefix string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// rulesToPrune returns the live rules last applied by skctl apply from source but absent from
+// rules, sorted by name. Rules applied from elsewhere or created otherwise are never pruned.
+func rulesToPrune(rules []core.Rule, liveRules map[string]core.Rule, source string) []core.Rule {
+	names := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		names[rule.GetRuleMeta().Name] = struct{}{}
+	}
+	pruned := make([]core.Rule, 0)
+	for name, rule := range liveRules {
+		meta := rule.GetRuleMeta()
+		if _, ok := names[name]; !ok && meta.LastApplied != "" && meta.AppliedFrom == source {
+			pruned = append(pruned, rule)
+		}
 	}
-	fmt.Printf("Response status: %v ;Regex rule Applied\n", resp.Status)
+	sort.Slice(pruned, func(i, j int) bool {
+		return pruned[i].GetRuleMeta().Name < pruned[j].GetRuleMeta().Name
+	})
+	return pruned
 }
 
 func init() {
 	rootCmd.AddCommand(applyCmd)
-	applyCmd.Flags().StringVarP(&file, "file", "f", "", "specify the configuration file")
+	applyCmd.Flags().StringVarP(&file, "file", "f", "", "specify the configuration file or directory")
+	applyCmd.Flags().BoolVar(&prune, "prune", false, "delete rules applied from the same file or directory before but absent from it now")
+	applyCmd.Flags().StringVar(&dryRun, "dry-run", dryRunNone, "one of none, client and server; rules are not applied unless none")
+	applyCmd.Flags().BoolVar(&wait, "wait", false, "wait until the rules are propagated to all the proxies")
+	applyCmd.Flags().DurationVar(&waitTimeout, "timeout", time.Minute, "how long to wait with --wait")
 	applyCmd.MarkFlagRequired("file")
 }
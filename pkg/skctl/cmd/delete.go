@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+var (
+	deleteCmd = &cobra.Command{
+		Use:   "delete",
+		Short: "Delete resources",
+	}
+	deleteRuleCmd = &cobra.Command{
+		Use:   "rule NAME",
+		Short: "Delete a rule, service entry or gateway",
+		Long: `Delete a rule, service entry or gateway
+
+The rule is removed from all proxies, so that requests are routed as if it were never applied.
+
+Examples:
+  # Delete the rule named my-ratio
+  skctl delete rule my-ratio`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := client.NewCtlClient()
+			if _, err := client.DeleteRule(args[0]); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Rule %s deleted\n", args[0])
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+	deleteCmd.AddCommand(deleteRuleCmd)
+}
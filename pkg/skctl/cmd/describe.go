@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+var (
+	describeCmd = &cobra.Command{
+		Use:   "describe",
+		Short: "Show details of a specific resource",
+	}
+	describeRuleCmd = &cobra.Command{
+		Use:   "rule NAME",
+		Short: "Show a rule, service entry or gateway",
+		Long: `Show a rule, service entry or gateway
+
+The rule is printed in the same format as the file it is applied from, followed by its
+status observed by skpilot.
+
+The Resolved condition tells whether the services the rule refers to exist and have a
+ClusterIP, and whether each of its selectors and subsets matches any pods. SUBSETS lists
+the number of pod IPs each of them selects.
+
+The Propagated condition tells whether all the agents and proxies run a config carrying
+the rule as it is. VERSION is the first config version that does, and each agent or proxy
+is SYNCED if it runs that version or later, STALE if it does not yet, and NACK if it
+rejected the config.
+
+Examples:
+  # Show the rule named my-ratio
+  skctl describe rule my-ratio`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := client.NewCtlClient()
+			rule, err := client.GetRule(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			status, err := client.GetRuleStatus(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			data, err := yaml.Marshal(rule)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Print(string(data))
+			fmt.Println()
+			printRuleStatus(status)
+		},
+	}
+)
+
+// printRuleStatus prints the state, the conditions, the subsets and the sync status of a rule.
+func printRuleStatus(status *core.RuleStatus) {
+	fmt.Printf("State:    %s\n", status.State)
+	if status.Version == 0 {
+		fmt.Printf("Version:  -\n")
+	} else {
+		fmt.Printf("Version:  %d\n", status.Version)
+	}
+
+	fmt.Println("Conditions:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+	for _, c := range status.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c.Type, formatConditionStatus(c.Status), orDash(c.Reason), orDash(c.Message))
+	}
+	w.Flush()
+
+	if len(status.Subsets) != 0 {
+		fmt.Println("Subsets:")
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "  NAME\tSELECTOR\tIPS")
+		for _, s := range status.Subsets {
+			selector := core.FormatSelector(s.Selector, s.MatchExpressions)
+			if s.Subset != "" {
+				selector = fmt.Sprintf("subset %s", s.Subset)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%d\n", s.Name, selector, s.IPs)
+		}
+		w.Flush()
+	}
+
+	if status.Version == 0 || len(status.Agents) == 0 {
+		return
+	}
+	fmt.Println("Agents:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  AGENT\tPROXY\tADDRESS\tVERSION\tSTATUS\tERROR")
+	for _, a := range status.Agents {
+		fmt.Fprintf(w, "  %s\t-\t-\t%d\t%s\t%s\n",
+			a.Agent, a.AckedVersion, ruleSyncStatus(status.Version, a.AckedVersion, a.Error), a.Error)
+		for _, p := range a.Proxies {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t%s\t%s\n",
+				a.Agent, shortID(p.ID), p.Address, p.Version, ruleSyncStatus(status.Version, p.Version, p.Error), p.Error)
+		}
+	}
+	w.Flush()
+}
+
+// ruleSyncStatus returns whether an agent or a proxy running version, which failed with err
+// to run a later one if err is not empty, is in sync with a rule of ruleVersion.
+func ruleSyncStatus(ruleVersion uint64, version uint64, err string) string {
+	switch {
+	case version >= ruleVersion:
+		return "SYNCED"
+	case err != "":
+		return "NACK"
+	default:
+		return "STALE"
+	}
+}
+
+// formatConditionStatus returns "True" or "False".
+func formatConditionStatus(status bool) string {
+	if status {
+		return "True"
+	}
+	return "False"
+}
+
+// orDash returns s, or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(describeCmd)
+	describeCmd.AddCommand(describeRuleCmd)
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+var (
+	diffFile string
+	diffCmd  = &cobra.Command{
+		Use:   "diff [-f FILENAME]",
+		Short: "Show the changes skctl apply would make",
+		Long: `Show the changes skctl apply would make
+
+For each rule in the file or directory that would be created or configured, the live rule is
+compared with the rule to apply, and the config the live rule produces is compared with the
+config the rule to apply would produce, e.g. which pod IPs land in which subset. skpilot checks
+the rules against the current services and pods, but nothing is committed or pushed to agents.
+
+It exits with 1 if there are any changes, and 0 otherwise.
+
+Examples:
+  # Show the changes before shifting traffic with ratio.yaml
+  skctl diff -f ./ratio.yaml`,
+		Run: func(cmd *cobra.Command, args []string) {
+			rules, err := readRules(diffFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			client := client.NewCtlClient()
+			liveRules, err := listRules(client)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			changed := false
+			for _, rule := range rules {
+				meta := rule.GetRuleMeta()
+				liveRule := liveRules[meta.Name]
+				planned, _, err := planRule(rule, liveRule)
+				if err != nil {
+					log.Fatalf("%s/%s: %v", meta.Kind, meta.Name, err)
+				}
+				if planned == nil {
+					continue
+				}
+				generator, currentGenerator, err := client.DryRunRule(planned)
+				if err != nil {
+					log.Fatalf("%s/%s: %v", meta.Kind, meta.Name, err)
+				}
+				changed = true
+
+				name := fmt.Sprintf("%s/%s", meta.Kind, meta.Name)
+				printDiff(name, toYAML(liveRule), toYAML(planned))
+				printDiff(name+" config", toYAML(currentGenerator), toYAML(generator))
+			}
+			if changed {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+// toYAML returns the YAML of v, or an empty string if v is nil.
+func toYAML(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(data)
+}
+
+// printDiff prints the differences between the live and the applied text of an object with
+// full context.
+func printDiff(name string, live string, applied string) {
+	fmt.Printf("--- %s (live)\n", name)
+	fmt.Printf("+++ %s (applied)\n", name)
+	for _, line := range diffLines(splitLines(live), splitLines(applied)) {
+		fmt.Println(line)
+	}
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the lines of a and b, each prefixed by "-" if it is only in a, "+" if it
+// is only in b, and " " if it is in both, based on the longest common subsequence.
+func diffLines(a []string, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+	return lines
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVarP(&diffFile, "file", "f", "", "specify the configuration file or directory")
+	diffCmd.MarkFlagRequired("file")
+}
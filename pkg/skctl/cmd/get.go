@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+var (
+	getCmd = &cobra.Command{
+		Use:   "get",
+		Short: "Display one or many resources",
+	}
+	getAgentsCmd = &cobra.Command{
+		Use:   "agents",
+		Short: "List all agents and gateways with their health",
+		Long: `List all agents and gateways with their health
+
+An agent is Healthy if it has sent heartbeats recently, Unreachable if it has missed
+heartbeats, and Removed if it has been evicted for missing heartbeats for too long.
+
+Examples:
+  # List all agents
+  skctl get agents`,
+		Run: func(cmd *cobra.Command, args []string) {
+			client := client.NewCtlClient()
+			agents, err := client.ListAgents()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tTYPE\tSTATE\tSTREAM\tLAST SEEN\tAGE")
+			for _, a := range agents {
+				kind := "agent"
+				if a.Gateway {
+					kind = "gateway"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s ago\t%s\n",
+					a.Name, kind, a.State, a.Streaming, since(a.LastSeen), since(a.RegisteredAt))
+			}
+			w.Flush()
+		},
+	}
+	getRulesCmd = &cobra.Command{
+		Use:   "rules",
+		Short: "List all rules, service entries, gateways, destination policies and rollouts",
+		Long: `List all rules, service entries, gateways, destination policies and rollouts
+
+TARGET is the service a rule, a destination policy or a rollout applies to, the hosts of a
+service entry, or the services a gateway routes to.
+
+STATE is Scheduled if the rule takes effect later, and Active if it is in effect. EXPIRES
+is when it expires, at which time skpilot deletes it, so expired rules soon disappear.
+
+Examples:
+  # List all rules
+  skctl get rules`,
+		Run: func(cmd *cobra.Command, args []string) {
+			client := client.NewCtlClient()
+			rules, err := client.ListRules()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			now := time.Now()
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tKIND\tTARGET\tSTATE\tEXPIRES")
+			for _, rule := range rules.All() {
+				meta := rule.GetRuleMeta()
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					meta.Name, meta.Kind, ruleTarget(rule), ruleState(meta, now), ruleExpiry(meta, now))
+			}
+			w.Flush()
+		},
+	}
+)
+
+// ruleTarget returns the service a rule, a destination policy or a rollout applies to, the hosts
+// of a service entry, or the services a gateway routes to.
+func ruleTarget(rule core.Rule) string {
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		return rule.Spec.ServiceName
+	case *core.RegexRule:
+		return rule.Spec.ServiceName
+	case *core.ServiceEntry:
+		return strings.Join(rule.Spec.Hosts, ",")
+	case *core.Gateway:
+		services := make([]string, 0, len(rule.Spec.Routes))
+		for _, route := range rule.Spec.Routes {
+			services = append(services, route.ServiceName)
+		}
+		return strings.Join(services, ",")
+	case *core.DestinationPolicy:
+		return rule.Spec.ServiceName
+	case *core.Rollout:
+		return rule.Spec.ServiceName
+	default:
+		return ""
+	}
+}
+
+// ruleState returns the state of a rule at now, with when it takes effect if scheduled.
+func ruleState(meta *core.RuleMeta, now time.Time) string {
+	state := meta.State(now)
+	if state == core.RuleScheduled {
+		return fmt.Sprintf("%s (in %s)", state, meta.ActiveFrom.Sub(now).Round(time.Second))
+	}
+	return string(state)
+}
+
+// ruleExpiry returns how long a rule lives from now, or "-" if it never expires.
+func ruleExpiry(meta *core.RuleMeta, now time.Time) string {
+	expiry := meta.Expiry()
+	switch {
+	case expiry == nil:
+		return "-"
+	case expiry.After(now):
+		return fmt.Sprintf("in %s", expiry.Sub(now).Round(time.Second))
+	default:
+		return fmt.Sprintf("%s ago", now.Sub(*expiry).Round(time.Second))
+	}
+}
+
+// since returns the time elapsed since t, rounded to seconds.
+func since(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
+
+func init() {
+	rootCmd.AddCommand(getCmd)
+	getCmd.AddCommand(getAgentsCmd)
+	getCmd.AddCommand(getRulesCmd)
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import "reflect"
+
+// threeWayMerge merges modified into current against original, which are all JSON objects.
+// A field changed from original to modified takes the value in modified, and a field removed
+// from original in modified is removed. Other fields keep the values in current, which may
+// have been changed by others. Nested objects are merged recursively, while arrays and other
+// values are replaced as a whole.
+func threeWayMerge(original, current, modified map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(current))
+	for k, v := range current {
+		merged[k] = v
+	}
+	for k, v := range modified {
+		originalValue, inOriginal := original[k]
+		if inOriginal && reflect.DeepEqual(originalValue, v) {
+			continue
+		}
+		modifiedObject, modifiedIsObject := v.(map[string]interface{})
+		currentObject, currentIsObject := current[k].(map[string]interface{})
+		if modifiedIsObject && currentIsObject {
+			originalObject, _ := originalValue.(map[string]interface{})
+			merged[k] = threeWayMerge(originalObject, currentObject, modifiedObject)
+		} else {
+			merged[k] = v
+		}
+	}
+	for k := range original {
+		if _, ok := modified[k]; !ok {
+			delete(merged, k)
+		}
+	}
+	return merged
+}
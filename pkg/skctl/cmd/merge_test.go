@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"p9t.io/skafos/pkg/api/core"
+)
+
+func TestThreeWayMerge(t *testing.T) {
+	type object = map[string]interface{}
+	tests := []struct {
+		name     string
+		original object
+		current  object
+		modified object
+		want     object
+	}{
+		{
+			name:     "field changed in file",
+			original: object{"ratio": 10.0},
+			current:  object{"ratio": 10.0},
+			modified: object{"ratio": 20.0},
+			want:     object{"ratio": 20.0},
+		},
+		{
+			name:     "field changed by others",
+			original: object{"ratio": 10.0, "service": "a"},
+			current:  object{"ratio": 30.0, "service": "a"},
+			modified: object{"ratio": 10.0, "service": "a"},
+			want:     object{"ratio": 30.0, "service": "a"},
+		},
+		{
+			name:     "field changed by both",
+			original: object{"ratio": 10.0},
+			current:  object{"ratio": 30.0},
+			modified: object{"ratio": 20.0},
+			want:     object{"ratio": 20.0},
+		},
+		{
+			name:     "field removed from file",
+			original: object{"ratio": 10.0, "ttl": "1h"},
+			current:  object{"ratio": 10.0, "ttl": "1h"},
+			modified: object{"ratio": 10.0},
+			want:     object{"ratio": 10.0},
+		},
+		{
+			name:     "field added by others",
+			original: object{"ratio": 10.0},
+			current:  object{"ratio": 10.0, "ttl": "1h"},
+			modified: object{"ratio": 10.0},
+			want:     object{"ratio": 10.0, "ttl": "1h"},
+		},
+		{
+			name:     "nested objects",
+			original: object{"spec": object{"ratio": 10.0, "selector": object{"v": "2"}}},
+			current:  object{"spec": object{"ratio": 30.0, "selector": object{"v": "2", "app": "a"}}},
+			modified: object{"spec": object{"ratio": 10.0, "selector": object{"v": "3"}}},
+			want:     object{"spec": object{"ratio": 30.0, "selector": object{"v": "3", "app": "a"}}},
+		},
+		{
+			name:     "nested field removed from file",
+			original: object{"spec": object{"ratio": 10.0, "subset": "v2"}},
+			current:  object{"spec": object{"ratio": 30.0, "subset": "v2"}},
+			modified: object{"spec": object{"ratio": 10.0}},
+			want:     object{"spec": object{"ratio": 30.0}},
+		},
+		{
+			name:     "arrays replaced as a whole",
+			original: object{"hosts": []interface{}{"a.com"}},
+			current:  object{"hosts": []interface{}{"a.com", "b.com"}},
+			modified: object{"hosts": []interface{}{"c.com"}},
+			want:     object{"hosts": []interface{}{"c.com"}},
+		},
+		{
+			name:     "nothing last applied",
+			original: object{},
+			current:  object{"ratio": 30.0, "ttl": "1h"},
+			modified: object{"ratio": 10.0},
+			want:     object{"ratio": 10.0, "ttl": "1h"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := threeWayMerge(tt.original, tt.current, tt.modified); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("threeWayMerge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulesToPrune(t *testing.T) {
+	rule := func(name string, lastApplied string, appliedFrom string) core.Rule {
+		return &core.RatioRule{RuleMeta: core.RuleMeta{
+			Kind:        core.RatioType,
+			Name:        name,
+			LastApplied: lastApplied,
+			AppliedFrom: appliedFrom,
+		}}
+	}
+	liveRules := map[string]core.Rule{
+		"kept":          rule("kept", "{}", "/rules"),
+		"removed":       rule("removed", "{}", "/rules"),
+		"other-dir":     rule("other-dir", "{}", "/other"),
+		"not-applied":   rule("not-applied", "", ""),
+		"before-source": rule("before-source", "{}", ""),
+		"also-removed":  rule("also-removed", "{}", "/rules"),
+	}
+	got := rulesToPrune([]core.Rule{rule("kept", "", "/rules")}, liveRules, "/rules")
+	names := make([]string, 0, len(got))
+	for _, r := range got {
+		names = append(names, r.GetRuleMeta().Name)
+	}
+	if want := []string{"also-removed", "removed"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("rulesToPrune() = %v, want %v", names, want)
+	}
+}
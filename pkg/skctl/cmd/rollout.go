@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+// rolloutWatchInterval is how often the status of a rollout is polled with --watch.
+const rolloutWatchInterval = time.Second * 2
+
+var (
+	rolloutWatch bool
+
+	rolloutCmd = &cobra.Command{
+		Use:   "rollout",
+		Short: "Manage rollouts",
+	}
+	rolloutStatusCmd = &cobra.Command{
+		Use:   "status [NAME] [-w]",
+		Short: "Show the status of rollouts",
+		Long: `Show the status of rollouts
+
+skpilot moves a rollout through its steps on its own, shifting requests to the canary pods
+by the weight of each step. Once the pause of a step has elapsed, the rollout moves on if
+the requests to the canary pods meet the thresholds of its analysis, and it is rolled back
+to a weight of 0 as soon as they breach them. A step without a pause waits to be resumed.
+
+Without a name, all rollouts are listed. With a name, the steps of the rollout and the
+requests measured in its current step are shown. With --watch, the status is shown again
+whenever it changes until the rollout completes, is rolled back or is aborted.
+
+Examples:
+  # List all rollouts
+  skctl rollout status
+
+  # Watch the rollout named reviews-v2
+  skctl rollout status reviews-v2 -w`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := client.NewCtlClient()
+			if len(args) == 0 {
+				rules, err := client.ListRules()
+				if err != nil {
+					log.Fatal(err)
+				}
+				printRollouts(rules.Rollouts)
+				return
+			}
+
+			var last *core.RolloutStatus
+			for {
+				rollout, err := getRollout(client, args[0])
+				if err != nil {
+					log.Fatal(err)
+				}
+				if last == nil || !reflect.DeepEqual(*last, rollout.Status) {
+					if last != nil {
+						fmt.Println()
+					}
+					printRollout(rollout)
+					last = &rollout.Status
+				}
+				if !rolloutWatch || !isRolloutActive(rollout) {
+					return
+				}
+				time.Sleep(rolloutWatchInterval)
+			}
+		},
+	}
+	rolloutPauseCmd = &cobra.Command{
+		Use:   "pause NAME",
+		Short: "Pause a rollout in its current step",
+		Long: `Pause a rollout in its current step
+
+A paused rollout keeps the weight of its current step, and is still rolled back if the
+canary pods breach the thresholds of its analysis.
+
+Examples:
+  # Pause the rollout named reviews-v2
+  skctl rollout pause reviews-v2`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			controlRollout(args[0], core.RolloutPause)
+		},
+	}
+	rolloutResumeCmd = &cobra.Command{
+		Use:   "resume NAME",
+		Short: "Resume a paused rollout",
+		Long: `Resume a paused rollout
+
+A rollout waiting in a step without a pause moves on to its next step, and a rollout paused
+by users restarts its current step. A rolled back or aborted rollout starts over from its
+first step.
+
+Examples:
+  # Resume the rollout named reviews-v2
+  skctl rollout resume reviews-v2`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			controlRollout(args[0], core.RolloutResume)
+		},
+	}
+	rolloutAbortCmd = &cobra.Command{
+		Use:   "abort NAME",
+		Short: "Abort a rollout",
+		Long: `Abort a rollout
+
+No requests are forwarded to the canary pods of an aborted rollout. The rollout is kept
+until deleted, and can be started over with skctl rollout resume.
+
+Examples:
+  # Abort the rollout named reviews-v2
+  skctl rollout abort reviews-v2`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			controlRollout(args[0], core.RolloutAbort)
+		},
+	}
+)
+
+// getRollout returns the rollout with the name.
+func getRollout(c *client.CtlClient, name string) (*core.Rollout, error) {
+	rule, err := c.GetRule(name)
+	if err != nil {
+		return nil, err
+	}
+	rollout, ok := rule.(*core.Rollout)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s rather than a rollout", name, rule.GetRuleMeta().Kind)
+	}
+	return rollout, nil
+}
+
+// controlRollout takes the action on the rollout with the name and prints its new status.
+func controlRollout(name string, action core.RolloutAction) {
+	client := client.NewCtlClient()
+	rollout, err := client.ControlRollout(name, action)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("rollout %s is %s in step %d/%d with weight %d\n",
+		rollout.Name, rollout.Status.Phase, rollout.Status.Step+1, len(rollout.Spec.Steps), rollout.Status.Weight)
+}
+
+// printRollouts prints a table of the rollouts.
+func printRollouts(rollouts []*core.Rollout) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSERVICE\tPHASE\tSTEP\tWEIGHT\tREQUESTS\tSUCCESS\tP99")
+	for _, r := range rollouts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%d%%\t%d\t%s\t%s\n",
+			r.Name, r.Spec.ServiceName, r.Status.Phase, r.Status.Step+1, len(r.Spec.Steps),
+			r.Status.Weight, r.Status.Requests, formatSuccessRate(&r.Status), formatLatency(&r.Status))
+	}
+	w.Flush()
+}
+
+// printRollout prints the status and the steps of a rollout.
+func printRollout(rollout *core.Rollout) {
+	status := &rollout.Status
+	fmt.Printf("Rollout:   %s\n", rollout.Name)
+	fmt.Printf("Service:   %s\n", rollout.Spec.ServiceName)
+	fmt.Printf("Phase:     %s\n", status.Phase)
+	if status.Message != "" {
+		fmt.Printf("Message:   %s\n", status.Message)
+	}
+	fmt.Printf("Weight:    %d%%\n", status.Weight)
+	if status.StepStartedAt != nil {
+		fmt.Printf("Started:   %s ago\n", since(*status.StepStartedAt))
+	}
+	fmt.Printf("Requests:  %d\n", status.Requests)
+	fmt.Printf("Success:   %s\n", formatSuccessRate(status))
+	fmt.Printf("P99:       %s\n", formatLatency(status))
+	if analysis := rollout.Spec.Analysis; analysis != nil {
+		fmt.Printf("Analysis:  success >= %.2f%%, p99 <= %dms, after %d requests\n",
+			analysis.MinSuccessRate, analysis.MaxLatency, analysis.MinRequests)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tSTEP\tWEIGHT\tPAUSE")
+	for i, step := range rollout.Spec.Steps {
+		current := ""
+		if i == status.Step {
+			current = "*"
+		}
+		pause := "until resumed"
+		switch {
+		case step.Pause > 0:
+			pause = (time.Duration(step.Pause) * time.Second).String()
+		case i == len(rollout.Spec.Steps)-1:
+			pause = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d%%\t%s\n", current, i+1, step.Weight, pause)
+	}
+	w.Flush()
+}
+
+// formatSuccessRate formats the success rate of the current step, which is "-" if there are no
+// requests yet.
+func formatSuccessRate(status *core.RolloutStatus) string {
+	if status.Requests == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", status.SuccessRate)
+}
+
+// formatLatency formats the 99th percentile of the latency of the current step, which is "-"
+// if there are no requests yet.
+func formatLatency(status *core.RolloutStatus) string {
+	if status.Requests == 0 || status.LatencyP99 == "" {
+		return "-"
+	}
+	return status.LatencyP99
+}
+
+// isRolloutActive tells whether a rollout may still change on its own.
+func isRolloutActive(rollout *core.Rollout) bool {
+	return rollout.Status.Phase == core.RolloutProgressing || rollout.Status.Phase == core.RolloutPaused
+}
+
+func init() {
+	rootCmd.AddCommand(rolloutCmd)
+	rolloutCmd.AddCommand(rolloutStatusCmd)
+	rolloutCmd.AddCommand(rolloutPauseCmd)
+	rolloutCmd.AddCommand(rolloutResumeCmd)
+	rolloutCmd.AddCommand(rolloutAbortCmd)
+	rolloutStatusCmd.Flags().BoolVarP(&rolloutWatch, "watch", "w", false, "watch the status until the rollout finishes")
+}
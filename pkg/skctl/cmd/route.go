@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+var (
+	routeTestPort    uint16
+	routeTestMethod  string
+	routeTestPath    string
+	routeTestHeaders []string
+	routeTestCount   int
+
+	routeCmd = &cobra.Command{
+		Use:   "route",
+		Short: "Inspect how requests are routed",
+	}
+	routeTestCmd = &cobra.Command{
+		Use:   "test SERVICE [--port PORT] [--method METHOD] [--path PATH] [-H HEADER]... [-n COUNT]",
+		Short: "Simulate the routing of a request to a service",
+		Long: `Simulate the routing of a request to a service
+
+skpilot evaluates the request with the same rule matching as proxies, using the rules and
+endpoints it currently holds, and prints the matched rule, the matcher of a regex rule, the
+candidate IPs, the port mapping and the address the request would be forwarded to. Nothing
+is sent to the service.
+
+All the ratio and regex rules of a service are merged into one routing table, where the
+matchers of regex rules are tried first and the ratio rule routes the rest. With -n greater
+than 1, the request is simulated COUNT times and the split of the requests among rules,
+clusters and addresses is printed.
+
+Examples:
+  # Show where a request to the first port of reviews would go
+  skctl route test reviews
+
+  # Show where a request with a header would go
+  skctl route test reviews --path /api -H "x-user: alice"
+
+  # Show how 1000 requests to port 8080 of reviews would be split
+  skctl route test reviews --port 8080 -n 1000`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			headers := make(map[string]string, len(routeTestHeaders))
+			for _, h := range routeTestHeaders {
+				kv := strings.SplitN(h, ":", 2)
+				if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+					log.Fatalf("invalid header %q, expected NAME: VALUE", h)
+				}
+				headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+			request := &core.RouteTestRequest{
+				Service: args[0],
+				Port:    routeTestPort,
+				Method:  routeTestMethod,
+				Path:    routeTestPath,
+				Headers: headers,
+				Count:   routeTestCount,
+			}
+
+			client := client.NewCtlClient()
+			result, err := client.TestRoute(request)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if request.Count == 1 {
+				printRoute(request, result)
+			} else {
+				printRouteSplits(request, result)
+			}
+		},
+	}
+)
+
+// printRoute prints the routing of a single request.
+func printRoute(request *core.RouteTestRequest, result *core.RouteTestResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Service:\t%s (%s:%d)\n", request.Service, result.Host, result.Port)
+	if result.Rule == "" {
+		fmt.Fprintf(w, "Rule:\t<none>\n")
+	} else {
+		fmt.Fprintf(w, "Rule:\t%s/%s\n", result.Kind, result.Rule)
+	}
+	split := result.Splits[0]
+	if cluster := findRouteCluster(result, split.Cluster); cluster != nil {
+		fmt.Fprintf(w, "Cluster:\t%s\n", cluster.Name)
+		if cluster.Matcher != nil {
+			fmt.Fprintf(w, "Matcher:\t%s\n", formatMatcher(cluster.Matcher))
+		}
+		fmt.Fprintf(w, "Candidates:\t%s\n", strings.Join(cluster.Hosts, ","))
+		fmt.Fprintf(w, "Port mapping:\t%s\n", formatPortMapping(cluster.PortMapping, result.Port))
+	}
+	fmt.Fprintf(w, "Address:\t%s\n", split.Address)
+	w.Flush()
+}
+
+// printRouteSplits prints how the simulated requests are split among rules, clusters and
+// addresses.
+func printRouteSplits(request *core.RouteTestRequest, result *core.RouteTestResult) {
+	fmt.Printf("Service: %s (%s:%d)\n", request.Service, result.Host, result.Port)
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tCLUSTER\tADDRESS\tREQUESTS\tPERCENT")
+	for _, s := range result.Splits {
+		rule, cluster := fmt.Sprintf("%s/%s", s.Kind, s.Rule), s.Cluster
+		if s.Rule == "" {
+			rule = "-"
+		}
+		if cluster == "" {
+			cluster = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.1f%%\n",
+			rule, cluster, s.Address, s.Requests, float64(s.Requests)*100/float64(request.Count))
+	}
+	w.Flush()
+}
+
+// findRouteCluster returns the cluster of the matched rule with the name, or nil if there is
+// no such cluster.
+func findRouteCluster(result *core.RouteTestResult, name string) *core.RouteTestCluster {
+	for i := range result.Clusters {
+		if result.Clusters[i].Name == name {
+			return &result.Clusters[i]
+		}
+	}
+	return nil
+}
+
+// formatMatcher returns a matcher like "X-User =~ ^alice$ -> version=v2", or like
+// "X-User =~ ^alice$ -> subset v2" if it refers to a subset.
+func formatMatcher(matcher *core.Matcher) string {
+	if matcher.Subset != "" {
+		return fmt.Sprintf("%s =~ %s -> subset %s", matcher.Header, matcher.Regex, matcher.Subset)
+	}
+	return fmt.Sprintf("%s =~ %s -> %s",
+		matcher.Header, matcher.Regex, core.FormatSelector(matcher.Selector, matcher.MatchExpressions))
+}
+
+// formatPortMapping returns how a cluster maps the requested port.
+func formatPortMapping(portMapping map[uint16]uint16, port uint16) string {
+	if targetPort, ok := portMapping[port]; ok {
+		return fmt.Sprintf("%d -> %d", port, targetPort)
+	}
+	return fmt.Sprintf("%d (kept)", port)
+}
+
+func init() {
+	rootCmd.AddCommand(routeCmd)
+	routeCmd.AddCommand(routeTestCmd)
+	routeTestCmd.Flags().Uint16Var(&routeTestPort, "port", 0, "port of the service, the first port if not set")
+	routeTestCmd.Flags().StringVar(&routeTestMethod, "method", "GET", "HTTP method of the request")
+	routeTestCmd.Flags().StringVar(&routeTestPath, "path", "/", "path of the request")
+	routeTestCmd.Flags().StringArrayVarP(&routeTestHeaders, "header", "H", nil, "header of the request as NAME: VALUE, can be repeated")
+	routeTestCmd.Flags().IntVarP(&routeTestCount, "count", "n", 1, "number of requests to simulate")
+}
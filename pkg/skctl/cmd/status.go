@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skctl/client"
+)
+
+var proxyStatusCmd = &cobra.Command{
+	Use:   "proxy-status",
+	Short: "Show the config sync status of all agents and proxies",
+	Long: `Show the config sync status of all agents and proxies
+
+An agent or a proxy is SYNCED if it runs the latest config sent by skpilot, STALE if
+it has not acknowledged the latest config yet, and NACK if it rejected the config.
+
+Examples:
+  # Show the sync status of all agents and proxies
+  skctl proxy-status`,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := client.NewCtlClient()
+		statuses, err := client.ListSyncStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "AGENT\tPROXY\tADDRESS\tVERSION\tSTATUS\tERROR")
+		for _, s := range statuses {
+			agentStatus := "SYNCED"
+			switch {
+			case s.Error != "":
+				agentStatus = "NACK"
+			case s.SentVersion != s.AckedVersion:
+				agentStatus = "STALE"
+			}
+			fmt.Fprintf(w, "%s\t-\t-\t%d\t%s\t%s\n", s.Agent, s.AckedVersion, agentStatus, s.Error)
+			for _, p := range s.Proxies {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+					s.Agent, shortID(p.ID), p.Address, p.Version, proxyStatus(&s, &p), p.Error)
+			}
+		}
+		w.Flush()
+	},
+}
+
+// proxyStatus returns the sync status of a proxy of an agent.
+func proxyStatus(agent *core.AgentSyncStatus, proxy *core.ProxySyncStatus) string {
+	switch {
+	case proxy.Error != "":
+		return "NACK"
+	case proxy.Version != agent.AckedVersion:
+		return "STALE"
+	default:
+		return "SYNCED"
+	}
+}
+
+// shortID shortens a container ID like docker does.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func init() {
+	rootCmd.AddCommand(proxyStatusCmd)
+}
@@ -2,34 +2,90 @@ package agent
 
 import (
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"p9t.io/skafos/pkg/api/core"
 	"p9t.io/skafos/pkg/skpilot/buffer"
 	"p9t.io/skafos/pkg/skpilot/client"
+	"p9t.io/skafos/pkg/skpilot/component"
+)
+
+const (
+	// unreachableTimeout is how long an agent can miss heartbeats before it is unreachable.
+	unreachableTimeout = core.SKAGENT_HEARTBEAT_INTERVAL * 3
+	// evictionGracePeriod is how long an agent can miss heartbeats before it is evicted.
+	evictionGracePeriod = time.Minute
+	// healthCheckInterval is how often the health of agents is checked.
+	healthCheckInterval = core.SKAGENT_HEARTBEAT_INTERVAL
 )
 
 // AgentManager accepts the registration of an SkAgent and contains the information
 // of all the SkAgents.
+//
+// Agents may join at any time, and may register again after they or skpilot restart. Each time
+// an agent registers, it is resynced with the full state: all the current rules, and a proxy
+// for each ready pod on its node.
+//
+// Agents send heartbeats on their config streams. An agent missing heartbeats becomes
+// unreachable and receives no update, and is evicted after a grace period.
 type AgentManager interface {
-	// AddAgent adds an SkAgent into the cluster.
+	// AddAgent adds an SkAgent into the cluster and resyncs it with the full state.
 	AddAgent(address string, port uint16) error
-	// ListAgent lists all the registered SkAgents.
-	ListAllAgent() map[string]*client.SkClient
+	// AddGateway adds an SkGateway into the cluster. Gateways receive rules like SkAgents,
+	// but no proxy will be created on them.
+	AddGateway(address string, port uint16) error
+	// AttachStream makes the config stream opened by an SkAgent or an SkGateway the connection
+	// to it, registering it first if it is unknown, and resyncs it with the full state. It
+	// returns the key of the agent.
+	AttachStream(address string, port uint16, gateway bool, conn *client.StreamConn) (string, error)
+	// DetachStream stops using the broken stream of an agent, which falls back to unary calls.
+	DetachStream(key string, conn *client.StreamConn)
+	// MarkSeen records that a message, e.g. a heartbeat, has been received from an agent.
+	MarkSeen(key string)
+	// ListAgent lists the connections to all the healthy SkAgents.
+	ListAllAgent() map[string]client.AgentConn
+	// ListAgents returns the status of all the agents ever registered, sorted by name.
+	ListAgents() []core.AgentStatus
 }
 
 func NewAgentManager(
+	components *component.SkComponents,
 	ruleBuffer *buffer.RuleBuffer,
 	proxyBuffer *buffer.ProxyBuffer,
 ) AgentManager {
-	return &agentManagerInner{
-		skClients: map[string]*client.SkClient{},
-		buffers:   []buffer.SkBuffer{ruleBuffer, proxyBuffer},
+	am := &agentManagerInner{
+		skClients:   map[string]*client.SkClient{},
+		streams:     map[string]*client.StreamConn{},
+		statuses:    map[string]*core.AgentStatus{},
+		components:  components,
+		buffers:     []buffer.SkBuffer{ruleBuffer, proxyBuffer},
+		ruleBuffer:  ruleBuffer,
+		proxyBuffer: proxyBuffer,
 	}
+	go func() {
+		for range time.Tick(healthCheckInterval) {
+			am.checkHealth()
+		}
+	}()
+	return am
 }
 
 type agentManagerInner struct {
+	// mtx protects skClients, streams and statuses.
+	mtx       sync.RWMutex
 	skClients map[string]*client.SkClient
-	buffers   []buffer.SkBuffer
+	// streams are the config streams of agents, which are preferred over skClients.
+	streams map[string]*client.StreamConn
+	// statuses contains the status of all agents, including evicted ones.
+	statuses map[string]*core.AgentStatus
+	// components is where the pods on the node of an agent are found.
+	components  *component.SkComponents
+	buffers     []buffer.SkBuffer
+	ruleBuffer  *buffer.RuleBuffer
+	proxyBuffer *buffer.ProxyBuffer
 }
 
 func (am *agentManagerInner) AddAgent(address string, port uint16) error {
@@ -37,21 +93,218 @@ func (am *agentManagerInner) AddAgent(address string, port uint16) error {
 	if err != nil {
 		return fmt.Errorf("fail to create client with skagent: %v", err)
 	}
-	am.skClients[address] = client
+	am.register(address, address, port, false, client)
+
+	// The agent may join after rules are applied and pods are created, or may have lost its
+	// state in a restart, so fill the buffers with the full state for it.
+	am.components.Mtx.Lock()
+	infos := am.components.GetHostSandboxInfos(address)
+	am.proxyBuffer.LockBuffer()
+	am.proxyBuffer.ResyncAgent(address, infos)
+	am.proxyBuffer.UnlockBuffer()
+	am.components.Mtx.Unlock()
+
+	am.ruleBuffer.LockBuffer()
+	am.ruleBuffer.ResyncAgent(address)
+	am.ruleBuffer.UnlockBuffer()
+
+	glog.Infof("[AGENT MANAGER] agent %s registered with %d pods", address, len(infos))
 
-	// Based on the assumption that all agents joins before the work starts, we just
-	// initialize the buffer for the client without writing anything into it.
-	for _, buf := range am.buffers {
-		buf.LockBuffer()
-		buf.ResetAgentBuffer(address)
-		buf.UnlockBuffer()
+	return nil
+}
+
+func (am *agentManagerInner) AddGateway(address string, port uint16) error {
+	client, err := client.NewSkClient(address, port)
+	if err != nil {
+		return fmt.Errorf("fail to create client with skgateway: %v", err)
 	}
+	key := gatewayKey(address, port)
+	am.register(key, address, port, true, client)
 
-	glog.Infof("[AGENT MANAGER] agent %s registered", address)
+	am.ruleBuffer.LockBuffer()
+	am.ruleBuffer.ResyncAgent(key)
+	am.ruleBuffer.UnlockBuffer()
+
+	glog.Infof("[AGENT MANAGER] gateway %s registered", key)
 
 	return nil
 }
 
-func (am *agentManagerInner) ListAllAgent() map[string]*client.SkClient {
-	return am.skClients
+// register records a newly registered agent as healthy.
+func (am *agentManagerInner) register(key string, address string, port uint16, gateway bool, cli *client.SkClient) {
+	am.mtx.Lock()
+	defer am.mtx.Unlock()
+	if old, ok := am.skClients[key]; ok {
+		old.Close()
+	}
+	am.skClients[key] = cli
+	now := time.Now()
+	am.statuses[key] = &core.AgentStatus{
+		Name:         key,
+		Address:      address,
+		Port:         port,
+		Gateway:      gateway,
+		State:        core.AgentHealthy,
+		RegisteredAt: now,
+		LastSeen:     now,
+	}
+}
+
+func (am *agentManagerInner) ListAllAgent() map[string]client.AgentConn {
+	am.mtx.RLock()
+	defer am.mtx.RUnlock()
+	ret := make(map[string]client.AgentConn, len(am.skClients))
+	for key, cli := range am.skClients {
+		// Sending updates to unreachable agents would only time out.
+		if am.statuses[key].State != core.AgentHealthy {
+			continue
+		}
+		if stream, ok := am.streams[key]; ok {
+			ret[key] = stream
+		} else {
+			ret[key] = cli
+		}
+	}
+	return ret
+}
+
+func (am *agentManagerInner) ListAgents() []core.AgentStatus {
+	am.mtx.RLock()
+	defer am.mtx.RUnlock()
+	ret := make([]core.AgentStatus, 0, len(am.statuses))
+	for key, status := range am.statuses {
+		s := *status
+		_, s.Streaming = am.streams[key]
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func (am *agentManagerInner) MarkSeen(key string) {
+	am.mtx.Lock()
+	defer am.mtx.Unlock()
+	status, ok := am.statuses[key]
+	if !ok || status.State == core.AgentRemoved {
+		return
+	}
+	status.LastSeen = time.Now()
+	if status.State != core.AgentHealthy {
+		status.State = core.AgentHealthy
+		glog.Infof("[AGENT MANAGER] agent %s is healthy again", key)
+		// Updates have been held back while it was unreachable.
+		for _, buf := range am.buffers {
+			buf.NotifyChanged()
+		}
+	}
+}
+
+// checkHealth marks agents missing heartbeats as unreachable, and evicts those that have been
+// unreachable for longer than the grace period.
+func (am *agentManagerInner) checkHealth() {
+	now := time.Now()
+	evicted := make([]string, 0)
+	func() {
+		am.mtx.Lock()
+		defer am.mtx.Unlock()
+		for key, status := range am.statuses {
+			if status.State == core.AgentRemoved {
+				continue
+			}
+			silence := now.Sub(status.LastSeen)
+			if silence > evictionGracePeriod {
+				status.State = core.AgentRemoved
+				if cli, ok := am.skClients[key]; ok {
+					cli.Close()
+				}
+				delete(am.skClients, key)
+				// Ending the stream makes the agent reconnect, which registers and resyncs it
+				// again, if it is still alive.
+				if stream, ok := am.streams[key]; ok {
+					stream.Close()
+				}
+				delete(am.streams, key)
+				evicted = append(evicted, key)
+				glog.Warningf("[AGENT MANAGER] agent %s evicted after %v without heartbeat", key, silence.Round(time.Second))
+			} else if silence > unreachableTimeout && status.State == core.AgentHealthy {
+				status.State = core.AgentUnreachable
+				glog.Warningf("[AGENT MANAGER] agent %s unreachable after %v without heartbeat", key, silence.Round(time.Second))
+			}
+		}
+	}()
+
+	for _, key := range evicted {
+		for _, buf := range am.buffers {
+			buf.LockBuffer()
+			// The agent may have registered again in the meantime.
+			am.mtx.RLock()
+			removed := am.statuses[key].State == core.AgentRemoved
+			am.mtx.RUnlock()
+			if removed {
+				buf.RemoveAgentBuffer(key)
+			}
+			buf.UnlockBuffer()
+		}
+	}
+}
+
+func (am *agentManagerInner) AttachStream(
+	address string,
+	port uint16,
+	gateway bool,
+	conn *client.StreamConn,
+) (string, error) {
+	key := address
+	if gateway {
+		key = gatewayKey(address, port)
+	}
+
+	am.mtx.RLock()
+	_, registered := am.skClients[key]
+	am.mtx.RUnlock()
+	if !registered {
+		// skpilot may have restarted since the agent registered. Registering resyncs the agent.
+		var err error
+		if gateway {
+			err = am.AddGateway(address, port)
+		} else {
+			err = am.AddAgent(address, port)
+		}
+		if err != nil {
+			return "", err
+		}
+	} else {
+		// Whatever rules the agent missed while it was disconnected, the full state brings it
+		// up to date. Its proxies keep running, so they need no resync.
+		am.ruleBuffer.LockBuffer()
+		am.ruleBuffer.ResyncAgent(key)
+		am.ruleBuffer.UnlockBuffer()
+	}
+
+	am.mtx.Lock()
+	am.streams[key] = conn
+	am.mtx.Unlock()
+
+	glog.Infof("[AGENT MANAGER] config stream of %s attached", key)
+
+	return key, nil
+}
+
+func (am *agentManagerInner) DetachStream(key string, conn *client.StreamConn) {
+	am.mtx.Lock()
+	defer am.mtx.Unlock()
+	// The agent may have opened a new stream already.
+	if am.streams[key] == conn {
+		delete(am.streams, key)
+		glog.Infof("[AGENT MANAGER] config stream of %s detached", key)
+	}
+}
+
+// gatewayKey returns the key of a gateway. A gateway may run on the same host as an agent, so
+// it is identified by its port too. Since its key never equals a host IP, no proxy will be
+// buffered for it.
+func gatewayKey(address string, port uint16) string {
+	return fmt.Sprintf("gateway@%s:%d", address, port)
 }
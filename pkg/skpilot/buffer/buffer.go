@@ -9,8 +9,9 @@ import (
 // SkBuffer is the base type for all the buffers in Skafos.
 //
 // When discoverer or SkPilot finds that something needs to be updated and send to SkAgent, it will
-// write the updated data into SkBuffer. Messager reads SkBuffer at set intervals. When buffers
-// are not empty, it will retrieve the data and send them to SkAgent.
+// write the updated data into SkBuffer. Messager reads SkBuffer whenever it changes, and also at
+// set intervals to retry failed updates. When buffers are not empty, it will retrieve the data
+// and send them to SkAgent.
 //
 // Each SkAgent has its own SkBuffer.
 type SkBuffer interface {
@@ -22,10 +23,42 @@ type SkBuffer interface {
 	IsEmpty(agentAddr string) bool
 	// ResetAgentBuffer clears the buffer for an SkAgent.
 	ResetAgentBuffer(agentAddr string)
-	// AcceptAgent sends the data in the buffer to an SkAgent. On success, it will clear the buffer.
-	// Otherwise, the buffer will not be cleared, and the data will be sent next time this function
-	// gets called.
-	AcceptAgent(agentAddr string, cli *client.SkClient, wg *sync.WaitGroup)
+	// RemoveAgentBuffer removes the buffer for an SkAgent that has been evicted.
+	RemoveAgentBuffer(agentAddr string)
+	// AcceptAgent sends the data in the buffer to an SkAgent. On success, it will clear the data
+	// sent from the buffer. Otherwise, the buffer will not be cleared, and the data will be sent
+	// next time this function gets called. It must be called without the lock of the buffer,
+	// which it only holds while reading and clearing the buffer, so that data can be written
+	// while it waits for the SkAgent.
+	AcceptAgent(agentAddr string, cli client.AgentConn, wg *sync.WaitGroup)
 	// BufferType returns the type of an SkBuffer.
 	BufferType() string
+	// Changed returns a channel that receives a value after data is written into the buffer.
+	Changed() <-chan struct{}
+	// NotifyChanged wakes up the messager as if data were written into the buffer.
+	NotifyChanged()
+}
+
+// changeNotifier implements SkBuffer.Changed. Notifications are coalesced, so that a burst of
+// writes triggers only one round of messaging.
+type changeNotifier struct {
+	changed chan struct{}
+}
+
+func newChangeNotifier() changeNotifier {
+	return changeNotifier{
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (n *changeNotifier) Changed() <-chan struct{} {
+	return n.changed
+}
+
+// NotifyChanged wakes up the messager without blocking.
+func (n *changeNotifier) NotifyChanged() {
+	select {
+	case n.changed <- struct{}{}:
+	default:
+	}
 }
@@ -10,14 +10,20 @@ import (
 
 // ProxyBuffer is the SkBuffer for proxy updates.
 type ProxyBuffer struct {
+	changeNotifier
 	mtx          sync.Mutex
 	sandboxInfos map[string][]core.SandboxInfo
+	// generations maps agent address to the number of times its buffer has been replaced as a
+	// whole, so that an update sent before can tell whether it may reset the buffer.
+	generations map[string]uint64
 }
 
 func NewProxyBuffer() *ProxyBuffer {
 	return &ProxyBuffer{
-		mtx:          sync.Mutex{},
-		sandboxInfos: map[string][]core.SandboxInfo{},
+		changeNotifier: newChangeNotifier(),
+		mtx:            sync.Mutex{},
+		sandboxInfos:   map[string][]core.SandboxInfo{},
+		generations:    map[string]uint64{},
 	}
 }
 
@@ -35,17 +41,42 @@ func (pb *ProxyBuffer) IsEmpty(agentAddr string) bool {
 
 func (pb *ProxyBuffer) ResetAgentBuffer(agentAddr string) {
 	pb.sandboxInfos[agentAddr] = make([]core.SandboxInfo, 0)
+	pb.generations[agentAddr]++
 }
 
-func (pb *ProxyBuffer) AcceptAgent(agentAddr string, cli *client.SkClient, wg *sync.WaitGroup) {
+func (pb *ProxyBuffer) RemoveAgentBuffer(agentAddr string) {
+	delete(pb.sandboxInfos, agentAddr)
+	pb.generations[agentAddr]++
+}
+
+// ResyncAgent replaces the buffer of an agent with the sandboxes of all the pods on its node.
+func (pb *ProxyBuffer) ResyncAgent(agentAddr string, infos []core.SandboxInfo) {
+	pb.sandboxInfos[agentAddr] = infos
+	pb.generations[agentAddr]++
+	glog.Infof("[PROXY BUFFER] resync agent %s with %d proxies", agentAddr, len(infos))
+	pb.NotifyChanged()
+}
+
+func (pb *ProxyBuffer) AcceptAgent(agentAddr string, cli client.AgentConn, wg *sync.WaitGroup) {
 	defer wg.Done()
-	infos := pb.sandboxInfos[agentAddr]
-	_, err := cli.CreateProxy(infos)
-	if err == nil {
-		glog.Infof("[PROXY BUFFER] created proxies %v, now reset buffer for agent %s", infos, agentAddr)
-		pb.ResetAgentBuffer(agentAddr)
-	} else {
+	pb.LockBuffer()
+	infos := append([]core.SandboxInfo{}, pb.sandboxInfos[agentAddr]...)
+	generation := pb.generations[agentAddr]
+	pb.UnlockBuffer()
+
+	err := cli.CreateProxy(infos)
+
+	pb.LockBuffer()
+	defer pb.UnlockBuffer()
+	if err != nil {
 		glog.Errorf("[PROXY BUFFER] fail to inform agent %s: %v", agentAddr, err)
+		return
+	}
+	glog.Infof("[PROXY BUFFER] created proxies %v, now reset buffer for agent %s", infos, agentAddr)
+	// Sandboxes are only appended to the buffer, unless it is replaced as a whole, so those
+	// added while the update was being sent are still to be sent.
+	if pb.generations[agentAddr] == generation {
+		pb.sandboxInfos[agentAddr] = append([]core.SandboxInfo{}, pb.sandboxInfos[agentAddr][len(infos):]...)
 	}
 }
 
@@ -60,4 +91,5 @@ func (pb *ProxyBuffer) SetSandboxInfo(info *core.SandboxInfo) {
 			glog.Infof("[PROXY BUFFER] add proxy with ip %s for agent %s", info.SandboxIP, addr)
 		}
 	}
+	pb.NotifyChanged()
 }
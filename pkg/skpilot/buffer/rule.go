@@ -1,23 +1,92 @@
 package buffer
 
 import (
+	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"p9t.io/skafos/pkg/api/core"
 	"p9t.io/skafos/pkg/skpilot/client"
 	"p9t.io/skafos/pkg/skproxy"
 )
 
 // RuleBuffer is the SkBuffer for rule updates.
+//
+// Rules are buffered incrementally, while the mesh settings, i.e. the outbound policy, the mesh
+// hosts and the trace sample rate, are always sent in full to agents that have not received
+// their latest version.
+//
+// Each update sent to an agent carries a new version and a nonce. The buffer of an agent is
+// reset only when the agent acknowledges that very update, so updates that are lost or
+// rejected are sent again with the next probe. Updates are sent without the lock of the buffer,
+// so only the rules that are unchanged since the update was taken from the buffer are reset.
+//
+// The buffer also keeps all the current rules, so that an agent that has lost track of the
+// rules, e.g. after reconnecting, can be resynced with the full state.
+//
+// Versions increase across all agents, and each update carries everything written into the
+// buffer before it is sent. So an agent or a proxy running a version no older than the one
+// recorded when a route table, a service entry or a gateway was written has received it.
 type RuleBuffer struct {
+	changeNotifier
 	mtx   sync.Mutex
 	rules map[string]skproxy.Config
+	// desired contains all the current rules, without nil generators.
+	desired skproxy.Config
+	// fullResyncs contains the agents whose buffer holds the full state to be resynced.
+	fullResyncs map[string]bool
+	// generations maps agent address to the number of times its buffer has been replaced as a
+	// whole, so that an update sent before can tell whether it may reset the buffer.
+	generations map[string]uint64
+	// agentMtx protects per-agent states modified concurrently in AcceptAgent, as well as
+	// configVersion and writtenVersions, which are read without the lock of the buffer.
+	agentMtx sync.Mutex
+	// outboundPolicy is the outbound policy of all proxies.
+	outboundPolicy skproxy.OutboundPolicy
+	// meshHosts is the set of service IPs and pod IPs inside the mesh.
+	meshHosts []string
+	// traceSampleRate is the proportion of new traces that are sampled by proxies.
+	traceSampleRate float64
+	// settingsVersion increases each time any of the mesh settings changes.
+	settingsVersion int
+	// agentSettingsVersions maps agent address to the latest settingsVersion it has received.
+	agentSettingsVersions map[string]int
+	// configVersion is the version of the latest update sent to any agent. It starts from
+	// the time skpilot starts, so that versions keep increasing across restarts.
+	configVersion uint64
+	// syncStatuses maps agent address to the sync status of the agent and its proxies.
+	syncStatuses map[string]*core.AgentSyncStatus
+	// writtenVersions maps a route table, a service entry or a gateway to the first version
+	// carrying its latest change.
+	writtenVersions map[generatorKey]uint64
+}
+
+// generatorKey identifies a route table, a service entry or a gateway in the buffer.
+type generatorKey struct {
+	// kind is "routetable", "serviceentry" or "gateway".
+	kind string
+	// name is the name of the service of a route table, or the name of a service entry or a
+	// gateway.
+	name string
 }
 
 func NewRuleBuffer() *RuleBuffer {
 	return &RuleBuffer{
-		mtx:   sync.Mutex{},
-		rules: map[string]skproxy.Config{},
+		changeNotifier:        newChangeNotifier(),
+		mtx:                   sync.Mutex{},
+		rules:                 map[string]skproxy.Config{},
+		desired:               newIncrementalConfig(),
+		fullResyncs:           map[string]bool{},
+		generations:           map[string]uint64{},
+		outboundPolicy:        skproxy.AllowAny,
+		meshHosts:             []string{},
+		settingsVersion:       1,
+		agentSettingsVersions: map[string]int{},
+		configVersion:         uint64(time.Now().UnixNano()),
+		syncStatuses:          map[string]*core.AgentSyncStatus{},
+		writtenVersions:       map[generatorKey]uint64{},
 	}
 }
 
@@ -30,48 +99,315 @@ func (rb *RuleBuffer) UnlockBuffer() {
 }
 
 func (rb *RuleBuffer) IsEmpty(agentAddr string) bool {
-	return len(rb.rules[agentAddr].RatioRules) == 0 &&
-		len(rb.rules[agentAddr].RegexRules) == 0
+	return len(rb.rules[agentAddr].RouteTables) == 0 &&
+		len(rb.rules[agentAddr].ServiceEntries) == 0 &&
+		len(rb.rules[agentAddr].Gateways) == 0 &&
+		rb.agentSettingsVersions[agentAddr] == rb.settingsVersion &&
+		!rb.fullResyncs[agentAddr]
 }
 
 func (rb *RuleBuffer) ResetAgentBuffer(agentAddr string) {
-	rb.rules[agentAddr] = skproxy.Config{
-		RatioRules: map[string]*skproxy.RatioRuleGenerator{},
-		RegexRules: map[string]*skproxy.RegexRuleGenerator{},
+	rb.rules[agentAddr] = newIncrementalConfig()
+	delete(rb.fullResyncs, agentAddr)
+	rb.generations[agentAddr]++
+}
+
+func (rb *RuleBuffer) RemoveAgentBuffer(agentAddr string) {
+	rb.agentMtx.Lock()
+	defer rb.agentMtx.Unlock()
+	delete(rb.rules, agentAddr)
+	delete(rb.fullResyncs, agentAddr)
+	rb.generations[agentAddr]++
+	delete(rb.agentSettingsVersions, agentAddr)
+	delete(rb.syncStatuses, agentAddr)
+}
+
+// ResyncAgent replaces the buffer of an agent with all the current rules and mesh settings,
+// which will be sent as the full state replacing everything the agent has.
+func (rb *RuleBuffer) ResyncAgent(agentAddr string) {
+	rb.agentMtx.Lock()
+	defer rb.agentMtx.Unlock()
+	rb.rules[agentAddr] = rb.copyDesired()
+	rb.fullResyncs[agentAddr] = true
+	rb.generations[agentAddr]++
+	delete(rb.agentSettingsVersions, agentAddr)
+	glog.Infof("[RULE BUFFER] resync agent %s with full state", agentAddr)
+	rb.NotifyChanged()
+}
+
+// DesiredConfig returns the full config with all the current rules and mesh settings, which
+// every proxy should eventually run. The caller must hold the lock of the buffer.
+func (rb *RuleBuffer) DesiredConfig() skproxy.Config {
+	config := rb.copyDesired()
+	config.OutboundPolicy = rb.outboundPolicy
+	config.MeshHosts = rb.meshHosts
+	config.TraceSampleRate = rb.traceSampleRate
+	return config
+}
+
+// copyDesired returns a copy of all the current rules.
+func (rb *RuleBuffer) copyDesired() skproxy.Config {
+	return copyConfig(rb.desired)
+}
+
+// newIncrementalConfig returns an empty config to which generators can be added.
+func newIncrementalConfig() skproxy.Config {
+	return skproxy.Config{
+		RouteTables:    map[string]*skproxy.RouteTableGenerator{},
+		ServiceEntries: map[string]*skproxy.ServiceEntryGenerator{},
+		Gateways:       map[string]*skproxy.GatewayGenerator{},
 	}
 }
 
-func (rb *RuleBuffer) AcceptAgent(agentAddr string, cli *client.SkClient, wg *sync.WaitGroup) {
+func (rb *RuleBuffer) AcceptAgent(agentAddr string, cli client.AgentConn, wg *sync.WaitGroup) {
 	defer wg.Done()
-	config := rb.rules[agentAddr]
-	_, err := cli.UpdateRule(&config)
-	if err == nil {
-		glog.Infof("[RULE BUFFER] updated rules %v, now reset buffer for agent %s", config, agentAddr)
-		rb.ResetAgentBuffer(agentAddr)
-	} else {
+	rb.LockBuffer()
+	rb.agentMtx.Lock()
+	config := copyConfig(rb.rules[agentAddr])
+	settingsVersion := rb.settingsVersion
+	if rb.agentSettingsVersions[agentAddr] != settingsVersion {
+		config.OutboundPolicy = rb.outboundPolicy
+		config.MeshHosts = rb.meshHosts
+		config.TraceSampleRate = rb.traceSampleRate
+	}
+	full := rb.fullResyncs[agentAddr]
+	generation := rb.generations[agentAddr]
+	rb.configVersion++
+	version := rb.configVersion
+	nonce := client.NewNonce()
+	status := rb.syncStatusLocked(agentAddr)
+	status.SentVersion = version
+	status.Nonce = nonce
+	rb.agentMtx.Unlock()
+	rb.UnlockBuffer()
+
+	// Waiting for the ack may take long, during which rules can still be written.
+	resp, err := cli.UpdateRule(&config, version, nonce, full)
+	now := time.Now()
+
+	rb.LockBuffer()
+	defer rb.UnlockBuffer()
+	rb.agentMtx.Lock()
+	defer rb.agentMtx.Unlock()
+	status.UpdatedAt = &now
+	switch {
+	case err != nil:
+		status.Error = err.Error()
 		glog.Errorf("[RULE BUFFER] fail to inform agent %s: %v", agentAddr, err)
+	case resp.Nonce != nonce || resp.Version != version:
+		status.Error = fmt.Sprintf("response to version %d is for version %d", version, resp.Version)
+		glog.Errorf("[RULE BUFFER] agent %s: %s", agentAddr, status.Error)
+	case resp.Error != "":
+		status.Error = resp.Error
+		glog.Errorf("[RULE BUFFER] agent %s rejected version %d: %s", agentAddr, version, resp.Error)
+	default:
+		glog.Infof("[RULE BUFFER] agent %s acknowledged version %d of rules %v, now reset buffer", agentAddr, version, config)
+		// The buffer may have been replaced as a whole while the update was being sent, in
+		// which case the new buffer is still to be sent.
+		if rb.generations[agentAddr] == generation {
+			rb.resetSent(agentAddr, &config, full)
+			rb.agentSettingsVersions[agentAddr] = settingsVersion
+		}
+		status.AckedVersion = version
+		status.Error = ""
+		status.Proxies = make([]core.ProxySyncStatus, 0, len(resp.Proxies))
+		for _, p := range resp.Proxies {
+			status.Proxies = append(status.Proxies, core.ProxySyncStatus{
+				ID:      p.ProxyId,
+				Address: p.Address,
+				Version: p.Version,
+				Error:   p.Error,
+			})
+			if p.Error != "" {
+				glog.Errorf("[RULE BUFFER] proxy %s on agent %s rejected version %d: %s", p.ProxyId, agentAddr, version, p.Error)
+			}
+		}
+	}
+}
+
+// resetSent removes from the buffer of an agent the rules in config that have been sent to it,
+// unless they have changed since. The caller must hold the lock of the buffer.
+func (rb *RuleBuffer) resetSent(agentAddr string, config *skproxy.Config, full bool) {
+	buffered, ok := rb.rules[agentAddr]
+	if !ok {
+		return
+	}
+	for name, table := range config.RouteTables {
+		if current, ok := buffered.RouteTables[name]; ok && current == table {
+			delete(buffered.RouteTables, name)
+		}
+	}
+	for name, entry := range config.ServiceEntries {
+		if current, ok := buffered.ServiceEntries[name]; ok && current == entry {
+			delete(buffered.ServiceEntries, name)
+		}
+	}
+	for name, gateway := range config.Gateways {
+		if current, ok := buffered.Gateways[name]; ok && current == gateway {
+			delete(buffered.Gateways, name)
+		}
+	}
+	if full {
+		delete(rb.fullResyncs, agentAddr)
+	}
+}
+
+// copyConfig returns a copy of the rules in config, so that the rules sent to an agent are not
+// changed by rules written while they are being sent.
+func copyConfig(config skproxy.Config) skproxy.Config {
+	ret := newIncrementalConfig()
+	for name, table := range config.RouteTables {
+		ret.RouteTables[name] = table
+	}
+	for name, entry := range config.ServiceEntries {
+		ret.ServiceEntries[name] = entry
+	}
+	for name, gateway := range config.Gateways {
+		ret.Gateways[name] = gateway
+	}
+	return ret
+}
+
+// syncStatusLocked returns the sync status of an agent, creating it if absent.
+// agentMtx must be held.
+func (rb *RuleBuffer) syncStatusLocked(agentAddr string) *core.AgentSyncStatus {
+	status, ok := rb.syncStatuses[agentAddr]
+	if !ok {
+		status = &core.AgentSyncStatus{
+			Agent:   agentAddr,
+			Proxies: []core.ProxySyncStatus{},
+		}
+		rb.syncStatuses[agentAddr] = status
 	}
+	return status
+}
+
+// GetSyncStatus returns a copy of the sync status of an agent.
+func (rb *RuleBuffer) GetSyncStatus(agentAddr string) core.AgentSyncStatus {
+	rb.agentMtx.Lock()
+	defer rb.agentMtx.Unlock()
+	status := *rb.syncStatusLocked(agentAddr)
+	status.Proxies = append([]core.ProxySyncStatus{}, status.Proxies...)
+	return status
+}
+
+// markWritten records that the generator with the key has been written, so that the updates
+// sent from now on carry it.
+func (rb *RuleBuffer) markWritten(key generatorKey) {
+	rb.agentMtx.Lock()
+	defer rb.agentMtx.Unlock()
+	rb.writtenVersions[key] = rb.configVersion + 1
+}
+
+// writtenVersion returns the first version carrying the latest change of the generator with the
+// key, or zero if it has never been written.
+func (rb *RuleBuffer) writtenVersion(key generatorKey) uint64 {
+	rb.agentMtx.Lock()
+	defer rb.agentMtx.Unlock()
+	return rb.writtenVersions[key]
+}
+
+// RouteTableVersion returns the first version carrying the latest route table of a service, or
+// zero if it has never been written.
+func (rb *RuleBuffer) RouteTableVersion(serviceName string) uint64 {
+	return rb.writtenVersion(generatorKey{kind: "routetable", name: serviceName})
+}
+
+// ServiceEntryVersion returns the first version carrying the latest change of a service entry,
+// or zero if it has never been written.
+func (rb *RuleBuffer) ServiceEntryVersion(entryName string) uint64 {
+	return rb.writtenVersion(generatorKey{kind: "serviceentry", name: entryName})
+}
+
+// GatewayVersion returns the first version carrying the latest change of a gateway, or zero if
+// it has never been written.
+func (rb *RuleBuffer) GatewayVersion(gatewayName string) uint64 {
+	return rb.writtenVersion(generatorKey{kind: "gateway", name: gatewayName})
 }
 
 func (rb *RuleBuffer) BufferType() string {
 	return "rule"
 }
 
-func (rb *RuleBuffer) SetRatioRule(ruleName string, ratioRule *skproxy.RatioRuleGenerator) {
+// SetRouteTable sets the route table of a service, which is merged from all the ratio and regex
+// rules applied to the service. A nil table removes the table of the service.
+func (rb *RuleBuffer) SetRouteTable(serviceName string, table *skproxy.RouteTableGenerator) {
+	for _, config := range rb.rules {
+		config.RouteTables[serviceName] = table
+	}
+	if table == nil {
+		delete(rb.desired.RouteTables, serviceName)
+	} else {
+		rb.desired.RouteTables[serviceName] = table
+	}
+	rb.markWritten(generatorKey{kind: "routetable", name: serviceName})
+	rb.NotifyChanged()
+	glog.Infof("[RULE BUFFER] add route table of service %s: %v", serviceName, table)
+	if table != nil {
+		for _, matcher := range table.Matchers {
+			glog.Infof("%v\n", *matcher)
+		}
+	}
+}
+
+func (rb *RuleBuffer) SetServiceEntry(entryName string, serviceEntry *skproxy.ServiceEntryGenerator) {
 	for _, config := range rb.rules {
-		config.RatioRules[ruleName] = ratioRule
+		config.ServiceEntries[entryName] = serviceEntry
 	}
-	glog.Infof("[RULE BUFFER] add ratio rule %s: %v", ruleName, ratioRule)
+	if serviceEntry == nil {
+		delete(rb.desired.ServiceEntries, entryName)
+	} else {
+		rb.desired.ServiceEntries[entryName] = serviceEntry
+	}
+	rb.markWritten(generatorKey{kind: "serviceentry", name: entryName})
+	rb.NotifyChanged()
+	glog.Infof("[RULE BUFFER] add service entry %s: %v", entryName, serviceEntry)
 }
 
-func (rb *RuleBuffer) SetRegexRule(ruleName string, regexRule *skproxy.RegexRuleGenerator) {
+func (rb *RuleBuffer) SetGateway(gatewayName string, gateway *skproxy.GatewayGenerator) {
 	for _, config := range rb.rules {
-		config.RegexRules[ruleName] = regexRule
+		config.Gateways[gatewayName] = gateway
 	}
-	glog.Infof("[RULE BUFFER] add regex rule %s: %v", ruleName, regexRule)
-	if regexRule != nil {
-		for _, matcher := range regexRule.Matchers {
-			glog.Infof("%v\n", *matcher)
-		}
+	if gateway == nil {
+		delete(rb.desired.Gateways, gatewayName)
+	} else {
+		rb.desired.Gateways[gatewayName] = gateway
+	}
+	rb.markWritten(generatorKey{kind: "gateway", name: gatewayName})
+	rb.NotifyChanged()
+	glog.Infof("[RULE BUFFER] add gateway %s: %v", gatewayName, gateway)
+}
+
+// SetOutboundPolicy sets the outbound policy of all proxies.
+func (rb *RuleBuffer) SetOutboundPolicy(policy skproxy.OutboundPolicy) {
+	if policy == rb.outboundPolicy {
+		return
+	}
+	rb.outboundPolicy = policy
+	rb.settingsVersion++
+	glog.Infof("[RULE BUFFER] set outbound policy %s", policy)
+	rb.NotifyChanged()
+}
+
+// SetMeshHosts sets the hosts inside the mesh. meshHosts should be sorted so that
+// unchanged hosts will not be sent again.
+func (rb *RuleBuffer) SetMeshHosts(meshHosts []string) {
+	if reflect.DeepEqual(meshHosts, rb.meshHosts) {
+		return
+	}
+	rb.meshHosts = meshHosts
+	rb.settingsVersion++
+	glog.Infof("[RULE BUFFER] set %d mesh hosts", len(meshHosts))
+	rb.NotifyChanged()
+}
+
+// SetTraceSampleRate sets the proportion of new traces that are sampled by proxies.
+func (rb *RuleBuffer) SetTraceSampleRate(rate float64) {
+	if rate == rb.traceSampleRate {
+		return
 	}
+	rb.traceSampleRate = rate
+	rb.settingsVersion++
+	glog.Infof("[RULE BUFFER] set trace sample rate %v", rate)
+	rb.NotifyChanged()
 }
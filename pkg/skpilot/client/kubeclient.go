@@ -9,12 +9,31 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"p9t.io/kuberboat/pkg/api/core"
 	kubePb "p9t.io/kuberboat/pkg/proto"
 )
 
 var KUBE_CONN_TIMEOUT time.Duration = time.Second
 
+// kubeKeepaliveTime is how often the connection to the API server is checked while watching, so
+// that a watch on a dead connection breaks instead of waiting forever. It is the least interval
+// gRPC servers allow by default.
+const kubeKeepaliveTime = time.Minute * 5
+
+// KubeEvent is a change of a pod or a service in the API server of Kuberboat. Exactly one of Pod
+// and Service is set.
+type KubeEvent struct {
+	// Type is ADDED, MODIFIED or DELETED.
+	Type string
+	// ResourceVersion is the version of the API server after the change.
+	ResourceVersion uint64
+	Pod             *core.Pod
+	Service         *core.Service
+	// ServicePodNames are the names of the pods selected by Service.
+	ServicePodNames []string
+}
+
 type KubeClient struct {
 	connection *grpc.ClientConn
 	client     kubePb.ApiServerCtlServiceClient
@@ -22,7 +41,11 @@ type KubeClient struct {
 
 func NewKubeClient(url string, KubePort uint16) (*KubeClient, error) {
 	addr := fmt.Sprintf("%v:%v", url, KubePort)
-	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(
+		addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: kubeKeepaliveTime}),
+	)
 	if err != nil {
 		return nil, errors.New("client failed to connect to worker node")
 	}
@@ -76,3 +99,44 @@ func (c *KubeClient) GetAllServices() ([]*core.Service, [][]string, error) {
 	}
 	return services, servicePods, nil
 }
+
+// WatchObjects watches the changes of pods and services after resourceVersion, and calls handle
+// with each of them in order. If resourceVersion is zero, every existing object is sent as added
+// first. It returns when the watch breaks, with an OutOfRange error if the changes after
+// resourceVersion are no longer kept by the API server.
+func (c *KubeClient) WatchObjects(resourceVersion uint64, handle func(*KubeEvent)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.client.WatchObjects(ctx, &kubePb.WatchObjectsRequest{
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		event := &KubeEvent{
+			Type:            resp.Type,
+			ResourceVersion: resp.ResourceVersion,
+		}
+		if len(resp.Pod) != 0 {
+			if err := json.Unmarshal(resp.Pod, &event.Pod); err != nil {
+				return err
+			}
+		} else {
+			if err := json.Unmarshal(resp.Service, &event.Service); err != nil {
+				return err
+			}
+			if len(resp.ServicePodNames) != 0 {
+				if err := json.Unmarshal(resp.ServicePodNames, &event.ServicePodNames); err != nil {
+					return err
+				}
+			}
+		}
+		handle(event)
+	}
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +18,16 @@ import (
 
 var SK_CONN_TIMEOUT time.Duration = time.Second * 6
 
+// AgentConn is a connection through which skpilot pushes updates to an SkAgent.
+type AgentConn interface {
+	// CreateProxy asks the SkAgent to create proxies for the sandboxes.
+	CreateProxy(infos []core.SandboxInfo) error
+	// UpdateRule sends config to the SkAgent as the update identified by version and nonce.
+	// If full is true, config is the full state replacing all the rules of the SkAgent.
+	UpdateRule(config *skproxy.Config, version uint64, nonce string, full bool) (*pb.UpdateRulesResponse, error)
+}
+
+// SkClient is the AgentConn sending each update with an unary call.
 type SkClient struct {
 	connection *grpc.ClientConn
 	client     pb.SkagentSkpilotServiceClient
@@ -33,31 +45,58 @@ func NewSkClient(url string, skAgentPort uint16) (*SkClient, error) {
 	}, nil
 }
 
-func (c *SkClient) CreateProxy(infos []core.SandboxInfo) (*pb.DefaultResponse, error) {
+// Close closes the connection to the SkAgent.
+func (c *SkClient) Close() error {
+	return c.connection.Close()
+}
+
+func (c *SkClient) CreateProxy(infos []core.SandboxInfo) error {
 	ctx, cancel := context.WithTimeout(context.Background(), SK_CONN_TIMEOUT)
 	defer cancel()
+	_, err := c.client.CreateProxy(ctx, newCreateProxyRequest(infos, ""))
+	return err
+}
+
+func (c *SkClient) UpdateRule(config *skproxy.Config, version uint64, nonce string, full bool) (*pb.UpdateRulesResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SK_CONN_TIMEOUT)
+	defer cancel()
+	req, err := newUpdateRulesRequest(config, version, nonce, full)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.UpdateRule(ctx, req)
+}
 
+func newCreateProxyRequest(infos []core.SandboxInfo, nonce string) *pb.CreateProxyRequest {
 	containerNames := make([]string, 0, len(infos))
 	sandboxIPs := make([]string, 0, len(infos))
 	for _, info := range infos {
 		containerNames = append(containerNames, info.SandboxName)
 		sandboxIPs = append(sandboxIPs, info.SandboxIP)
 	}
-
-	return c.client.CreateProxy(ctx, &pb.CreateProxyRequest{
+	return &pb.CreateProxyRequest{
 		ContainerNames: containerNames,
 		SandboxIps:     sandboxIPs,
-	})
+		Nonce:          nonce,
+	}
 }
 
-func (c *SkClient) UpdateRule(config *skproxy.Config) (*pb.DefaultResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), SK_CONN_TIMEOUT)
-	defer cancel()
+func newUpdateRulesRequest(config *skproxy.Config, version uint64, nonce string, full bool) (*pb.UpdateRulesRequest, error) {
 	data, err := json.Marshal(config)
 	if err != nil {
-		return &pb.DefaultResponse{Status: -1}, err
+		return nil, err
 	}
-	return c.client.UpdateRule(ctx, &pb.UpdateRulesRequest{
-		Config: data,
-	})
+	return &pb.UpdateRulesRequest{
+		Config:  data,
+		Version: version,
+		Nonce:   nonce,
+		Full:    full,
+	}, nil
+}
+
+// NewNonce returns a random nonce identifying an update.
+func NewNonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
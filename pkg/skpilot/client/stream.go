@@ -0,0 +1,164 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"p9t.io/skafos/pkg/api/core"
+	pb "p9t.io/skafos/pkg/proto"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+// StreamConn is the AgentConn pushing updates over the config stream opened by an SkAgent.
+// Each update carries a nonce, and the ack with the same nonce comes back on the stream.
+type StreamConn struct {
+	stream pb.SkpilotSkagentService_StreamConfigServer
+	// sendMtx serializes sending on the stream.
+	sendMtx sync.Mutex
+	// mtx protects pending.
+	mtx sync.Mutex
+	// pending maps the nonce of each update to the channel waiting for its ack.
+	pending map[string]chan *pb.AgentMessage
+	// done is closed when the stream is broken.
+	done chan struct{}
+	// closed is closed when skpilot closes the stream.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewStreamConn(stream pb.SkpilotSkagentService_StreamConfigServer) *StreamConn {
+	return &StreamConn{
+		stream:  stream,
+		pending: map[string]chan *pb.AgentMessage{},
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close makes Serve return, which ends the stream. The agent will open a new stream and
+// register again.
+func (c *StreamConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// Serve receives acks from the stream and dispatches them to the waiting updates. onMessage
+// is called on each message, including heartbeats. It returns when the stream is broken or
+// closed. Once the handler of the stream returns, the receiving goroutine stops too.
+func (c *StreamConn) Serve(onMessage func()) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.receive(onMessage)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-c.closed:
+		return errors.New("config stream is closed by skpilot")
+	}
+}
+
+// receive dispatches the messages on the stream until it is broken.
+func (c *StreamConn) receive(onMessage func()) error {
+	defer close(c.done)
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return err
+		}
+		onMessage()
+		var nonce string
+		switch m := msg.Message.(type) {
+		case *pb.AgentMessage_Heartbeat:
+			continue
+		case *pb.AgentMessage_RuleAck:
+			nonce = m.RuleAck.Nonce
+		case *pb.AgentMessage_ProxyAck:
+			nonce = m.ProxyAck.Nonce
+		default:
+			glog.Warningf("unexpected message on config stream: %v", msg)
+			continue
+		}
+		c.mtx.Lock()
+		ch, ok := c.pending[nonce]
+		delete(c.pending, nonce)
+		c.mtx.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (c *StreamConn) CreateProxy(infos []core.SandboxInfo) error {
+	nonce := NewNonce()
+	msg, err := c.request(nonce, &pb.PilotMessage{
+		Message: &pb.PilotMessage_CreateProxy{
+			CreateProxy: newCreateProxyRequest(infos, nonce),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ack := msg.GetProxyAck()
+	if ack == nil {
+		return errors.New("create proxy is not acknowledged")
+	}
+	if ack.Error != "" {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+func (c *StreamConn) UpdateRule(config *skproxy.Config, version uint64, nonce string, full bool) (*pb.UpdateRulesResponse, error) {
+	req, err := newUpdateRulesRequest(config, version, nonce, full)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.request(nonce, &pb.PilotMessage{
+		Message: &pb.PilotMessage_UpdateRules{
+			UpdateRules: req,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ack := msg.GetRuleAck()
+	if ack == nil {
+		return nil, errors.New("update rule is not acknowledged")
+	}
+	return ack, nil
+}
+
+// request sends msg and waits for the ack with nonce.
+func (c *StreamConn) request(nonce string, msg *pb.PilotMessage) (*pb.AgentMessage, error) {
+	ch := make(chan *pb.AgentMessage, 1)
+	c.mtx.Lock()
+	c.pending[nonce] = ch
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		delete(c.pending, nonce)
+		c.mtx.Unlock()
+	}()
+
+	c.sendMtx.Lock()
+	err := c.stream.Send(msg)
+	c.sendMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case ack := <-ch:
+		return ack, nil
+	case <-c.done:
+		return nil, errors.New("config stream is broken")
+	case <-c.closed:
+		return nil, errors.New("config stream is closed by skpilot")
+	case <-time.After(SK_CONN_TIMEOUT):
+		return nil, errors.New("timed out waiting for ack")
+	}
+}
@@ -2,7 +2,9 @@ package component
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	kubeCore "p9t.io/kuberboat/pkg/api/core"
 	"p9t.io/skafos/pkg/api/core"
@@ -24,19 +26,32 @@ type SkComponents struct {
 	RatioRules map[string]*core.RatioRule
 	// Stores the mapping from the name of a regex rule to the rule.
 	RegexRules map[string]*core.RegexRule
-	// Stores the mapping from the name of a service to metadata of the rule applied to it.
-	ServiceToRule map[string]*core.RuleMeta
+	// Stores the mapping from the name of a destination policy to the policy.
+	DestinationPolicies map[string]*core.DestinationPolicy
+	// Stores the mapping from the name of a rollout to the rollout.
+	Rollouts map[string]*core.Rollout
+	// Stores the mapping from the name of a service to metadata of the rules, the destination
+	// policy and the rollout applied to it by name.
+	ServiceToRules map[string]map[string]*core.RuleMeta
+	// Stores the mapping from the name of a service entry to the entry.
+	ServiceEntries map[string]*core.ServiceEntry
+	// Stores the mapping from the name of a gateway to the gateway.
+	Gateways map[string]*core.Gateway
 }
 
 func NewSkComponents() *SkComponents {
 	return &SkComponents{
-		Mtx:            sync.Mutex{},
-		Pods:           map[string]*kubeCore.Pod{},
-		Services:       map[string]*kubeCore.Service{},
-		ServicesToPods: map[string]*[]string{},
-		RatioRules:     map[string]*core.RatioRule{},
-		RegexRules:     map[string]*core.RegexRule{},
-		ServiceToRule:  map[string]*core.RuleMeta{},
+		Mtx:                 sync.Mutex{},
+		Pods:                map[string]*kubeCore.Pod{},
+		Services:            map[string]*kubeCore.Service{},
+		ServicesToPods:      map[string]*[]string{},
+		RatioRules:          map[string]*core.RatioRule{},
+		RegexRules:          map[string]*core.RegexRule{},
+		DestinationPolicies: map[string]*core.DestinationPolicy{},
+		Rollouts:            map[string]*core.Rollout{},
+		ServiceToRules:      map[string]map[string]*core.RuleMeta{},
+		ServiceEntries:      map[string]*core.ServiceEntry{},
+		Gateways:            map[string]*core.Gateway{},
 	}
 }
 
@@ -45,7 +60,13 @@ func NewSkComponents() *SkComponents {
 func (sc *SkComponents) GetServiceAndServicePods(serviceName string) (*kubeCore.Service, []*kubeCore.Pod, error) {
 	service, ok := sc.Services[serviceName]
 	if !ok {
-		return nil, nil, fmt.Errorf("no such service: %s", serviceName)
+		return nil, nil, core.NewError(
+			core.ErrorReasonNotFound,
+			"spec.serviceName",
+			serviceName,
+			"no such service: %s",
+			serviceName,
+		)
 	}
 	servicePodNames, ok := sc.ServicesToPods[serviceName]
 	if !ok {
@@ -62,19 +83,335 @@ func (sc *SkComponents) GetServiceAndServicePods(serviceName string) (*kubeCore.
 	return service, servicePods, nil
 }
 
-// CheckRule checks whether a rule could be applied to a service.
-func (sc *SkComponents) CheckRule(ruleName string, serviceName string) error {
+// AddServiceRule records that the rule or destination policy is applied to the service.
+func (sc *SkComponents) AddServiceRule(serviceName string, ruleMeta *core.RuleMeta) {
+	if _, ok := sc.ServiceToRules[serviceName]; !ok {
+		sc.ServiceToRules[serviceName] = map[string]*core.RuleMeta{}
+	}
+	sc.ServiceToRules[serviceName][ruleMeta.Name] = ruleMeta
+}
+
+// RemoveServiceRule records that the rule or destination policy is no longer applied to the
+// service.
+func (sc *SkComponents) RemoveServiceRule(serviceName string, ruleName string) {
+	delete(sc.ServiceToRules[serviceName], ruleName)
+	if len(sc.ServiceToRules[serviceName]) == 0 {
+		delete(sc.ServiceToRules, serviceName)
+	}
+}
+
+// GetServiceRules returns the ratio rule applied to a service, which is nil if there is none,
+// and the regex rules applied to it sorted by name, whether they are in effect or not. A rollout
+// of the service is returned as the ratio rule it acts as in its current step.
+func (sc *SkComponents) GetServiceRules(serviceName string) (*core.RatioRule, []*core.RegexRule) {
+	return sc.getServiceRules(serviceName, nil)
+}
+
+// GetActiveServiceRules is like GetServiceRules, but only returns the rules in effect at now.
+// They make up the route table of the service.
+func (sc *SkComponents) GetActiveServiceRules(serviceName string, now time.Time) (*core.RatioRule, []*core.RegexRule) {
+	return sc.getServiceRules(serviceName, &now)
+}
+
+// getServiceRules returns the ratio rule and the regex rules applied to a service, leaving out
+// those not in effect at now unless now is nil.
+func (sc *SkComponents) getServiceRules(serviceName string, now *time.Time) (*core.RatioRule, []*core.RegexRule) {
+	var ratioRule *core.RatioRule
+	regexRules := make([]*core.RegexRule, 0)
+	for name, ruleMeta := range sc.ServiceToRules[serviceName] {
+		if now != nil && !ruleMeta.IsActive(*now) {
+			continue
+		}
+		switch ruleMeta.Kind {
+		case core.RatioType:
+			ratioRule = sc.RatioRules[name]
+		case core.RolloutType:
+			ratioRule = sc.Rollouts[name].RatioRule()
+		case core.RegexType:
+			regexRules = append(regexRules, sc.RegexRules[name])
+		}
+	}
+	sort.Slice(regexRules, func(i, j int) bool {
+		return regexRules[i].Name < regexRules[j].Name
+	})
+	return ratioRule, regexRules
+}
+
+// GetDestinationPolicy returns the destination policy of a service, or nil if there is none.
+func (sc *SkComponents) GetDestinationPolicy(serviceName string) *core.DestinationPolicy {
+	for name, ruleMeta := range sc.ServiceToRules[serviceName] {
+		if ruleMeta.Kind == core.DestinationPolicyType {
+			return sc.DestinationPolicies[name]
+		}
+	}
+	return nil
+}
+
+// GetActiveDestinationPolicy returns the destination policy of a service if it is in effect at
+// now, or nil otherwise.
+func (sc *SkComponents) GetActiveDestinationPolicy(serviceName string, now time.Time) *core.DestinationPolicy {
+	policy := sc.GetDestinationPolicy(serviceName)
+	if policy == nil || !policy.IsActive(now) {
+		return nil
+	}
+	return policy
+}
+
+// SubsetReference is a subset of the destination policy of a service named by a rule of the
+// service.
+type SubsetReference struct {
+	// Field is the path of the field of the rule naming the subset, like "spec.subset".
+	Field  string
+	Subset string
+}
+
+// CheckSubsets checks whether the subsets are all defined in the destination policy of the
+// service.
+func (sc *SkComponents) CheckSubsets(serviceName string, subsets []SubsetReference) error {
+	policy := sc.GetDestinationPolicy(serviceName)
+	for _, subset := range subsets {
+		if policy == nil || policy.GetSubset(subset.Subset) == nil {
+			return core.NewError(
+				core.ErrorReasonNotFound,
+				subset.Field,
+				subset.Subset,
+				"no subset %s in the destination policy of service %s",
+				subset.Subset,
+				serviceName,
+			)
+		}
+	}
+	return nil
+}
+
+// CheckSubsetReferences checks whether the ratio and regex rules of a service could still refer
+// to their subsets if policy became the destination policy of the service. A nil policy means
+// the destination policy of the service is removed.
+func (sc *SkComponents) CheckSubsetReferences(serviceName string, policy *core.DestinationPolicy) error {
+	ratioRule, regexRules := sc.GetServiceRules(serviceName)
+	references := make([]*core.RuleMeta, 0)
+	subsets := make([]string, 0)
+	if ratioRule != nil && ratioRule.Spec.Subset != "" {
+		references = append(references, &ratioRule.RuleMeta)
+		subsets = append(subsets, ratioRule.Spec.Subset)
+	}
+	for _, rule := range regexRules {
+		for _, matcher := range rule.Spec.Matchers {
+			if matcher.Subset != "" {
+				references = append(references, &rule.RuleMeta)
+				subsets = append(subsets, matcher.Subset)
+			}
+		}
+	}
+	for i, subset := range subsets {
+		if policy != nil && policy.GetSubset(subset) != nil {
+			continue
+		}
+		// A removed policy is at fault as a whole rather than by one of its fields.
+		field, value := "spec.subsets", subset
+		if policy == nil {
+			field, value = "", ""
+		}
+		return core.NewError(
+			core.ErrorReasonInUse,
+			field,
+			value,
+			"subset %s of service %s is referenced by %s rule %s",
+			subset,
+			serviceName,
+			references[i].Kind,
+			references[i].Name,
+		)
+	}
+	return nil
+}
+
+// CheckDestinationPolicyConflicts checks whether a destination policy could be applied to its
+// service. A service can have only one destination policy.
+func (sc *SkComponents) CheckDestinationPolicyConflicts(policy *core.DestinationPolicy) error {
+	for name, ruleMeta := range sc.ServiceToRules[policy.Spec.ServiceName] {
+		if name != policy.Name && ruleMeta.Kind == core.DestinationPolicyType {
+			return core.NewError(
+				core.ErrorReasonConflict,
+				"spec.serviceName",
+				policy.Spec.ServiceName,
+				"conflict with destination policy %s: service %s can have only one destination policy",
+				name,
+				policy.Spec.ServiceName,
+			)
+		}
+	}
+	return nil
+}
+
+// CheckRatioRuleConflicts checks whether a ratio rule could be applied to its service along
+// with the other rules of the service. The ratio rule is the default route of the service, so
+// a service can have only one ratio rule or rollout.
+func (sc *SkComponents) CheckRatioRuleConflicts(rule *core.RatioRule) error {
+	return sc.checkDefaultRouteConflicts(rule.Spec.ServiceName, rule.Name)
+}
+
+// CheckRolloutConflicts checks whether a rollout could be applied to its service along with the
+// other rules of the service. A rollout acts as the ratio rule of the service, so a service can
+// have only one ratio rule or rollout.
+func (sc *SkComponents) CheckRolloutConflicts(rollout *core.Rollout) error {
+	return sc.checkDefaultRouteConflicts(rollout.Spec.ServiceName, rollout.Name)
+}
+
+// checkDefaultRouteConflicts checks whether the service has a ratio rule or a rollout other
+// than the one with ruleName.
+func (sc *SkComponents) checkDefaultRouteConflicts(serviceName string, ruleName string) error {
+	for name, ruleMeta := range sc.ServiceToRules[serviceName] {
+		if name == ruleName {
+			continue
+		}
+		kind := ""
+		switch ruleMeta.Kind {
+		case core.RatioType:
+			kind = "ratio rule"
+		case core.RolloutType:
+			kind = "rollout"
+		default:
+			continue
+		}
+		return core.NewError(
+			core.ErrorReasonConflict,
+			"spec.serviceName",
+			serviceName,
+			"conflict with %s %s: service %s can have only one ratio rule or rollout as its default route",
+			kind,
+			name,
+			serviceName,
+		)
+	}
+	return nil
+}
+
+// CheckRegexRuleConflicts checks whether a regex rule could be applied to its service along
+// with the other rules of the service. A matcher of the same header and regex as a matcher of
+// another regex rule would never be reached, so it is a conflict.
+func (sc *SkComponents) CheckRegexRuleConflicts(rule *core.RegexRule) error {
+	_, regexRules := sc.GetServiceRules(rule.Spec.ServiceName)
+	for _, other := range regexRules {
+		if other.Name == rule.Name {
+			continue
+		}
+		for i, matcher := range rule.Spec.Matchers {
+			for _, otherMatcher := range other.Spec.Matchers {
+				if matcher.Header == otherMatcher.Header && matcher.Regex == otherMatcher.Regex {
+					return core.NewError(
+						core.ErrorReasonConflict,
+						fmt.Sprintf("spec.matchers[%d].regex", i),
+						matcher.Regex,
+						"conflict with regex rule %s: both match header %s against %q on service %s",
+						other.Name,
+						matcher.Header,
+						matcher.Regex,
+						rule.Spec.ServiceName,
+					)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckRuleName checks whether the name has been taken by any rule, service entry, gateway,
+// destination policy or rollout.
+func (sc *SkComponents) CheckRuleName(ruleName string) error {
+	_, isRatioRule := sc.RatioRules[ruleName]
+	_, isRegexRule := sc.RegexRules[ruleName]
+	_, isServiceEntry := sc.ServiceEntries[ruleName]
+	_, isGateway := sc.Gateways[ruleName]
+	_, isDestinationPolicy := sc.DestinationPolicies[ruleName]
+	_, isRollout := sc.Rollouts[ruleName]
+	if isRatioRule || isRegexRule || isServiceEntry || isGateway || isDestinationPolicy || isRollout {
+		return core.NewError(core.ErrorReasonDuplicate, "name", ruleName, "duplicate rule: %s", ruleName)
+	}
+	return nil
+}
+
+// GetRuleKind returns the kind of the rule, service entry, gateway, destination policy or
+// rollout with the name.
+func (sc *SkComponents) GetRuleKind(ruleName string) (core.Kind, error) {
 	if _, ok := sc.RatioRules[ruleName]; ok {
-		return fmt.Errorf("duplicate rule: %s", ruleName)
+		return core.RatioType, nil
 	}
 	if _, ok := sc.RegexRules[ruleName]; ok {
-		return fmt.Errorf("duplicate rule: %s", ruleName)
+		return core.RegexType, nil
 	}
-	if _, ok := sc.ServiceToRule[serviceName]; ok {
-		return fmt.Errorf(
-			"service %s already has a rule applied to it",
-			serviceName,
+	if _, ok := sc.ServiceEntries[ruleName]; ok {
+		return core.ServiceEntryType, nil
+	}
+	if _, ok := sc.Gateways[ruleName]; ok {
+		return core.GatewayType, nil
+	}
+	if _, ok := sc.DestinationPolicies[ruleName]; ok {
+		return core.DestinationPolicyType, nil
+	}
+	if _, ok := sc.Rollouts[ruleName]; ok {
+		return core.RolloutType, nil
+	}
+	return "", core.NewError(core.ErrorReasonNotFound, "name", ruleName, "no such rule: %s", ruleName)
+}
+
+// CheckRuleKind checks whether there is a rule of the kind with the name to update. A rule
+// cannot change its kind by an update.
+func (sc *SkComponents) CheckRuleKind(ruleName string, kind core.Kind) error {
+	currentKind, err := sc.GetRuleKind(ruleName)
+	if err != nil {
+		return err
+	}
+	if currentKind != kind {
+		return core.NewError(
+			core.ErrorReasonKindMismatch,
+			"kind",
+			string(kind),
+			"rule %s is of kind %s rather than %s",
+			ruleName,
+			currentKind,
+			kind,
 		)
 	}
 	return nil
 }
+
+// GetMeshHosts returns the sorted IPs of all services and pods in the mesh.
+func (sc *SkComponents) GetMeshHosts() []string {
+	hosts := make([]string, 0, len(sc.Services)+len(sc.Pods))
+	for _, service := range sc.Services {
+		if service.Spec.ClusterIP != "" {
+			hosts = append(hosts, service.Spec.ClusterIP)
+		}
+	}
+	for _, pod := range sc.Pods {
+		if pod.Status.PodIP != "" {
+			hosts = append(hosts, pod.Status.PodIP)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// GetHostSandboxInfos returns the sandbox information of all the pods on the host, sorted by pod
+// name. Only ready pods are discovered, so the result contains only ready pods.
+func (sc *SkComponents) GetHostSandboxInfos(hostIP string) []core.SandboxInfo {
+	names := make([]string, 0)
+	for name, pod := range sc.Pods {
+		if core.IsSameHostAddr(hostIP, pod.Status.HostIP) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	infos := make([]core.SandboxInfo, 0, len(names))
+	for _, name := range names {
+		pod := sc.Pods[name]
+		infos = append(infos, core.SandboxInfo{
+			SandboxName: core.GetPodSpecificPauseName(pod),
+			SandboxIP:   pod.Status.PodIP,
+			HostIP:      pod.Status.HostIP,
+		})
+	}
+	return infos
+}
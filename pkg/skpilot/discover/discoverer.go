@@ -1,68 +1,178 @@
 package discover
 
 import (
-	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	kubeCore "p9t.io/kuberboat/pkg/api/core"
 	"p9t.io/skafos/pkg/api/core"
 	"p9t.io/skafos/pkg/skpilot/buffer"
-	"p9t.io/skafos/pkg/skpilot/client"
 	"p9t.io/skafos/pkg/skpilot/component"
+	"p9t.io/skafos/pkg/skpilot/registry"
 	"p9t.io/skafos/pkg/skpilot/util"
 )
 
-// Discoverer does pod discovery and service discovery at set intervals. If there are any changes,
-// it will generate new rules and detect proxy updates based on the changes, and then write them
-// into the buffers.
+// Discoverer does pod discovery and service discovery. It watches the changes of pods and services
+// and handles each of them incrementally, and also resyncs all pods and services at set intervals
+// in case any change is missed. For each change, it will generate new rules and detect proxy
+// updates, and then write them into the buffers.
 type Discoverer struct {
-	// kubeClient queries Kuberboat on the information of pods and services.
-	kubeClient *client.KubeClient
+	// registry is the service-discovery backend providing pods and services.
+	registry registry.Registry
 	// components stores metadata of all pods, services and rules.
 	components *component.SkComponents
 	// ruleBuffer is the buffer where rules to update are stored.
 	ruleBuffer *buffer.RuleBuffer
 	// proxyBuffer is the buffer where proxies to create are stored.
 	proxyBuffer *buffer.ProxyBuffer
+	// servicePodNames maps each service to the names of the pods it selects, including pods
+	// that are not ready. Only ready pods are recorded in components.
+	servicePodNames map[string][]string
 }
 
 func NewDiscoverer(
-	kubeEndpoint string,
+	registry registry.Registry,
 	components *component.SkComponents,
 	ruleBuffer *buffer.RuleBuffer,
 	proxyBuffer *buffer.ProxyBuffer,
 ) *Discoverer {
-	kubeClient, err := client.NewKubeClient(kubeEndpoint, core.KUBE_PORT)
+	return &Discoverer{
+		registry:        registry,
+		components:      components,
+		ruleBuffer:      ruleBuffer,
+		proxyBuffer:     proxyBuffer,
+		servicePodNames: map[string][]string{},
+	}
+}
+
+// DoDiscovering handles the changes of pods and services in the registry as they are watched,
+// and resyncs all of them every resyncInterval in case any change is missed.
+func (d *Discoverer) DoDiscovering(resyncInterval time.Duration) {
+	events := d.registry.Watch()
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
+	for {
+		select {
+		case event := <-events:
+			if event.Pod != nil {
+				d.handlePodEvent(event)
+			} else {
+				d.handleServiceEvent(event)
+			}
+		case <-resync.C:
+			d.resync()
+		}
+	}
+}
+
+// resync discovers all pods and services and updates them as a whole.
+func (d *Discoverer) resync() {
+	pods, err := d.registry.ListPods()
 	if err != nil {
-		glog.Fatal(err)
+		glog.Error(err)
+		return
 	}
-	return &Discoverer{
-		kubeClient:  kubeClient,
-		components:  components,
-		ruleBuffer:  ruleBuffer,
-		proxyBuffer: proxyBuffer,
+	services, servicePods, err := d.registry.ListServices()
+	if err != nil {
+		glog.Error(err)
+		return
 	}
+	// We regard the pods and services here together as one snapshot.
+	d.updatePodsAndServices(pods, services, servicePods)
 }
 
-// DoDiscovering discovers pods and services of Kuberboat at set intervals.
-func (d *Discoverer) DoDiscovering(discoverInterval time.Duration) {
-	for range time.Tick(discoverInterval) {
-		pods, err := d.kubeClient.GetAllPods()
-		if err != nil {
-			glog.Error(err)
-			continue
+// handlePodEvent updates the pod in the event, creates a proxy for it if it is new, and updates
+// the rules of services selecting it.
+func (d *Discoverer) handlePodEvent(event registry.WatchEvent) {
+	d.components.Mtx.Lock()
+	defer d.components.Mtx.Unlock()
+
+	pod := event.Pod
+	existentPod, existed := d.components.Pods[pod.Name]
+	// We only consider ready pods
+	if event.Type == registry.WatchDeleted || pod.Status.Phase != kubeCore.PodReady {
+		if !existed {
+			return
 		}
-		services, servicePods, err := d.kubeClient.GetAllServices()
-		if err != nil {
-			glog.Error(err)
-			continue
+		delete(d.components.Pods, pod.Name)
+	} else {
+		if existed && reflect.DeepEqual(*existentPod, *pod) {
+			return
+		}
+		d.components.Pods[pod.Name] = pod
+		func() {
+			d.proxyBuffer.LockBuffer()
+			defer d.proxyBuffer.UnlockBuffer()
+			d.proxyBuffer.SetSandboxInfo(newSandboxInfo(pod))
+		}()
+	}
+	glog.Infof("[DISCOVERER] pod %s %s", pod.Name, strings.ToLower(string(event.Type)))
+
+	// Update the services selecting the pod.
+	servicesToUpdateRule := make([]string, 0)
+	for serviceName, podNames := range d.servicePodNames {
+		for _, podName := range podNames {
+			if podName == pod.Name {
+				d.components.ServicesToPods[serviceName] = d.readyPodNames(podNames)
+				servicesToUpdateRule = append(servicesToUpdateRule, serviceName)
+				break
+			}
 		}
-		// We regard the pods and services here together as one snapshot.
-		d.updatePodsAndServices(pods, services, servicePods)
 	}
+	sort.Strings(servicesToUpdateRule)
+	d.updateRules(servicesToUpdateRule, map[string]bool{}, d.getServiceIPs())
+}
+
+// handleServiceEvent updates the service in the event and its route table.
+func (d *Discoverer) handleServiceEvent(event registry.WatchEvent) {
+	d.components.Mtx.Lock()
+	defer d.components.Mtx.Unlock()
+
+	service := event.Service
+	previousServiceIPs := d.getServiceIPs()
+	servicesWithPendingRules := make(map[string]bool)
+	if event.Type == registry.WatchDeleted {
+		if _, ok := d.components.Services[service.Name]; !ok {
+			return
+		}
+		delete(d.components.Services, service.Name)
+		delete(d.components.ServicesToPods, service.Name)
+		delete(d.servicePodNames, service.Name)
+		// The rules applied to the deleted service wait for it to come back.
+		_, servicesWithPendingRules[service.Name] = d.components.ServiceToRules[service.Name]
+	} else {
+		podNames := append([]string{}, event.ServicePodNames...)
+		sort.Strings(podNames)
+		d.components.Services[service.Name] = service
+		d.components.ServicesToPods[service.Name] = d.readyPodNames(podNames)
+		d.servicePodNames[service.Name] = podNames
+	}
+	glog.Infof("[DISCOVERER] service %s %s", service.Name, strings.ToLower(string(event.Type)))
+
+	d.updateRules([]string{service.Name}, servicesWithPendingRules, previousServiceIPs)
+}
+
+// readyPodNames returns the pods in podNames that are discovered, i.e. ready.
+func (d *Discoverer) readyPodNames(podNames []string) *[]string {
+	ready := make([]string, 0, len(podNames))
+	for _, podName := range podNames {
+		if _, ok := d.components.Pods[podName]; ok {
+			ready = append(ready, podName)
+		}
+	}
+	return &ready
+}
+
+// getServiceIPs returns the mapping from the name of each service to its IP.
+func (d *Discoverer) getServiceIPs() map[string]string {
+	serviceIPs := make(map[string]string)
+	for name, service := range d.components.Services {
+		serviceIPs[name] = service.Spec.ClusterIP
+	}
+	return serviceIPs
 }
 
 // updatePodsAndServices updates pods and services based on the discovering result. It also
@@ -75,6 +185,9 @@ func (d *Discoverer) updatePodsAndServices(
 	d.components.Mtx.Lock()
 	defer d.components.Mtx.Unlock()
 
+	// Record the previous service IPs, which gateways depend on.
+	previousServiceIPs := d.getServiceIPs()
+
 	// Check pods
 	newSandboxInfos, currentPods := d.checkPods(pods)
 
@@ -82,7 +195,7 @@ func (d *Discoverer) updatePodsAndServices(
 	servicesToUpdateRule,
 		currentServices,
 		currentServiceToPods,
-		deletedServiceRuleTypes := d.checkServices(services, servicePods, currentPods)
+		servicesWithPendingRules := d.checkServices(services, servicePods, currentPods)
 
 	// Update metadata
 	d.components.Pods = currentPods
@@ -99,62 +212,55 @@ func (d *Discoverer) updatePodsAndServices(
 	}()
 
 	// Update rules
+	d.updateRules(servicesToUpdateRule, servicesWithPendingRules, previousServiceIPs)
+}
+
+// updateRules writes the mesh hosts, the changes of gateways and the route tables of services
+// into the rule buffer. servicesWithPendingRules contains the deleted services with rules applied
+// to them, whose route tables are removed while the rules are kept until the services are
+// discovered again, like the rules restored before their services are discovered.
+func (d *Discoverer) updateRules(
+	servicesToUpdateRule []string,
+	servicesWithPendingRules map[string]bool,
+	previousServiceIPs map[string]string,
+) {
 	func() {
 		d.ruleBuffer.LockBuffer()
 		defer d.ruleBuffer.UnlockBuffer()
+		d.ruleBuffer.SetMeshHosts(d.components.GetMeshHosts())
+		d.updateGateways(previousServiceIPs)
 		for _, serviceName := range servicesToUpdateRule {
-			ruleMeta, ok := d.components.ServiceToRule[serviceName]
-			if !ok {
-				oldRuleMeta, ok := deletedServiceRuleTypes[serviceName]
-				if !ok {
-					continue
-				}
-				// Remove the rule applied to the deleted service.
-				switch oldRuleMeta.Kind {
-				case core.RatioType:
-					d.ruleBuffer.SetRatioRule(oldRuleMeta.Name, nil)
-				case core.RegexType:
-					d.ruleBuffer.SetRegexRule(oldRuleMeta.Name, nil)
-				}
-			} else {
-				// Apply change of the rule.
-				switch ruleMeta.Kind {
-				case core.RatioType:
-					rule, ok := d.components.RatioRules[ruleMeta.Name]
-					if !ok {
-						panic(fmt.Sprintf(
-							"expect to have ratio rule %s for service %s",
-							ruleMeta.Name,
-							serviceName,
-						))
-					}
-					service, pods, err := d.components.GetServiceAndServicePods(serviceName)
-					if err != nil {
-						panic(fmt.Sprintf("expect service %s", serviceName))
-					}
-					ruleGenerator := util.GenerateRatioRule(rule, service, pods)
-					d.ruleBuffer.SetRatioRule(ruleMeta.Name, ruleGenerator)
-				case core.RegexType:
-					rule, ok := d.components.RegexRules[ruleMeta.Name]
-					if !ok {
-						panic(fmt.Sprintf(
-							"expect to have regex rule %s for service %s",
-							ruleMeta.Name,
-							serviceName,
-						))
-					}
-					service, pods, err := d.components.GetServiceAndServicePods(serviceName)
-					if err != nil {
-						panic(fmt.Sprintf("expect service %s", serviceName))
-					}
-					ruleGenerator := util.GenerateRegexRule(rule, service, pods)
-					d.ruleBuffer.SetRegexRule(ruleMeta.Name, ruleGenerator)
-				}
+			table := util.GenerateServiceRouteTable(d.components, serviceName)
+			if table == nil && !servicesWithPendingRules[serviceName] {
+				// The service has no rules applied to it.
+				continue
 			}
+			d.ruleBuffer.SetRouteTable(serviceName, table)
 		}
 	}()
 }
 
+// updateGateways regenerates the gateways routing to services whose IPs have changed, including
+// services that are created or deleted. The caller must hold the lock of the rule buffer.
+func (d *Discoverer) updateGateways(previousServiceIPs map[string]string) {
+	currentServiceIPs := d.getServiceIPs()
+	now := time.Now()
+	for name, gateway := range d.components.Gateways {
+		if !gateway.IsActive(now) {
+			// The gateway is sent once it takes effect.
+			continue
+		}
+		for _, route := range gateway.Spec.Routes {
+			previousIP, previousOk := previousServiceIPs[route.ServiceName]
+			currentIP, currentOk := currentServiceIPs[route.ServiceName]
+			if previousOk != currentOk || previousIP != currentIP {
+				d.ruleBuffer.SetGateway(name, util.GenerateGateway(gateway, d.components.Services))
+				break
+			}
+		}
+	}
+}
+
 // checkPods checks whether there are updates on pods and generates corresponding new proxy information.
 // It will also generate a new snapshot of current pods whether there are updates or not.
 func (d *Discoverer) checkPods(pods []*kubeCore.Pod) ([]*core.SandboxInfo, map[string]*kubeCore.Pod) {
@@ -168,64 +274,75 @@ func (d *Discoverer) checkPods(pods []*kubeCore.Pod) ([]*core.SandboxInfo, map[s
 		existentPod, ok := d.components.Pods[pod.Name]
 		if !ok || !reflect.DeepEqual(*existentPod, *pod) {
 			// The pod is a new pod
-			sandboxName := core.GetPodSpecificPauseName(pod)
-			newSandboxInfos = append(newSandboxInfos, &core.SandboxInfo{
-				SandboxName: sandboxName,
-				SandboxIP:   pod.Status.PodIP,
-				HostIP:      pod.Status.HostIP,
-			})
+			newSandboxInfos = append(newSandboxInfos, newSandboxInfo(pod))
 		}
 		currentPods[pod.Name] = pod
 	}
 	return newSandboxInfos, currentPods
 }
 
+// newSandboxInfo returns the information of the sandbox of a pod, for which a proxy is created.
+func newSandboxInfo(pod *kubeCore.Pod) *core.SandboxInfo {
+	return &core.SandboxInfo{
+		SandboxName: core.GetPodSpecificPauseName(pod),
+		SandboxIP:   pod.Status.PodIP,
+		HostIP:      pod.Status.HostIP,
+	}
+}
+
 // checkServices checks whether there are updates on services and records necessary information for generating
 // new rules. It will also generate a new snapshot of current services whether there are updates or not.
 func (d *Discoverer) checkServices(
 	services []*kubeCore.Service,
 	servicePods [][]string,
 	currentPods map[string]*kubeCore.Pod,
-) ([]string, map[string]*kubeCore.Service, map[string]*[]string, map[string]*core.RuleMeta) {
+) ([]string, map[string]*kubeCore.Service, map[string]*[]string, map[string]bool) {
 
 	servicesToUpdateRule := make([]string, 0)
 	currentServices := make(map[string]*kubeCore.Service)
 	currentServiceToPods := make(map[string]*[]string)
+	currentServicePodNames := make(map[string][]string)
 	for i, service := range services {
 		existentService, ok := d.components.Services[service.Name]
 		sort.Strings(servicePods[i])
+		currentServicePodNames[service.Name] = servicePods[i]
+		// Only ready pods are discovered.
+		readyPods := make([]string, 0, len(servicePods[i]))
+		for _, podName := range servicePods[i] {
+			if _, ok := currentPods[podName]; ok {
+				readyPods = append(readyPods, podName)
+			}
+		}
+		servicePods[i] = readyPods
 		if ok {
 			// If the service is different from the previous one, or pods in the service have changed,
-			// then the rule applied to this service (if exists) needs to be updated.
+			// then the route table of this service (if exists) needs to be updated.
 			if !reflect.DeepEqual(*existentService, *service) ||
 				d.checkServicePodsUpdate(service.Name, &servicePods[i], &currentPods) {
 				servicesToUpdateRule = append(servicesToUpdateRule, service.Name)
 			}
 			delete(d.components.Services, service.Name)
+		} else if _, ok := d.components.ServiceToRules[service.Name]; ok {
+			// The rules restored from the store, or kept after the service was deleted, are
+			// waiting for the service.
+			servicesToUpdateRule = append(servicesToUpdateRule, service.Name)
 		}
 		currentServices[service.Name] = service
 		currentServiceToPods[service.Name] = &servicePods[i]
 	}
 
-	// Remove rules for deleted services if exist
-	deletedServiceRuleTypes := make(map[string]*core.RuleMeta)
+	d.servicePodNames = currentServicePodNames
+
+	// Remove the route tables of deleted services, whose rules wait for them to come back.
+	servicesWithPendingRules := make(map[string]bool)
 	for serviceName := range d.components.Services {
-		ruleMeta, ok := d.components.ServiceToRule[serviceName]
-		if ok {
-			switch ruleMeta.Kind {
-			case core.RatioType:
-				deletedServiceRuleTypes[serviceName] = ruleMeta
-				delete(d.components.RatioRules, ruleMeta.Name)
-			case core.RegexType:
-				deletedServiceRuleTypes[serviceName] = ruleMeta
-				delete(d.components.RegexRules, ruleMeta.Name)
-			}
-			delete(d.components.ServiceToRule, serviceName)
+		if _, ok := d.components.ServiceToRules[serviceName]; ok {
+			servicesWithPendingRules[serviceName] = true
 			servicesToUpdateRule = append(servicesToUpdateRule, serviceName)
 		}
 	}
 
-	return servicesToUpdateRule, currentServices, currentServiceToPods, deletedServiceRuleTypes
+	return servicesToUpdateRule, currentServices, currentServiceToPods, servicesWithPendingRules
 }
 
 // checkServicePodsUpdate checks whether the pods in a service need update.
@@ -8,8 +8,9 @@ import (
 	"p9t.io/skafos/pkg/skpilot/buffer"
 )
 
-// Messager informs SkAgent of the rule changes and proxy updates at set interval by reading the
-// buffers and send the data in buffers to SkAgent.
+// Messager informs SkAgent of the rule changes and proxy updates by reading the buffers and
+// sending the data in buffers to SkAgent. Data are sent as soon as they are written into the
+// buffers, and buffers are also probed at set interval to retry failed updates.
 type Messager struct {
 	// buffers are all the buffers from which Messager retrieves data and sends to SkAgent.
 	buffers []buffer.SkBuffer
@@ -28,12 +29,31 @@ func NewMessager(
 	}
 }
 
-// DoProbingAndMessaging probes the buffers and messages SkAgent rule changes and proxy updates.
+// DoProbingAndMessaging messages SkAgent rule changes and proxy updates whenever a buffer
+// changes, and probes the buffers every probeInterval.
 func (m *Messager) DoProbingAndMessaging(probeInterval time.Duration) {
-	for range time.Tick(probeInterval) {
-		for _, buf := range m.buffers {
-			go m.probeAndMessage(buf)
+	var wg sync.WaitGroup
+	wg.Add(len(m.buffers))
+	for _, buf := range m.buffers {
+		go func(buf buffer.SkBuffer) {
+			defer wg.Done()
+			m.messageOnChange(buf, probeInterval)
+		}(buf)
+	}
+	wg.Wait()
+}
+
+// messageOnChange probes buf and messages SkAgent each time buf changes or probeInterval elapses.
+// Changes made while messaging are handled right after it.
+func (m *Messager) messageOnChange(buf buffer.SkBuffer, probeInterval time.Duration) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-buf.Changed():
 		}
+		m.probeAndMessage(buf)
 	}
 }
 
@@ -41,18 +61,19 @@ func (m *Messager) DoProbingAndMessaging(probeInterval time.Duration) {
 // and empty the buffer on success.
 func (m *Messager) probeAndMessage(buf buffer.SkBuffer) {
 	clients := m.agentManager.ListAllAgent()
-	{
-		buf.LockBuffer()
-		var wg sync.WaitGroup
-		wg.Add(len(clients))
-		for addr, cli := range clients {
-			if !buf.IsEmpty(addr) {
-				go buf.AcceptAgent(addr, cli, &wg)
-			} else {
-				wg.Done()
-			}
+	buf.LockBuffer()
+	for addr := range clients {
+		if buf.IsEmpty(addr) {
+			delete(clients, addr)
 		}
-		wg.Wait()
-		buf.UnlockBuffer()
 	}
+	buf.UnlockBuffer()
+
+	// The buffer is not locked while waiting for agents, which may take long.
+	var wg sync.WaitGroup
+	wg.Add(len(clients))
+	for addr, cli := range clients {
+		go buf.AcceptAgent(addr, cli, &wg)
+	}
+	wg.Wait()
 }
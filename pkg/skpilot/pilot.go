@@ -1,24 +1,40 @@
 package skpilot
 
 import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/golang/glog"
 	"p9t.io/skafos/pkg/api/core"
 	"p9t.io/skafos/pkg/skpilot/agent"
 	"p9t.io/skafos/pkg/skpilot/buffer"
 	"p9t.io/skafos/pkg/skpilot/component"
 	"p9t.io/skafos/pkg/skpilot/discover"
 	"p9t.io/skafos/pkg/skpilot/message"
+	"p9t.io/skafos/pkg/skpilot/registry"
+	"p9t.io/skafos/pkg/skpilot/store"
 	"p9t.io/skafos/pkg/skpilot/util"
+	"p9t.io/skafos/pkg/skproxy"
 )
 
 const (
-	discoverInterval = time.Second * 10
-	probeInterval    = time.Second * 8
+	// resyncInterval is how often all pods and services are listed in case any change is
+	// missed by the watch on the registry.
+	resyncInterval = time.Minute * 5
+	probeInterval  = time.Second * 8
+	// maxRouteTestCount is the maximum number of requests simulated in a route test.
+	maxRouteTestCount = 100000
+	// pendingServiceIP stands in for the cluster IP of a service without one when its route
+	// table is checked.
+	pendingServiceIP = "0.0.0.0"
 )
 
 // SkPilot handles user's requests of applying ratio rules and regex rules. It also
-// starts the discoverer, which discovers all the pods and services from Kuberboat, and
+// starts the discoverer, which discovers all the pods and services from the registry, and
 // the messager, which informs SkAgent of the rule changes and proxy updates.
 type SkPilot interface {
 	// ApplyRatioRule handles user's requests of applying a ratio rule. It will write
@@ -27,94 +43,1051 @@ type SkPilot interface {
 	// ApplyRegexRule handles user's requests of applying a regex rule. It will write
 	// the rule to the buffer if it is valid.
 	ApplyRegexRule(rule *core.RegexRule) error
+	// ApplyServiceEntry handles user's requests of registering an external service. It will
+	// write the entry to the buffer if it is valid.
+	ApplyServiceEntry(entry *core.ServiceEntry) error
+	// ApplyGateway handles user's requests of applying gateway routes. It will write
+	// the routes to the buffer if they are valid.
+	ApplyGateway(gateway *core.Gateway) error
+	// ApplyDestinationPolicy handles user's requests of applying a destination policy. It will
+	// write the route table of its service to the buffer if it is valid.
+	ApplyDestinationPolicy(policy *core.DestinationPolicy) error
+	// ApplyRollout handles user's requests of applying a rollout. It will write the route table
+	// of its service to the buffer if it is valid, and drive the rollout from its first step.
+	ApplyRollout(rollout *core.Rollout) error
+	// UpdateRatioRule handles user's requests of updating a ratio rule. It will write the
+	// rule to the buffer if it is valid.
+	UpdateRatioRule(rule *core.RatioRule) error
+	// UpdateRegexRule handles user's requests of updating a regex rule. It will write the
+	// rule to the buffer if it is valid.
+	UpdateRegexRule(rule *core.RegexRule) error
+	// UpdateServiceEntry handles user's requests of updating a service entry. It will write
+	// the entry to the buffer if it is valid.
+	UpdateServiceEntry(entry *core.ServiceEntry) error
+	// UpdateGateway handles user's requests of updating gateway routes. It will write the
+	// routes to the buffer if they are valid.
+	UpdateGateway(gateway *core.Gateway) error
+	// UpdateDestinationPolicy handles user's requests of updating a destination policy. It will
+	// write the route table of its service to the buffer if it is valid.
+	UpdateDestinationPolicy(policy *core.DestinationPolicy) error
+	// UpdateRollout handles user's requests of updating a rollout. It will write the route table
+	// of its service to the buffer if it is valid. The rollout starts over if its spec changes.
+	UpdateRollout(rollout *core.Rollout) error
+	// ControlRollout pauses, resumes or aborts the rollout with the name, and returns the
+	// rollout with its new status.
+	ControlRollout(name string, action core.RolloutAction) (*core.Rollout, error)
+	// DeleteRule deletes the rule, service entry, gateway, destination policy or rollout with
+	// the name, and removes it from all SkAgents through the buffer.
+	DeleteRule(ruleName string) error
+	// GetRule returns the kind and the rule, service entry, gateway, destination policy or
+	// rollout with the name.
+	GetRule(ruleName string) (core.Kind, core.Rule, error)
+	// ListRules returns all the rules, service entries, gateways, destination policies and
+	// rollouts.
+	ListRules() *core.RuleList
+	// DryRunRule checks a rule as if it were applied, or updated if a rule with the same name
+	// exists, against the current services and pods. It returns the generator the rule would
+	// produce, and the generator of the current rule with the same name if any. Nothing is
+	// committed or sent to SkAgents.
+	DryRunRule(rule core.Rule) (interface{}, interface{}, error)
+	// TestRoute simulates the routing of a request to a service as proxies would, with the
+	// rules and endpoints currently held by skpilot.
+	TestRoute(request *core.RouteTestRequest) (*core.RouteTestResult, error)
+	// GetRuleStatus returns the status of the rule, service entry, gateway, destination policy
+	// or rollout with the name: whether the services and pods it refers to are found, and which
+	// SkAgents and proxies run a config carrying it.
+	GetRuleStatus(ruleName string) (*core.RuleStatus, error)
+	// ListSyncStatus returns the config sync status of all SkAgents and their proxies,
+	// sorted by agent address. Evicted SkAgents are not included.
+	ListSyncStatus() []core.AgentSyncStatus
+	// ListAgents returns the status of all SkAgents ever registered, sorted by name.
+	ListAgents() []core.AgentStatus
 }
 
 func NewSkPilot(
-	kubeEndpoint string,
+	registry registry.Registry,
+	ruleStore store.RuleStore,
 	components *component.SkComponents,
 	ruleBuffer *buffer.RuleBuffer,
 	proxyBuffer *buffer.ProxyBuffer,
 	agentManager agent.AgentManager,
 ) SkPilot {
 
+	// Restore rules before discovering, so that rules of services are generated as soon as
+	// the services are discovered.
+	if err := restoreRules(ruleStore, components, ruleBuffer); err != nil {
+		glog.Fatal(err)
+	}
+
 	// Start discoverer
 	discoverer := discover.NewDiscoverer(
-		kubeEndpoint,
+		registry,
 		components,
 		ruleBuffer,
 		proxyBuffer,
 	)
-	go discoverer.DoDiscovering(discoverInterval)
+	go discoverer.DoDiscovering(resyncInterval)
 
 	// Start messager
 	messager := message.NewMessager(ruleBuffer, proxyBuffer, agentManager)
 	go messager.DoProbingAndMessaging(probeInterval)
 
-	return &skPilotInner{
-		components: components,
-		ruleBuffer: ruleBuffer,
+	pilot := &skPilotInner{
+		ruleStore:        ruleStore,
+		components:       components,
+		ruleBuffer:       ruleBuffer,
+		agentManager:     agentManager,
+		rolloutBaselines: map[string]*rolloutBaseline{},
 	}
+
+	// Start driving rollouts
+	go pilot.doRollouts(rolloutInterval)
+
+	// Start activating and expiring rules on schedule
+	go pilot.doScheduling(scheduleInterval)
+
+	return pilot
 }
 
 type skPilotInner struct {
+	// ruleStore persists all the rules applied.
+	ruleStore store.RuleStore
 	// components stores metadata of all pods, services and rules.
 	components *component.SkComponents
 	// ruleBuffer is the buffer where rules to update are stored.
 	ruleBuffer *buffer.RuleBuffer
+	// agentManager contains information of all SkAgents.
+	agentManager agent.AgentManager
+	// rolloutBaselines maps the name of a running rollout to the baseline of its current step.
+	// It is only accessed by the goroutine driving rollouts.
+	rolloutBaselines map[string]*rolloutBaseline
+	// lastScheduled is when rules were last activated and expired on schedule. It is protected
+	// by the lock of components.
+	lastScheduled time.Time
 }
 
 func (sp *skPilotInner) ApplyRatioRule(rule *core.RatioRule) error {
 	sp.components.Mtx.Lock()
 	defer sp.components.Mtx.Unlock()
 
-	if err := sp.components.CheckRule(rule.Name, rule.Spec.ServiceName); err != nil {
+	if err := sp.components.CheckRuleName(rule.Name); err != nil {
 		return err
 	}
+	if err := sp.components.CheckRatioRuleConflicts(rule); err != nil {
+		return err
+	}
+	return sp.setRatioRule(rule)
+}
 
-	service, servicePods, err := sp.components.GetServiceAndServicePods(rule.Spec.ServiceName)
-	if err != nil {
+func (sp *skPilotInner) UpdateRatioRule(rule *core.RatioRule) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(rule.Name, core.RatioType); err != nil {
 		return err
 	}
+	if err := sp.components.CheckRatioRuleConflicts(rule); err != nil {
+		return err
+	}
+	return sp.setRatioRule(rule)
+}
 
-	// Add the rule
-	ruleGenerator := util.GenerateRatioRule(rule, service, servicePods)
+// setRatioRule persists a checked ratio rule and writes the route table of its service to the
+// buffer, replacing the rule with the same name if exists. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) setRatioRule(rule *core.RatioRule) error {
+	if err := sp.checkSchedule(&rule.RuleMeta, time.Now()); err != nil {
+		return err
+	}
+	if _, _, err := sp.components.GetServiceAndServicePods(rule.Spec.ServiceName); err != nil {
+		return err
+	}
+	if err := sp.components.CheckSubsets(rule.Spec.ServiceName, ratioRuleSubsets(rule)); err != nil {
+		return err
+	}
+	if _, err := sp.checkGenerator(rule); err != nil {
+		return err
+	}
+
+	if err := sp.ruleStore.Put(core.RatioType, rule.Name, rule); err != nil {
+		return err
+	}
+
+	// Update metadata
+	serviceNames := []string{rule.Spec.ServiceName}
+	if previousRule, ok := sp.components.RatioRules[rule.Name]; ok {
+		sp.components.RemoveServiceRule(previousRule.Spec.ServiceName, rule.Name)
+		if previousRule.Spec.ServiceName != rule.Spec.ServiceName {
+			serviceNames = append(serviceNames, previousRule.Spec.ServiceName)
+		}
+	}
+	sp.components.RatioRules[rule.Name] = rule
+	sp.components.AddServiceRule(rule.Spec.ServiceName, &rule.RuleMeta)
+
+	// Update the route tables
+	sp.updateRouteTables(serviceNames)
+
+	return nil
+}
+
+func (sp *skPilotInner) ApplyRegexRule(rule *core.RegexRule) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleName(rule.Name); err != nil {
+		return err
+	}
+	if err := sp.components.CheckRegexRuleConflicts(rule); err != nil {
+		return err
+	}
+	return sp.setRegexRule(rule)
+}
+
+func (sp *skPilotInner) UpdateRegexRule(rule *core.RegexRule) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(rule.Name, core.RegexType); err != nil {
+		return err
+	}
+	if err := sp.components.CheckRegexRuleConflicts(rule); err != nil {
+		return err
+	}
+	return sp.setRegexRule(rule)
+}
+
+// setRegexRule persists a checked regex rule and writes the route table of its service to the
+// buffer, replacing the rule with the same name if exists. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) setRegexRule(rule *core.RegexRule) error {
+	if err := sp.checkSchedule(&rule.RuleMeta, time.Now()); err != nil {
+		return err
+	}
+	if _, _, err := sp.components.GetServiceAndServicePods(rule.Spec.ServiceName); err != nil {
+		return err
+	}
+	if err := sp.components.CheckSubsets(rule.Spec.ServiceName, regexRuleSubsets(rule)); err != nil {
+		return err
+	}
+	if _, err := sp.checkGenerator(rule); err != nil {
+		return err
+	}
+
+	if err := sp.ruleStore.Put(core.RegexType, rule.Name, rule); err != nil {
+		return err
+	}
+
+	// Update metadata
+	serviceNames := []string{rule.Spec.ServiceName}
+	if previousRule, ok := sp.components.RegexRules[rule.Name]; ok {
+		sp.components.RemoveServiceRule(previousRule.Spec.ServiceName, rule.Name)
+		if previousRule.Spec.ServiceName != rule.Spec.ServiceName {
+			serviceNames = append(serviceNames, previousRule.Spec.ServiceName)
+		}
+	}
+	sp.components.RegexRules[rule.Name] = rule
+	sp.components.AddServiceRule(rule.Spec.ServiceName, &rule.RuleMeta)
+
+	// Update the route tables
+	sp.updateRouteTables(serviceNames)
+
+	return nil
+}
+
+// ratioRuleSubsets returns the subsets a ratio rule refers to.
+func ratioRuleSubsets(rule *core.RatioRule) []component.SubsetReference {
+	if rule.Spec.Subset == "" {
+		return nil
+	}
+	return []component.SubsetReference{{Field: "spec.subset", Subset: rule.Spec.Subset}}
+}
+
+// regexRuleSubsets returns the subsets the matchers of a regex rule refer to.
+func regexRuleSubsets(rule *core.RegexRule) []component.SubsetReference {
+	subsets := make([]component.SubsetReference, 0)
+	for i, matcher := range rule.Spec.Matchers {
+		if matcher.Subset != "" {
+			subsets = append(subsets, component.SubsetReference{
+				Field:  fmt.Sprintf("spec.matchers[%d].subset", i),
+				Subset: matcher.Subset,
+			})
+		}
+	}
+	return subsets
+}
+
+func (sp *skPilotInner) ApplyDestinationPolicy(policy *core.DestinationPolicy) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleName(policy.Name); err != nil {
+		return err
+	}
+	if err := sp.components.CheckDestinationPolicyConflicts(policy); err != nil {
+		return err
+	}
+	return sp.setDestinationPolicy(policy)
+}
+
+func (sp *skPilotInner) UpdateDestinationPolicy(policy *core.DestinationPolicy) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(policy.Name, core.DestinationPolicyType); err != nil {
+		return err
+	}
+	if err := sp.components.CheckDestinationPolicyConflicts(policy); err != nil {
+		return err
+	}
+	return sp.setDestinationPolicy(policy)
+}
+
+// setDestinationPolicy persists a checked destination policy and writes the route table of its
+// service to the buffer, replacing the policy with the same name if exists. The caller must
+// hold the lock of components.
+func (sp *skPilotInner) setDestinationPolicy(policy *core.DestinationPolicy) error {
+	if err := sp.checkSchedule(&policy.RuleMeta, time.Now()); err != nil {
+		return err
+	}
+	if err := sp.checkDestinationPolicy(policy); err != nil {
+		return err
+	}
+	if _, err := sp.checkGenerator(policy); err != nil {
+		return err
+	}
+
+	if err := sp.ruleStore.Put(core.DestinationPolicyType, policy.Name, policy); err != nil {
+		return err
+	}
+
+	// Update metadata
+	serviceNames := []string{policy.Spec.ServiceName}
+	if previousPolicy, ok := sp.components.DestinationPolicies[policy.Name]; ok {
+		sp.components.RemoveServiceRule(previousPolicy.Spec.ServiceName, policy.Name)
+		if previousPolicy.Spec.ServiceName != policy.Spec.ServiceName {
+			serviceNames = append(serviceNames, previousPolicy.Spec.ServiceName)
+		}
+	}
+	sp.components.DestinationPolicies[policy.Name] = policy
+	sp.components.AddServiceRule(policy.Spec.ServiceName, &policy.RuleMeta)
+
+	// Update the route tables
+	sp.updateRouteTables(serviceNames)
+
+	return nil
+}
+
+// checkDestinationPolicy checks whether the service of a destination policy exists, and whether
+// the subsets referred to by rules are still defined after the policy replaces the one with the
+// same name. A destination policy cannot be scheduled, since rules referring to its subsets
+// would select no pods while it is not in effect. The caller must hold the lock of components.
+func (sp *skPilotInner) checkDestinationPolicy(policy *core.DestinationPolicy) error {
+	if err := checkUnscheduled(&policy.RuleMeta); err != nil {
+		return err
+	}
+	if _, _, err := sp.components.GetServiceAndServicePods(policy.Spec.ServiceName); err != nil {
+		return err
+	}
+	if previousPolicy, ok := sp.components.DestinationPolicies[policy.Name]; ok &&
+		previousPolicy.Spec.ServiceName != policy.Spec.ServiceName {
+		if err := sp.components.CheckSubsetReferences(previousPolicy.Spec.ServiceName, nil); err != nil {
+			return err
+		}
+	}
+	return sp.components.CheckSubsetReferences(policy.Spec.ServiceName, policy)
+}
+
+// updateRouteTables regenerates the route tables of the services from the rules applied to
+// them and writes them to the buffer. The caller must hold the lock of components.
+func (sp *skPilotInner) updateRouteTables(serviceNames []string) {
+	sp.ruleBuffer.LockBuffer()
+	defer sp.ruleBuffer.UnlockBuffer()
+	for _, serviceName := range serviceNames {
+		sp.ruleBuffer.SetRouteTable(serviceName, util.GenerateServiceRouteTable(sp.components, serviceName))
+	}
+}
+
+func (sp *skPilotInner) ApplyServiceEntry(entry *core.ServiceEntry) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleName(entry.Name); err != nil {
+		return err
+	}
+	return sp.setServiceEntry(entry)
+}
+
+func (sp *skPilotInner) UpdateServiceEntry(entry *core.ServiceEntry) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(entry.Name, core.ServiceEntryType); err != nil {
+		return err
+	}
+	return sp.setServiceEntry(entry)
+}
+
+// setServiceEntry persists a checked service entry and writes it to the buffer, replacing the
+// entry with the same name if exists. The caller must hold the lock of components.
+func (sp *skPilotInner) setServiceEntry(entry *core.ServiceEntry) error {
+	now := time.Now()
+	if err := sp.checkSchedule(&entry.RuleMeta, now); err != nil {
+		return err
+	}
+	if _, err := sp.checkGenerator(entry); err != nil {
+		return err
+	}
+
+	if err := sp.ruleStore.Put(core.ServiceEntryType, entry.Name, entry); err != nil {
+		return err
+	}
+
+	// Add the entry, which is removed if it is not in effect yet.
+	entryGenerator := util.GenerateActiveServiceEntry(entry, now)
 	{
 		sp.ruleBuffer.LockBuffer()
-		sp.ruleBuffer.SetRatioRule(rule.Name, ruleGenerator)
+		sp.ruleBuffer.SetServiceEntry(entry.Name, entryGenerator)
 		sp.ruleBuffer.UnlockBuffer()
 	}
 
 	// Update metadata
-	sp.components.RatioRules[rule.Name] = rule
-	sp.components.ServiceToRule[rule.Spec.ServiceName] = &rule.RuleMeta
+	sp.components.ServiceEntries[entry.Name] = entry
 
 	return nil
 }
 
-func (sp *skPilotInner) ApplyRegexRule(rule *core.RegexRule) error {
+func (sp *skPilotInner) ApplyGateway(gateway *core.Gateway) error {
 	sp.components.Mtx.Lock()
 	defer sp.components.Mtx.Unlock()
 
-	if err := sp.components.CheckRule(rule.Name, rule.Spec.ServiceName); err != nil {
+	if err := sp.components.CheckRuleName(gateway.Name); err != nil {
 		return err
 	}
+	return sp.setGateway(gateway)
+}
 
-	service, servicePods, err := sp.components.GetServiceAndServicePods(rule.Spec.ServiceName)
-	if err != nil {
+func (sp *skPilotInner) UpdateGateway(gateway *core.Gateway) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(gateway.Name, core.GatewayType); err != nil {
+		return err
+	}
+	return sp.setGateway(gateway)
+}
+
+// setGateway persists a checked gateway and writes it to the buffer, replacing the gateway
+// with the same name if exists. The caller must hold the lock of components.
+func (sp *skPilotInner) setGateway(gateway *core.Gateway) error {
+	now := time.Now()
+	if err := sp.checkSchedule(&gateway.RuleMeta, now); err != nil {
+		return err
+	}
+	if err := sp.checkGatewayRoutes(gateway); err != nil {
+		return err
+	}
+	if _, err := sp.checkGenerator(gateway); err != nil {
+		return err
+	}
+
+	if err := sp.ruleStore.Put(core.GatewayType, gateway.Name, gateway); err != nil {
 		return err
 	}
 
-	// Add the rule
-	ruleGenerator := util.GenerateRegexRule(rule, service, servicePods)
+	// Add the gateway, which is removed if it is not in effect yet.
+	gatewayGenerator := util.GenerateActiveGateway(gateway, sp.components.Services, now)
 	{
 		sp.ruleBuffer.LockBuffer()
-		sp.ruleBuffer.SetRegexRule(rule.Name, ruleGenerator)
+		sp.ruleBuffer.SetGateway(gateway.Name, gatewayGenerator)
 		sp.ruleBuffer.UnlockBuffer()
 	}
 
 	// Update metadata
-	sp.components.RegexRules[rule.Name] = rule
-	sp.components.ServiceToRule[rule.Spec.ServiceName] = &rule.RuleMeta
+	sp.components.Gateways[gateway.Name] = gateway
+
+	return nil
+}
+
+// checkGatewayRoutes checks whether all the services a gateway routes to exist. The caller
+// must hold the lock of components.
+func (sp *skPilotInner) checkGatewayRoutes(gateway *core.Gateway) error {
+	for i, route := range gateway.Spec.Routes {
+		if _, ok := sp.components.Services[route.ServiceName]; !ok {
+			return core.NewError(
+				core.ErrorReasonNotFound,
+				fmt.Sprintf("spec.routes[%d].serviceName", i),
+				route.ServiceName,
+				"no such service: %s",
+				route.ServiceName,
+			)
+		}
+	}
+	return nil
+}
+
+func (sp *skPilotInner) DryRunRule(rule core.Rule) (interface{}, interface{}, error) {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	ruleName := rule.GetRuleMeta().Name
+	_, err := sp.components.GetRuleKind(ruleName)
+	exists := err == nil
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		if exists {
+			err = sp.components.CheckRuleKind(ruleName, core.RatioType)
+		} else {
+			err = sp.components.CheckRuleName(ruleName)
+		}
+		if err == nil {
+			err = sp.components.CheckRatioRuleConflicts(rule)
+		}
+		if err == nil {
+			err = sp.components.CheckSubsets(rule.Spec.ServiceName, ratioRuleSubsets(rule))
+		}
+	case *core.RegexRule:
+		if exists {
+			err = sp.components.CheckRuleKind(ruleName, core.RegexType)
+		} else {
+			err = sp.components.CheckRuleName(ruleName)
+		}
+		if err == nil {
+			err = sp.components.CheckRegexRuleConflicts(rule)
+		}
+		if err == nil {
+			err = sp.components.CheckSubsets(rule.Spec.ServiceName, regexRuleSubsets(rule))
+		}
+	case *core.ServiceEntry:
+		if exists {
+			err = sp.components.CheckRuleKind(ruleName, core.ServiceEntryType)
+		} else {
+			err = sp.components.CheckRuleName(ruleName)
+		}
+	case *core.Gateway:
+		if exists {
+			err = sp.components.CheckRuleKind(ruleName, core.GatewayType)
+		} else {
+			err = sp.components.CheckRuleName(ruleName)
+		}
+	case *core.DestinationPolicy:
+		if exists {
+			err = sp.components.CheckRuleKind(ruleName, core.DestinationPolicyType)
+		} else {
+			err = sp.components.CheckRuleName(ruleName)
+		}
+		if err == nil {
+			err = sp.components.CheckDestinationPolicyConflicts(rule)
+		}
+		if err == nil {
+			err = sp.checkDestinationPolicy(rule)
+		}
+	case *core.Rollout:
+		if exists {
+			err = sp.components.CheckRuleKind(ruleName, core.RolloutType)
+		} else {
+			err = sp.components.CheckRuleName(ruleName)
+		}
+		if err == nil {
+			err = sp.components.CheckRolloutConflicts(rule)
+		}
+		if err == nil {
+			err = sp.checkRollout(rule)
+		}
+	}
+	if err == nil {
+		err = sp.checkSchedule(rule.GetRuleMeta(), time.Now())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	generator, err := sp.checkGenerator(rule)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var currentGenerator interface{}
+	if exists {
+		_, currentRule, err := sp.getRule(ruleName)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The current rule may be waiting for its service, in which case it generates nothing.
+		currentGenerator, _ = sp.generateRule(currentRule)
+	}
+	return generator, currentGenerator, nil
+}
+
+// checkGenerator generates the generator of a checked rule and validates it as proxies would,
+// so that a rule rejected by proxies is never persisted. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) checkGenerator(rule core.Rule) (interface{}, error) {
+	generator, err := sp.generateRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	switch g := generator.(type) {
+	case *skproxy.RouteTableGenerator:
+		// A service without a cluster IP has no route table until it gets one, but the rules
+		// applied to it are checked all the same.
+		table := *g
+		if table.ServiceIP == "" {
+			table.ServiceIP = pendingServiceIP
+		}
+		_, err = table.GenerateRule()
+	case skproxy.ProxyRuleGenerator:
+		_, err = g.GenerateRule()
+	case *skproxy.GatewayGenerator:
+		err = g.Validate()
+	}
+	if err != nil {
+		return nil, core.NewError(core.ErrorReasonInvalid, "", "", "rejected by proxies: %v", err)
+	}
+	return generator, nil
+}
+
+// generateRule generates the generator of a rule from the current services and pods, which is
+// the route table of its service for a ratio rule, a regex rule, a destination policy or a
+// rollout. The caller must hold the lock of components.
+func (sp *skPilotInner) generateRule(rule core.Rule) (interface{}, error) {
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		return sp.generateRouteTableWith(rule.Spec.ServiceName, rule)
+	case *core.RegexRule:
+		return sp.generateRouteTableWith(rule.Spec.ServiceName, rule)
+	case *core.DestinationPolicy:
+		return sp.generateRouteTableWith(rule.Spec.ServiceName, rule)
+	case *core.Rollout:
+		// The rollout routes requests by the status it would have.
+		rollout := *rule
+		rollout.Status = sp.rolloutStatus(rule, time.Now())
+		return sp.generateRouteTableWith(rule.Spec.ServiceName, &rollout)
+	case *core.ServiceEntry:
+		return util.GenerateServiceEntry(rule), nil
+	case *core.Gateway:
+		if err := sp.checkGatewayRoutes(rule); err != nil {
+			return nil, err
+		}
+		return util.GenerateGateway(rule, sp.components.Services), nil
+	default:
+		return nil, fmt.Errorf("unknown rule %v", rule)
+	}
+}
+
+func (sp *skPilotInner) TestRoute(request *core.RouteTestRequest) (*core.RouteTestResult, error) {
+	if request.Count <= 0 || request.Count > maxRouteTestCount {
+		return nil, core.NewError(
+			core.ErrorReasonInvalid,
+			"count",
+			strconv.Itoa(request.Count),
+			"count must be between 1 and %d",
+			maxRouteTestCount,
+		)
+	}
+	if !strings.HasPrefix(request.Path, "/") {
+		return nil, core.NewError(core.ErrorReasonInvalid, "path", request.Path, "path must start with /: %q", request.Path)
+	}
+
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	service, ok := sp.components.Services[request.Service]
+	if !ok {
+		return nil, core.NewError(core.ErrorReasonNotFound, "service", request.Service, "no such service: %s", request.Service)
+	}
+	port := request.Port
+	if port == 0 {
+		if len(service.Spec.Ports) == 0 {
+			return nil, core.NewError(core.ErrorReasonNotFound, "port", "", "service %s has no ports", request.Service)
+		}
+		port = service.Spec.Ports[0].Port
+	} else {
+		found := false
+		for _, p := range service.Spec.Ports {
+			if p.Port == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, core.NewError(
+				core.ErrorReasonNotFound,
+				"port",
+				strconv.Itoa(int(port)),
+				"service %s has no port %d",
+				request.Service,
+				port,
+			)
+		}
+	}
+	host := service.Spec.ClusterIP
+
+	// Evaluate the request with the same rule manager as proxies, loaded with the config all
+	// proxies will eventually run.
+	sp.ruleBuffer.LockBuffer()
+	config := sp.ruleBuffer.DesiredConfig()
+	sp.ruleBuffer.UnlockBuffer()
+	manager := skproxy.NewProxyRuleManager()
+	if err := manager.ApplyConfig(&config); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(request.Method, fmt.Sprintf("http://%s:%d%s", host, port, request.Path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range request.Headers {
+		req.Header.Set(k, v)
+	}
+
+	result := &core.RouteTestResult{
+		Host: host,
+		Port: port,
+	}
+	splits := map[core.RouteTestSplit]int{}
+	for i := 0; i < request.Count; i++ {
+		route, err := manager.GetRoute(req, host, port)
+		if err != nil {
+			return nil, err
+		}
+		splits[core.RouteTestSplit{Rule: route.RuleName, Cluster: route.Cluster, Address: route.Address}]++
+	}
+	kinds := map[string]core.Kind{}
+	for split, requests := range splits {
+		split.Requests = requests
+		if split.Rule != "" {
+			kind, ok := kinds[split.Rule]
+			if !ok {
+				if kind, err = sp.components.GetRuleKind(split.Rule); err != nil {
+					return nil, err
+				}
+				kinds[split.Rule] = kind
+			}
+			split.Kind = kind
+		}
+		result.Splits = append(result.Splits, split)
+	}
+	sort.Slice(result.Splits, func(i, j int) bool {
+		if result.Splits[i].Rule != result.Splits[j].Rule {
+			return result.Splits[i].Rule < result.Splits[j].Rule
+		}
+		if result.Splits[i].Cluster != result.Splits[j].Cluster {
+			return result.Splits[i].Cluster < result.Splits[j].Cluster
+		}
+		return result.Splits[i].Address < result.Splits[j].Address
+	})
+
+	result.Rule, result.Kind = decidingRule(result.Splits)
+	if result.Rule == "" {
+		return result, nil
+	}
+	// Ratio and regex rules are merged into the route table named after the service, whose
+	// matcher clusters follow the order of the matchers of its regex rules sorted by name.
+	proxyRuleNames := map[string]bool{}
+	var matchers []core.Matcher
+	for rule, kind := range kinds {
+		if kind != core.RatioType && kind != core.RegexType && kind != core.RolloutType {
+			proxyRuleNames[rule] = true
+			continue
+		}
+		proxyRuleNames[request.Service] = true
+		if matchers == nil {
+			matchers = make([]core.Matcher, 0)
+			_, regexRules := sp.components.GetActiveServiceRules(request.Service, time.Now())
+			for _, regexRule := range regexRules {
+				matchers = append(matchers, regexRule.Spec.Matchers...)
+			}
+		}
+	}
+	for _, rc := range manager.ListClusters() {
+		if !proxyRuleNames[rc.Rule] {
+			continue
+		}
+		for _, c := range rc.Clusters {
+			cluster := core.RouteTestCluster{
+				Name:        c.Name,
+				Rule:        c.Rule,
+				Hosts:       c.Hosts,
+				PortMapping: c.PortMapping,
+			}
+			if cluster.Rule == "" {
+				cluster.Rule = rc.Rule
+			}
+			var i int
+			if _, err := fmt.Sscanf(c.Name, "matcher-%d", &i); err == nil && i < len(matchers) {
+				cluster.Matcher = &matchers[i]
+			}
+			result.Clusters = append(result.Clusters, cluster)
+		}
+	}
+	return result, nil
+}
+
+// decidingRule returns the rule and its kind deciding where the simulated requests go, which is
+// the regex rule whose matcher the requests match, or otherwise the rule splitting them by
+// ratio. It returns an empty name if no rule is matched. splits must be sorted.
+func decidingRule(splits []core.RouteTestSplit) (string, core.Kind) {
+	for _, split := range splits {
+		if strings.HasPrefix(split.Cluster, "matcher-") {
+			return split.Rule, split.Kind
+		}
+	}
+	for _, split := range splits {
+		if split.Rule != "" {
+			return split.Rule, split.Kind
+		}
+	}
+	return "", ""
+}
+
+// generateRouteTableWith generates the route table of a service as if the ratio rule, regex rule,
+// destination policy or rollout were applied to it and in effect, replacing the one with the same
+// name if exists. Other rules not in effect are left out. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) generateRouteTableWith(serviceName string, rule core.Rule) (*skproxy.RouteTableGenerator, error) {
+	service, servicePods, err := sp.components.GetServiceAndServicePods(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	ruleName := rule.GetRuleMeta().Name
+	now := time.Now()
+	ratioRule, regexRules := sp.components.GetActiveServiceRules(serviceName, now)
+	if ratioRule != nil && ratioRule.Name == ruleName {
+		ratioRule = nil
+	}
+	policy := sp.components.GetActiveDestinationPolicy(serviceName, now)
+	otherRegexRules := make([]*core.RegexRule, 0, len(regexRules)+1)
+	for _, regexRule := range regexRules {
+		if regexRule.Name != ruleName {
+			otherRegexRules = append(otherRegexRules, regexRule)
+		}
+	}
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		ratioRule = rule
+	case *core.RegexRule:
+		otherRegexRules = append(otherRegexRules, rule)
+		sort.Slice(otherRegexRules, func(i, j int) bool {
+			return otherRegexRules[i].Name < otherRegexRules[j].Name
+		})
+	case *core.DestinationPolicy:
+		policy = rule
+	case *core.Rollout:
+		ratioRule = rule.RatioRule()
+	}
+	return util.GenerateRouteTable(service, ratioRule, otherRegexRules, policy, servicePods), nil
+}
+
+func (sp *skPilotInner) DeleteRule(ruleName string) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	kind, err := sp.components.GetRuleKind(ruleName)
+	if err != nil {
+		return err
+	}
+	if kind == core.DestinationPolicyType {
+		serviceName := sp.components.DestinationPolicies[ruleName].Spec.ServiceName
+		if err := sp.components.CheckSubsetReferences(serviceName, nil); err != nil {
+			return err
+		}
+	}
+	return sp.deleteRule(kind, ruleName)
+}
+
+// deleteRule deletes the rule of kind with the name from the store, components and all SkAgents.
+// The caller must hold the lock of components.
+func (sp *skPilotInner) deleteRule(kind core.Kind, ruleName string) error {
+	if err := sp.ruleStore.Delete(kind, ruleName); err != nil {
+		return err
+	}
+
+	// Remove the rule from agents by nil generators or regenerated route tables, and update
+	// metadata.
+	sp.ruleBuffer.LockBuffer()
+	defer sp.ruleBuffer.UnlockBuffer()
+	switch kind {
+	case core.RatioType:
+		serviceName := sp.components.RatioRules[ruleName].Spec.ServiceName
+		sp.components.RemoveServiceRule(serviceName, ruleName)
+		delete(sp.components.RatioRules, ruleName)
+		sp.ruleBuffer.SetRouteTable(serviceName, util.GenerateServiceRouteTable(sp.components, serviceName))
+	case core.RegexType:
+		serviceName := sp.components.RegexRules[ruleName].Spec.ServiceName
+		sp.components.RemoveServiceRule(serviceName, ruleName)
+		delete(sp.components.RegexRules, ruleName)
+		sp.ruleBuffer.SetRouteTable(serviceName, util.GenerateServiceRouteTable(sp.components, serviceName))
+	case core.ServiceEntryType:
+		delete(sp.components.ServiceEntries, ruleName)
+		sp.ruleBuffer.SetServiceEntry(ruleName, nil)
+	case core.GatewayType:
+		delete(sp.components.Gateways, ruleName)
+		sp.ruleBuffer.SetGateway(ruleName, nil)
+	case core.DestinationPolicyType:
+		serviceName := sp.components.DestinationPolicies[ruleName].Spec.ServiceName
+		sp.components.RemoveServiceRule(serviceName, ruleName)
+		delete(sp.components.DestinationPolicies, ruleName)
+		sp.ruleBuffer.SetRouteTable(serviceName, util.GenerateServiceRouteTable(sp.components, serviceName))
+	case core.RolloutType:
+		serviceName := sp.components.Rollouts[ruleName].Spec.ServiceName
+		sp.components.RemoveServiceRule(serviceName, ruleName)
+		delete(sp.components.Rollouts, ruleName)
+		sp.ruleBuffer.SetRouteTable(serviceName, util.GenerateServiceRouteTable(sp.components, serviceName))
+	}
+
+	return nil
+}
+
+func (sp *skPilotInner) GetRule(ruleName string) (core.Kind, core.Rule, error) {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+	return sp.getRule(ruleName)
+}
 
+// getRule returns the kind and the rule, service entry, gateway, destination policy or rollout
+// with the name. The caller must hold the lock of components.
+func (sp *skPilotInner) getRule(ruleName string) (core.Kind, core.Rule, error) {
+	kind, err := sp.components.GetRuleKind(ruleName)
+	if err != nil {
+		return "", nil, err
+	}
+	switch kind {
+	case core.RatioType:
+		return kind, sp.components.RatioRules[ruleName], nil
+	case core.RegexType:
+		return kind, sp.components.RegexRules[ruleName], nil
+	case core.ServiceEntryType:
+		return kind, sp.components.ServiceEntries[ruleName], nil
+	case core.DestinationPolicyType:
+		return kind, sp.components.DestinationPolicies[ruleName], nil
+	case core.RolloutType:
+		return kind, sp.components.Rollouts[ruleName], nil
+	default:
+		return kind, sp.components.Gateways[ruleName], nil
+	}
+}
+
+func (sp *skPilotInner) ListRules() *core.RuleList {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+	return sp.listRules()
+}
+
+// listRules returns all the rules, each kind sorted by name. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) listRules() *core.RuleList {
+	rules := &core.RuleList{}
+	for _, rule := range sp.components.RatioRules {
+		rules.RatioRules = append(rules.RatioRules, rule)
+	}
+	sort.Slice(rules.RatioRules, func(i, j int) bool {
+		return rules.RatioRules[i].Name < rules.RatioRules[j].Name
+	})
+	for _, rule := range sp.components.RegexRules {
+		rules.RegexRules = append(rules.RegexRules, rule)
+	}
+	sort.Slice(rules.RegexRules, func(i, j int) bool {
+		return rules.RegexRules[i].Name < rules.RegexRules[j].Name
+	})
+	for _, entry := range sp.components.ServiceEntries {
+		rules.ServiceEntries = append(rules.ServiceEntries, entry)
+	}
+	sort.Slice(rules.ServiceEntries, func(i, j int) bool {
+		return rules.ServiceEntries[i].Name < rules.ServiceEntries[j].Name
+	})
+	for _, gateway := range sp.components.Gateways {
+		rules.Gateways = append(rules.Gateways, gateway)
+	}
+	sort.Slice(rules.Gateways, func(i, j int) bool {
+		return rules.Gateways[i].Name < rules.Gateways[j].Name
+	})
+	for _, policy := range sp.components.DestinationPolicies {
+		rules.DestinationPolicies = append(rules.DestinationPolicies, policy)
+	}
+	sort.Slice(rules.DestinationPolicies, func(i, j int) bool {
+		return rules.DestinationPolicies[i].Name < rules.DestinationPolicies[j].Name
+	})
+	for _, rollout := range sp.components.Rollouts {
+		rules.Rollouts = append(rules.Rollouts, rollout)
+	}
+	sort.Slice(rules.Rollouts, func(i, j int) bool {
+		return rules.Rollouts[i].Name < rules.Rollouts[j].Name
+	})
+	return rules
+}
+
+func (sp *skPilotInner) ListSyncStatus() []core.AgentSyncStatus {
+	agents := sp.agentManager.ListAgents()
+	ret := make([]core.AgentSyncStatus, 0, len(agents))
+	for _, agent := range agents {
+		if agent.State != core.AgentRemoved {
+			ret = append(ret, sp.ruleBuffer.GetSyncStatus(agent.Name))
+		}
+	}
+	return ret
+}
+
+func (sp *skPilotInner) ListAgents() []core.AgentStatus {
+	return sp.agentManager.ListAgents()
+}
+
+// restoreRules loads all the rules from the store into components. Service entries and gateways
+// are written into the rule buffer at once, while the route table of a service, which includes
+// its destination policy and rollout, is generated by the discoverer when the service is
+// discovered. Rollouts resume from their persisted status. Rules not in effect yet are written
+// once they take effect, and expired rules are deleted on schedule.
+func restoreRules(
+	ruleStore store.RuleStore,
+	components *component.SkComponents,
+	ruleBuffer *buffer.RuleBuffer,
+) error {
+	rules, err := ruleStore.Load()
+	if err != nil {
+		return err
+	}
+
+	components.Mtx.Lock()
+	defer components.Mtx.Unlock()
+	ruleBuffer.LockBuffer()
+	defer ruleBuffer.UnlockBuffer()
+
+	now := time.Now()
+	for _, rule := range rules.RatioRules {
+		components.RatioRules[rule.Name] = rule
+		components.AddServiceRule(rule.Spec.ServiceName, &rule.RuleMeta)
+	}
+	for _, rule := range rules.RegexRules {
+		components.RegexRules[rule.Name] = rule
+		components.AddServiceRule(rule.Spec.ServiceName, &rule.RuleMeta)
+	}
+	for _, entry := range rules.ServiceEntries {
+		components.ServiceEntries[entry.Name] = entry
+		if entry.IsActive(now) {
+			ruleBuffer.SetServiceEntry(entry.Name, util.GenerateServiceEntry(entry))
+		}
+	}
+	for _, gateway := range rules.Gateways {
+		components.Gateways[gateway.Name] = gateway
+		if gateway.IsActive(now) {
+			ruleBuffer.SetGateway(gateway.Name, util.GenerateGateway(gateway, components.Services))
+		}
+	}
+	for _, policy := range rules.DestinationPolicies {
+		components.DestinationPolicies[policy.Name] = policy
+		components.AddServiceRule(policy.Spec.ServiceName, &policy.RuleMeta)
+	}
+	for _, rollout := range rules.Rollouts {
+		components.Rollouts[rollout.Name] = rollout
+		components.AddServiceRule(rollout.Spec.ServiceName, &rollout.RuleMeta)
+	}
+	glog.Infof(
+		"restored %d ratio rules, %d regex rules, %d service entries, %d gateways, %d destination policies and %d rollouts",
+		len(rules.RatioRules),
+		len(rules.RegexRules),
+		len(rules.ServiceEntries),
+		len(rules.Gateways),
+		len(rules.DestinationPolicies),
+		len(rules.Rollouts),
+	)
 	return nil
 }
@@ -0,0 +1,173 @@
+package skpilot
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skpilot/agent"
+	"p9t.io/skafos/pkg/skpilot/buffer"
+	"p9t.io/skafos/pkg/skpilot/component"
+	"p9t.io/skafos/pkg/skpilot/registry"
+	"p9t.io/skafos/pkg/skpilot/store"
+)
+
+// newFileRegistryPilot runs skpilot on the example registry file, and waits until the service
+// and the pods in the file are discovered.
+func newFileRegistryPilot(t *testing.T) (SkPilot, *buffer.RuleBuffer) {
+	reg, err := registry.NewFileRegistry("../../test/examples/registry.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleStore, err := store.NewFileStore(filepath.Join(t.TempDir(), "rules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	components := component.NewSkComponents()
+	ruleBuffer := buffer.NewRuleBuffer()
+	proxyBuffer := buffer.NewProxyBuffer()
+	agentManager := agent.NewAgentManager(components, ruleBuffer, proxyBuffer)
+	sp := NewSkPilot(reg, ruleStore, components, ruleBuffer, proxyBuffer, agentManager)
+
+	// Every object in the file is watched as added at once.
+	discovered := func() bool {
+		components.Mtx.Lock()
+		defer components.Mtx.Unlock()
+		pods, ok := components.ServicesToPods["nginx-service"]
+		return ok && len(*pods) == 2
+	}
+	for deadline := time.Now().Add(5 * time.Second); !discovered(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("nginx-service and its pods are not discovered")
+		}
+	}
+	return sp, ruleBuffer
+}
+
+// nginxCanary returns a ratio rule sending 20% of the requests to nginx-service to its v2 pod.
+func nginxCanary() *core.RatioRule {
+	return &core.RatioRule{
+		RuleMeta: core.RuleMeta{Kind: core.RatioType, Name: "nginx-canary"},
+		Spec: core.RatioSpec{
+			ServiceName: "nginx-service",
+			Ratio:       20,
+			Selector:    map[string]string{"version": "v2"},
+		},
+	}
+}
+
+// TestFileRegistry checks that a ratio rule applied to the service in the example registry file
+// is routed to the pods in it.
+func TestFileRegistry(t *testing.T) {
+	sp, ruleBuffer := newFileRegistryPilot(t)
+	if err := sp.ApplyRatioRule(nginxCanary()); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleBuffer.LockBuffer()
+	config := ruleBuffer.DesiredConfig()
+	ruleBuffer.UnlockBuffer()
+	table := config.RouteTables["nginx-service"]
+	if table == nil || table.Split == nil {
+		t.Fatalf("route table of nginx-service = %+v, want a split", table)
+	}
+	if table.ServiceIP != "10.10.0.2" || !reflect.DeepEqual(table.PortMapping, map[uint16]uint16{80: 80}) {
+		t.Errorf("route table is for %s with ports %v, want 10.10.0.2 with 80:80", table.ServiceIP, table.PortMapping)
+	}
+	if table.Split.Ratio != 20 || !reflect.DeepEqual(table.Split.ProxiedIPs, []string{"172.17.0.3"}) {
+		t.Errorf("split = %+v, want 20%% to 172.17.0.3", table.Split)
+	}
+	if !reflect.DeepEqual(table.OtherIPs, []string{"172.17.0.2"}) {
+		t.Errorf("other IPs = %v, want 172.17.0.2", table.OtherIPs)
+	}
+
+	status, err := sp.GetRuleStatus("nginx-canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved := status.GetCondition(core.RuleResolved); !resolved.Status {
+		t.Errorf("rule is not resolved: %+v", resolved)
+	}
+}
+
+// TestRouteMixedRules checks that the routing of requests to a service with both a ratio rule
+// and a regex rule is reported by the rule deciding it, while each split has its own rule.
+func TestRouteMixedRules(t *testing.T) {
+	sp, _ := newFileRegistryPilot(t)
+	if err := sp.ApplyRatioRule(nginxCanary()); err != nil {
+		t.Fatal(err)
+	}
+	regexRule := &core.RegexRule{
+		RuleMeta: core.RuleMeta{Kind: core.RegexType, Name: "nginx-alice"},
+		Spec: core.RegexSpec{
+			ServiceName: "nginx-service",
+			Matchers: []core.Matcher{
+				{Header: "X-User", Regex: "^alice$", Selector: map[string]string{"version": "v1"}},
+			},
+		},
+	}
+	if err := sp.ApplyRegexRule(regexRule); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		rule    string
+		kind    core.Kind
+		// splits maps each cluster requests are routed to, to the kind and the rule of the split.
+		// Both are empty for requests forwarded as is.
+		splits map[string]string
+	}{
+		{
+			name:    "matched by the regex rule",
+			headers: map[string]string{"X-User": "alice"},
+			rule:    "nginx-alice",
+			kind:    core.RegexType,
+			splits:  map[string]string{"matcher-0": "regex/nginx-alice"},
+		},
+		{
+			name:    "split by the ratio rule",
+			headers: map[string]string{"X-User": "bob"},
+			rule:    "nginx-canary",
+			kind:    core.RatioType,
+			// The v1 pod is selected by the regex rule, so no pod is left for the other
+			// requests, which are forwarded as is.
+			splits: map[string]string{"proxied": "ratio/nginx-canary", "": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Enough requests that both clusters of the ratio rule are almost surely chosen.
+			result, err := sp.TestRoute(&core.RouteTestRequest{
+				Service: "nginx-service",
+				Method:  "GET",
+				Path:    "/",
+				Headers: tt.headers,
+				Count:   200,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Rule != tt.rule || result.Kind != tt.kind {
+				t.Errorf("rule = %s/%s, want %s/%s", result.Kind, result.Rule, tt.kind, tt.rule)
+			}
+			splits := map[string]string{}
+			for _, split := range result.Splits {
+				splits[split.Cluster] = ""
+				if split.Rule != "" {
+					splits[split.Cluster] = fmt.Sprintf("%s/%s", split.Kind, split.Rule)
+				}
+			}
+			if !reflect.DeepEqual(splits, tt.splits) {
+				t.Errorf("splits = %v, want %v", splits, tt.splits)
+			}
+			if len(result.Clusters) != 3 {
+				t.Errorf("clusters = %+v, want those of the route table of nginx-service", result.Clusters)
+			}
+		})
+	}
+}
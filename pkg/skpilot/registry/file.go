@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+	"p9t.io/kuberboat/pkg/api/core"
+)
+
+// fileWatchInterval is how often the registry file is checked for changes.
+const fileWatchInterval = time.Second
+
+// FileServicePort is a port of a service in the registry file.
+type FileServicePort struct {
+	// Port is the port of the service.
+	Port uint16 `json:"Port"`
+	// TargetPort is the port of the pods to which requests are forwarded.
+	TargetPort uint16 `yaml:"targetPort" json:"TargetPort"`
+}
+
+// FileService is a service in the registry file.
+type FileService struct {
+	// Name is the name of the service.
+	Name string
+	// ClusterIP is the IP of the service.
+	ClusterIP string `yaml:"clusterIP"`
+	// Ports are the ports of the service.
+	Ports []FileServicePort
+	// Selector selects the pods of the service by label.
+	Selector map[string]string
+}
+
+// FilePod is a pod in the registry file. All pods in the file are ready.
+type FilePod struct {
+	// Name is the name of the pod.
+	Name string
+	// Labels are the labels of the pod.
+	Labels map[string]string
+	// PodIP is the IP of the pod.
+	PodIP string `yaml:"podIP"`
+	// HostIP is the IP of the node running the pod.
+	HostIP string `yaml:"hostIP"`
+}
+
+// RegistryFile is the content of the registry file.
+type RegistryFile struct {
+	Services []FileService
+	Pods     []FilePod
+}
+
+// fileRegistry discovers pods and services from a static YAML file, so that skpilot can run
+// without Kuberboat. The file is read again whenever it is modified.
+type fileRegistry struct {
+	path string
+
+	// mtx protects the fields below, which are parsed from the file last modified at modTime.
+	mtx         sync.Mutex
+	modTime     time.Time
+	pods        []*core.Pod
+	services    []*core.Service
+	servicePods [][]string
+}
+
+func NewFileRegistry(path string) (Registry, error) {
+	r := &fileRegistry{
+		path: path,
+	}
+	// Fail early on a malformed file.
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *fileRegistry) ListPods() ([]*core.Pod, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r.pods, nil
+}
+
+func (r *fileRegistry) ListServices() ([]*core.Service, [][]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.load(); err != nil {
+		return nil, nil, err
+	}
+	return r.services, r.servicePods, nil
+}
+
+// Watch looks for changes of the file every fileWatchInterval, which only stats the file unless
+// it is modified.
+func (r *fileRegistry) Watch() <-chan WatchEvent {
+	return newPollingWatcher(r).watch(fileWatchInterval)
+}
+
+// load parses the file if it has been modified since last parsed. The caller must hold mtx,
+// except in the constructor.
+func (r *fileRegistry) load() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(r.modTime) && r.pods != nil {
+		return nil
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var file RegistryFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("malformed registry file %s: %v", r.path, err)
+	}
+
+	pods := make([]*core.Pod, 0, len(file.Pods))
+	podNames := make(map[string]struct{}, len(file.Pods))
+	for _, p := range file.Pods {
+		if p.Name == "" || p.PodIP == "" || p.HostIP == "" {
+			return fmt.Errorf("pod %q in registry file must have a name, a pod IP and a host IP", p.Name)
+		}
+		if _, ok := podNames[p.Name]; ok {
+			return fmt.Errorf("duplicate pod %s in registry file", p.Name)
+		}
+		podNames[p.Name] = struct{}{}
+		pod := &core.Pod{}
+		pod.Name = p.Name
+		// The same pod always gets the same UUID, and hence the same sandbox.
+		pod.UUID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(p.Name))
+		pod.Labels = p.Labels
+		pod.Status.Phase = core.PodReady
+		pod.Status.PodIP = p.PodIP
+		pod.Status.HostIP = p.HostIP
+		pods = append(pods, pod)
+	}
+
+	services := make([]*core.Service, 0, len(file.Services))
+	servicePods := make([][]string, 0, len(file.Services))
+	serviceNames := make(map[string]struct{}, len(file.Services))
+	for _, s := range file.Services {
+		if s.Name == "" || s.ClusterIP == "" {
+			return fmt.Errorf("service %q in registry file must have a name and a cluster IP", s.Name)
+		}
+		if _, ok := serviceNames[s.Name]; ok {
+			return fmt.Errorf("duplicate service %s in registry file", s.Name)
+		}
+		serviceNames[s.Name] = struct{}{}
+		service := &core.Service{}
+		service.Name = s.Name
+		service.Spec.ClusterIP = s.ClusterIP
+		// Ports are decoded the same way as they come from the API server of Kuberboat.
+		ports, _ := json.Marshal(s.Ports)
+		if err := json.Unmarshal(ports, &service.Spec.Ports); err != nil {
+			return fmt.Errorf("invalid ports of service %s in registry file: %v", s.Name, err)
+		}
+		services = append(services, service)
+		selected := make([]string, 0)
+		for _, p := range pods {
+			if matchLabels(s.Selector, p.Labels) {
+				selected = append(selected, p.Name)
+			}
+		}
+		servicePods = append(servicePods, selected)
+	}
+
+	r.modTime = info.ModTime()
+	r.pods = pods
+	r.services = services
+	r.servicePods = servicePods
+	return nil
+}
+
+// matchLabels returns true if labels contain all the labels in a non-empty selector.
+func matchLabels(selector map[string]string, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
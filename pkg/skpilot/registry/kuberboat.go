@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"p9t.io/kuberboat/pkg/api/core"
+	"p9t.io/skafos/pkg/skpilot/client"
+)
+
+// watchRetryInterval is how long to wait before a broken watch on the API server is resumed.
+const watchRetryInterval = time.Second * 5
+
+// kuberboatRegistry discovers pods and services from the API server of Kuberboat.
+type kuberboatRegistry struct {
+	kubeClient *client.KubeClient
+}
+
+func NewKuberboatRegistry(kubeEndpoint string, kubePort uint16) (Registry, error) {
+	kubeClient, err := client.NewKubeClient(kubeEndpoint, kubePort)
+	if err != nil {
+		return nil, err
+	}
+	return &kuberboatRegistry{
+		kubeClient: kubeClient,
+	}, nil
+}
+
+func (r *kuberboatRegistry) ListPods() ([]*core.Pod, error) {
+	return r.kubeClient.GetAllPods()
+}
+
+func (r *kuberboatRegistry) ListServices() ([]*core.Service, [][]string, error) {
+	return r.kubeClient.GetAllServices()
+}
+
+// Watch watches the API server, and resumes from the last resource version seen whenever the
+// watch breaks. If the API server no longer keeps the changes since then, the watch starts over
+// with every existing object, while deletions in between are left to resyncs.
+func (r *kuberboatRegistry) Watch() <-chan WatchEvent {
+	events := make(chan WatchEvent, 64)
+	go func() {
+		var resourceVersion uint64
+		for {
+			err := r.kubeClient.WatchObjects(resourceVersion, func(event *client.KubeEvent) {
+				resourceVersion = event.ResourceVersion
+				switch eventType := WatchEventType(event.Type); eventType {
+				case WatchAdded, WatchModified, WatchDeleted:
+					events <- WatchEvent{
+						Type:            eventType,
+						Pod:             event.Pod,
+						Service:         event.Service,
+						ServicePodNames: event.ServicePodNames,
+					}
+				default:
+					glog.Warningf("unknown change %s from API server", event.Type)
+				}
+			})
+			glog.Errorf("watch on API server broken at version %d: %v", resourceVersion, err)
+			if status.Code(err) == codes.OutOfRange {
+				resourceVersion = 0
+			}
+			time.Sleep(watchRetryInterval)
+		}
+	}()
+	return events
+}
@@ -0,0 +1,17 @@
+package registry
+
+import (
+	"p9t.io/kuberboat/pkg/api/core"
+)
+
+// Registry is a service-discovery backend from which skpilot discovers pods and services.
+type Registry interface {
+	// ListPods returns all the pods.
+	ListPods() ([]*core.Pod, error)
+	// ListServices returns all the services, and the names of the pods selected by each of them.
+	ListServices() ([]*core.Service, [][]string, error)
+	// Watch sends the changes of pods and services to the returned channel. Every existing
+	// object is sent as added at first. Changes may be missed, e.g. while the watch is broken,
+	// so objects should still be listed as a whole from time to time.
+	Watch() <-chan WatchEvent
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"p9t.io/kuberboat/pkg/api/core"
+)
+
+// WatchEventType is the type of a change of a pod or a service.
+type WatchEventType string
+
+const (
+	WatchAdded    WatchEventType = "ADDED"
+	WatchModified WatchEventType = "MODIFIED"
+	WatchDeleted  WatchEventType = "DELETED"
+)
+
+// WatchEvent is a change of a pod or a service. Exactly one of Pod and Service is set.
+// For deletion, the object is the last one seen before it was deleted.
+type WatchEvent struct {
+	Type    WatchEventType
+	Pod     *core.Pod
+	Service *core.Service
+	// ServicePodNames are the names of the pods selected by Service.
+	ServicePodNames []string
+}
+
+// pollingWatcher watches a registry whose pods and services are cheap to list, such as the
+// registry file. It lists all of them, and compares each object with the last one it has seen,
+// so that only changes are sent to consumers.
+type pollingWatcher struct {
+	registry Registry
+	events   chan WatchEvent
+
+	pods        map[string]*core.Pod
+	services    map[string]*core.Service
+	servicePods map[string][]string
+}
+
+func newPollingWatcher(registry Registry) *pollingWatcher {
+	return &pollingWatcher{
+		registry:    registry,
+		events:      make(chan WatchEvent, 64),
+		pods:        map[string]*core.Pod{},
+		services:    map[string]*core.Service{},
+		servicePods: map[string][]string{},
+	}
+}
+
+// watch polls the registry every interval and sends the changes to the returned channel.
+func (w *pollingWatcher) watch(interval time.Duration) <-chan WatchEvent {
+	go func() {
+		for ; ; time.Sleep(interval) {
+			if err := w.poll(); err != nil {
+				glog.Errorf("failed to watch registry: %v", err)
+			}
+		}
+	}()
+	return w.events
+}
+
+// poll lists all pods and services once and sends their changes.
+func (w *pollingWatcher) poll() error {
+	pods, err := w.registry.ListPods()
+	if err != nil {
+		return err
+	}
+	services, servicePods, err := w.registry.ListServices()
+	if err != nil {
+		return err
+	}
+
+	seenPods := make(map[string]struct{}, len(pods))
+	for _, pod := range pods {
+		seenPods[pod.Name] = struct{}{}
+		previous, ok := w.pods[pod.Name]
+		if ok && reflect.DeepEqual(previous, pod) {
+			continue
+		}
+		w.pods[pod.Name] = pod
+		w.events <- WatchEvent{Type: eventType(ok), Pod: pod}
+	}
+	for name, pod := range w.pods {
+		if _, ok := seenPods[name]; !ok {
+			delete(w.pods, name)
+			w.events <- WatchEvent{Type: WatchDeleted, Pod: pod}
+		}
+	}
+
+	seenServices := make(map[string]struct{}, len(services))
+	for i, service := range services {
+		seenServices[service.Name] = struct{}{}
+		// Pods selected by the service are part of it.
+		previous, ok := w.services[service.Name]
+		if ok && reflect.DeepEqual(previous, service) && reflect.DeepEqual(w.servicePods[service.Name], servicePods[i]) {
+			continue
+		}
+		w.services[service.Name] = service
+		w.servicePods[service.Name] = servicePods[i]
+		w.events <- WatchEvent{Type: eventType(ok), Service: service, ServicePodNames: servicePods[i]}
+	}
+	for name, service := range w.services {
+		if _, ok := seenServices[name]; !ok {
+			delete(w.services, name)
+			delete(w.servicePods, name)
+			w.events <- WatchEvent{Type: WatchDeleted, Service: service}
+		}
+	}
+	return nil
+}
+
+func eventType(existed bool) WatchEventType {
+	if existed {
+		return WatchModified
+	}
+	return WatchAdded
+}
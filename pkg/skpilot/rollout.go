@@ -0,0 +1,547 @@
+package skpilot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skpilot/component"
+	"p9t.io/skafos/pkg/skpilot/util"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+const (
+	// rolloutInterval is how often rollouts are driven.
+	rolloutInterval = time.Second * 10
+	// statsTimeout is how long skpilot waits for the statistics of a proxy.
+	statsTimeout = time.Second * 3
+	// rolloutLatencyQuantile is the quantile of the latency checked against the analysis.
+	rolloutLatencyQuantile = 0.99
+)
+
+// upstreamStats maps the address of a proxy or gateway to the statistics of the requests it
+// forwarded by upstream host.
+type upstreamStats map[string]map[string]*skproxy.UpstreamStats
+
+// rolloutBaseline is the statistics of upstreams when skpilot started to measure the current
+// step of a rollout. The counters of proxies only ever grow, so the requests in a step are the
+// difference from its baseline.
+type rolloutBaseline struct {
+	// step is the index of the step.
+	step int
+	// startedAt is when the step started.
+	startedAt time.Time
+	// stats is the statistics of upstreams by proxy at the start of the step.
+	stats upstreamStats
+}
+
+func (sp *skPilotInner) ApplyRollout(rollout *core.Rollout) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleName(rollout.Name); err != nil {
+		return err
+	}
+	if err := sp.components.CheckRolloutConflicts(rollout); err != nil {
+		return err
+	}
+	return sp.setRollout(rollout)
+}
+
+func (sp *skPilotInner) UpdateRollout(rollout *core.Rollout) error {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(rollout.Name, core.RolloutType); err != nil {
+		return err
+	}
+	if err := sp.components.CheckRolloutConflicts(rollout); err != nil {
+		return err
+	}
+	return sp.setRollout(rollout)
+}
+
+// setRollout persists a checked rollout and writes the route table of its service to the
+// buffer, replacing the rollout with the same name if exists. A new rollout, or one whose spec
+// changes, starts from its first step. The caller must hold the lock of components.
+func (sp *skPilotInner) setRollout(rollout *core.Rollout) error {
+	if err := sp.checkRollout(rollout); err != nil {
+		return err
+	}
+	if _, err := sp.checkGenerator(rollout); err != nil {
+		return err
+	}
+	rollout.Status = sp.rolloutStatus(rollout, time.Now())
+
+	if err := sp.ruleStore.Put(core.RolloutType, rollout.Name, rollout); err != nil {
+		return err
+	}
+
+	// Update metadata
+	serviceNames := []string{rollout.Spec.ServiceName}
+	if previousRollout, ok := sp.components.Rollouts[rollout.Name]; ok {
+		sp.components.RemoveServiceRule(previousRollout.Spec.ServiceName, rollout.Name)
+		if previousRollout.Spec.ServiceName != rollout.Spec.ServiceName {
+			serviceNames = append(serviceNames, previousRollout.Spec.ServiceName)
+		}
+	}
+	sp.components.Rollouts[rollout.Name] = rollout
+	sp.components.AddServiceRule(rollout.Spec.ServiceName, &rollout.RuleMeta)
+
+	// Update the route tables
+	sp.updateRouteTables(serviceNames)
+
+	glog.Infof("rollout %s is %s in step %d with weight %d", rollout.Name, rollout.Status.Phase, rollout.Status.Step+1, rollout.Status.Weight)
+	return nil
+}
+
+// checkRollout checks whether the service of a rollout exists, whether the rollout has steps
+// with valid weights, and whether its subset is defined. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) checkRollout(rollout *core.Rollout) error {
+	if _, _, err := sp.components.GetServiceAndServicePods(rollout.Spec.ServiceName); err != nil {
+		return err
+	}
+	if len(rollout.Spec.Steps) == 0 {
+		return core.NewError(core.ErrorReasonInvalid, "spec.steps", "", "rollout %s has no steps", rollout.Name)
+	}
+	// Only the weight of the current step is in the route table, so the others are checked here.
+	for i, step := range rollout.Spec.Steps {
+		if step.Weight > 100 {
+			return core.NewError(
+				core.ErrorReasonInvalid,
+				fmt.Sprintf("spec.steps[%d].weight", i),
+				fmt.Sprint(step.Weight),
+				"weight %d is not between 0 and 100",
+				step.Weight,
+			)
+		}
+	}
+	return sp.components.CheckSubsets(rollout.Spec.ServiceName, rolloutSubsets(rollout))
+}
+
+// rolloutSubsets returns the subsets a rollout refers to.
+func rolloutSubsets(rollout *core.Rollout) []component.SubsetReference {
+	if rollout.Spec.Subset == "" {
+		return nil
+	}
+	return []component.SubsetReference{{Field: "spec.subset", Subset: rollout.Spec.Subset}}
+}
+
+// rolloutStatus returns the status a rollout has once applied at now, which is the status of the
+// rollout with the same name if their specs are the same, or the status of the first step
+// otherwise. The first step starts when the rollout takes effect. The caller must hold the lock
+// of components.
+func (sp *skPilotInner) rolloutStatus(rollout *core.Rollout, now time.Time) core.RolloutStatus {
+	if previousRollout, ok := sp.components.Rollouts[rollout.Name]; ok &&
+		reflect.DeepEqual(previousRollout.Spec, rollout.Spec) {
+		return previousRollout.Status
+	}
+	if rollout.ActiveFrom != nil && rollout.ActiveFrom.After(now) {
+		now = *rollout.ActiveFrom
+	}
+	return startRollout(&rollout.Spec, now)
+}
+
+func (sp *skPilotInner) ControlRollout(name string, action core.RolloutAction) (*core.Rollout, error) {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	if err := sp.components.CheckRuleKind(name, core.RolloutType); err != nil {
+		return nil, err
+	}
+	rollout := sp.components.Rollouts[name]
+	status := rollout.Status
+	now := time.Now()
+	switch action {
+	case core.RolloutPause:
+		if status.Phase != core.RolloutProgressing {
+			return nil, core.NewError(
+				core.ErrorReasonInvalidPhase,
+				"action",
+				string(action),
+				"rollout %s is %s, not %s",
+				name,
+				status.Phase,
+				core.RolloutProgressing,
+			)
+		}
+		status.Phase = core.RolloutPaused
+		status.Message = "paused by user"
+	case core.RolloutResume:
+		switch status.Phase {
+		case core.RolloutCompleted:
+			return nil, core.NewError(
+				core.ErrorReasonInvalidPhase,
+				"action",
+				string(action),
+				"rollout %s is already %s",
+				name,
+				status.Phase,
+			)
+		case core.RolloutProgressing:
+			return nil, core.NewError(core.ErrorReasonInvalidPhase, "action", string(action), "rollout %s is not paused", name)
+		case core.RolloutRolledBack, core.RolloutAborted:
+			status = startRollout(&rollout.Spec, now)
+		default:
+			if isManualStep(&rollout.Spec, status.Step) {
+				status = advanceRollout(&rollout.Spec, status, now)
+			} else {
+				status = restartStep(status, now)
+			}
+		}
+	case core.RolloutAbort:
+		if status.Phase == core.RolloutAborted {
+			return nil, core.NewError(
+				core.ErrorReasonInvalidPhase,
+				"action",
+				string(action),
+				"rollout %s is already %s",
+				name,
+				status.Phase,
+			)
+		}
+		status.Phase = core.RolloutAborted
+		status.Weight = 0
+		status.Message = "aborted by user"
+	default:
+		return nil, core.NewError(core.ErrorReasonInvalid, "action", string(action), "unknown action on rollout: %s", action)
+	}
+
+	return sp.setRolloutStatus(rollout, status)
+}
+
+// setRolloutStatus persists a rollout with the new status and writes the route table of its
+// service to the buffer. Rollouts in components are never modified in place, since they may be
+// read after the lock of components is released. The caller must hold the lock of components.
+func (sp *skPilotInner) setRolloutStatus(rollout *core.Rollout, status core.RolloutStatus) (*core.Rollout, error) {
+	updated := *rollout
+	updated.Status = status
+	if err := sp.ruleStore.Put(core.RolloutType, updated.Name, &updated); err != nil {
+		return nil, err
+	}
+	sp.components.Rollouts[updated.Name] = &updated
+	sp.components.AddServiceRule(updated.Spec.ServiceName, &updated.RuleMeta)
+	if updated.Status.Weight != rollout.Status.Weight {
+		sp.updateRouteTables([]string{updated.Spec.ServiceName})
+	}
+	if updated.Status.Phase != rollout.Status.Phase || updated.Status.Step != rollout.Status.Step {
+		glog.Infof(
+			"rollout %s is %s in step %d with weight %d: %s",
+			updated.Name,
+			updated.Status.Phase,
+			updated.Status.Step+1,
+			updated.Status.Weight,
+			updated.Status.Message,
+		)
+	}
+	return &updated, nil
+}
+
+// doRollouts drives the rollouts every interval. The statistics of upstreams are fetched from
+// proxies only if any rollout in effect is progressing or paused.
+func (sp *skPilotInner) doRollouts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !sp.hasRunningRollouts(time.Now()) {
+			continue
+		}
+		stats := sp.collectUpstreamStats()
+
+		sp.components.Mtx.Lock()
+		sp.driveRollouts(time.Now(), stats)
+		sp.components.Mtx.Unlock()
+	}
+}
+
+// hasRunningRollouts tells whether any rollout in effect at now is progressing or paused.
+func (sp *skPilotInner) hasRunningRollouts(now time.Time) bool {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+	for _, rollout := range sp.components.Rollouts {
+		if isRunning(rollout) && rollout.IsActive(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectUpstreamStats fetches the statistics of upstreams from all proxies and gateways, summing
+// up the ports of each upstream host. Those that cannot be reached are left out.
+func (sp *skPilotInner) collectUpstreamStats() upstreamStats {
+	addresses := make([]string, 0)
+	for _, agent := range sp.agentManager.ListAgents() {
+		if agent.State == core.AgentRemoved {
+			continue
+		}
+		if agent.Gateway {
+			addresses = append(addresses, agent.Address)
+			continue
+		}
+		for _, proxy := range sp.ruleBuffer.GetSyncStatus(agent.Name).Proxies {
+			addresses = append(addresses, proxy.Address)
+		}
+	}
+
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	stats := upstreamStats{}
+	wg.Add(len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			defer wg.Done()
+			proxyStats, err := fetchProxyStats(address)
+			if err != nil {
+				glog.Warningf("failed to fetch stats of proxy %s: %v", address, err)
+				return
+			}
+			hosts := map[string]*skproxy.UpstreamStats{}
+			for upstream, s := range proxyStats.Upstreams {
+				host, _, err := net.SplitHostPort(upstream)
+				if err != nil {
+					host = upstream
+				}
+				if _, ok := hosts[host]; !ok {
+					hosts[host] = &skproxy.UpstreamStats{}
+				}
+				hosts[host].Add(s)
+			}
+			mtx.Lock()
+			stats[address] = hosts
+			mtx.Unlock()
+		}(address)
+	}
+	wg.Wait()
+	return stats
+}
+
+// fetchProxyStats fetches the statistics from the admin API of the proxy at address.
+func fetchProxyStats(address string) (*skproxy.ProxyStats, error) {
+	client := http.Client{Timeout: statsTimeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/stats", net.JoinHostPort(address, fmt.Sprint(skproxy.AdminPort))))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("proxy responded with %v", resp.Status)
+	}
+	var stats skproxy.ProxyStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// driveRollouts measures the requests to the canary pods of each progressing or paused rollout
+// in effect in its current step from stats, and moves it on, completes it or rolls it back. The
+// caller must hold the lock of components.
+func (sp *skPilotInner) driveRollouts(now time.Time, stats upstreamStats) {
+	names := make([]string, 0, len(sp.components.Rollouts))
+	for name, rollout := range sp.components.Rollouts {
+		// A rollout of a deleted service waits for the service to come back.
+		if _, ok := sp.components.Services[rollout.Spec.ServiceName]; !ok {
+			continue
+		}
+		if isRunning(rollout) && rollout.IsActive(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	baselines := make(map[string]*rolloutBaseline, len(names))
+	for _, name := range names {
+		rollout := sp.components.Rollouts[name]
+		baseline, ok := sp.rolloutBaselines[name]
+		if !ok || baseline.step != rollout.Status.Step || !baseline.startedAt.Equal(*rollout.Status.StepStartedAt) {
+			baseline = &rolloutBaseline{
+				step:      rollout.Status.Step,
+				startedAt: *rollout.Status.StepStartedAt,
+				stats:     upstreamStats{},
+			}
+		}
+		baselines[name] = baseline
+
+		measured := measureRequests(sp.canaryIPs(rollout), baseline, stats)
+		status := stepRollout(rollout, measured, now)
+		if reflect.DeepEqual(status, rollout.Status) {
+			continue
+		}
+		updated, err := sp.setRolloutStatus(rollout, status)
+		if err != nil {
+			glog.Errorf("failed to update rollout %s: %v", name, err)
+			continue
+		}
+		if updated.Status.Step != rollout.Status.Step && isRunning(updated) {
+			// The next step starts from the statistics just fetched.
+			baselines[name] = &rolloutBaseline{
+				step:      updated.Status.Step,
+				startedAt: *updated.Status.StepStartedAt,
+				stats:     stats,
+			}
+		}
+	}
+	// Forget the baselines of rollouts no longer running.
+	sp.rolloutBaselines = baselines
+}
+
+// canaryIPs returns the IPs of the canary pods of a rollout. The caller must hold the lock of
+// components.
+func (sp *skPilotInner) canaryIPs(rollout *core.Rollout) []string {
+	table := util.GenerateServiceRouteTable(sp.components, rollout.Spec.ServiceName)
+	if table == nil || table.Split == nil || table.Split.Rule != rollout.Name {
+		return nil
+	}
+	return table.Split.ProxiedIPs
+}
+
+// measureRequests sums up the requests to the IPs since the baseline. A proxy missing from the
+// baseline, or whose counters have been reset, is added to the baseline and counted from then
+// on, since its earlier requests may belong to previous steps.
+func measureRequests(ips []string, baseline *rolloutBaseline, stats upstreamStats) *skproxy.UpstreamStats {
+	measured := &skproxy.UpstreamStats{}
+	for address, hosts := range stats {
+		baseHosts, ok := baseline.stats[address]
+		if !ok {
+			baseline.stats[address] = hosts
+			continue
+		}
+		proxyMeasured := &skproxy.UpstreamStats{}
+		reset := false
+		for _, ip := range ips {
+			current, base := hosts[ip], baseHosts[ip]
+			if current == nil {
+				current = &skproxy.UpstreamStats{}
+			}
+			if base == nil {
+				base = &skproxy.UpstreamStats{}
+			}
+			delta, ok := current.Since(base)
+			if !ok {
+				reset = true
+				break
+			}
+			proxyMeasured.Add(delta)
+		}
+		if reset {
+			baseline.stats[address] = hosts
+			continue
+		}
+		measured.Add(proxyMeasured)
+	}
+	return measured
+}
+
+// stepRollout returns the status of a progressing or paused rollout at now, given the requests
+// measured in its current step. The rollout is rolled back once the measured requests breach its
+// analysis, and a progressing one moves on after the pause of its step has elapsed with enough
+// requests.
+func stepRollout(rollout *core.Rollout, measured *skproxy.UpstreamStats, now time.Time) core.RolloutStatus {
+	status := rollout.Status
+	status.Requests = measured.Requests
+	status.SuccessRate = measured.SuccessRate()
+	latency, ok := measured.LatencyQuantile(rolloutLatencyQuantile)
+	if ok {
+		status.LatencyP99 = latency.String()
+	} else {
+		status.LatencyP99 = ">" + latency.String()
+	}
+
+	analysis := rollout.Spec.Analysis
+	if analysis != nil && measured.Requests > 0 && measured.Requests >= uint64(analysis.MinRequests) {
+		if breach := checkAnalysis(analysis, status.SuccessRate, latency, ok); breach != "" {
+			status.Phase = core.RolloutRolledBack
+			status.Weight = 0
+			status.Message = fmt.Sprintf("rolled back in step %d: %s", status.Step+1, breach)
+			return status
+		}
+	}
+
+	if status.Phase != core.RolloutProgressing {
+		return status
+	}
+	pause := time.Duration(rollout.Spec.Steps[status.Step].Pause) * time.Second
+	if now.Sub(*status.StepStartedAt) < pause {
+		return status
+	}
+	if analysis != nil && measured.Requests < uint64(analysis.MinRequests) {
+		status.Message = fmt.Sprintf(
+			"waiting for %d requests to the canary pods, got %d",
+			analysis.MinRequests,
+			measured.Requests,
+		)
+		return status
+	}
+	return advanceRollout(&rollout.Spec, status, now)
+}
+
+// checkAnalysis returns why the success rate and the latency breach the thresholds of analysis,
+// or an empty string if they do not. measured is false if the latency is beyond what skproxy
+// measures, in which case it is a lower bound.
+func checkAnalysis(analysis *core.RolloutAnalysis, successRate float64, latency time.Duration, measured bool) string {
+	if analysis.MinSuccessRate > 0 && successRate < analysis.MinSuccessRate {
+		return fmt.Sprintf("success rate %.2f%% is below %.2f%%", successRate, analysis.MinSuccessRate)
+	}
+	maxLatency := time.Duration(analysis.MaxLatency) * time.Millisecond
+	if analysis.MaxLatency > 0 && (latency > maxLatency || (!measured && latency >= maxLatency)) {
+		return fmt.Sprintf("p99 latency exceeds %v", maxLatency)
+	}
+	return ""
+}
+
+// startRollout returns the status of a rollout starting from its first step at now.
+func startRollout(spec *core.RolloutSpec, now time.Time) core.RolloutStatus {
+	return advanceRollout(spec, core.RolloutStatus{Step: -1}, now)
+}
+
+// advanceRollout returns the status of a rollout moving from the step in status on to the next
+// one at now, or completing if it is in its last step. A rollout entering a step that waits to
+// be resumed is paused, and one entering its last step without a pause completes at once.
+func advanceRollout(spec *core.RolloutSpec, status core.RolloutStatus, now time.Time) core.RolloutStatus {
+	last := len(spec.Steps) - 1
+	if status.Step < last {
+		status.Step++
+		status.Weight = spec.Steps[status.Step].Weight
+		status = restartStep(status, now)
+		if status.Step < last || spec.Steps[last].Pause > 0 {
+			if isManualStep(spec, status.Step) {
+				status.Phase = core.RolloutPaused
+				status.Message = fmt.Sprintf("step %d waits to be resumed", status.Step+1)
+			}
+			return status
+		}
+	}
+	status.Phase = core.RolloutCompleted
+	status.Message = "all steps completed"
+	return status
+}
+
+// restartStep returns the status of a rollout restarting its current step at now.
+func restartStep(status core.RolloutStatus, now time.Time) core.RolloutStatus {
+	status.Phase = core.RolloutProgressing
+	status.StepStartedAt = &now
+	status.Requests = 0
+	status.SuccessRate = 0
+	status.LatencyP99 = ""
+	status.Message = ""
+	return status
+}
+
+// isManualStep tells whether the step waits to be resumed by users, which is a step other than
+// the last one without a pause.
+func isManualStep(spec *core.RolloutSpec, step int) bool {
+	return step < len(spec.Steps)-1 && spec.Steps[step].Pause == 0
+}
+
+// isRunning tells whether a rollout is progressing or paused.
+func isRunning(rollout *core.Rollout) bool {
+	return rollout.Status.Phase == core.RolloutProgressing || rollout.Status.Phase == core.RolloutPaused
+}
@@ -0,0 +1,238 @@
+package skpilot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skproxy"
+)
+
+// fastStats returns the stats of requests all answered within the fastest latency bucket.
+func fastStats(requests uint64, failures uint64) *skproxy.UpstreamStats {
+	return &skproxy.UpstreamStats{
+		Requests:      requests,
+		Failures:      failures,
+		LatencyCounts: []uint64{requests},
+	}
+}
+
+func TestAdvanceRollout(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		steps  []core.RolloutStep
+		step   int
+		phase  core.RolloutPhase
+		weight uint32
+	}{
+		{"start with a paused step", []core.RolloutStep{{Weight: 10, Pause: 60}, {Weight: 100}}, -1, core.RolloutProgressing, 10},
+		{"start with a manual step", []core.RolloutStep{{Weight: 10}, {Weight: 100}}, -1, core.RolloutPaused, 10},
+		{"enter a manual step", []core.RolloutStep{{Weight: 10, Pause: 60}, {Weight: 50}, {Weight: 100}}, 0, core.RolloutPaused, 50},
+		{"enter the last step without pause", []core.RolloutStep{{Weight: 10, Pause: 60}, {Weight: 100}}, 0, core.RolloutCompleted, 100},
+		{"enter the last step with pause", []core.RolloutStep{{Weight: 10, Pause: 60}, {Weight: 100, Pause: 60}}, 0, core.RolloutProgressing, 100},
+		{"complete the last step", []core.RolloutStep{{Weight: 10, Pause: 60}, {Weight: 100, Pause: 60}}, 1, core.RolloutCompleted, 100},
+		{"start with the only step", []core.RolloutStep{{Weight: 100}}, -1, core.RolloutCompleted, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &core.RolloutSpec{Steps: tt.steps}
+			status := core.RolloutStatus{Step: tt.step, Phase: core.RolloutProgressing}
+			if tt.step >= 0 {
+				status.Weight = tt.steps[tt.step].Weight
+			}
+			got := advanceRollout(spec, status, now)
+			if got.Phase != tt.phase || got.Weight != tt.weight {
+				t.Fatalf("advanceRollout() = %+v, want phase %s and weight %d", got, tt.phase, tt.weight)
+			}
+			if got.Phase != core.RolloutCompleted && (got.StepStartedAt == nil || !got.StepStartedAt.Equal(now)) {
+				t.Errorf("step of %+v does not start at %v", got, now)
+			}
+		})
+	}
+}
+
+func TestStepRollout(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-time.Minute)
+	steps := []core.RolloutStep{{Weight: 10, Pause: 30}, {Weight: 50}, {Weight: 100, Pause: 30}}
+	analysis := &core.RolloutAnalysis{MinSuccessRate: 95, MaxLatency: 100, MinRequests: 100}
+	tests := []struct {
+		name     string
+		step     int
+		phase    core.RolloutPhase
+		started  time.Time
+		analysis *core.RolloutAnalysis
+		measured *skproxy.UpstreamStats
+		// wantStep and wantPhase are the step and phase after stepping.
+		wantStep  int
+		wantPhase core.RolloutPhase
+		// wantMessage is contained in the message after stepping.
+		wantMessage string
+	}{
+		{
+			name: "pause not elapsed", step: 0, phase: core.RolloutProgressing, started: now.Add(-time.Second),
+			analysis: analysis, measured: fastStats(200, 0),
+			wantStep: 0, wantPhase: core.RolloutProgressing,
+		},
+		{
+			name: "waiting for requests", step: 0, phase: core.RolloutProgressing, started: started,
+			analysis: analysis, measured: fastStats(99, 0),
+			wantStep: 0, wantPhase: core.RolloutProgressing, wantMessage: "waiting for 100 requests to the canary pods, got 99",
+		},
+		{
+			name: "no breach below min requests", step: 0, phase: core.RolloutProgressing, started: started,
+			analysis: analysis, measured: fastStats(99, 99),
+			wantStep: 0, wantPhase: core.RolloutProgressing,
+		},
+		{
+			name: "breach at min requests", step: 0, phase: core.RolloutProgressing, started: now,
+			analysis: analysis, measured: fastStats(100, 6),
+			wantStep: 0, wantPhase: core.RolloutRolledBack, wantMessage: "rolled back in step 1: success rate 94.00% is below 95.00%",
+		},
+		{
+			name: "latency breach beyond measurement", step: 0, phase: core.RolloutProgressing, started: now,
+			analysis: analysis, measured: &skproxy.UpstreamStats{Requests: 100, LatencyCounts: []uint64{0}},
+			wantStep: 0, wantPhase: core.RolloutRolledBack, wantMessage: "p99 latency exceeds 100ms",
+		},
+		{
+			name: "move on", step: 0, phase: core.RolloutProgressing, started: started,
+			analysis: analysis, measured: fastStats(100, 5),
+			wantStep: 1, wantPhase: core.RolloutPaused, wantMessage: "step 2 waits to be resumed",
+		},
+		{
+			name: "move on without analysis", step: 0, phase: core.RolloutProgressing, started: started,
+			measured: fastStats(0, 0),
+			wantStep: 1, wantPhase: core.RolloutPaused,
+		},
+		{
+			name: "manual step stays paused", step: 1, phase: core.RolloutPaused, started: started,
+			analysis: analysis, measured: fastStats(1000, 0),
+			wantStep: 1, wantPhase: core.RolloutPaused,
+		},
+		{
+			name: "manual step rolled back", step: 1, phase: core.RolloutPaused, started: started,
+			analysis: analysis, measured: fastStats(1000, 100),
+			wantStep: 1, wantPhase: core.RolloutRolledBack, wantMessage: "rolled back in step 2",
+		},
+		{
+			name: "complete the last step", step: 2, phase: core.RolloutProgressing, started: started,
+			analysis: analysis, measured: fastStats(100, 0),
+			wantStep: 2, wantPhase: core.RolloutCompleted, wantMessage: "all steps completed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := tt.started
+			rollout := &core.Rollout{
+				Spec: core.RolloutSpec{Steps: steps, Analysis: tt.analysis},
+				Status: core.RolloutStatus{
+					Phase:         tt.phase,
+					Step:          tt.step,
+					Weight:        steps[tt.step].Weight,
+					StepStartedAt: &started,
+				},
+			}
+			got := stepRollout(rollout, tt.measured, now)
+			if got.Step != tt.wantStep || got.Phase != tt.wantPhase || !strings.Contains(got.Message, tt.wantMessage) {
+				t.Fatalf("stepRollout() = %+v, want step %d, phase %s and message %q", got, tt.wantStep, tt.wantPhase, tt.wantMessage)
+			}
+			if got.Phase == core.RolloutRolledBack && got.Weight != 0 {
+				t.Errorf("rolled back with weight %d", got.Weight)
+			}
+		})
+	}
+}
+
+func TestMeasureRequests(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	tests := []struct {
+		name     string
+		baseline upstreamStats
+		stats    upstreamStats
+		// requests and failures are the measured ones.
+		requests uint64
+		failures uint64
+		// rebased are the proxies whose baseline becomes their current stats.
+		rebased []string
+	}{
+		{
+			name: "sum canary pods across proxies",
+			baseline: upstreamStats{
+				"p1": {"10.0.0.1": fastStats(10, 1), "10.0.0.9": fastStats(5, 0)},
+				"p2": {},
+			},
+			stats: upstreamStats{
+				"p1": {"10.0.0.1": fastStats(30, 2), "10.0.0.2": fastStats(5, 1), "10.0.0.9": fastStats(50, 50)},
+				"p2": {"10.0.0.2": fastStats(7, 0)},
+			},
+			requests: 32,
+			failures: 2,
+		},
+		{
+			name:     "proxy missing from baseline",
+			baseline: upstreamStats{"p1": {"10.0.0.1": fastStats(10, 0)}},
+			stats: upstreamStats{
+				"p1": {"10.0.0.1": fastStats(20, 0)},
+				"p2": {"10.0.0.1": fastStats(100, 100)},
+			},
+			requests: 10,
+			rebased:  []string{"p2"},
+		},
+		{
+			name: "counter reset",
+			baseline: upstreamStats{
+				"p1": {"10.0.0.1": fastStats(50, 0)},
+				"p2": {"10.0.0.1": fastStats(10, 0)},
+			},
+			stats: upstreamStats{
+				"p1": {"10.0.0.1": fastStats(5, 5)},
+				"p2": {"10.0.0.1": fastStats(15, 1)},
+			},
+			requests: 5,
+			failures: 1,
+			rebased:  []string{"p1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline := &rolloutBaseline{stats: tt.baseline}
+			got := measureRequests(ips, baseline, tt.stats)
+			if got.Requests != tt.requests || got.Failures != tt.failures {
+				t.Fatalf("measureRequests() = %d requests and %d failures, want %d and %d",
+					got.Requests, got.Failures, tt.requests, tt.failures)
+			}
+			for _, address := range tt.rebased {
+				if baseline.stats[address]["10.0.0.1"] != tt.stats[address]["10.0.0.1"] {
+					t.Errorf("baseline of %s is not reset", address)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckAnalysis(t *testing.T) {
+	analysis := &core.RolloutAnalysis{MinSuccessRate: 99, MaxLatency: 250}
+	tests := []struct {
+		name        string
+		analysis    *core.RolloutAnalysis
+		successRate float64
+		latency     time.Duration
+		measured    bool
+		want        string
+	}{
+		{"within thresholds", analysis, 99, 250 * time.Millisecond, true, ""},
+		{"low success rate", analysis, 98.5, 0, true, "success rate 98.50% is below 99.00%"},
+		{"high latency", analysis, 100, 500 * time.Millisecond, true, "p99 latency exceeds 250ms"},
+		{"latency beyond measurement", analysis, 100, 250 * time.Millisecond, false, "p99 latency exceeds 250ms"},
+		{"no thresholds", &core.RolloutAnalysis{}, 0, time.Hour, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkAnalysis(tt.analysis, tt.successRate, tt.latency, tt.measured); got != tt.want {
+				t.Errorf("checkAnalysis() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
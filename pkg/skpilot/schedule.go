@@ -0,0 +1,140 @@
+package skpilot
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skpilot/util"
+)
+
+// scheduleInterval is how often rules are activated and expired on schedule.
+const scheduleInterval = time.Second
+
+// checkSchedule checks the schedule of a rule applied at now, and sets its CreatedAt, which is
+// kept from the rule with the same name if exists. The caller must hold the lock of components.
+func (sp *skPilotInner) checkSchedule(meta *core.RuleMeta, now time.Time) error {
+	meta.CreatedAt = &now
+	if _, previousRule, err := sp.getRule(meta.Name); err == nil && previousRule.GetRuleMeta().CreatedAt != nil {
+		meta.CreatedAt = previousRule.GetRuleMeta().CreatedAt
+	}
+
+	if meta.TTL != "" {
+		if meta.ExpiresAt != nil {
+			return core.NewError(
+				core.ErrorReasonInvalid,
+				"ttl",
+				meta.TTL,
+				"rule %s cannot have both a ttl and an expiry time",
+				meta.Name,
+			)
+		}
+		ttl, err := time.ParseDuration(meta.TTL)
+		if err != nil {
+			return core.NewError(core.ErrorReasonInvalid, "ttl", meta.TTL, "invalid ttl %q of rule %s: %v", meta.TTL, meta.Name, err)
+		}
+		if ttl <= 0 {
+			return core.NewError(core.ErrorReasonInvalid, "ttl", meta.TTL, "ttl of rule %s must be positive", meta.Name)
+		}
+	}
+	expiry := meta.Expiry()
+	if expiry == nil {
+		return nil
+	}
+	// The expiry time is given by expiresAt, or else by ttl.
+	field, value := "expiresAt", expiry.Format(time.RFC3339)
+	if meta.ExpiresAt == nil {
+		field, value = "ttl", meta.TTL
+	}
+	if meta.ActiveFrom != nil && !expiry.After(*meta.ActiveFrom) {
+		return core.NewError(core.ErrorReasonInvalid, field, value, "rule %s expires before it takes effect", meta.Name)
+	}
+	if !expiry.After(now) {
+		return core.NewError(
+			core.ErrorReasonInvalid,
+			field,
+			value,
+			"rule %s has already expired at %s",
+			meta.Name,
+			expiry.Format(time.RFC3339),
+		)
+	}
+	return nil
+}
+
+// checkUnscheduled checks that a destination policy has neither activeFrom, expiresAt nor ttl.
+func checkUnscheduled(meta *core.RuleMeta) error {
+	field, value := "", ""
+	switch {
+	case meta.ActiveFrom != nil:
+		field, value = "activeFrom", meta.ActiveFrom.Format(time.RFC3339)
+	case meta.ExpiresAt != nil:
+		field, value = "expiresAt", meta.ExpiresAt.Format(time.RFC3339)
+	case meta.TTL != "":
+		field, value = "ttl", meta.TTL
+	default:
+		return nil
+	}
+	return core.NewError(core.ErrorReasonInvalid, field, value, "destination policy %s cannot be scheduled", meta.Name)
+}
+
+// doScheduling activates and expires rules on schedule every interval.
+func (sp *skPilotInner) doScheduling(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sp.components.Mtx.Lock()
+		sp.scheduleRules(time.Now())
+		sp.components.Mtx.Unlock()
+	}
+}
+
+// scheduleRules deletes the rules expired at now, and writes the rules taking effect since the
+// last call to the buffer. A destination policy whose subsets are still referred to is kept,
+// even if it has expired. The caller must hold the lock of components.
+func (sp *skPilotInner) scheduleRules(now time.Time) {
+	for _, rule := range sp.listRules().All() {
+		meta := rule.GetRuleMeta()
+		switch {
+		case meta.State(now) == core.RuleExpired:
+			if policy, ok := rule.(*core.DestinationPolicy); ok {
+				if err := sp.components.CheckSubsetReferences(policy.Spec.ServiceName, nil); err != nil {
+					continue
+				}
+			}
+			if err := sp.deleteRule(meta.Kind, meta.Name); err != nil {
+				glog.Errorf("failed to delete expired %s %s: %v", meta.Kind, meta.Name, err)
+				continue
+			}
+			glog.Infof("%s %s expired at %s and is deleted", meta.Kind, meta.Name, meta.Expiry().Format(time.RFC3339))
+		case meta.ActiveFrom != nil && meta.ActiveFrom.After(sp.lastScheduled) && !meta.ActiveFrom.After(now):
+			sp.refreshRule(rule, now)
+			glog.Infof("%s %s takes effect", meta.Kind, meta.Name)
+		}
+	}
+	sp.lastScheduled = now
+}
+
+// refreshRule writes a rule to the buffer as it is at now, which is the route table of its
+// service for a ratio rule, a regex rule, a destination policy or a rollout. The caller must hold
+// the lock of components.
+func (sp *skPilotInner) refreshRule(rule core.Rule, now time.Time) {
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		sp.updateRouteTables([]string{rule.Spec.ServiceName})
+	case *core.RegexRule:
+		sp.updateRouteTables([]string{rule.Spec.ServiceName})
+	case *core.DestinationPolicy:
+		sp.updateRouteTables([]string{rule.Spec.ServiceName})
+	case *core.Rollout:
+		sp.updateRouteTables([]string{rule.Spec.ServiceName})
+	case *core.ServiceEntry:
+		sp.ruleBuffer.LockBuffer()
+		sp.ruleBuffer.SetServiceEntry(rule.Name, util.GenerateActiveServiceEntry(rule, now))
+		sp.ruleBuffer.UnlockBuffer()
+	case *core.Gateway:
+		sp.ruleBuffer.LockBuffer()
+		sp.ruleBuffer.SetGateway(rule.Name, util.GenerateActiveGateway(rule, sp.components.Services, now))
+		sp.ruleBuffer.UnlockBuffer()
+	}
+}
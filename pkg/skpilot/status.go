@@ -0,0 +1,259 @@
+package skpilot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"p9t.io/skafos/pkg/api/core"
+)
+
+func (sp *skPilotInner) GetRuleStatus(ruleName string) (*core.RuleStatus, error) {
+	sp.components.Mtx.Lock()
+	defer sp.components.Mtx.Unlock()
+
+	_, rule, err := sp.getRule(ruleName)
+	if err != nil {
+		return nil, err
+	}
+	meta := rule.GetRuleMeta()
+	now := time.Now()
+	status := &core.RuleStatus{
+		State: meta.State(now),
+	}
+	if status.State == core.RuleActive {
+		status.Version = sp.ruleVersion(rule)
+	}
+	// The sync status is read after the version, so that it is never older than the version.
+	status.Agents = sp.ListSyncStatus()
+
+	resolved, subsets := sp.resolveRule(rule)
+	status.Subsets = subsets
+	status.Conditions = []core.RuleCondition{resolved, propagationCondition(meta, status)}
+	return status, nil
+}
+
+// ruleVersion returns the first config version carrying the generator of a rule as it is, which
+// is the route table of its service for a ratio rule, a regex rule, a destination policy or a
+// rollout. It is zero if the generator has never been written to the buffer.
+func (sp *skPilotInner) ruleVersion(rule core.Rule) uint64 {
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		return sp.ruleBuffer.RouteTableVersion(rule.Spec.ServiceName)
+	case *core.RegexRule:
+		return sp.ruleBuffer.RouteTableVersion(rule.Spec.ServiceName)
+	case *core.DestinationPolicy:
+		return sp.ruleBuffer.RouteTableVersion(rule.Spec.ServiceName)
+	case *core.Rollout:
+		return sp.ruleBuffer.RouteTableVersion(rule.Spec.ServiceName)
+	case *core.ServiceEntry:
+		return sp.ruleBuffer.ServiceEntryVersion(rule.Name)
+	case *core.Gateway:
+		return sp.ruleBuffer.GatewayVersion(rule.Name)
+	default:
+		return 0
+	}
+}
+
+// resolveRule finds the services and the pods a rule refers to. It returns the Resolved
+// condition of the rule, and the pods selected by each of its selectors and subsets. The caller
+// must hold the lock of components.
+func (sp *skPilotInner) resolveRule(rule core.Rule) (core.RuleCondition, []core.RuleSubsetStatus) {
+	condition := core.RuleCondition{
+		Type:   core.RuleResolved,
+		Status: true,
+	}
+	reasons := make([]string, 0)
+	messages := make([]string, 0)
+	var subsets []core.RuleSubsetStatus
+
+	switch rule := rule.(type) {
+	case *core.Gateway:
+		for _, route := range rule.Spec.Routes {
+			if reason, message := sp.checkRuleService(route.ServiceName); reason != "" {
+				reasons = append(reasons, reason)
+				messages = append(messages, message)
+			}
+		}
+	case *core.ServiceEntry:
+		// A service entry refers to nothing inside the mesh.
+	default:
+		serviceName := ruleServiceName(rule)
+		if reason, message := sp.checkRuleService(serviceName); reason != "" {
+			reasons = append(reasons, reason)
+			messages = append(messages, message)
+			break
+		}
+		subsets = sp.resolveSubsets(serviceName, rule)
+		for _, subset := range subsets {
+			if subset.IPs == 0 {
+				reasons = append(reasons, core.RuleReasonNoPods)
+				messages = append(messages, fmt.Sprintf("%s matches no pods", formatRuleSubset(&subset)))
+			}
+		}
+	}
+
+	if len(reasons) != 0 {
+		condition.Status = false
+		condition.Reason = reasons[0]
+		condition.Message = strings.Join(messages, "; ")
+	}
+	return condition, subsets
+}
+
+// checkRuleService checks whether a service a rule refers to exists and has a cluster IP. It
+// returns the reason and the message if not, or empty strings otherwise. The caller must hold
+// the lock of components.
+func (sp *skPilotInner) checkRuleService(serviceName string) (string, string) {
+	service, ok := sp.components.Services[serviceName]
+	if !ok {
+		return core.RuleReasonServiceNotFound, fmt.Sprintf("no such service: %s", serviceName)
+	}
+	if service.Spec.ClusterIP == "" {
+		return core.RuleReasonNoClusterIP, fmt.Sprintf("service %s has no ClusterIP", serviceName)
+	}
+	return "", ""
+}
+
+// resolveSubsets returns the pods selected by each selector and subset of a ratio rule, a regex
+// rule, a destination policy or a rollout applied to the service, which must exist. Pods are
+// counted as in the route table of the service, where a pod is selected by at most one matcher
+// of a regex rule. The caller must hold the lock of components.
+func (sp *skPilotInner) resolveSubsets(serviceName string, rule core.Rule) []core.RuleSubsetStatus {
+	subsets := make([]core.RuleSubsetStatus, 0)
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		table, _ := sp.generateRouteTableWith(serviceName, rule)
+		subsets = append(subsets, core.RuleSubsetStatus{
+			Name:             "proxied",
+			Subset:           rule.Spec.Subset,
+			Selector:         rule.Spec.Selector,
+			MatchExpressions: rule.Spec.MatchExpressions,
+			IPs:              len(table.Split.ProxiedIPs),
+		})
+	case *core.Rollout:
+		table, _ := sp.generateRouteTableWith(serviceName, rule)
+		subsets = append(subsets, core.RuleSubsetStatus{
+			Name:             "canary",
+			Subset:           rule.Spec.Subset,
+			Selector:         rule.Spec.Selector,
+			MatchExpressions: rule.Spec.MatchExpressions,
+			IPs:              len(table.Split.ProxiedIPs),
+		})
+	case *core.RegexRule:
+		table, _ := sp.generateRouteTableWith(serviceName, rule)
+		i := 0
+		for _, matcher := range table.Matchers {
+			if matcher.Rule != rule.Name {
+				continue
+			}
+			subsets = append(subsets, core.RuleSubsetStatus{
+				Name:             fmt.Sprintf("matcher-%d", i),
+				Subset:           rule.Spec.Matchers[i].Subset,
+				Selector:         rule.Spec.Matchers[i].Selector,
+				MatchExpressions: rule.Spec.Matchers[i].MatchExpressions,
+				IPs:              len(matcher.IPs),
+			})
+			i++
+		}
+	case *core.DestinationPolicy:
+		_, pods, _ := sp.components.GetServiceAndServicePods(serviceName)
+		for _, subset := range rule.Spec.Subsets {
+			status := core.RuleSubsetStatus{
+				Name:             subset.Name,
+				Selector:         subset.Selector,
+				MatchExpressions: subset.MatchExpressions,
+			}
+			for _, pod := range pods {
+				if core.MatchSelector(subset.Selector, subset.MatchExpressions, pod.Labels) {
+					status.IPs++
+				}
+			}
+			subsets = append(subsets, status)
+		}
+	}
+	return subsets
+}
+
+// ruleServiceName returns the service a ratio rule, a regex rule, a destination policy or a
+// rollout applies to.
+func ruleServiceName(rule core.Rule) string {
+	switch rule := rule.(type) {
+	case *core.RatioRule:
+		return rule.Spec.ServiceName
+	case *core.RegexRule:
+		return rule.Spec.ServiceName
+	case *core.DestinationPolicy:
+		return rule.Spec.ServiceName
+	case *core.Rollout:
+		return rule.Spec.ServiceName
+	default:
+		return ""
+	}
+}
+
+// formatRuleSubset returns how the pods of a subset status are selected, like "subset v2" or
+// "selector app=reviews,version=v2".
+func formatRuleSubset(subset *core.RuleSubsetStatus) string {
+	if subset.Subset != "" {
+		return fmt.Sprintf("subset %s", subset.Subset)
+	}
+	return fmt.Sprintf("selector %s", core.FormatSelector(subset.Selector, subset.MatchExpressions))
+}
+
+// propagationCondition returns the Propagated condition of a rule with the metadata, which holds
+// once all the agents and proxies in status run the version of status or later.
+func propagationCondition(meta *core.RuleMeta, status *core.RuleStatus) core.RuleCondition {
+	condition := core.RuleCondition{
+		Type: core.RulePropagated,
+	}
+	switch {
+	case status.State == core.RuleScheduled:
+		condition.Reason = core.RuleReasonScheduled
+		condition.Message = fmt.Sprintf("rule takes effect at %s", meta.ActiveFrom.Format(time.RFC3339))
+		return condition
+	case status.State == core.RuleExpired:
+		condition.Reason = core.RuleReasonExpired
+		condition.Message = fmt.Sprintf("rule expired at %s", meta.Expiry().Format(time.RFC3339))
+		return condition
+	case status.Version == 0:
+		condition.Reason = core.RuleReasonPending
+		condition.Message = "rule has not been sent to agents yet"
+		return condition
+	}
+
+	syncedAgents, proxies, syncedProxies := 0, 0, 0
+	agentErrors := make([]string, 0)
+	rejections := make([]string, 0)
+	for _, agent := range status.Agents {
+		if agent.AckedVersion >= status.Version {
+			syncedAgents++
+		} else if agent.Error != "" {
+			agentErrors = append(agentErrors, fmt.Sprintf("agent %s: %s", agent.Agent, agent.Error))
+		}
+		for _, proxy := range agent.Proxies {
+			proxies++
+			if proxy.Version >= status.Version {
+				syncedProxies++
+			} else if proxy.Error != "" {
+				rejections = append(rejections, fmt.Sprintf("proxy %s on agent %s: %s", proxy.Address, agent.Agent, proxy.Error))
+			}
+		}
+	}
+
+	condition.Message = fmt.Sprintf("%d/%d agents and %d/%d proxies are in sync",
+		syncedAgents, len(status.Agents), syncedProxies, proxies)
+	switch {
+	case len(rejections) != 0:
+		condition.Reason = core.RuleReasonRejected
+		condition.Message += "; rejected by " + strings.Join(rejections, "; ")
+	case syncedAgents != len(status.Agents) || syncedProxies != proxies:
+		condition.Reason = core.RuleReasonPending
+		if len(agentErrors) != 0 {
+			condition.Message += "; " + strings.Join(agentErrors, "; ")
+		}
+	default:
+		condition.Status = true
+	}
+	return condition
+}
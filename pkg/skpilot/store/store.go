@@ -0,0 +1,199 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"p9t.io/skafos/pkg/api/core"
+)
+
+// RuleStore persists the rules applied by users, so that they survive restarts of skpilot.
+type RuleStore interface {
+	// Load returns all the rules in the store.
+	Load() (*core.RuleList, error)
+	// Put adds or replaces the rule of kind with name. rule must be one of RatioRule,
+	// RegexRule, ServiceEntry, Gateway, DestinationPolicy and Rollout.
+	Put(kind core.Kind, name string, rule interface{}) error
+	// Delete removes the rule of kind with name. It is a no-op if there is no such rule.
+	Delete(kind core.Kind, name string) error
+}
+
+// fileStore keeps all the rules in a single JSON file. Each change rewrites the whole file to
+// a temporary file and renames it over the old one, so that a crash in the middle of a write
+// leaves either the old or the new file, but never a partial one.
+type fileStore struct {
+	path string
+
+	// mtx protects records and the file.
+	mtx sync.Mutex
+	// records maps each kind to the JSON of its rules by name, as written in the file.
+	records map[core.Kind]map[string]json.RawMessage
+}
+
+func NewFileStore(path string) (RuleStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		path:    path,
+		records: map[core.Kind]map[string]json.RawMessage{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, fmt.Errorf("corrupted rule store %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileStore) Load() (*core.RuleList, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rules := &core.RuleList{}
+	for _, name := range sortedNames(s.records[core.RatioType]) {
+		var rule core.RatioRule
+		if err := json.Unmarshal(s.records[core.RatioType][name], &rule); err != nil {
+			return nil, fmt.Errorf("corrupted ratio rule %s: %v", name, err)
+		}
+		rules.RatioRules = append(rules.RatioRules, &rule)
+	}
+	for _, name := range sortedNames(s.records[core.RegexType]) {
+		var rule core.RegexRule
+		if err := json.Unmarshal(s.records[core.RegexType][name], &rule); err != nil {
+			return nil, fmt.Errorf("corrupted regex rule %s: %v", name, err)
+		}
+		rules.RegexRules = append(rules.RegexRules, &rule)
+	}
+	for _, name := range sortedNames(s.records[core.ServiceEntryType]) {
+		var entry core.ServiceEntry
+		if err := json.Unmarshal(s.records[core.ServiceEntryType][name], &entry); err != nil {
+			return nil, fmt.Errorf("corrupted service entry %s: %v", name, err)
+		}
+		rules.ServiceEntries = append(rules.ServiceEntries, &entry)
+	}
+	for _, name := range sortedNames(s.records[core.GatewayType]) {
+		var gateway core.Gateway
+		if err := json.Unmarshal(s.records[core.GatewayType][name], &gateway); err != nil {
+			return nil, fmt.Errorf("corrupted gateway %s: %v", name, err)
+		}
+		rules.Gateways = append(rules.Gateways, &gateway)
+	}
+	for _, name := range sortedNames(s.records[core.DestinationPolicyType]) {
+		var policy core.DestinationPolicy
+		if err := json.Unmarshal(s.records[core.DestinationPolicyType][name], &policy); err != nil {
+			return nil, fmt.Errorf("corrupted destination policy %s: %v", name, err)
+		}
+		rules.DestinationPolicies = append(rules.DestinationPolicies, &policy)
+	}
+	for _, name := range sortedNames(s.records[core.RolloutType]) {
+		var rollout core.Rollout
+		if err := json.Unmarshal(s.records[core.RolloutType][name], &rollout); err != nil {
+			return nil, fmt.Errorf("corrupted rollout %s: %v", name, err)
+		}
+		rules.Rollouts = append(rules.Rollouts, &rollout)
+	}
+	return rules, nil
+}
+
+func (s *fileStore) Put(kind core.Kind, name string, rule interface{}) error {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	records := s.copyRecords()
+	if _, ok := records[kind]; !ok {
+		records[kind] = map[string]json.RawMessage{}
+	}
+	records[kind][name] = data
+	return s.commit(records)
+}
+
+func (s *fileStore) Delete(kind core.Kind, name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.records[kind][name]; !ok {
+		return nil
+	}
+	records := s.copyRecords()
+	delete(records[kind], name)
+	return s.commit(records)
+}
+
+// copyRecords returns a copy of records, so that records are left untouched if the write fails.
+// The caller must hold mtx.
+func (s *fileStore) copyRecords() map[core.Kind]map[string]json.RawMessage {
+	records := make(map[core.Kind]map[string]json.RawMessage, len(s.records))
+	for kind, rules := range s.records {
+		records[kind] = make(map[string]json.RawMessage, len(rules))
+		for name, data := range rules {
+			records[kind][name] = data
+		}
+	}
+	return records
+}
+
+// commit writes records to the file and takes them as the current records if the write
+// succeeds. The caller must hold mtx.
+func (s *fileStore) commit(records map[core.Kind]map[string]json.RawMessage) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(s.path, data); err != nil {
+		return fmt.Errorf("failed to persist rules: %v", err)
+	}
+	s.records = records
+	return nil
+}
+
+// writeFileAtomically replaces the file at path with data. The data is flushed to disk before
+// the rename, and the rename is flushed to disk before returning.
+func writeFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func sortedNames(rules map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,86 +1,239 @@
 package util
 
 import (
-	"reflect"
+	"time"
 
 	kubeCore "p9t.io/kuberboat/pkg/api/core"
 	"p9t.io/skafos/pkg/api/core"
+	"p9t.io/skafos/pkg/skpilot/component"
 	"p9t.io/skafos/pkg/skproxy"
 )
 
-// GenerateRatioRule generates a ratio rule that could be recognized by SkAgent and SkProxy
-// based on the rule info, the service it applied to and pods of the service.
-func GenerateRatioRule(
-	rule *core.RatioRule,
+// GenerateServiceRouteTable generates the route table of a service from all the rules and the
+// destination policy in effect on it in components. It returns nil if the service does not exist,
+// has no cluster IP yet, or has neither rules nor a destination policy in effect, in which case
+// the route table of the service should be removed. The caller must hold the lock of components.
+func GenerateServiceRouteTable(components *component.SkComponents, serviceName string) *skproxy.RouteTableGenerator {
+	now := time.Now()
+	ratioRule, regexRules := components.GetActiveServiceRules(serviceName, now)
+	policy := components.GetActiveDestinationPolicy(serviceName, now)
+	if ratioRule == nil && len(regexRules) == 0 && policy == nil {
+		return nil
+	}
+	service, pods, err := components.GetServiceAndServicePods(serviceName)
+	if err != nil || service.Spec.ClusterIP == "" {
+		return nil
+	}
+	return GenerateRouteTable(service, ratioRule, regexRules, policy, pods)
+}
+
+// GenerateRouteTable generates the route table of a service that could be recognized by SkAgent
+// and SkProxy, merging the ratio rule and the regex rules applied to the service based on the
+// pods of the service. ratioRule may be nil, and regexRules should be sorted by name, so that
+// the matchers of the rules are tried in that order. Subsets referred to by the rules are
+// resolved in policy, which may be nil, and pods selected by a subset are sent requests by its
+// traffic policy. Other pods follow the traffic policy of the whole service.
+func GenerateRouteTable(
 	service *kubeCore.Service,
+	ratioRule *core.RatioRule,
+	regexRules []*core.RegexRule,
+	policy *core.DestinationPolicy,
 	pods []*kubeCore.Pod,
-) *skproxy.RatioRuleGenerator {
+) *skproxy.RouteTableGenerator {
 
 	portMapping := make(map[uint16]uint16)
 	for _, portPair := range service.Spec.Ports {
 		portMapping[portPair.Port] = portPair.TargetPort
 	}
 
-	proxiedIPs := make([]string, 0)
+	// A pod is selected by any number of rules, but by at most one matcher of each regex rule.
+	selected := make(map[string]bool, len(pods))
+	matchers := make([]*skproxy.HeaderRegexMatcher, 0)
+	for _, rule := range regexRules {
+		ruleMatchers := make([]*skproxy.HeaderRegexMatcher, 0, len(rule.Spec.Matchers))
+		for _, matcher := range rule.Spec.Matchers {
+			ruleMatchers = append(ruleMatchers, &skproxy.HeaderRegexMatcher{
+				Header: matcher.Header,
+				Regex:  matcher.Regex,
+				IPs:    []string{},
+				Rule:   rule.Name,
+				Policy: GenerateTrafficPolicy(policy, matcher.Subset),
+			})
+		}
+		for _, pod := range pods {
+			for i, matcher := range rule.Spec.Matchers {
+				if matchPod(policy, matcher.Subset, matcher.Selector, matcher.MatchExpressions, pod) {
+					ruleMatchers[i].IPs = append(ruleMatchers[i].IPs, pod.Status.PodIP)
+					selected[pod.Name] = true
+					break
+				}
+			}
+		}
+		matchers = append(matchers, ruleMatchers...)
+	}
+
+	var split *skproxy.RatioSplit
+	if ratioRule != nil {
+		split = &skproxy.RatioSplit{
+			Rule:       ratioRule.Name,
+			Ratio:      int(ratioRule.Spec.Ratio),
+			ProxiedIPs: []string{},
+			Policy:     GenerateTrafficPolicy(policy, ratioRule.Spec.Subset),
+		}
+		for _, pod := range pods {
+			if matchPod(policy, ratioRule.Spec.Subset, ratioRule.Spec.Selector, ratioRule.Spec.MatchExpressions, pod) {
+				split.ProxiedIPs = append(split.ProxiedIPs, pod.Status.PodIP)
+				selected[pod.Name] = true
+			}
+		}
+	}
+
 	otherIPs := make([]string, 0)
 	for _, pod := range pods {
-		if reflect.DeepEqual(rule.Spec.Selector, pod.Labels) {
-			proxiedIPs = append(proxiedIPs, pod.Status.PodIP)
-		} else {
+		if !selected[pod.Name] {
 			otherIPs = append(otherIPs, pod.Status.PodIP)
 		}
 	}
 
-	return &skproxy.RatioRuleGenerator{
+	return &skproxy.RouteTableGenerator{
 		ServiceIP:   service.Spec.ClusterIP,
 		PortMapping: portMapping,
-		Ratio:       int(rule.Spec.Ratio),
-		ProxiedIPs:  proxiedIPs,
+		Matchers:    matchers,
+		Split:       split,
 		OtherIPs:    otherIPs,
+		OtherPolicy: GenerateTrafficPolicy(policy, ""),
 	}
 }
 
-// GenerateRegexRule generates a regex rule that could be recognized by SkAgent and SkProxy
-// based on the rule info, the service it applied to and pods of the service.
-func GenerateRegexRule(
-	rule *core.RegexRule,
-	service *kubeCore.Service,
-	pods []*kubeCore.Pod,
-) *skproxy.RegexRuleGenerator {
+// matchPod tells whether a pod is selected by the subset of policy if subset is not empty, or by
+// the selector and expressions otherwise. A subset missing from policy selects no pods.
+func matchPod(
+	policy *core.DestinationPolicy,
+	subset string,
+	selector map[string]string,
+	expressions []core.SelectorRequirement,
+	pod *kubeCore.Pod,
+) bool {
+	if subset == "" {
+		return core.MatchSelector(selector, expressions, pod.Labels)
+	}
+	if policy == nil {
+		return false
+	}
+	s := policy.GetSubset(subset)
+	if s == nil {
+		return false
+	}
+	return core.MatchSelector(s.Selector, s.MatchExpressions, pod.Labels)
+}
 
-	portMapping := make(map[uint16]uint16)
-	for _, portPair := range service.Spec.Ports {
-		portMapping[portPair.Port] = portPair.TargetPort
+// GenerateTrafficPolicy generates the traffic policy of the pods in a subset of policy, where the
+// fields set in the traffic policy of the subset override those of the whole service. If subset
+// is empty, it is the traffic policy of the whole service. It returns nil if policy is nil or
+// sets nothing, which means the defaults of SkProxy.
+func GenerateTrafficPolicy(policy *core.DestinationPolicy, subset string) *skproxy.TrafficPolicy {
+	if policy == nil {
+		return nil
 	}
+	generated := &skproxy.TrafficPolicy{}
+	mergeTrafficPolicy(generated, policy.Spec.TrafficPolicy)
+	if subset != "" {
+		if s := policy.GetSubset(subset); s != nil {
+			mergeTrafficPolicy(generated, s.TrafficPolicy)
+		}
+	}
+	if *generated == (skproxy.TrafficPolicy{}) {
+		return nil
+	}
+	return generated
+}
 
-	matchers := make([]*skproxy.HeaderRegexMatcher, 0, len(rule.Spec.Matchers))
-	for _, matcher := range rule.Spec.Matchers {
-		matchers = append(matchers, &skproxy.HeaderRegexMatcher{
-			Header: matcher.Header,
-			Regex:  matcher.Regex,
-			IPs:    []string{},
+// mergeTrafficPolicy overrides the fields of generated with those set in policy, which may be
+// nil.
+func mergeTrafficPolicy(generated *skproxy.TrafficPolicy, policy *core.TrafficPolicy) {
+	if policy == nil {
+		return
+	}
+	if policy.LoadBalancer != "" {
+		generated.LoadBalancer = skproxy.LoadBalancer(policy.LoadBalancer)
+	}
+	if policy.ConnectionPool != nil {
+		generated.MaxRequests = int(policy.ConnectionPool.MaxRequests)
+	}
+	if policy.OutlierDetection != nil {
+		generated.ConsecutiveErrors = int(policy.OutlierDetection.ConsecutiveErrors)
+		generated.BaseEjectionTimeMs = int(policy.OutlierDetection.BaseEjectionTime)
+	}
+	if policy.TLSMode != "" {
+		generated.TLSMode = skproxy.TLSMode(policy.TLSMode)
+	}
+}
+
+// GenerateServiceEntry generates a service entry rule that could be recognized by SkAgent and SkProxy
+// based on the service entry info.
+func GenerateServiceEntry(entry *core.ServiceEntry) *skproxy.ServiceEntryGenerator {
+	endpoints := make([]*skproxy.ServiceEntryEndpoint, 0, len(entry.Spec.Endpoints))
+	for _, endpoint := range entry.Spec.Endpoints {
+		endpoints = append(endpoints, &skproxy.ServiceEntryEndpoint{
+			Address: endpoint.Address,
+			Weight:  int(endpoint.Weight),
 		})
 	}
-	otherIPs := make([]string, 0)
+	return &skproxy.ServiceEntryGenerator{
+		Hosts:     entry.Spec.Hosts,
+		Ports:     entry.Spec.Ports,
+		Endpoints: endpoints,
+		Retries:   int(entry.Spec.Retries),
+		TimeoutMs: int(entry.Spec.Timeout),
+	}
+}
 
-	for _, pod := range pods {
-		matched := false
-		for i, matcher := range rule.Spec.Matchers {
-			if reflect.DeepEqual(matcher.Selector, pod.Labels) {
-				matchers[i].IPs = append(matchers[i].IPs, pod.Status.PodIP)
-				matched = true
-				break
-			}
-		}
-		if !matched {
-			otherIPs = append(otherIPs, pod.Status.PodIP)
+// GenerateActiveServiceEntry generates a service entry rule like GenerateServiceEntry if the
+// entry is in effect at now. It returns nil otherwise, in which case the entry should be removed.
+func GenerateActiveServiceEntry(entry *core.ServiceEntry, now time.Time) *skproxy.ServiceEntryGenerator {
+	if !entry.IsActive(now) {
+		return nil
+	}
+	return GenerateServiceEntry(entry)
+}
+
+// GenerateGateway generates gateway routes that could be recognized by SkGateway based on the
+// gateway info and all the services. Routes to services that do not exist or have no cluster IP
+// yet are ignored.
+func GenerateGateway(
+	gateway *core.Gateway,
+	services map[string]*kubeCore.Service,
+) *skproxy.GatewayGenerator {
+
+	routes := make([]*skproxy.GatewayRoute, 0, len(gateway.Spec.Routes))
+	for _, route := range gateway.Spec.Routes {
+		service, ok := services[route.ServiceName]
+		if !ok || service.Spec.ClusterIP == "" {
+			continue
 		}
+		routes = append(routes, &skproxy.GatewayRoute{
+			Host:       route.Host,
+			PathPrefix: route.PathPrefix,
+			ServiceIP:  service.Spec.ClusterIP,
+			Port:       route.Port,
+		})
 	}
 
-	return &skproxy.RegexRuleGenerator{
-		ServiceIP:   service.Spec.ClusterIP,
-		PortMapping: portMapping,
-		Matchers:    matchers,
-		OtherIPs:    otherIPs,
+	return &skproxy.GatewayGenerator{
+		Routes: routes,
+	}
+}
+
+// GenerateActiveGateway generates gateway routes like GenerateGateway if the gateway is in effect
+// at now. It returns nil otherwise, in which case the gateway should be removed.
+func GenerateActiveGateway(
+	gateway *core.Gateway,
+	services map[string]*kubeCore.Service,
+	now time.Time,
+) *skproxy.GatewayGenerator {
+
+	if !gateway.IsActive(now) {
+		return nil
 	}
+	return GenerateGateway(gateway, services)
 }
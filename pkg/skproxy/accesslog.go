@@ -0,0 +1,212 @@
+package skproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// RequestIDHeader is the header carrying the id of a request across proxies.
+	RequestIDHeader = "X-Request-Id"
+	// AccessLogStdout is the access log path meaning logs go to stdout.
+	AccessLogStdout = "stdout"
+	// AccessLogJSONFormat is the access log format writing each entry as a JSON object.
+	AccessLogJSONFormat = "json"
+)
+
+// AccessLogEntry is what skproxy logs for each proxied request.
+type AccessLogEntry struct {
+	// Timestamp is the time the request is received in RFC 3339 format.
+	Timestamp string `json:"timestamp"`
+	// Method is the HTTP method of the request.
+	Method string `json:"method"`
+	// Path is the URL path of the request.
+	Path string `json:"path"`
+	// Host is the original host of the request.
+	Host string `json:"host"`
+	// Upstream is the address the request is forwarded to. It is empty if the request is rejected.
+	Upstream string `json:"upstream"`
+	// Rule is the name of the matched rule. It is empty if no rule is matched.
+	Rule string `json:"rule"`
+	// Code is the response status code.
+	Code int `json:"code"`
+	// Bytes is the size of the response body.
+	Bytes int64 `json:"bytes"`
+	// DurationMs is how long the request takes in milliseconds.
+	DurationMs float64 `json:"duration_ms"`
+	// RequestID is the id of the request.
+	RequestID string `json:"request_id"`
+	// TraceID is the id of the trace the request belongs to.
+	TraceID string `json:"trace_id"`
+}
+
+// AccessLogConfig configures the access log of skproxy.
+type AccessLogConfig struct {
+	// Path is where logs are written to, either AccessLogStdout or a file path.
+	// Access logs are disabled if it is empty.
+	Path string
+	// Format is either AccessLogJSONFormat or a text/template over AccessLogEntry,
+	// e.g. "{{.Method}} {{.Path}} {{.Code}}".
+	Format string
+	// SampleRate is the proportion of requests that are logged, ranging from 0 to 1.
+	SampleRate float64
+	// MaxSizeMB is the size of the log file in megabytes after which it is rotated.
+	// Zero means the file is never rotated.
+	MaxSizeMB int
+	// MaxBackups is the number of rotated files to keep.
+	MaxBackups int
+}
+
+// accessLogger writes access log entries according to AccessLogConfig.
+type accessLogger struct {
+	// mtx ensures entries are not interleaved.
+	mtx        sync.Mutex
+	out        io.Writer
+	template   *template.Template
+	sampleRate float64
+}
+
+// accessLog is the access logger used by all proxied requests. Nil means access logs are disabled.
+var accessLog *accessLogger = &accessLogger{
+	out:        os.Stdout,
+	sampleRate: 1,
+}
+
+// SetupAccessLog replaces the access logger with one configured by config.
+func SetupAccessLog(config *AccessLogConfig) error {
+	if config.Path == "" {
+		accessLog = nil
+		return nil
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return fmt.Errorf("sample rate %v is not between 0 and 1", config.SampleRate)
+	}
+
+	logger := &accessLogger{
+		out:        os.Stdout,
+		sampleRate: config.SampleRate,
+	}
+	if config.Format != "" && config.Format != AccessLogJSONFormat {
+		tmpl, err := template.New("accesslog").Parse(config.Format)
+		if err != nil {
+			return fmt.Errorf("invalid access log format: %v", err)
+		}
+		logger.template = tmpl
+	}
+	if config.Path != AccessLogStdout {
+		writer, err := newRotatingWriter(config.Path, int64(config.MaxSizeMB)*1024*1024, config.MaxBackups)
+		if err != nil {
+			return err
+		}
+		logger.out = writer
+	}
+	accessLog = logger
+	return nil
+}
+
+// Log writes an entry if the request is sampled.
+func (l *accessLogger) Log(entry *AccessLogEntry) {
+	if l == nil || mathrand.Float64() >= l.sampleRate {
+		return
+	}
+
+	var buf bytes.Buffer
+	if l.template == nil {
+		if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+			glog.Errorf("failed to encode access log: %v", err.Error())
+			return
+		}
+	} else {
+		if err := l.template.Execute(&buf, entry); err != nil {
+			glog.Errorf("failed to format access log: %v", err.Error())
+			return
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, err := l.out.Write(buf.Bytes()); err != nil {
+		glog.Errorf("failed to write access log: %v", err.Error())
+	}
+}
+
+// newRequestID generates a random request id.
+func newRequestID() string {
+	return randomHex(16)
+}
+
+// rotatingWriter writes to a file, and rotates it when it grows larger than maxSize.
+// Rotated files are named path.1, path.2, ... with path.1 being the newest.
+type rotatingWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	w := &rotatingWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, shifts the backups and opens a new file.
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if w.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxBackups))
+		for i := w.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.open()
+}
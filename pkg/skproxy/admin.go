@@ -0,0 +1,120 @@
+package skproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// ready is set to 1 once skproxy starts accepting proxied requests.
+var ready int32
+
+// MarkReady marks skproxy as ready to accept proxied requests.
+func MarkReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+// newAdminHandler returns the handler of the admin API, which exposes the state of m.
+//
+// The admin API includes:
+//   - GET /config_dump: the current config with its version.
+//   - GET /clusters: the upstreams of every rule with their health status.
+//   - GET /stats: a summary of the metrics in JSON.
+//   - GET /metrics: all the metrics in Prometheus text exposition format.
+//   - GET /ready: 200 if skproxy is ready to accept proxied requests.
+//   - GET /healthz: 200 if skproxy is alive.
+//   - GET /logging: the current log verbosity.
+//   - POST /logging?level=: change the log verbosity. Only allowed from localhost.
+func newAdminHandler(m *ProxyRuleManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config_dump", getOnly(func(resp http.ResponseWriter, req *http.Request) {
+		writeJSON(resp, m.DumpConfig())
+	}))
+	mux.HandleFunc("/clusters", getOnly(func(resp http.ResponseWriter, req *http.Request) {
+		writeJSON(resp, m.ListClusters())
+	}))
+	mux.HandleFunc("/stats", getOnly(func(resp http.ResponseWriter, req *http.Request) {
+		writeJSON(resp, metrics.Stats())
+	}))
+	mux.HandleFunc("/metrics", getOnly(ServeMetrics))
+	mux.HandleFunc("/ready", getOnly(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			resp.Write([]byte("NOT READY\n"))
+			return
+		}
+		resp.Write([]byte("READY\n"))
+	}))
+	mux.HandleFunc("/healthz", getOnly(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("OK\n"))
+	}))
+	mux.HandleFunc("/logging", serveLogging)
+	return mux
+}
+
+// serveLogging shows the log verbosity on GET and changes it on POST.
+func serveLogging(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		resp.Write([]byte(fmt.Sprintf("level: %v\n", flag.Lookup("v").Value.String())))
+	case http.MethodPost:
+		if !isLocalRequest(req) {
+			resp.WriteHeader(http.StatusForbidden)
+			resp.Write([]byte("mutating admin requests are only allowed from localhost\n"))
+			return
+		}
+		level := req.URL.Query().Get("level")
+		if _, err := strconv.ParseUint(level, 10, 31); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(fmt.Sprintf("invalid level %q\n", level)))
+			return
+		}
+		if err := flag.Set("v", level); err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		glog.Infof("log verbosity set to %v", level)
+		resp.Write([]byte(fmt.Sprintf("level: %v\n", level)))
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getOnly rejects requests to handler other than GET.
+func getOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		handler(resp, req)
+	}
+}
+
+// isLocalRequest returns true if req comes from the loopback interface.
+func isLocalRequest(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
@@ -0,0 +1,161 @@
+package skproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// GatewayPort is the default port number on which the gateway receives http requests
+// from outside the mesh.
+const GatewayPort uint16 = 16080
+
+// GatewayRoute is the exported version of gatewayRoute for easy serialization.
+type GatewayRoute struct {
+	// Host is the host of requests this route matches. Any host is matched if it is empty.
+	Host string
+	// PathPrefix is the prefix of the path of requests this route matches.
+	PathPrefix string
+	// ServiceIP is the IP of the service to which matched requests are forwarded.
+	ServiceIP string
+	// Port is the port of the service to which matched requests are forwarded.
+	Port uint16
+}
+
+// GatewayGenerator is the exported version of the routes of a gateway.
+// This struct should be used in configuration for easy serialization.
+type GatewayGenerator struct {
+	// Routes are the routes from requests outside the mesh to services.
+	Routes []*GatewayRoute
+}
+
+// Validate checks whether the routes of the gateway could be applied by SkGateway.
+func (g *GatewayGenerator) Validate() error {
+	for i, r := range g.Routes {
+		if r.ServiceIP == "" || r.Port == 0 {
+			return fmt.Errorf("route %d has no service IP or port", i)
+		}
+	}
+	return nil
+}
+
+// gatewayRoute tells whether a request from outside the mesh should be forwarded to a service.
+type gatewayRoute struct {
+	host       string
+	pathPrefix string
+	serviceIP  string
+	port       uint16
+}
+
+// Match returns true if the request to host with path can be routed by this route.
+func (r *gatewayRoute) Match(host string, path string) bool {
+	if r.host != "" && r.host != host {
+		return false
+	}
+	return strings.HasPrefix(path, r.pathPrefix)
+}
+
+// Gateway is the standalone mode of skproxy. It accepts requests from outside the mesh,
+// matches them against the gateway routes by host and path to find the destination service,
+// and then forwards them with the same rules as sidecar proxies.
+type Gateway struct {
+	// mtx serializes config applications.
+	mtx sync.Mutex
+	// routes holds the current []*gatewayRoute, which are sorted so that the most specific
+	// route comes first. Like rules, it is swapped atomically as a whole.
+	routes atomic.Value
+	// ruleManager manages the rules of services.
+	ruleManager *ProxyRuleManager
+}
+
+func NewGateway() *Gateway {
+	g := &Gateway{
+		ruleManager: NewProxyRuleManager(),
+	}
+	g.routes.Store([]*gatewayRoute{})
+	return g
+}
+
+// ApplyConfig replaces all the routes and rules of the gateway with config. If any part
+// of config is invalid, the whole config is rejected and the current one is kept.
+func (g *Gateway) ApplyConfig(config *Config) error {
+	routes := make([]*gatewayRoute, 0)
+	for name, generator := range config.Gateways {
+		if generator == nil {
+			return fmt.Errorf("gateway %s: empty gateway", name)
+		}
+		if err := generator.Validate(); err != nil {
+			return fmt.Errorf("gateway %s: %v", name, err)
+		}
+		for _, r := range generator.Routes {
+			routes = append(routes, &gatewayRoute{
+				host:       strings.ToLower(r.Host),
+				pathPrefix: r.PathPrefix,
+				serviceIP:  r.ServiceIP,
+				port:       r.Port,
+			})
+		}
+	}
+	// Longer path prefixes and routes with host come first.
+	sort.SliceStable(routes, func(i, j int) bool {
+		if len(routes[i].pathPrefix) != len(routes[j].pathPrefix) {
+			return len(routes[i].pathPrefix) > len(routes[j].pathPrefix)
+		}
+		return routes[i].host != "" && routes[j].host == ""
+	})
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if err := g.ruleManager.ApplyConfig(config); err != nil {
+		return err
+	}
+	g.routes.Store(routes)
+	SetTraceSampleRate(config.TraceSampleRate)
+	return nil
+}
+
+// AppliedVersion returns the version of the config applied to the gateway.
+func (g *Gateway) AppliedVersion() uint64 {
+	return g.ruleManager.DumpConfig().Version
+}
+
+// matchRoute finds the most specific route for a request. Returns nil if there is none.
+func (g *Gateway) matchRoute(req *http.Request) *gatewayRoute {
+	host := strings.ToLower(getHost(req))
+	for _, r := range g.routes.Load().([]*gatewayRoute) {
+		if r.Match(host, req.URL.Path) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	// Serve http request only.
+	if !strings.HasPrefix(req.Proto, "HTTP") {
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte("only http is supported"))
+		return
+	}
+	req.URL.Scheme = "http"
+
+	route := g.matchRoute(req)
+	if route == nil {
+		glog.Warningf("no gateway route for %v%v", req.Host, req.URL.Path)
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("no route matched"))
+		return
+	}
+
+	ForwardRequest(g.ruleManager, resp, req, route.serviceIP, route.port)
+}
+
+// AdminHandler returns the handler of the admin port of the gateway.
+func (g *Gateway) AdminHandler() http.Handler {
+	return newAdminHandler(g.ruleManager)
+}
@@ -0,0 +1,132 @@
+package skproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// staleUpstreamTimeout is how long an upstream receiving no request is tracked. Upstreams
+	// of ALLOW_ANY requests come and go, so they must not be tracked forever.
+	staleUpstreamTimeout = time.Minute * 10
+	// pruneInterval is how often stale upstreams are looked for.
+	pruneInterval = time.Minute
+)
+
+// UpstreamStatus is the health status of an upstream.
+type UpstreamStatus struct {
+	// Healthy is false if the upstream is currently ejected.
+	Healthy bool
+	// EjectedUntil is when the upstream will be selected again if it is ejected.
+	EjectedUntil *time.Time `json:",omitempty"`
+	// Requests is the number of requests forwarded to the upstream.
+	Requests uint64
+	// Failures is the number of failed requests forwarded to the upstream.
+	Failures uint64
+	// ConsecutiveFailures is the number of failed requests since the last successful one.
+	ConsecutiveFailures int
+	// Ejections is the number of times the upstream has been ejected.
+	Ejections int
+}
+
+// upstreamStats is the health of an upstream. Its fields are accessed atomically, so that
+// requests to different upstreams never contend.
+type upstreamStats struct {
+	requests            uint64
+	failures            uint64
+	consecutiveFailures int64
+	ejections           int64
+	// ejectedUntil is when the last ejection ends in Unix nanoseconds, or zero if the
+	// upstream has never been ejected.
+	ejectedUntil int64
+	// lastUsed is when the last request was forwarded to the upstream in Unix nanoseconds.
+	lastUsed int64
+}
+
+// isEjected tells whether the upstream is ejected at now.
+func (s *upstreamStats) isEjected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&s.ejectedUntil)
+}
+
+// healthTracker passively tracks the health of upstreams by the results of proxied requests.
+// Upstreams are ejected by outlier detection, and the tracker reports whether they are.
+type healthTracker struct {
+	// upstreams maps the host of an upstream to its *upstreamStats.
+	upstreams sync.Map
+	// lastPruned is when stale upstreams were last pruned in Unix nanoseconds.
+	lastPruned int64
+}
+
+// upstreamHealth tracks all upstreams skproxy forwards requests to.
+var upstreamHealth = &healthTracker{}
+
+// RecordResult records the result of a request forwarded to host at now, and returns the
+// stats of the upstream.
+func (t *healthTracker) RecordResult(host string, failed bool, now time.Time) *upstreamStats {
+	stats := t.getOrCreate(host, now)
+	atomic.AddUint64(&stats.requests, 1)
+	atomic.StoreInt64(&stats.lastUsed, now.UnixNano())
+	if !failed {
+		atomic.StoreInt64(&stats.consecutiveFailures, 0)
+		return stats
+	}
+	atomic.AddUint64(&stats.failures, 1)
+	atomic.AddInt64(&stats.consecutiveFailures, 1)
+	return stats
+}
+
+// IsEjected returns true if host is currently ejected.
+func (t *healthTracker) IsEjected(host string) bool {
+	stats, ok := t.upstreams.Load(host)
+	return ok && stats.(*upstreamStats).isEjected(time.Now())
+}
+
+// Status returns the health status of host.
+func (t *healthTracker) Status(host string) UpstreamStatus {
+	value, ok := t.upstreams.Load(host)
+	if !ok {
+		return UpstreamStatus{Healthy: true}
+	}
+	stats := value.(*upstreamStats)
+	ret := UpstreamStatus{
+		Healthy:             !stats.isEjected(time.Now()),
+		Requests:            atomic.LoadUint64(&stats.requests),
+		Failures:            atomic.LoadUint64(&stats.failures),
+		ConsecutiveFailures: int(atomic.LoadInt64(&stats.consecutiveFailures)),
+		Ejections:           int(atomic.LoadInt64(&stats.ejections)),
+	}
+	if !ret.Healthy {
+		until := time.Unix(0, atomic.LoadInt64(&stats.ejectedUntil))
+		ret.EjectedUntil = &until
+	}
+	return ret
+}
+
+// getOrCreate returns the stats of host, which are created if host is not tracked yet. Stale
+// upstreams are pruned from time to time when an upstream is created.
+func (t *healthTracker) getOrCreate(host string, now time.Time) *upstreamStats {
+	if stats, ok := t.upstreams.Load(host); ok {
+		return stats.(*upstreamStats)
+	}
+	stats, loaded := t.upstreams.LoadOrStore(host, &upstreamStats{lastUsed: now.UnixNano()})
+	if !loaded {
+		last := atomic.LoadInt64(&t.lastPruned)
+		if now.UnixNano()-last > int64(pruneInterval) && atomic.CompareAndSwapInt64(&t.lastPruned, last, now.UnixNano()) {
+			t.prune(now)
+		}
+	}
+	return stats.(*upstreamStats)
+}
+
+// prune stops tracking the upstreams receiving no request for staleUpstreamTimeout, unless
+// they are ejected.
+func (t *healthTracker) prune(now time.Time) {
+	t.upstreams.Range(func(host, value interface{}) bool {
+		stats := value.(*upstreamStats)
+		if now.UnixNano()-atomic.LoadInt64(&stats.lastUsed) > int64(staleUpstreamTimeout) && !stats.isEjected(now) {
+			t.upstreams.Delete(host)
+		}
+		return true
+	})
+}
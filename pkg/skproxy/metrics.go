@@ -0,0 +1,357 @@
+package skproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request latency histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics collects the statistics of all proxied requests.
+var metrics = newProxyMetrics()
+
+// requestKey identifies a series of requests.
+type requestKey struct {
+	service   string
+	upstream  string
+	codeClass string
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	// counts[i] is the number of observations not greater than latencyBuckets[i].
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// proxyMetrics holds the counters and histograms exposed on the metrics endpoint.
+type proxyMetrics struct {
+	// mtx ensures safe concurrent access to the maps.
+	mtx sync.Mutex
+	// requests counts requests by service, upstream and status code class.
+	requests map[requestKey]uint64
+	// latencies is the histogram of request latencies by service.
+	latencies map[string]*histogram
+	// upstreams holds the statistics of requests by upstream address.
+	upstreams map[string]*UpstreamStats
+	// retries counts retried requests by service.
+	retries map[string]uint64
+	// ruleHits counts requests matching a rule by rule name.
+	ruleHits map[string]uint64
+	// activeConnections is the number of open downstream connections.
+	activeConnections int64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests:  map[requestKey]uint64{},
+		latencies: map[string]*histogram{},
+		upstreams: map[string]*UpstreamStats{},
+		retries:   map[string]uint64{},
+		ruleHits:  map[string]uint64{},
+	}
+}
+
+// ObserveRequest records a finished request to service, which is forwarded to upstream.
+// upstream is empty if the request is not forwarded at all.
+func (m *proxyMetrics) ObserveRequest(service string, upstream string, code int, duration time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.requests[requestKey{
+		service:   service,
+		upstream:  upstream,
+		codeClass: fmt.Sprintf("%dxx", code/100),
+	}]++
+	h, ok := m.latencies[service]
+	if !ok {
+		h = newHistogram()
+		m.latencies[service] = h
+	}
+	h.Observe(duration.Seconds())
+	if upstream != "" {
+		s, ok := m.upstreams[upstream]
+		if !ok {
+			s = newUpstreamStats()
+			m.upstreams[upstream] = s
+		}
+		s.Observe(code, duration)
+	}
+}
+
+// IncRetries records a retry of a request to service.
+func (m *proxyMetrics) IncRetries(service string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.retries[service]++
+}
+
+// IncRuleHits records a request matching the rule.
+func (m *proxyMetrics) IncRuleHits(rule string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.ruleHits[rule]++
+}
+
+// ProxyStats is a summary of the metrics of skproxy.
+type ProxyStats struct {
+	// Requests is the total number of proxied requests.
+	Requests uint64
+	// RequestsByCodeClass maps status code class, e.g. "2xx", to the number of requests.
+	RequestsByCodeClass map[string]uint64
+	// RequestsByService maps service to the number of requests.
+	RequestsByService map[string]uint64
+	// Retries is the total number of retried requests.
+	Retries uint64
+	// RuleHits maps rule name to the number of requests matching it.
+	RuleHits map[string]uint64
+	// ActiveConnections is the number of open downstream connections.
+	ActiveConnections int64
+	// Upstreams maps the address of an upstream to the statistics of requests forwarded to it.
+	Upstreams map[string]*UpstreamStats `json:",omitempty"`
+}
+
+// Stats returns a summary of the metrics.
+func (m *proxyMetrics) Stats() *ProxyStats {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	stats := &ProxyStats{
+		RequestsByCodeClass: map[string]uint64{},
+		RequestsByService:   map[string]uint64{},
+		RuleHits:            map[string]uint64{},
+		ActiveConnections:   atomic.LoadInt64(&m.activeConnections),
+		Upstreams:           map[string]*UpstreamStats{},
+	}
+	for k, n := range m.requests {
+		stats.Requests += n
+		stats.RequestsByCodeClass[k.codeClass] += n
+		stats.RequestsByService[k.service] += n
+	}
+	for _, n := range m.retries {
+		stats.Retries += n
+	}
+	for rule, n := range m.ruleHits {
+		stats.RuleHits[rule] = n
+	}
+	for upstream, s := range m.upstreams {
+		stats.Upstreams[upstream] = s.Copy()
+	}
+	return stats
+}
+
+// UpstreamStats is the statistics of requests forwarded to an upstream.
+type UpstreamStats struct {
+	// Requests is the number of requests.
+	Requests uint64
+	// Failures is the number of requests responded with 5xx, including those failed to be
+	// forwarded.
+	Failures uint64
+	// LatencyCounts[i] is the number of requests not slower than the i-th latency bucket.
+	LatencyCounts []uint64
+}
+
+func newUpstreamStats() *UpstreamStats {
+	return &UpstreamStats{
+		LatencyCounts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+// Observe records a request responded with code after duration.
+func (s *UpstreamStats) Observe(code int, duration time.Duration) {
+	s.Requests++
+	if code >= 500 {
+		s.Failures++
+	}
+	for i, bound := range latencyBuckets {
+		if duration.Seconds() <= bound {
+			s.LatencyCounts[i]++
+		}
+	}
+}
+
+// Copy returns a deep copy of s.
+func (s *UpstreamStats) Copy() *UpstreamStats {
+	ret := *s
+	ret.LatencyCounts = append([]uint64{}, s.LatencyCounts...)
+	return &ret
+}
+
+// Add adds the requests in other to s.
+func (s *UpstreamStats) Add(other *UpstreamStats) {
+	if len(s.LatencyCounts) < len(latencyBuckets) {
+		s.LatencyCounts = append(s.LatencyCounts, make([]uint64, len(latencyBuckets)-len(s.LatencyCounts))...)
+	}
+	s.Requests += other.Requests
+	s.Failures += other.Failures
+	for i := range latencyBuckets {
+		if i < len(other.LatencyCounts) {
+			s.LatencyCounts[i] += other.LatencyCounts[i]
+		}
+	}
+}
+
+// Since returns the requests in s that are not in base, where s is a later snapshot of the same
+// counters. It returns false if the counters have been reset in between.
+func (s *UpstreamStats) Since(base *UpstreamStats) (*UpstreamStats, bool) {
+	if s.Requests < base.Requests || s.Failures < base.Failures {
+		return nil, false
+	}
+	ret := newUpstreamStats()
+	ret.Requests = s.Requests - base.Requests
+	ret.Failures = s.Failures - base.Failures
+	for i := range latencyBuckets {
+		var n, baseN uint64
+		if i < len(s.LatencyCounts) {
+			n = s.LatencyCounts[i]
+		}
+		if i < len(base.LatencyCounts) {
+			baseN = base.LatencyCounts[i]
+		}
+		if n < baseN {
+			return nil, false
+		}
+		ret.LatencyCounts[i] = n - baseN
+	}
+	return ret, true
+}
+
+// SuccessRate returns the percentage of requests not failed. It is 100 if there are no requests.
+func (s *UpstreamStats) SuccessRate() float64 {
+	if s.Requests == 0 {
+		return 100
+	}
+	return float64(s.Requests-s.Failures) * 100 / float64(s.Requests)
+}
+
+// LatencyQuantile returns the upper bound of the latency bucket the q-quantile falls in, e.g.
+// q = 0.99 for the 99th percentile, which is zero if there are no requests. It returns false
+// with the upper bound of the slowest bucket if the quantile is even slower.
+func (s *UpstreamStats) LatencyQuantile(q float64) (time.Duration, bool) {
+	if s.Requests == 0 {
+		return 0, true
+	}
+	rank := q * float64(s.Requests)
+	for i, bound := range latencyBuckets {
+		if i < len(s.LatencyCounts) && float64(s.LatencyCounts[i]) >= rank {
+			return time.Duration(bound * float64(time.Second)), true
+		}
+	}
+	return time.Duration(latencyBuckets[len(latencyBuckets)-1] * float64(time.Second)), false
+}
+
+// Write writes all metrics in Prometheus text exposition format.
+func (m *proxyMetrics) Write(w io.Writer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	writeHeader(w, "skproxy_requests_total", "counter", "Total number of proxied requests.")
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.upstream != b.upstream {
+			return a.upstream < b.upstream
+		}
+		return a.codeClass < b.codeClass
+	})
+	for _, k := range requestKeys {
+		fmt.Fprintf(w, "skproxy_requests_total{service=\"%s\",upstream=\"%s\",code_class=\"%s\"} %d\n",
+			escapeLabel(k.service), escapeLabel(k.upstream), k.codeClass, m.requests[k])
+	}
+
+	writeHeader(w, "skproxy_request_duration_seconds", "histogram", "Latency of proxied requests.")
+	services := make([]string, 0, len(m.latencies))
+	for service := range m.latencies {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		h := m.latencies[service]
+		label := escapeLabel(service)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "skproxy_request_duration_seconds_bucket{service=\"%s\",le=\"%g\"} %d\n",
+				label, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "skproxy_request_duration_seconds_bucket{service=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "skproxy_request_duration_seconds_sum{service=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(w, "skproxy_request_duration_seconds_count{service=\"%s\"} %d\n", label, h.count)
+	}
+
+	writeHeader(w, "skproxy_retries_total", "counter", "Total number of retried requests.")
+	for _, service := range sortedKeys(m.retries) {
+		fmt.Fprintf(w, "skproxy_retries_total{service=\"%s\"} %d\n", escapeLabel(service), m.retries[service])
+	}
+
+	writeHeader(w, "skproxy_rule_hits_total", "counter", "Total number of requests matching a rule.")
+	for _, rule := range sortedKeys(m.ruleHits) {
+		fmt.Fprintf(w, "skproxy_rule_hits_total{rule=\"%s\"} %d\n", escapeLabel(rule), m.ruleHits[rule])
+	}
+
+	writeHeader(w, "skproxy_active_connections", "gauge", "Number of open downstream connections.")
+	fmt.Fprintf(w, "skproxy_active_connections %d\n", atomic.LoadInt64(&m.activeConnections))
+}
+
+func writeHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// escapeLabel escapes a label value as required by the text exposition format.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TrackConnState keeps track of the number of open downstream connections.
+// It should be used as the ConnState hook of the server accepting proxied requests.
+func TrackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&metrics.activeConnections, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&metrics.activeConnections, -1)
+	}
+}
+
+// ServeMetrics serves all metrics of skproxy in Prometheus text exposition format.
+func ServeMetrics(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Write(resp)
+}
@@ -0,0 +1,56 @@
+package skproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// consecutiveFailuresToEject is the default number of consecutive failed requests after which
+	// an upstream is ejected.
+	consecutiveFailuresToEject = 5
+	// baseEjectionTime is how long an upstream is ejected for the first time by default. It is multiplied
+	// by the number of times the upstream has been ejected.
+	baseEjectionTime = time.Second * 30
+	// maxEjectionTime is the longest time an upstream can be ejected.
+	maxEjectionTime = time.Minute * 5
+)
+
+// detectOutlier records the result of a request forwarded to host, and ejects the upstream
+// from load balancing for a while if it keeps failing under the outlier detection of policy,
+// which uses the defaults if it is nil.
+func detectOutlier(host string, failed bool, policy *TrafficPolicy) {
+	now := time.Now()
+	stats := upstreamHealth.RecordResult(host, failed, now)
+	if !failed {
+		return
+	}
+	failures := atomic.LoadInt64(&stats.consecutiveFailures)
+	failuresToEject, baseTime := ejectionThresholds(policy)
+	if failures < int64(failuresToEject) || stats.isEjected(now) {
+		return
+	}
+	// Only the request resetting the count ejects the upstream.
+	if !atomic.CompareAndSwapInt64(&stats.consecutiveFailures, failures, 0) {
+		return
+	}
+	ejections := atomic.AddInt64(&stats.ejections, 1)
+	ejectionTime := baseTime * time.Duration(ejections)
+	if ejectionTime > maxEjectionTime {
+		ejectionTime = maxEjectionTime
+	}
+	atomic.StoreInt64(&stats.ejectedUntil, now.Add(ejectionTime).UnixNano())
+}
+
+// ejectionThresholds returns the number of consecutive failures to eject an upstream and the
+// base ejection time under policy, which may be nil.
+func ejectionThresholds(policy *TrafficPolicy) (int, time.Duration) {
+	failures, ejectionTime := consecutiveFailuresToEject, baseEjectionTime
+	if policy != nil && policy.ConsecutiveErrors > 0 {
+		failures = policy.ConsecutiveErrors
+	}
+	if policy != nil && policy.BaseEjectionTimeMs > 0 {
+		ejectionTime = time.Duration(policy.BaseEjectionTimeMs) * time.Millisecond
+	}
+	return failures, ejectionTime
+}
@@ -0,0 +1,105 @@
+package skproxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// LoadBalancer is how an upstream is selected among the hosts of a cluster.
+type LoadBalancer string
+
+const (
+	// RoundRobin selects the hosts in turn. It is the default.
+	RoundRobin LoadBalancer = "ROUND_ROBIN"
+	// Random selects a host at random.
+	Random LoadBalancer = "RANDOM"
+)
+
+// TLSMode is whether requests to the upstreams of a cluster are sent over TLS.
+type TLSMode string
+
+const (
+	// TLSDisable sends plain HTTP requests. It is the default.
+	TLSDisable TLSMode = "DISABLE"
+	// TLSSimple sends HTTPS requests, verifying the certificates of the upstreams.
+	TLSSimple TLSMode = "SIMPLE"
+)
+
+// TrafficPolicy describes how requests are sent to the upstreams of a cluster. Zero values
+// mean the defaults.
+type TrafficPolicy struct {
+	// LoadBalancer is how an upstream is selected for a request.
+	LoadBalancer LoadBalancer `json:",omitempty"`
+	// MaxRequests is the maximum number of concurrent requests to each upstream. Requests
+	// beyond the limit fail at once. Zero means no limit.
+	MaxRequests int `json:",omitempty"`
+	// ConsecutiveErrors is the number of consecutive failed requests after which an upstream
+	// is ejected.
+	ConsecutiveErrors int `json:",omitempty"`
+	// BaseEjectionTimeMs is how long an upstream is ejected for the first time in milliseconds.
+	BaseEjectionTimeMs int `json:",omitempty"`
+	// TLSMode is whether requests are sent over TLS.
+	TLSMode TLSMode `json:",omitempty"`
+}
+
+// validate checks whether the values of a policy are valid.
+func (p *TrafficPolicy) validate() error {
+	switch p.LoadBalancer {
+	case "", RoundRobin, Random:
+	default:
+		return fmt.Errorf("unknown load balancer %v", p.LoadBalancer)
+	}
+	switch p.TLSMode {
+	case "", TLSDisable, TLSSimple:
+	default:
+		return fmt.Errorf("unknown TLS mode %v", p.TLSMode)
+	}
+	if p.MaxRequests < 0 || p.ConsecutiveErrors < 0 || p.BaseEjectionTimeMs < 0 {
+		return fmt.Errorf("limits of traffic policy cannot be negative")
+	}
+	return nil
+}
+
+// validateTrafficPolicy checks policy, which may be nil.
+func validateTrafficPolicy(policy *TrafficPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	return policy.validate()
+}
+
+// requestLimiter limits the number of concurrent requests to each upstream.
+type requestLimiter struct {
+	// mtx ensures safe concurrent access.
+	mtx sync.Mutex
+	// active maps the address of an upstream to the number of requests in flight.
+	active map[string]int
+}
+
+// upstreamRequests limits the requests to all upstreams skproxy forwards requests to.
+var upstreamRequests = &requestLimiter{
+	active: map[string]int{},
+}
+
+// Acquire counts a request to address in, and returns false if there are already max
+// requests in flight, in which case the request must not be sent. Zero max means no limit.
+// Release must be called after a successful Acquire once the request finishes.
+func (l *requestLimiter) Acquire(address string, max int) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if max > 0 && l.active[address] >= max {
+		return false
+	}
+	l.active[address]++
+	return true
+}
+
+// Release counts a finished request to address out.
+func (l *requestLimiter) Release(address string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.active[address]--
+	if l.active[address] <= 0 {
+		delete(l.active, address)
+	}
+}
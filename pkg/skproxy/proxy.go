@@ -1,6 +1,8 @@
 package skproxy
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +10,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -17,6 +20,8 @@ const (
 	ProxyPort uint16 = 16000
 	// ConfigPort is the port number on which skproxy receives http requests for configuration.
 	ConfigPort uint16 = 16001
+	// AdminPort is the port number on which skproxy serves the admin API.
+	AdminPort uint16 = 16002
 )
 
 var ruleManager *ProxyRuleManager = NewProxyRuleManager()
@@ -37,69 +42,181 @@ func getPort(req *http.Request) (uint16, error) {
 	return uint16(port), nil
 }
 
-// getNewAddress looks up the proxy rules and determine which IP/domain and port
-// the original request should be forwarded to.
-// The returned address will contain the new host and port. Port 80 will not be omitted.
-func getNewAddress(req *http.Request, host string, port uint16) string {
-	// Currently just forward as is.
-	return ruleManager.GetProxiedAddress(req, host, port)
+// getHost extracts the target host from the request, with port stripped off.
+func getHost(req *http.Request) string {
+	host := req.Host
+	colonIdx := strings.LastIndex(host, ":")
+	if colonIdx != -1 {
+		host = host[0:colonIdx]
+	}
+	return host
 }
 
 // buildNewRequest builds a new request based on the original request, except that
-// the host and port might be altered based on proxy rules.
-func buildNewRequest(req *http.Request) (*http.Request, error) {
+// the host and port might be altered based on proxy rules in m.
+func buildNewRequest(m *ProxyRuleManager, req *http.Request, host string, port uint16) (*http.Request, *Route, error) {
 	// NOTE: Some fields in newReq are shallow copied, but it seems fine.
 	newReq := new(http.Request)
 	*newReq = *req
 
-	// Get original port.
-	port, err := getPort(req)
+	// Look up the proxy rules to determine which IP/domain and port the original
+	// request should be forwarded to.
+	route, err := m.GetRoute(req, host, port)
 	if err != nil {
-		return nil, fmt.Errorf("invalid request port: %v", err.Error())
-	}
-
-	// Strip off port from original host.
-	host := req.Host
-	colonIdx := strings.LastIndex(host, ":")
-	if colonIdx != -1 {
-		host = host[0:colonIdx]
+		return nil, nil, err
 	}
 
 	// Modify new request data.
-	newHost := getNewAddress(req, host, port)
-	newReq.Host = newHost
-	newReq.URL.Host = newHost
+	newURL := *req.URL
+	newURL.Host = route.Address
+	if route.Traffic != nil && route.Traffic.TLSMode == TLSSimple {
+		newURL.Scheme = "https"
+	}
+	newReq.Host = route.Address
+	newReq.URL = &newURL
 	newReq.RequestURI = newReq.URL.String()
 
-	return newReq, nil
+	return newReq, route, nil
 }
 
-func ProxyRequest(resp http.ResponseWriter, req *http.Request) {
+// forwardRequest sends the request according to the retry and timeout policy of the route, and
+// records the results under the outlier detection of traffic, which may be nil. The returned
+// cancel function must be called after the response body is consumed.
+func forwardRequest(
+	req *http.Request,
+	policy RoutePolicy,
+	traffic *TrafficPolicy,
+	service string,
+) (*http.Response, context.CancelFunc, error) {
 	transport := http.DefaultTransport
 
-	// Serve http request only.
-	if !strings.HasPrefix(req.Proto, "HTTP") {
-		resp.WriteHeader(http.StatusBadGateway)
-		resp.Write([]byte("only http is supported"))
-		return
+	// Buffer the body so that it can be replayed on retries.
+	var body []byte
+	if policy.Retries > 0 && req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt <= policy.Retries; attempt++ {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if policy.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		}
+		attemptReq := req.WithContext(ctx)
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err = transport.RoundTrip(attemptReq)
+		detectOutlier(getHost(req), err != nil || isRetriableStatus(resp.StatusCode), traffic)
+		if err == nil && !isRetriableStatus(resp.StatusCode) {
+			return resp, cancel, nil
+		}
+		if attempt == policy.Retries {
+			if err != nil {
+				cancel()
+				return nil, nil, err
+			}
+			return resp, cancel, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		metrics.IncRetries(service)
+		glog.Warningf("retrying %v (attempt %v/%v)", req.Host, attempt+1, policy.Retries)
+	}
+	return nil, nil, err
+}
+
+// isRetriableStatus returns true if a response with status code should be retried.
+func isRetriableStatus(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// ForwardRequest forwards a request destined to host:port according to the rules in m,
+// and writes the forwarded response back.
+func ForwardRequest(m *ProxyRuleManager, resp http.ResponseWriter, req *http.Request, host string, port uint16) {
+	start := time.Now()
+	service := fmt.Sprintf("%v:%v", host, port)
+
+	// Make sure the request can be identified across proxies.
+	requestID := req.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	entry := &AccessLogEntry{
+		Timestamp: start.Format(time.RFC3339Nano),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Host:      req.Host,
+		RequestID: requestID,
+	}
+	var s *span
+	finish := func(code int, bytes int64) {
+		if s != nil {
+			tracing.FinishSpan(s, code)
+		}
+		duration := time.Since(start)
+		entry.Code = code
+		entry.Bytes = bytes
+		entry.DurationMs = float64(duration) / float64(time.Millisecond)
+		accessLog.Log(entry)
+		metrics.ObserveRequest(service, entry.Upstream, code, duration)
 	}
-	req.URL.Scheme = "http"
 
 	// Build new request.
-	newReq, err := buildNewRequest(req)
+	newReq, route, err := buildNewRequest(m, req, host, port)
 	if err != nil {
+		glog.Warningf("request to %v%v rejected: %v", req.Host, req.URL.Path, err.Error())
 		resp.WriteHeader(http.StatusBadGateway)
-		resp.Write([]byte(fmt.Sprintf("invalid request port: %v", err.Error())))
+		n, _ := resp.Write([]byte(err.Error()))
+		finish(http.StatusBadGateway, int64(n))
 		return
 	}
+	newReq.Header = req.Header.Clone()
+	newReq.Header.Set(RequestIDHeader, requestID)
+	entry.Upstream = route.Address
+	entry.Rule = route.RuleName
+	s = tracing.StartSpan(req, newReq)
+	s.attributes["http.method"] = req.Method
+	s.attributes["http.target"] = req.URL.RequestURI()
+	s.attributes["http.host"] = req.Host
+	s.attributes["skafos.upstream"] = route.Address
+	s.attributes["skafos.rule"] = route.RuleName
+	s.attributes["skafos.request_id"] = requestID
+	entry.TraceID = s.traceID
+	if route.RuleName != "" {
+		metrics.IncRuleHits(route.RuleName)
+	}
 
-	// Send the new request.
-	glog.Infof(fmt.Sprintf("%v %v -> %v", req.Host, req.URL.Path, newReq.RequestURI))
-	forwardedResp, err := transport.RoundTrip(newReq)
+	// Send the new request, unless the upstream has too many requests in flight.
+	maxRequests := 0
+	if route.Traffic != nil {
+		maxRequests = route.Traffic.MaxRequests
+	}
+	if !upstreamRequests.Acquire(route.Address, maxRequests) {
+		glog.Warningf("request to %v%v rejected: too many requests to %v", req.Host, req.URL.Path, route.Address)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		n, _ := resp.Write([]byte(fmt.Sprintf("too many requests to %v", route.Address)))
+		finish(http.StatusServiceUnavailable, int64(n))
+		return
+	}
+	defer upstreamRequests.Release(route.Address)
+	forwardedResp, cancel, err := forwardRequest(newReq, route.Policy, route.Traffic, service)
 	if err != nil {
 		resp.WriteHeader(http.StatusBadGateway)
+		finish(http.StatusBadGateway, 0)
 		return
 	}
+	defer cancel()
 
 	// Copy response.
 	for k, vs := range forwardedResp.Header {
@@ -108,35 +225,94 @@ func ProxyRequest(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 	resp.WriteHeader(forwardedResp.StatusCode)
-	io.Copy(resp, forwardedResp.Body)
+	n, _ := io.Copy(resp, forwardedResp.Body)
 	forwardedResp.Body.Close()
+	finish(forwardedResp.StatusCode, n)
+}
+
+func ProxyRequest(resp http.ResponseWriter, req *http.Request) {
+	// Serve http request only.
+	if !strings.HasPrefix(req.Proto, "HTTP") {
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte("only http is supported"))
+		return
+	}
+	req.URL.Scheme = "http"
+
+	// Get original port.
+	port, err := getPort(req)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte(fmt.Sprintf("invalid request port: %v", err.Error())))
+		return
+	}
+
+	ForwardRequest(ruleManager, resp, req, getHost(req), port)
+}
+
+// ConfigAck is the response of skproxy to a config. The config is accepted (ACK) if Error is
+// empty. Otherwise it is rejected (NACK), and Version is that of the config still in use.
+type ConfigAck struct {
+	// Version is the config version running on the proxy.
+	Version uint64
+	// Nonce is the nonce of the received config.
+	Nonce string
+	// Error is why the config is rejected.
+	Error string `json:",omitempty"`
 }
 
+// SetConfig applies the config in the request body and responds with a ConfigAck.
 func SetConfig(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		glog.Errorf("failed to read request body: %v", err.Error())
+		writeConfigAck(resp, "", fmt.Errorf("failed to read request body: %v", err.Error()))
 		return
 	}
 
 	var config Config
 	err = json.Unmarshal(data, &config)
 	if err != nil {
+		// Keep the current rules rather than clearing them for a config we cannot read.
 		glog.Errorf("failed to unmarshal config: %v", err.Error())
+		writeConfigAck(resp, "", fmt.Errorf("failed to unmarshal config: %v", err.Error()))
+		return
 	}
 
-	glog.Infof("config received")
-	ruleManager.ClearRules()
-	for name, ratioRuleGenerator := range config.RatioRules {
-		err := ruleManager.SetRule(name, ratioRuleGenerator)
-		if err != nil {
-			glog.Errorf("failed to add ratio rule %+v: %v", ratioRuleGenerator, err.Error())
-		}
+	glog.Infof("config version %v received", config.Version)
+	if err := ruleManager.ApplyConfig(&config); err != nil {
+		glog.Errorf("config rejected: %v", err.Error())
+		writeConfigAck(resp, config.Nonce, err)
+		return
 	}
-	for name, regexRuleGenerator := range config.RegexRules {
-		err := ruleManager.SetRule(name, regexRuleGenerator)
-		if err != nil {
-			glog.Errorf("failed to add regex rule %+v: %v", regexRuleGenerator, err.Error())
-		}
+	// The sample rate has been validated with the rest of the config.
+	SetTraceSampleRate(config.TraceSampleRate)
+	writeConfigAck(resp, config.Nonce, nil)
+}
+
+// writeConfigAck responds with an ACK if err is nil, or a NACK with 400 otherwise.
+func writeConfigAck(resp http.ResponseWriter, nonce string, err error) {
+	ack := ConfigAck{
+		Version: ruleManager.DumpConfig().Version,
+		Nonce:   nonce,
+	}
+	code := http.StatusOK
+	if err != nil {
+		ack.Error = err.Error()
+		code = http.StatusBadRequest
 	}
+	data, _ := json.Marshal(ack)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	resp.Write(data)
+}
+
+// NewAdminHandler returns the handler of the admin port of skproxy.
+func NewAdminHandler() http.Handler {
+	return newAdminHandler(ruleManager)
 }
@@ -6,7 +6,11 @@ import (
 	"math/rand"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // IMPORTANT: Any IP address or domain name must not contain http:// or ending slash.
@@ -29,10 +33,27 @@ import (
 type ProxyRule interface {
 	// CanProxyRequest returns true if this proxy rule can forward host:port to some other address.
 	CanProxyRequest(host string, port uint16) bool
-	// GetProxiedAddress returns the proxied address. We still pass in host and port, because
-	// they cannot be easily extracted from the original request object. The caller must compute host and port
-	// and ensure they are valid.
-	GetProxiedAddress(req *http.Request, host string, port uint16) (string, error)
+	// GetProxiedAddress returns the proxied address, and the name of the cluster from which it is
+	// selected. We still pass in host and port, because they cannot be easily extracted from the
+	// original request object. The caller must compute host and port and ensure they are valid.
+	GetProxiedAddress(req *http.Request, host string, port uint16) (string, string, error)
+	// Clusters returns the sets of upstreams requests may be forwarded to by this rule.
+	Clusters() []*Cluster
+}
+
+// Cluster is a set of upstreams of a rule, among which one will be selected for a request.
+type Cluster struct {
+	// Name tells which part of the rule the cluster belongs to, e.g. "proxied" for a ratio rule.
+	Name string
+	// Hosts are the IPs or domain names of the upstreams.
+	Hosts []string
+	// PortMapping maps the requested port to the upstream port. It is nil if the port is kept.
+	PortMapping map[uint16]uint16 `json:",omitempty"`
+	// Rule is the name of the user rule the cluster comes from, if the proxy rule is merged
+	// from several of them.
+	Rule string `json:",omitempty"`
+	// Policy is how requests are sent to the upstreams. It is nil for the defaults.
+	Policy *TrafficPolicy `json:",omitempty"`
 }
 
 // ruleBase is the part of a ProxyRule that corresponds to service info.
@@ -73,33 +94,42 @@ type ratioRule struct {
 	ratio int
 	// proxiedIPs is the set of IPs from which the new IP will be selected
 	// for the ratio of requests.
-	proxiedIPs *ipRRSelector
+	proxiedIPs *ipSelector
 	// otherIPs is the set of IPs from which the new IP will be selected
 	// for (1 - ratio%) of requests.
-	otherIPs *ipRRSelector
+	otherIPs *ipSelector
 }
 
 func (r *ratioRule) CanProxyRequest(host string, port uint16) bool {
 	return r.base.CanProxyRequest(host, port)
 }
 
-func (r *ratioRule) GetProxiedAddress(req *http.Request, host string, port uint16) (string, error) {
+func (r *ratioRule) GetProxiedAddress(req *http.Request, host string, port uint16) (string, string, error) {
 	if !r.CanProxyRequest(host, port) {
-		return "", errors.New("%v:%p cannot be proxied by this rule")
+		return "", "", errors.New("%v:%p cannot be proxied by this rule")
 	}
 
 	rand := rand.Intn(100)
 	var err error
 	var ip string
+	cluster := "proxied"
 	if rand < r.ratio {
 		ip, err = r.proxiedIPs.NextIP()
 	} else {
+		cluster = "other"
 		ip, err = r.otherIPs.NextIP()
 	}
 	if err != nil {
-		return "", err
+		return "", "", err
 	} else {
-		return fmt.Sprintf("%v:%v", ip, r.base.GetMappedPort(port)), nil
+		return fmt.Sprintf("%v:%v", ip, r.base.GetMappedPort(port)), cluster, nil
+	}
+}
+
+func (r *ratioRule) Clusters() []*Cluster {
+	return []*Cluster{
+		{Name: "proxied", Hosts: r.proxiedIPs.ips, PortMapping: r.base.portMapping},
+		{Name: "other", Hosts: r.otherIPs.ips, PortMapping: r.base.portMapping},
 	}
 }
 
@@ -114,23 +144,23 @@ type regexRule struct {
 	matchers []*headerRegexMatcher
 	// otherIPs is the set of IPs from which the new IP will be selected
 	// if none of the matchers are matched.
-	otherIPs *ipRRSelector
+	otherIPs *ipSelector
 }
 
 func (r *regexRule) CanProxyRequest(host string, port uint16) bool {
 	return r.base.CanProxyRequest(host, port)
 }
 
-func (r *regexRule) GetProxiedAddress(req *http.Request, host string, port uint16) (string, error) {
+func (r *regexRule) GetProxiedAddress(req *http.Request, host string, port uint16) (string, string, error) {
 	if !r.CanProxyRequest(host, port) {
-		return "", errors.New("%v:%p cannot be proxied by this rule")
+		return "", "", errors.New("%v:%p cannot be proxied by this rule")
 	}
 
 	for k, vs := range req.Header {
 		for _, v := range vs {
-			for _, matcher := range r.matchers {
+			for i, matcher := range r.matchers {
 				if ip, ok := matcher.MatchAndGetIP(k, v); ok {
-					return fmt.Sprintf("%v:%v", ip, r.base.GetMappedPort(port)), nil
+					return fmt.Sprintf("%v:%v", ip, r.base.GetMappedPort(port)), fmt.Sprintf("matcher-%d", i), nil
 				}
 			}
 		}
@@ -138,12 +168,183 @@ func (r *regexRule) GetProxiedAddress(req *http.Request, host string, port uint1
 
 	ip, err := r.otherIPs.NextIP()
 	if err != nil {
-		return "", err
+		return "", "", err
 	} else {
-		return fmt.Sprintf("%v:%v", ip, r.base.GetMappedPort(port)), nil
+		return fmt.Sprintf("%v:%v", ip, r.base.GetMappedPort(port)), "other", nil
 	}
 }
 
+func (r *regexRule) Clusters() []*Cluster {
+	clusters := make([]*Cluster, 0, len(r.matchers)+1)
+	for i, m := range r.matchers {
+		clusters = append(clusters, &Cluster{
+			Name:        fmt.Sprintf("matcher-%d", i),
+			Hosts:       m.ips.ips,
+			PortMapping: r.base.portMapping,
+		})
+	}
+	clusters = append(clusters, &Cluster{
+		Name:        "other",
+		Hosts:       r.otherIPs.ips,
+		PortMapping: r.base.portMapping,
+	})
+	return clusters
+}
+
+// routeTable is the routing table of a service merged from all the rules applied to it.
+// Requests are matched against the header matchers in order, and those matching none of them
+// are split between proxiedIPs and otherIPs by ratio.
+type routeTable struct {
+	// base is used to determine if host:port can be proxied.
+	base *ruleBase
+	// matchers are the header matchers of regex rules, the first matched of which is chosen.
+	matchers []*headerRegexMatcher
+	// ratio is the proportion of requests matching no matchers that will be redirected to
+	// IPs in proxiedIPs. It is zero if there is no ratio rule.
+	ratio int
+	// ratioRule is the name of the ratio rule. It is empty if there is no ratio rule.
+	ratioRule string
+	// proxiedIPs is the set of IPs selected by the ratio rule.
+	proxiedIPs *ipSelector
+	// proxiedPolicy is the traffic policy of proxiedIPs.
+	proxiedPolicy *TrafficPolicy
+	// otherIPs is the set of IPs selected by neither the ratio rule nor any matcher.
+	otherIPs *ipSelector
+	// otherPolicy is the traffic policy of otherIPs.
+	otherPolicy *TrafficPolicy
+}
+
+func (t *routeTable) CanProxyRequest(host string, port uint16) bool {
+	return t.base.CanProxyRequest(host, port)
+}
+
+func (t *routeTable) GetProxiedAddress(req *http.Request, host string, port uint16) (string, string, error) {
+	if !t.CanProxyRequest(host, port) {
+		return "", "", fmt.Errorf("%v:%v cannot be proxied by this rule", host, port)
+	}
+
+	for i, matcher := range t.matchers {
+		for _, v := range req.Header[matcher.header] {
+			if ip, ok := matcher.MatchAndGetIP(matcher.header, v); ok {
+				return fmt.Sprintf("%v:%v", ip, t.base.GetMappedPort(port)), fmt.Sprintf("matcher-%d", i), nil
+			}
+		}
+	}
+
+	var err error
+	var ip string
+	cluster := "proxied"
+	if rand.Intn(100) < t.ratio {
+		ip, err = t.proxiedIPs.NextIP()
+	} else {
+		cluster = "other"
+		ip, err = t.otherIPs.NextIP()
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%v:%v", ip, t.base.GetMappedPort(port)), cluster, nil
+}
+
+func (t *routeTable) Clusters() []*Cluster {
+	clusters := make([]*Cluster, 0, len(t.matchers)+2)
+	for i, m := range t.matchers {
+		clusters = append(clusters, &Cluster{
+			Name:        fmt.Sprintf("matcher-%d", i),
+			Hosts:       m.ips.ips,
+			PortMapping: t.base.portMapping,
+			Rule:        m.rule,
+			Policy:      m.policy,
+		})
+	}
+	if t.ratioRule != "" {
+		clusters = append(clusters, &Cluster{
+			Name:        "proxied",
+			Hosts:       t.proxiedIPs.ips,
+			PortMapping: t.base.portMapping,
+			Rule:        t.ratioRule,
+			Policy:      t.proxiedPolicy,
+		})
+	}
+	clusters = append(clusters, &Cluster{
+		Name:        "other",
+		Hosts:       t.otherIPs.ips,
+		PortMapping: t.base.portMapping,
+		Rule:        t.ClusterRule("other"),
+		Policy:      t.otherPolicy,
+	})
+	return clusters
+}
+
+// ClusterRule returns the name of the user rule a cluster comes from. Requests matching no
+// matchers are routed by the ratio rule, or by the last regex rule if there is no ratio rule.
+func (t *routeTable) ClusterRule(cluster string) string {
+	var i int
+	if _, err := fmt.Sscanf(cluster, "matcher-%d", &i); err == nil && i < len(t.matchers) {
+		return t.matchers[i].rule
+	}
+	if t.ratioRule == "" && len(t.matchers) != 0 {
+		return t.matchers[len(t.matchers)-1].rule
+	}
+	return t.ratioRule
+}
+
+// ClusterPolicy returns the traffic policy of a cluster, which is nil for the defaults.
+func (t *routeTable) ClusterPolicy(cluster string) *TrafficPolicy {
+	var i int
+	if _, err := fmt.Sscanf(cluster, "matcher-%d", &i); err == nil && i < len(t.matchers) {
+		return t.matchers[i].policy
+	}
+	if cluster == "proxied" {
+		return t.proxiedPolicy
+	}
+	return t.otherPolicy
+}
+
+// serviceEntryRule forwards requests to a service registered outside the mesh.
+type serviceEntryRule struct {
+	// hosts is the set of domain names or IPs of the external service.
+	hosts map[string]struct{}
+	// ports is the set of ports of the external service. Any port is accepted if empty.
+	ports map[uint16]struct{}
+	// endpoints is the set of addresses from which the new address will be selected.
+	// The original host is kept if it is empty.
+	endpoints *weightedSelector
+	// policy is the retry and timeout policy of requests to this service.
+	policy RoutePolicy
+}
+
+func (r *serviceEntryRule) CanProxyRequest(host string, port uint16) bool {
+	if _, ok := r.hosts[strings.ToLower(host)]; !ok {
+		return false
+	}
+	if len(r.ports) == 0 {
+		return true
+	}
+	_, ok := r.ports[port]
+	return ok
+}
+
+func (r *serviceEntryRule) GetProxiedAddress(req *http.Request, host string, port uint16) (string, string, error) {
+	if !r.CanProxyRequest(host, port) {
+		return "", "", fmt.Errorf("%v:%v cannot be proxied by this rule", host, port)
+	}
+	if r.endpoints.IsEmpty() {
+		return fmt.Sprintf("%v:%v", host, port), "", nil
+	}
+	return fmt.Sprintf("%v:%v", r.endpoints.Next(), port), "endpoints", nil
+}
+
+func (r *serviceEntryRule) Clusters() []*Cluster {
+	return []*Cluster{
+		{Name: "endpoints", Hosts: r.endpoints.addresses},
+	}
+}
+
+func (r *serviceEntryRule) RoutePolicy() RoutePolicy {
+	return r.policy
+}
+
 // =============================================================================
 //
 // Proxy rule generator:
@@ -152,11 +353,46 @@ func (r *regexRule) GetProxiedAddress(req *http.Request, host string, port uint1
 //
 // =============================================================================
 
+// OutboundPolicy determines how skproxy handles requests to hosts outside the mesh.
+type OutboundPolicy string
+
+const (
+	// AllowAny forwards requests to unknown hosts as is.
+	AllowAny OutboundPolicy = "ALLOW_ANY"
+	// RegistryOnly blocks requests to hosts that are neither in the mesh nor
+	// registered by a service entry.
+	RegistryOnly OutboundPolicy = "REGISTRY_ONLY"
+)
+
+// IsValid returns true if p is a known outbound policy. An empty policy is
+// treated as AllowAny.
+func (p OutboundPolicy) IsValid() bool {
+	return p == "" || p == AllowAny || p == RegistryOnly
+}
+
 // Config configures proxy rules. Each time a Config is applied,
 // the original config will be completely overwritten.
 type Config struct {
 	RatioRules map[string]*RatioRuleGenerator
 	RegexRules map[string]*RegexRuleGenerator
+	// RouteTables are the routing tables of services by service name, each merged by skpilot
+	// from all the ratio and regex rules applied to the service.
+	RouteTables    map[string]*RouteTableGenerator `json:",omitempty"`
+	ServiceEntries map[string]*ServiceEntryGenerator
+	// Gateways are the routes of gateways, which are ignored by sidecar proxies.
+	Gateways map[string]*GatewayGenerator
+	// OutboundPolicy determines how requests to unknown hosts are handled.
+	OutboundPolicy OutboundPolicy
+	// MeshHosts is the set of service IPs and pod IPs inside the mesh.
+	// Requests to these hosts are never blocked by OutboundPolicy.
+	MeshHosts []string
+	// TraceSampleRate is the proportion of new traces that are sampled, ranging from 0 to 1.
+	TraceSampleRate float64
+	// Version identifies the config. A config older than the applied one is rejected, and
+	// zero means the config is not versioned.
+	Version uint64 `json:",omitempty"`
+	// Nonce identifies the update from skpilot that produced the config.
+	Nonce string `json:",omitempty"`
 }
 
 // ProxyRuleGenerator can be used to generate ProxyRule, which includes members that cannot be
@@ -185,11 +421,17 @@ type RatioRuleGenerator struct {
 }
 
 func (g *RatioRuleGenerator) GenerateRule() (ProxyRule, error) {
+	if g.ServiceIP == "" {
+		return nil, errors.New("service IP is empty")
+	}
+	if g.Ratio < 0 || g.Ratio > 100 {
+		return nil, fmt.Errorf("ratio %v is not between 0 and 100", g.Ratio)
+	}
 	return &ratioRule{
 		base:       newRuleBase(g.ServiceIP, g.PortMapping),
 		ratio:      g.Ratio,
-		proxiedIPs: newIPRRSelector(g.ProxiedIPs),
-		otherIPs:   newIPRRSelector(g.OtherIPs),
+		proxiedIPs: newIPSelector(g.ProxiedIPs, nil),
+		otherIPs:   newIPSelector(g.OtherIPs, nil),
 	}, nil
 }
 
@@ -212,18 +454,149 @@ type RegexRuleGenerator struct {
 }
 
 func (g *RegexRuleGenerator) GenerateRule() (ProxyRule, error) {
+	if g.ServiceIP == "" {
+		return nil, errors.New("service IP is empty")
+	}
 	actualMatchers := make([]*headerRegexMatcher, 0, len(g.Matchers))
-	for _, m := range g.Matchers {
+	for i, m := range g.Matchers {
+		if m == nil {
+			return nil, fmt.Errorf("matcher %d is empty", i)
+		}
 		matcher, err := newHeaderRegexMatcher(m)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("matcher %d: %v", i, err)
 		}
 		actualMatchers = append(actualMatchers, matcher)
 	}
 	return &regexRule{
 		base:     newRuleBase(g.ServiceIP, g.PortMapping),
 		matchers: actualMatchers,
-		otherIPs: newIPRRSelector(g.OtherIPs),
+		otherIPs: newIPSelector(g.OtherIPs, nil),
+	}, nil
+}
+
+// RatioSplit is the ratio rule of a route table, which splits the requests matching no
+// matchers.
+type RatioSplit struct {
+	// Rule is the name of the ratio rule.
+	Rule string
+	// Ratio is the proportion of requests that will be redirected to IPs in ProxiedIPs.
+	Ratio int
+	// ProxiedIPs is the set of IPs selected by the ratio rule.
+	ProxiedIPs []string
+	// Policy is the traffic policy of requests to ProxiedIPs.
+	Policy *TrafficPolicy `json:",omitempty"`
+}
+
+// RouteTableGenerator is the exported generator of route table.
+// This struct should be used in configuration for easy serialization.
+type RouteTableGenerator struct {
+	// ServiceIP is the service IP this table applies to.
+	ServiceIP string
+	// PortMapping is the port mapping of that service.
+	PortMapping map[uint16]uint16
+	// Matchers are the matchers of all the regex rules of the service. They are tried in
+	// order, and the first one matching any value of its header is chosen.
+	Matchers []*HeaderRegexMatcher
+	// Split splits the requests matching no matchers between its ProxiedIPs and OtherIPs. If
+	// it is nil, all such requests are forwarded to OtherIPs.
+	Split *RatioSplit `json:",omitempty"`
+	// OtherIPs is the set of IPs selected by neither the ratio rule nor any matcher.
+	OtherIPs []string
+	// OtherPolicy is the traffic policy of requests to OtherIPs.
+	OtherPolicy *TrafficPolicy `json:",omitempty"`
+}
+
+func (g *RouteTableGenerator) GenerateRule() (ProxyRule, error) {
+	if g.ServiceIP == "" {
+		return nil, errors.New("service IP is empty")
+	}
+	if err := validateTrafficPolicy(g.OtherPolicy); err != nil {
+		return nil, err
+	}
+	table := &routeTable{
+		base:        newRuleBase(g.ServiceIP, g.PortMapping),
+		matchers:    make([]*headerRegexMatcher, 0, len(g.Matchers)),
+		proxiedIPs:  newIPSelector(nil, nil),
+		otherIPs:    newIPSelector(g.OtherIPs, g.OtherPolicy),
+		otherPolicy: g.OtherPolicy,
+	}
+	for i, m := range g.Matchers {
+		if m == nil {
+			return nil, fmt.Errorf("matcher %d is empty", i)
+		}
+		matcher, err := newHeaderRegexMatcher(m)
+		if err != nil {
+			return nil, fmt.Errorf("matcher %d: %v", i, err)
+		}
+		table.matchers = append(table.matchers, matcher)
+	}
+	if g.Split != nil {
+		if g.Split.Ratio < 0 || g.Split.Ratio > 100 {
+			return nil, fmt.Errorf("ratio %v is not between 0 and 100", g.Split.Ratio)
+		}
+		if err := validateTrafficPolicy(g.Split.Policy); err != nil {
+			return nil, err
+		}
+		table.ratio = g.Split.Ratio
+		table.ratioRule = g.Split.Rule
+		table.proxiedIPs = newIPSelector(g.Split.ProxiedIPs, g.Split.Policy)
+		table.proxiedPolicy = g.Split.Policy
+	}
+	return table, nil
+}
+
+// ServiceEntryEndpoint is an address of an external service with its weight.
+type ServiceEntryEndpoint struct {
+	// Address is the IP or domain name of the endpoint.
+	Address string
+	// Weight is the relative proportion of requests forwarded to this endpoint.
+	Weight int
+}
+
+// ServiceEntryGenerator is the exported generator of service entry rule.
+// This struct should be used in configuration for easy serialization.
+type ServiceEntryGenerator struct {
+	// Hosts is the set of domain names or IPs of the external service.
+	Hosts []string
+	// Ports is the set of ports of the external service. Any port is accepted if empty.
+	Ports []uint16
+	// Endpoints is the set of addresses from which the new address will be selected
+	// according to their weights. The original host is kept if it is empty.
+	Endpoints []*ServiceEntryEndpoint
+	// Retries is the number of times a failed request will be retried.
+	Retries int
+	// TimeoutMs is the timeout of each attempt in milliseconds. Zero means no timeout.
+	TimeoutMs int
+}
+
+func (g *ServiceEntryGenerator) GenerateRule() (ProxyRule, error) {
+	if len(g.Hosts) == 0 {
+		return nil, errors.New("service entry must have at least one host")
+	}
+	if g.Retries < 0 || g.TimeoutMs < 0 {
+		return nil, errors.New("retries and timeout of service entry cannot be negative")
+	}
+	hosts := make(map[string]struct{}, len(g.Hosts))
+	for _, host := range g.Hosts {
+		hosts[strings.ToLower(host)] = struct{}{}
+	}
+	ports := make(map[uint16]struct{}, len(g.Ports))
+	for _, port := range g.Ports {
+		ports[port] = struct{}{}
+	}
+	endpoints, err := newWeightedSelector(g.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return &serviceEntryRule{
+		hosts:     hosts,
+		ports:     ports,
+		endpoints: endpoints,
+		policy: RoutePolicy{
+			Retries: g.Retries,
+			Timeout: time.Duration(g.TimeoutMs) * time.Millisecond,
+		},
 	}, nil
 }
 
@@ -235,55 +608,280 @@ func (g *RegexRuleGenerator) GenerateRule() (ProxyRule, error) {
 //
 // =============================================================================
 
+// RoutePolicy describes how a forwarded request should be retried and timed out.
+type RoutePolicy struct {
+	// Retries is the number of times a failed request will be retried.
+	Retries int
+	// Timeout is the timeout of each attempt. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// routePolicyProvider is implemented by rules that carry a RoutePolicy.
+type routePolicyProvider interface {
+	RoutePolicy() RoutePolicy
+}
+
+// clusterRuleProvider is implemented by rules merged from several user rules, which tells the
+// user rule each cluster comes from.
+type clusterRuleProvider interface {
+	ClusterRule(cluster string) string
+}
+
+// clusterPolicyProvider is implemented by rules whose clusters carry traffic policies.
+type clusterPolicyProvider interface {
+	ClusterPolicy(cluster string) *TrafficPolicy
+}
+
+// Route is the result of looking up the proxy rules for a request.
+type Route struct {
+	// Address is the new host and port the request should be forwarded to.
+	Address string
+	// RuleName is the name of the matched rule. It is empty if no rule is matched.
+	RuleName string
+	// Cluster is the name of the cluster of the matched rule from which the address is
+	// selected. It is empty if the address is not selected from any cluster.
+	Cluster string
+	// Policy is the retry and timeout policy of the request.
+	Policy RoutePolicy
+	// Traffic is the traffic policy of the cluster the address is selected from. It is nil
+	// for the defaults.
+	Traffic *TrafficPolicy
+}
+
+// ConfigDump is the config currently applied to a ProxyRuleManager.
+type ConfigDump struct {
+	// Version is the version of the applied config. For configs that are not versioned,
+	// it increases by one each time a config is applied.
+	Version uint64
+	// AppliedAt is when the config was applied. It is nil if no config has been applied.
+	AppliedAt *time.Time `json:",omitempty"`
+	// Config is the applied config.
+	Config *Config
+}
+
+// RuleClusters contains the clusters of a rule and the health status of their upstreams.
+type RuleClusters struct {
+	// Rule is the name of the rule.
+	Rule string
+	// Clusters are the clusters of the rule.
+	Clusters []*Cluster
+	// Upstreams maps the host of each upstream in the clusters to its health status.
+	Upstreams map[string]UpstreamStatus
+}
+
+// namedRule is a rule with its name.
+type namedRule struct {
+	name string
+	rule ProxyRule
+}
+
+// ruleSnapshot is a config compiled into rules. It is immutable once built, so it can be
+// read by any number of requests without locking.
+type ruleSnapshot struct {
+	// rules are sorted by name so that rules are matched in a deterministic order.
+	rules []namedRule
+	// outboundPolicy determines how requests matching no rule are handled.
+	outboundPolicy OutboundPolicy
+	// meshHosts is the set of hosts inside the mesh.
+	meshHosts map[string]struct{}
+	// dump is the config from which the snapshot is built.
+	dump ConfigDump
+}
+
+// newRuleSnapshot compiles config into a snapshot. If any part of config is invalid,
+// an error describing every invalid part is returned.
+func newRuleSnapshot(config *Config, version uint64) (*ruleSnapshot, error) {
+	errs := make([]string, 0)
+	rules := make([]namedRule, 0, len(config.RatioRules)+len(config.RegexRules)+len(config.RouteTables)+len(config.ServiceEntries))
+	addRule := func(kind string, name string, generator ProxyRuleGenerator) {
+		rule, err := generator.GenerateRule()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s: %v", kind, name, err))
+			return
+		}
+		rules = append(rules, namedRule{name: name, rule: rule})
+	}
+	for name, g := range config.RatioRules {
+		if g == nil {
+			errs = append(errs, fmt.Sprintf("ratio rule %s: empty rule", name))
+			continue
+		}
+		addRule("ratio rule", name, g)
+	}
+	for name, g := range config.RegexRules {
+		if g == nil {
+			errs = append(errs, fmt.Sprintf("regex rule %s: empty rule", name))
+			continue
+		}
+		addRule("regex rule", name, g)
+	}
+	for name, g := range config.RouteTables {
+		if g == nil {
+			errs = append(errs, fmt.Sprintf("route table %s: empty table", name))
+			continue
+		}
+		addRule("route table", name, g)
+	}
+	for name, g := range config.ServiceEntries {
+		if g == nil {
+			errs = append(errs, fmt.Sprintf("service entry %s: empty entry", name))
+			continue
+		}
+		addRule("service entry", name, g)
+	}
+	if !config.OutboundPolicy.IsValid() {
+		errs = append(errs, fmt.Sprintf("unknown outbound policy %v", config.OutboundPolicy))
+	}
+	if config.TraceSampleRate < 0 || config.TraceSampleRate > 1 {
+		errs = append(errs, fmt.Sprintf("trace sample rate %v is not between 0 and 1", config.TraceSampleRate))
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].name < rules[j].name
+	})
+	meshHosts := make(map[string]struct{}, len(config.MeshHosts))
+	for _, host := range config.MeshHosts {
+		meshHosts[host] = struct{}{}
+	}
+	outboundPolicy := config.OutboundPolicy
+	if outboundPolicy == "" {
+		outboundPolicy = AllowAny
+	}
+	now := time.Now()
+	return &ruleSnapshot{
+		rules:          rules,
+		outboundPolicy: outboundPolicy,
+		meshHosts:      meshHosts,
+		dump: ConfigDump{
+			Version:   version,
+			AppliedAt: &now,
+			Config:    config,
+		},
+	}, nil
+}
+
+// isMeshHost returns true if host is inside the mesh or is the local host.
+func (s *ruleSnapshot) isMeshHost(host string) bool {
+	if host == "localhost" || host == "127.0.0.1" {
+		return true
+	}
+	_, ok := s.meshHosts[host]
+	return ok
+}
+
 // ProxyManager manages all the proxy rules.
+//
+// Rules are compiled into an immutable snapshot, which is swapped atomically when a new
+// config is applied. Requests therefore always see either the old rules or the new ones,
+// never a partial set, and looking up rules never takes a lock.
 type ProxyRuleManager struct {
-	// mtx ensures safe concurrent access.
-	mtx sync.RWMutex
-	// rules maps rule name to the rule.
-	rules map[string]ProxyRule
+	// mtx serializes config applications.
+	mtx sync.Mutex
+	// snapshot holds the current *ruleSnapshot.
+	snapshot atomic.Value
 }
 
-// SetRule sets a rule with given name.
-func (m *ProxyRuleManager) SetRule(name string, generator ProxyRuleGenerator) error {
+// ApplyConfig replaces all the rules and the outbound policy with config. If any part of
+// config is invalid, the whole config is rejected and the current rules are kept.
+func (m *ProxyRuleManager) ApplyConfig(config *Config) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	if rule, err := generator.GenerateRule(); err != nil {
+	current := m.load().dump.Version
+	version := config.Version
+	if version == 0 {
+		version = current + 1
+	} else if version < current {
+		return fmt.Errorf("stale config version %d, version %d is already applied", version, current)
+	}
+	snapshot, err := newRuleSnapshot(config, version)
+	if err != nil {
 		return err
-	} else {
-		m.rules[name] = rule
-		return nil
 	}
+	m.snapshot.Store(snapshot)
+	return nil
 }
 
-// ClearRules removes all rules.
-func (m *ProxyRuleManager) ClearRules() {
-	m.mtx.Lock()
-	defer m.mtx.Unlock()
-	for k := range m.rules {
-		delete(m.rules, k)
+// ValidateConfig checks whether config would be accepted by proxies without applying it.
+func ValidateConfig(config *Config) error {
+	_, err := newRuleSnapshot(config, config.Version)
+	return err
+}
+
+// load returns the current snapshot.
+func (m *ProxyRuleManager) load() *ruleSnapshot {
+	return m.snapshot.Load().(*ruleSnapshot)
+}
+
+// DumpConfig returns the config most recently applied.
+func (m *ProxyRuleManager) DumpConfig() ConfigDump {
+	return m.load().dump
+}
+
+// ListClusters returns the clusters of all rules sorted by rule name.
+func (m *ProxyRuleManager) ListClusters() []*RuleClusters {
+	rules := m.load().rules
+	ret := make([]*RuleClusters, 0, len(rules))
+	for _, r := range rules {
+		rc := &RuleClusters{
+			Rule:      r.name,
+			Clusters:  r.rule.Clusters(),
+			Upstreams: map[string]UpstreamStatus{},
+		}
+		for _, c := range rc.Clusters {
+			for _, host := range c.Hosts {
+				rc.Upstreams[host] = upstreamHealth.Status(host)
+			}
+		}
+		ret = append(ret, rc)
 	}
+	return ret
 }
 
-// GetProxiedAddress tries to match the request against every rule. If no rule can be matched,
-// just return host:port.
-func (m *ProxyRuleManager) GetProxiedAddress(req *http.Request, host string, port uint16) string {
-	m.mtx.RLock()
-	defer m.mtx.RUnlock()
-	for _, rule := range m.rules {
-		if rule.CanProxyRequest(host, port) {
-			addr, err := rule.GetProxiedAddress(req, host, port)
+// GetRoute tries to match the request against every rule. If no rule can be matched,
+// the request is forwarded to host:port as is, unless the outbound policy forbids it,
+// in which case an error is returned.
+func (m *ProxyRuleManager) GetRoute(req *http.Request, host string, port uint16) (*Route, error) {
+	snapshot := m.load()
+	for _, r := range snapshot.rules {
+		if r.rule.CanProxyRequest(host, port) {
+			addr, cluster, err := r.rule.GetProxiedAddress(req, host, port)
 			if err == nil {
-				return addr
+				route := &Route{
+					Address:  addr,
+					RuleName: r.name,
+					Cluster:  cluster,
+				}
+				if p, ok := r.rule.(clusterRuleProvider); ok {
+					route.RuleName = p.ClusterRule(cluster)
+				}
+				if p, ok := r.rule.(routePolicyProvider); ok {
+					route.Policy = p.RoutePolicy()
+				}
+				if p, ok := r.rule.(clusterPolicyProvider); ok {
+					route.Traffic = p.ClusterPolicy(cluster)
+				}
+				return route, nil
 			}
 		}
 	}
-	return fmt.Sprintf("%v:%v", host, port)
+	if snapshot.outboundPolicy == RegistryOnly && !snapshot.isMeshHost(host) {
+		return nil, fmt.Errorf("%v:%v is not registered in the mesh", host, port)
+	}
+	return &Route{Address: fmt.Sprintf("%v:%v", host, port)}, nil
 }
 
 func NewProxyRuleManager() *ProxyRuleManager {
-	return &ProxyRuleManager{
-		rules: map[string]ProxyRule{},
-	}
+	m := &ProxyRuleManager{}
+	m.snapshot.Store(&ruleSnapshot{
+		rules:          []namedRule{},
+		outboundPolicy: AllowAny,
+		meshHosts:      map[string]struct{}{},
+	})
+	return m
 }
 
 // =============================================================================
@@ -292,40 +890,105 @@ func NewProxyRuleManager() *ProxyRuleManager {
 //
 // =============================================================================
 
-// ipRRSelector selects IP addresses in a round robin fashion.
-// IPs cannot be modified after construction.
-type ipRRSelector struct {
+// ipSelector selects IP addresses in a round robin fashion, or at random if its traffic
+// policy says so. IPs cannot be modified after construction, and it is safe for concurrent use.
+type ipSelector struct {
 	ips []string
-	idx int
+	// random is true if IPs are selected at random.
+	random bool
+	// counter is the number of selections made, which is increased atomically.
+	counter uint64
 }
 
-func newIPRRSelector(ips []string) *ipRRSelector {
-	return &ipRRSelector{
-		ips: ips,
-		idx: 0,
+// newIPSelector returns a selector of ips balanced by policy, which may be nil.
+func newIPSelector(ips []string, policy *TrafficPolicy) *ipSelector {
+	return &ipSelector{
+		ips:    ips,
+		random: policy != nil && policy.LoadBalancer == Random,
 	}
 }
 
-// NextIP selects the next IP from the selector.
-func (s *ipRRSelector) NextIP() (string, error) {
+// NextIP selects the next IP from the selector. Ejected IPs are skipped,
+// unless all the IPs are ejected.
+func (s *ipSelector) NextIP() (string, error) {
 	if len(s.ips) == 0 {
 		return "", errors.New("no IP to select")
 	}
-	ret := s.ips[s.idx]
-	if s.idx == len(s.ips)-1 {
-		s.idx = 0
-	} else {
-		s.idx++
+	for i := 0; i < len(s.ips); i++ {
+		ip := s.next()
+		if !upstreamHealth.IsEjected(ip) {
+			return ip, nil
+		}
+	}
+	return s.next(), nil
+}
+
+// next selects the next IP regardless of its health.
+func (s *ipSelector) next() string {
+	if s.random {
+		return s.ips[rand.Intn(len(s.ips))]
+	}
+	n := atomic.AddUint64(&s.counter, 1) - 1
+	return s.ips[n%uint64(len(s.ips))]
+}
+
+// weightedSelector selects addresses randomly according to their weights.
+// Addresses cannot be modified after construction.
+type weightedSelector struct {
+	addresses []string
+	// cumulativeWeights[i] is the sum of weights of addresses[0..i].
+	cumulativeWeights []int
+}
+
+func newWeightedSelector(endpoints []*ServiceEntryEndpoint) (*weightedSelector, error) {
+	s := &weightedSelector{
+		addresses:         make([]string, 0, len(endpoints)),
+		cumulativeWeights: make([]int, 0, len(endpoints)),
 	}
-	return ret, nil
+	total := 0
+	for _, e := range endpoints {
+		if e.Weight < 0 {
+			return nil, fmt.Errorf("weight of endpoint %v cannot be negative", e.Address)
+		}
+		if e.Weight == 0 {
+			continue
+		}
+		total += e.Weight
+		s.addresses = append(s.addresses, e.Address)
+		s.cumulativeWeights = append(s.cumulativeWeights, total)
+	}
+	if len(endpoints) != 0 && total == 0 {
+		return nil, errors.New("at least one endpoint must have a positive weight")
+	}
+	return s, nil
+}
+
+// IsEmpty returns true if there is no address to select.
+func (s *weightedSelector) IsEmpty() bool {
+	return len(s.addresses) == 0
+}
+
+// Next selects an address. The caller must ensure the selector is not empty.
+func (s *weightedSelector) Next() string {
+	n := rand.Intn(s.cumulativeWeights[len(s.cumulativeWeights)-1])
+	for i, w := range s.cumulativeWeights {
+		if n < w {
+			return s.addresses[i]
+		}
+	}
+	return s.addresses[len(s.addresses)-1]
 }
 
 // headerRegexMatcher tells whether an HTTP header of a request matches a regex.
 // If so, it also tells which IP this request should be redirected to.
 type headerRegexMatcher struct {
+	// rule is the name of the regex rule the matcher belongs to in a route table.
+	rule   string
 	header string
 	regex  *regexp.Regexp
-	ips    *ipRRSelector
+	ips    *ipSelector
+	// policy is the traffic policy of requests to ips.
+	policy *TrafficPolicy
 }
 
 // MatchAndGetIP is the matching logic for headerRegexMatcher.
@@ -352,6 +1015,10 @@ type HeaderRegexMatcher struct {
 	// IPs is the set of IPs from which the new IP will be chosen
 	// if there is a match.
 	IPs []string
+	// Rule is the name of the regex rule the matcher belongs to in a route table.
+	Rule string `json:",omitempty"`
+	// Policy is the traffic policy of requests to IPs.
+	Policy *TrafficPolicy `json:",omitempty"`
 }
 
 func newHeaderRegexMatcher(m *HeaderRegexMatcher) (*headerRegexMatcher, error) {
@@ -359,9 +1026,14 @@ func newHeaderRegexMatcher(m *HeaderRegexMatcher) (*headerRegexMatcher, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := validateTrafficPolicy(m.Policy); err != nil {
+		return nil, err
+	}
 	return &headerRegexMatcher{
+		rule:   m.Rule,
 		header: m.Header,
 		regex:  compiledRegex,
-		ips:    newIPRRSelector(m.IPs),
+		ips:    newIPSelector(m.IPs, m.Policy),
+		policy: m.Policy,
 	}, nil
 }
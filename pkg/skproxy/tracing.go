@@ -0,0 +1,358 @@
+package skproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	traceparentHeader    = "Traceparent"
+	tracestateHeader     = "Tracestate"
+	b3Header             = "B3"
+	b3TraceIDHeader      = "X-B3-Traceid"
+	b3SpanIDHeader       = "X-B3-Spanid"
+	b3ParentSpanIDHeader = "X-B3-Parentspanid"
+	b3SampledHeader      = "X-B3-Sampled"
+
+	// spanBatchSize is the number of spans after which they are exported at once.
+	spanBatchSize = 100
+	// spanQueueSize is the number of spans waiting to be exported, after which new spans are dropped.
+	spanQueueSize = 2048
+	// spanExportInterval is the longest time a span waits before being exported.
+	spanExportInterval = time.Second * 5
+	// spanExportTimeout is the timeout of exporting a batch of spans.
+	spanExportTimeout = time.Second * 5
+)
+
+// OTLP span kind and status code. See https://github.com/open-telemetry/opentelemetry-proto.
+const (
+	otlpSpanKindClient  = 3
+	otlpStatusCodeOk    = 1
+	otlpStatusCodeError = 2
+)
+
+// traceContext is the part of a span that is propagated across services.
+type traceContext struct {
+	// traceID is a 32 characters lowercase hex string.
+	traceID string
+	// spanID is a 16 characters lowercase hex string.
+	spanID string
+	// sampled tells whether the trace is recorded.
+	sampled bool
+	// traceState is the vendor specific data in W3C tracestate header.
+	traceState string
+}
+
+// span records a proxied request.
+type span struct {
+	traceContext
+	parentSpanID string
+	name         string
+	start        time.Time
+	end          time.Time
+	attributes   map[string]string
+	code         int
+}
+
+// tracer creates spans for proxied requests and exports the sampled ones.
+type tracer struct {
+	// mtx ensures safe concurrent access to sampleRate.
+	mtx sync.RWMutex
+	// sampleRate is the proportion of new traces that are sampled.
+	sampleRate float64
+	// collector is the address of the OTLP/HTTP collector. Spans are not exported if it is empty.
+	collector string
+	// queue holds the spans to be exported.
+	queue chan *span
+}
+
+var tracing = &tracer{}
+
+// SetupTracing makes skproxy export sampled spans to an OTLP/HTTP collector at address
+// host:port. Spans are not exported if collector is empty, but trace headers are still
+// propagated.
+func SetupTracing(collector string) {
+	if collector == "" {
+		return
+	}
+	tracing.collector = collector
+	tracing.queue = make(chan *span, spanQueueSize)
+	go tracing.exportLoop()
+}
+
+// SetTraceSampleRate sets the proportion of new traces that are sampled.
+func SetTraceSampleRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("trace sample rate %v is not between 0 and 1", rate)
+	}
+	tracing.mtx.Lock()
+	defer tracing.mtx.Unlock()
+	tracing.sampleRate = rate
+	return nil
+}
+
+// StartSpan creates a span for req, which continues the trace in the headers of req
+// if there is one. The trace headers of newReq are set to the new span.
+func (t *tracer) StartSpan(req *http.Request, newReq *http.Request) *span {
+	s := &span{
+		name:       fmt.Sprintf("%v %v", req.Method, req.Host),
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+	if parent, ok := extractTraceContext(req.Header); ok {
+		s.traceID = parent.traceID
+		s.sampled = parent.sampled
+		s.traceState = parent.traceState
+		s.parentSpanID = parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+		t.mtx.RLock()
+		s.sampled = mathrand.Float64() < t.sampleRate
+		t.mtx.RUnlock()
+	}
+	s.spanID = randomHex(8)
+	injectTraceContext(newReq.Header, &s.traceContext, s.parentSpanID)
+	return s
+}
+
+// FinishSpan ends the span and queues it for export if it is sampled.
+func (t *tracer) FinishSpan(s *span, code int) {
+	s.end = time.Now()
+	s.code = code
+	if !s.sampled || t.queue == nil {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		glog.Warningf("span queue is full, dropping span %v", s.spanID)
+	}
+}
+
+// exportLoop exports queued spans in batches.
+func (t *tracer) exportLoop() {
+	batch := make([]*span, 0, spanBatchSize)
+	ticker := time.NewTicker(spanExportInterval)
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			glog.Errorf("failed to export %v spans: %v", len(batch), err.Error())
+		}
+		batch = make([]*span, 0, spanBatchSize)
+	}
+}
+
+// export sends spans to the collector in OTLP/HTTP JSON encoding.
+func (t *tracer) export(spans []*span) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		attributes := make([]map[string]interface{}, 0, len(s.attributes)+1)
+		for k, v := range s.attributes {
+			attributes = append(attributes, stringAttribute(k, v))
+		}
+		attributes = append(attributes, map[string]interface{}{
+			"key":   "http.status_code",
+			"value": map[string]interface{}{"intValue": strconv.Itoa(s.code)},
+		})
+		statusCode := otlpStatusCodeOk
+		if s.code >= http.StatusInternalServerError {
+			statusCode = otlpStatusCodeError
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              otlpSpanKindClient,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+			"status":            map[string]interface{}{"code": statusCode},
+		}
+		if s.parentSpanID != "" {
+			otlpSpan["parentSpanId"] = s.parentSpanID
+		}
+		if s.traceState != "" {
+			otlpSpan["traceState"] = s.traceState
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{
+						stringAttribute("service.name", "skproxy"),
+						stringAttribute("host.name", hostname),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "skproxy"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: spanExportTimeout}
+	resp, err := client.Post(
+		fmt.Sprintf("http://%v/v1/traces", t.collector),
+		"application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %v", resp.Status)
+	}
+	return nil
+}
+
+func stringAttribute(key string, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"key":   key,
+		"value": map[string]interface{}{"stringValue": value},
+	}
+}
+
+// extractTraceContext reads the trace context from W3C headers, or B3 headers if there
+// is no W3C header. The second return value is false if there is no valid trace context.
+func extractTraceContext(header http.Header) (*traceContext, bool) {
+	if tp := header.Get(traceparentHeader); tp != "" {
+		if ctx, ok := parseTraceparent(tp); ok {
+			ctx.traceState = header.Get(tracestateHeader)
+			return ctx, true
+		}
+	}
+	if b3 := header.Get(b3Header); b3 != "" {
+		// traceid-spanid-sampled-parentspanid
+		parts := strings.Split(b3, "-")
+		if len(parts) >= 2 && isB3TraceID(parts[0]) && isID(parts[1], 16) {
+			return &traceContext{
+				traceID: padTraceID(parts[0]),
+				spanID:  parts[1],
+				sampled: len(parts) >= 3 && (parts[2] == "1" || parts[2] == "d"),
+			}, true
+		}
+	}
+	traceID, spanID := header.Get(b3TraceIDHeader), header.Get(b3SpanIDHeader)
+	if isB3TraceID(traceID) && isID(spanID, 16) {
+		return &traceContext{
+			traceID: padTraceID(traceID),
+			spanID:  spanID,
+			sampled: header.Get(b3SampledHeader) == "1",
+		}, true
+	}
+	return nil, false
+}
+
+// parseTraceparent parses a W3C traceparent header of the form version-traceid-spanid-flags.
+// Headers of version 00 have exactly these four parts, while later versions may append more.
+// The second return value is false if the header is invalid.
+func parseTraceparent(tp string) (*traceContext, bool) {
+	parts := strings.Split(tp, "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" {
+		return nil, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil, false
+	}
+	if !isID(parts[1], 32) || !isID(parts[2], 16) || !isHex(parts[3], 2) {
+		return nil, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return &traceContext{
+		traceID: parts[1],
+		spanID:  parts[2],
+		sampled: flags&1 == 1,
+	}, true
+}
+
+// injectTraceContext writes the trace context to both W3C and B3 headers.
+func injectTraceContext(header http.Header, ctx *traceContext, parentSpanID string) {
+	flags, sampled := "00", "0"
+	if ctx.sampled {
+		flags, sampled = "01", "1"
+	}
+	header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%s", ctx.traceID, ctx.spanID, flags))
+	if ctx.traceState != "" {
+		header.Set(tracestateHeader, ctx.traceState)
+	}
+	header.Set(b3TraceIDHeader, ctx.traceID)
+	header.Set(b3SpanIDHeader, ctx.spanID)
+	header.Set(b3SampledHeader, sampled)
+	if parentSpanID != "" {
+		header.Set(b3ParentSpanIDHeader, parentSpanID)
+	} else {
+		header.Del(b3ParentSpanIDHeader)
+	}
+	if header.Get(b3Header) != "" {
+		header.Set(b3Header, fmt.Sprintf("%s-%s-%s", ctx.traceID, ctx.spanID, sampled))
+	}
+}
+
+// isHex returns true if s is a lowercase hex string of length n.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isID returns true if s is a lowercase hex string of length n that is not all zeros, which
+// is a valid trace or span id.
+func isID(s string, n int) bool {
+	return isHex(s, n) && strings.Trim(s, "0") != ""
+}
+
+// isB3TraceID returns true if s is a valid 64-bit or 128-bit B3 trace id.
+func isB3TraceID(s string) bool {
+	return isID(s, 16) || isID(s, 32)
+}
+
+// padTraceID pads a 64-bit B3 trace id to 128 bits as required by W3C.
+func padTraceID(traceID string) string {
+	return strings.Repeat("0", 32-len(traceID)) + traceID
+}
+
+// randomHex generates a random hex string of n bytes.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		mathrand.Read(b)
+	}
+	return hex.EncodeToString(b)
+}
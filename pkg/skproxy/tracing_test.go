@@ -0,0 +1,45 @@
+package skproxy
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags", "00-" + traceID + "-" + spanID + "-03", true, true},
+		{"later version with more parts", "01-" + traceID + "-" + spanID + "-01-extra", true, true},
+		{"version 00 with more parts", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"invalid version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"non hex version", "0x-" + traceID + "-" + spanID + "-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"short trace id", "00-" + traceID[:31] + "-" + spanID + "-01", false, false},
+		{"uppercase trace id", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"short flags", "00-" + traceID + "-" + spanID + "-1", false, false},
+		{"non hex flags", "00-" + traceID + "-" + spanID + "-zz", false, false},
+		{"missing flags", "00-" + traceID + "-" + spanID, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ok := parseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if ctx.traceID != traceID || ctx.spanID != spanID || ctx.sampled != tt.sampled {
+				t.Errorf("parseTraceparent(%q) = %+v, want sampled %v", tt.header, ctx, tt.sampled)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 #!/bin/bash
 kill -9 $(pgrep skagent)
 kill -9 $(pgrep skpilot)
+kill -9 $(pgrep skgateway)
 
 docker ps -aq -f "name=skproxy" | xargs docker stop &>/dev/null
 docker ps -aq -f "name=skproxy" | xargs docker rm &>/dev/null
\ No newline at end of file